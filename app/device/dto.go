@@ -0,0 +1,34 @@
+package device
+
+// DeviceRequest is the request body for registering a device. ID is taken
+// from the path on PUT.
+type DeviceRequest struct {
+	ID          string            `json:"id"          example:"esp32-rack"`
+	Name        string            `json:"name"        example:"Rack ESP32"`
+	Description string            `json:"description" example:"Relay board behind the server rack"`
+	States      []StateRefRequest `json:"states"      validate:"dive"`
+}
+
+// StateRefRequest is one state a device controls.
+type StateRefRequest struct {
+	Type string `json:"type" validate:"required" example:"switch"`
+	Key  string `json:"key"  validate:"required" example:"server_1"`
+}
+
+// DeviceResponse is the JSON representation of a device. Online is derived
+// from LastSeen and the offline timeout.
+type DeviceResponse struct {
+	ID          string             `json:"id"                  example:"esp32-rack"`
+	Name        string             `json:"name"                example:"Rack ESP32"`
+	Description string             `json:"description"         example:"Relay board behind the server rack"`
+	States      []StateRefResponse `json:"states"`
+	Online      bool               `json:"online"              example:"true"`
+	LastSeen    string             `json:"last_seen,omitempty" example:"2026-03-16T12:34:56Z"`
+	CreatedAt   string             `json:"created_at"          example:"2026-03-16T12:34:56Z"`
+	UpdatedAt   string             `json:"updated_at"          example:"2026-03-16T12:34:56Z"`
+}
+
+type StateRefResponse struct {
+	Type string `json:"type" example:"switch"`
+	Key  string `json:"key"  example:"server_1"`
+}
@@ -0,0 +1,263 @@
+package device
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nurhudajoantama/hmauto/app/server"
+	"github.com/nurhudajoantama/hmauto/internal/request"
+	"github.com/nurhudajoantama/hmauto/internal/response"
+	"github.com/rs/zerolog"
+)
+
+type DeviceHandler struct {
+	service *DeviceService
+}
+
+func (s *DeviceService) deviceToResponse(d Device) DeviceResponse {
+	states := make([]StateRefResponse, 0, len(d.States))
+	for _, ref := range d.States {
+		states = append(states, StateRefResponse(ref))
+	}
+	out := DeviceResponse{
+		ID:          d.ID,
+		Name:        d.Name,
+		Description: d.Description,
+		States:      states,
+		Online:      s.Online(d, time.Now()),
+		CreatedAt:   d.CreatedAt.UTC().Format(time.RFC3339),
+		UpdatedAt:   d.UpdatedAt.UTC().Format(time.RFC3339),
+	}
+	if !d.LastSeen.IsZero() {
+		out.LastSeen = d.LastSeen.UTC().Format(time.RFC3339)
+	}
+	return out
+}
+
+func requestToInput(body DeviceRequest) Input {
+	states := make([]StateRef, 0, len(body.States))
+	for _, ref := range body.States {
+		states = append(states, StateRef(ref))
+	}
+	return Input{Name: body.Name, Description: body.Description, States: states}
+}
+
+func errorResponse(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrDeviceNotFound):
+		response.ErrorResponse(w, http.StatusNotFound, "device not found", err)
+	case errors.Is(err, ErrDeviceAlreadyExists):
+		response.ErrorResponse(w, http.StatusConflict, "device already exists", err)
+	case errors.Is(err, ErrStateOwned):
+		response.ErrorResponse(w, http.StatusConflict, err.Error(), err)
+	case errors.Is(err, ErrInvalidDevice):
+		response.ErrorResponse(w, http.StatusBadRequest, err.Error(), err)
+	default:
+		response.ErrorResponse(w, http.StatusInternalServerError, err.Error(), err)
+	}
+}
+
+func RegisterHandlers(s *server.Server, svc *DeviceService) {
+	h := &DeviceHandler{service: svc}
+
+	v1 := s.GetRouter().PathPrefix("/v1").Subrouter()
+	s.ApplyAuthMiddleware(v1)
+
+	v1.HandleFunc("/devices", h.listDevices).Methods("GET")
+	v1.HandleFunc("/devices", h.createDevice).Methods("POST")
+	v1.HandleFunc("/devices/{id}", h.getDevice).Methods("GET")
+	v1.HandleFunc("/devices/{id}", h.updateDevice).Methods("PUT")
+	v1.HandleFunc("/devices/{id}", h.deleteDevice).Methods("DELETE")
+	v1.HandleFunc("/devices/{id}/heartbeat", h.heartbeat).Methods("POST")
+}
+
+// listDevices godoc
+//
+//	@Summary		List devices
+//	@Description	Lists registered devices with the states they control and whether they are online
+//	@Tags			devices
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Success		200	{object}	response.JsonResponse{data=[]DeviceResponse}	"List of devices"
+//	@Failure		401	{object}	response.JsonResponse							"Unauthorized"
+//	@Failure		500	{object}	response.JsonResponse							"Internal error"
+//	@Router			/devices [get]
+func (h *DeviceHandler) listDevices(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+	l.Info().Msg("Handling listDevices request")
+
+	devices, err := h.service.List(ctx)
+	if err != nil {
+		l.Error().Err(err).Msg("listDevices failed")
+		errorResponse(w, err)
+		return
+	}
+
+	data := make([]DeviceResponse, 0, len(devices))
+	for _, d := range devices {
+		data = append(data, h.service.deviceToResponse(d))
+	}
+	response.SuccessResponse(w, data)
+}
+
+// createDevice godoc
+//
+//	@Summary		Register a device
+//	@Description	Registers a device and the states it controls. A state can belong to one device only.
+//	@Tags			devices
+//	@Accept			json
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			body	body		DeviceRequest								true	"Device"
+//	@Success		201		{object}	response.JsonResponse{data=DeviceResponse}	"Registered device"
+//	@Failure		400		{object}	response.JsonResponse						"Invalid id or states"
+//	@Failure		401		{object}	response.JsonResponse						"Unauthorized"
+//	@Failure		409		{object}	response.JsonResponse						"Device already exists, or a state belongs to another device"
+//	@Failure		500		{object}	response.JsonResponse						"Internal error"
+//	@Router			/devices [post]
+func (h *DeviceHandler) createDevice(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+	l.Info().Msg("Handling createDevice request")
+
+	var body DeviceRequest
+	if err := request.DecodeAndValidate(r, &body); err != nil {
+		l.Error().Err(err).Msg("createDevice: validation failed")
+		response.ErrorResponse(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	d, err := h.service.Create(ctx, body.ID, requestToInput(body))
+	if err != nil {
+		l.Error().Err(err).Msg("createDevice failed")
+		errorResponse(w, err)
+		return
+	}
+
+	response.CreatedResponse(w, h.service.deviceToResponse(d))
+}
+
+// getDevice godoc
+//
+//	@Summary		Get a device
+//	@Tags			devices
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			id	path		string										true	"Device id"	example(esp32-rack)
+//	@Success		200	{object}	response.JsonResponse{data=DeviceResponse}	"Device"
+//	@Failure		401	{object}	response.JsonResponse						"Unauthorized"
+//	@Failure		404	{object}	response.JsonResponse						"Device not found"
+//	@Router			/devices/{id} [get]
+func (h *DeviceHandler) getDevice(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+	id := mux.Vars(r)["id"]
+	l.Info().Str("device", id).Msg("Handling getDevice request")
+
+	d, err := h.service.Get(ctx, id)
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+
+	response.SuccessResponse(w, h.service.deviceToResponse(d))
+}
+
+// updateDevice godoc
+//
+//	@Summary		Replace a device
+//	@Description	Replaces the name, description and states of a device; its last-seen time is kept. The id in the body is ignored.
+//	@Tags			devices
+//	@Accept			json
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			id		path		string										true	"Device id"	example(esp32-rack)
+//	@Param			body	body		DeviceRequest								true	"Device"
+//	@Success		200		{object}	response.JsonResponse{data=DeviceResponse}	"Updated device"
+//	@Failure		400		{object}	response.JsonResponse						"Invalid states"
+//	@Failure		401		{object}	response.JsonResponse						"Unauthorized"
+//	@Failure		404		{object}	response.JsonResponse						"Device not found"
+//	@Failure		409		{object}	response.JsonResponse						"A state belongs to another device"
+//	@Failure		500		{object}	response.JsonResponse						"Internal error"
+//	@Router			/devices/{id} [put]
+func (h *DeviceHandler) updateDevice(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+	id := mux.Vars(r)["id"]
+	l.Info().Str("device", id).Msg("Handling updateDevice request")
+
+	var body DeviceRequest
+	if err := request.DecodeAndValidate(r, &body); err != nil {
+		l.Error().Err(err).Msg("updateDevice: validation failed")
+		response.ErrorResponse(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	d, err := h.service.Update(ctx, id, requestToInput(body))
+	if err != nil {
+		l.Error().Err(err).Msg("updateDevice failed")
+		errorResponse(w, err)
+		return
+	}
+
+	response.SuccessResponse(w, h.service.deviceToResponse(d))
+}
+
+// deleteDevice godoc
+//
+//	@Summary		Delete a device
+//	@Description	Removes the device from the registry; its states are kept and no longer show a device
+//	@Tags			devices
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			id	path		string										true	"Device id"	example(esp32-rack)
+//	@Success		200	{object}	response.JsonResponse{data=DeviceResponse}	"Deleted device"
+//	@Failure		401	{object}	response.JsonResponse						"Unauthorized"
+//	@Failure		404	{object}	response.JsonResponse						"Device not found"
+//	@Failure		500	{object}	response.JsonResponse						"Internal error"
+//	@Router			/devices/{id} [delete]
+func (h *DeviceHandler) deleteDevice(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+	id := mux.Vars(r)["id"]
+	l.Info().Str("device", id).Msg("Handling deleteDevice request")
+
+	d, err := h.service.Delete(ctx, id)
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+
+	response.SuccessResponse(w, h.service.deviceToResponse(d))
+}
+
+// heartbeat godoc
+//
+//	@Summary		Device heartbeat
+//	@Description	Marks the device as seen now. Batch syncs with an X-Device-ID header and device reports count as heartbeats too.
+//	@Tags			devices
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			id	path		string										true	"Device id"	example(esp32-rack)
+//	@Success		200	{object}	response.JsonResponse{data=DeviceResponse}	"Device"
+//	@Failure		401	{object}	response.JsonResponse						"Unauthorized"
+//	@Failure		404	{object}	response.JsonResponse						"Device not found"
+//	@Failure		500	{object}	response.JsonResponse						"Internal error"
+//	@Router			/devices/{id}/heartbeat [post]
+func (h *DeviceHandler) heartbeat(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+	id := mux.Vars(r)["id"]
+	l.Debug().Str("device", id).Msg("Handling heartbeat request")
+
+	d, err := h.service.Heartbeat(ctx, id)
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+
+	response.SuccessResponse(w, h.service.deviceToResponse(d))
+}
@@ -0,0 +1,40 @@
+package device
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+func textResult(v any) *mcp.CallToolResult {
+	b, _ := json.Marshal(v)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(b)}},
+	}
+}
+
+func errResult(msg string) *mcp.CallToolResult {
+	return &mcp.CallToolResult{
+		IsError: true,
+		Content: []mcp.Content{&mcp.TextContent{Text: msg}},
+	}
+}
+
+// RegisterMCPTools registers the device tools on the given MCP server.
+func RegisterMCPTools(s *mcp.Server, svc *DeviceService) {
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "list_devices",
+		Description: "List the registered IoT devices (e.g. ESP32 boards), the states each one controls, when each was last seen and whether it is online. Use when the user asks why a switch does not respond.",
+	}, func(ctx context.Context, _ *mcp.CallToolRequest, _ struct{}) (*mcp.CallToolResult, any, error) {
+		devices, err := svc.List(ctx)
+		if err != nil {
+			return errResult(err.Error()), nil, nil
+		}
+		data := make([]DeviceResponse, 0, len(devices))
+		for _, d := range devices {
+			data = append(data, svc.deviceToResponse(d))
+		}
+		return textResult(data), nil, nil
+	})
+}
@@ -0,0 +1,344 @@
+package device
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/nurhudajoantama/hmauto/app/hmstt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+var ErrDeviceNotFound = errors.New("DEVICE NOT FOUND")
+var ErrDeviceAlreadyExists = errors.New("DEVICE ALREADY EXISTS")
+var ErrInvalidDevice = errors.New("INVALID DEVICE")
+var ErrStateOwned = errors.New("STATE OWNED BY ANOTHER DEVICE")
+
+// MaxDeviceStates bounds the states one device may control.
+const MaxDeviceStates = 256
+
+// DefaultOfflineAfter is how long a device may stay silent and still count
+// as online.
+const DefaultOfflineAfter = time.Minute
+
+// deviceIDPattern keeps device ids usable as a path segment and header value.
+var deviceIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+var deviceOnline = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "device_online",
+		Help: "Whether a registered device was seen within the offline timeout (1) or not (0).",
+	},
+	[]string{"device"},
+)
+
+type ServiceConfig struct {
+	OfflineAfter time.Duration // silence after which a device is offline
+}
+
+// DeviceService manages the device registry. It keeps every device in
+// memory, refreshed from Redis by Run, so state responses can say which
+// device owns a state without a Redis round trip per state.
+type DeviceService struct {
+	store        Store
+	offlineAfter time.Duration
+
+	mu      sync.RWMutex
+	devices map[string]Device
+	owners  map[StateRef]string // state → device id
+}
+
+func NewService(store Store, cfg *ServiceConfig) *DeviceService {
+	if cfg == nil {
+		cfg = &ServiceConfig{}
+	}
+	offlineAfter := cfg.OfflineAfter
+	if offlineAfter <= 0 {
+		offlineAfter = DefaultOfflineAfter
+	}
+	return &DeviceService{
+		store:        store,
+		offlineAfter: offlineAfter,
+		devices:      map[string]Device{},
+		owners:       map[StateRef]string{},
+	}
+}
+
+// Online reports whether d was seen within the offline timeout of now.
+func (s *DeviceService) Online(d Device, now time.Time) bool {
+	return !d.LastSeen.IsZero() && now.Sub(d.LastSeen) <= s.offlineAfter
+}
+
+// Input is the user-editable part of a device.
+type Input struct {
+	Name        string
+	Description string
+	States      []StateRef
+}
+
+// validate checks the definition and that no other device already controls
+// one of its states.
+func (s *DeviceService) validate(ctx context.Context, id string, in Input) error {
+	if !deviceIDPattern.MatchString(id) {
+		return fmt.Errorf("%w: id must be 1-64 letters, digits, '_' or '-'", ErrInvalidDevice)
+	}
+	if len(in.States) > MaxDeviceStates {
+		return fmt.Errorf("%w: %d states, at most %d allowed", ErrInvalidDevice, len(in.States), MaxDeviceStates)
+	}
+	seen := make(map[StateRef]bool, len(in.States))
+	for _, ref := range in.States {
+		if ref.Type == "" || ref.Key == "" {
+			return fmt.Errorf("%w: type and key are required", ErrInvalidDevice)
+		}
+		if seen[ref] {
+			return fmt.Errorf("%w: %s appears more than once", ErrInvalidDevice, ref)
+		}
+		seen[ref] = true
+	}
+
+	devices, err := s.store.List(ctx)
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("validate device: List failed")
+		return errors.New("LIST DEVICES ERROR")
+	}
+	for _, other := range devices {
+		if other.ID == id {
+			continue
+		}
+		for _, ref := range other.States {
+			if seen[ref] {
+				return fmt.Errorf("%w: %s is controlled by %s", ErrStateOwned, ref, other.ID)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *DeviceService) List(ctx context.Context) ([]Device, error) {
+	devices, err := s.store.List(ctx)
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("List devices failed")
+		return nil, errors.New("LIST DEVICES ERROR")
+	}
+	return devices, nil
+}
+
+func (s *DeviceService) Get(ctx context.Context, id string) (Device, error) {
+	d, err := s.store.Get(ctx, id)
+	if err != nil {
+		if errors.Is(err, ErrDeviceNotFound) {
+			return Device{}, ErrDeviceNotFound
+		}
+		zerolog.Ctx(ctx).Error().Err(err).Msg("Get device failed")
+		return Device{}, errors.New("GET DEVICE ERROR")
+	}
+	return d, nil
+}
+
+func (s *DeviceService) Create(ctx context.Context, id string, in Input) (Device, error) {
+	l := zerolog.Ctx(ctx)
+	l.Info().Str("device", id).Int("states", len(in.States)).Msg("Handling Create device service")
+
+	if err := s.validate(ctx, id, in); err != nil {
+		return Device{}, err
+	}
+	now := time.Now().UTC()
+	d := Device{
+		ID:          id,
+		Name:        in.Name,
+		Description: in.Description,
+		States:      in.States,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if err := s.store.Create(ctx, d); err != nil {
+		if errors.Is(err, ErrDeviceAlreadyExists) {
+			return Device{}, ErrDeviceAlreadyExists
+		}
+		l.Error().Err(err).Msg("Create device failed")
+		return Device{}, errors.New("CREATE DEVICE ERROR")
+	}
+	s.cache(d)
+	return d, nil
+}
+
+// Update replaces the name, description and states of an existing device.
+func (s *DeviceService) Update(ctx context.Context, id string, in Input) (Device, error) {
+	l := zerolog.Ctx(ctx)
+	l.Info().Str("device", id).Int("states", len(in.States)).Msg("Handling Update device service")
+
+	if err := s.validate(ctx, id, in); err != nil {
+		return Device{}, err
+	}
+	d, err := s.Get(ctx, id)
+	if err != nil {
+		return Device{}, err
+	}
+	d.Name = in.Name
+	d.Description = in.Description
+	d.States = in.States
+	d.UpdatedAt = time.Now().UTC()
+	if err := s.store.Update(ctx, d); err != nil {
+		if errors.Is(err, ErrDeviceNotFound) {
+			return Device{}, ErrDeviceNotFound
+		}
+		l.Error().Err(err).Msg("Update device failed")
+		return Device{}, errors.New("UPDATE DEVICE ERROR")
+	}
+	s.cache(d)
+	return d, nil
+}
+
+func (s *DeviceService) Delete(ctx context.Context, id string) (Device, error) {
+	l := zerolog.Ctx(ctx)
+	l.Info().Str("device", id).Msg("Handling Delete device service")
+
+	d, err := s.Get(ctx, id)
+	if err != nil {
+		return Device{}, err
+	}
+	if err := s.store.Delete(ctx, id); err != nil {
+		if errors.Is(err, ErrDeviceNotFound) {
+			return Device{}, ErrDeviceNotFound
+		}
+		l.Error().Err(err).Msg("Delete device failed")
+		return Device{}, errors.New("DELETE DEVICE ERROR")
+	}
+	s.uncache(id)
+	return d, nil
+}
+
+// Heartbeat records that the device is alive now.
+func (s *DeviceService) Heartbeat(ctx context.Context, id string) (Device, error) {
+	now := time.Now().UTC()
+	if err := s.store.Touch(ctx, id, now); err != nil {
+		if errors.Is(err, ErrDeviceNotFound) {
+			return Device{}, ErrDeviceNotFound
+		}
+		zerolog.Ctx(ctx).Error().Err(err).Str("device", id).Msg("Heartbeat failed")
+		return Device{}, errors.New("HEARTBEAT ERROR")
+	}
+	d, err := s.Get(ctx, id)
+	if err != nil {
+		return Device{}, err
+	}
+	s.cache(d)
+	return d, nil
+}
+
+// Seen implements hmstt.DeviceRegistry: batch syncs and reports count as
+// heartbeats. Ids that are not registered are ignored.
+func (s *DeviceService) Seen(ctx context.Context, id string) {
+	now := time.Now().UTC()
+	if err := s.store.Touch(ctx, id, now); err != nil {
+		if !errors.Is(err, ErrDeviceNotFound) {
+			zerolog.Ctx(ctx).Warn().Err(err).Str("device", id).Msg("recording device sign of life failed")
+		}
+		return
+	}
+	s.mu.Lock()
+	if d, ok := s.devices[id]; ok {
+		d.LastSeen = now
+		s.devices[id] = d
+		deviceOnline.WithLabelValues(id).Set(1)
+	}
+	s.mu.Unlock()
+}
+
+// DeviceOf implements hmstt.DeviceRegistry from the in-memory registry.
+func (s *DeviceService) DeviceOf(tipe, key string) (hmstt.DeviceStatus, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	id, ok := s.owners[StateRef{Type: tipe, Key: key}]
+	if !ok {
+		return hmstt.DeviceStatus{}, false
+	}
+	return hmstt.DeviceStatus{ID: id, Online: s.Online(s.devices[id], time.Now())}, true
+}
+
+func (s *DeviceService) cache(d Device) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.putLocked(d, time.Now())
+}
+
+func (s *DeviceService) uncache(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeLocked(id)
+}
+
+func (s *DeviceService) putLocked(d Device, now time.Time) {
+	if old, ok := s.devices[d.ID]; ok {
+		for _, ref := range old.States {
+			delete(s.owners, ref)
+		}
+	}
+	s.devices[d.ID] = d
+	for _, ref := range d.States {
+		s.owners[ref] = d.ID
+	}
+	online := 0.0
+	if s.Online(d, now) {
+		online = 1
+	}
+	deviceOnline.WithLabelValues(d.ID).Set(online)
+}
+
+func (s *DeviceService) removeLocked(id string) {
+	if old, ok := s.devices[id]; ok {
+		for _, ref := range old.States {
+			delete(s.owners, ref)
+		}
+	}
+	delete(s.devices, id)
+	deviceOnline.DeleteLabelValues(id)
+}
+
+// Refresh reloads the registry from Redis, picking up changes made by other
+// instances, and updates the online gauges.
+func (s *DeviceService) Refresh(ctx context.Context) error {
+	devices, err := s.store.List(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keep := make(map[string]bool, len(devices))
+	for _, d := range devices {
+		keep[d.ID] = true
+		s.putLocked(d, now)
+	}
+	for id := range s.devices {
+		if !keep[id] {
+			s.removeLocked(id)
+		}
+	}
+	return nil
+}
+
+// Run refreshes the registry every interval until ctx is cancelled. A device
+// going offline shows up in responses and gauges within one interval.
+func (s *DeviceService) Run(ctx context.Context, interval time.Duration) error {
+	l := log.With().Str("component", "device_registry").Logger()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.Refresh(ctx); err != nil && ctx.Err() == nil {
+			l.Error().Err(err).Msg("refreshing devices failed")
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
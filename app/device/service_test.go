@@ -0,0 +1,183 @@
+package device
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeStore struct {
+	mu      sync.Mutex
+	devices map[string]Device
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{devices: map[string]Device{}}
+}
+
+func (f *fakeStore) Create(_ context.Context, d Device) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.devices[d.ID]; ok {
+		return ErrDeviceAlreadyExists
+	}
+	f.devices[d.ID] = d
+	return nil
+}
+
+func (f *fakeStore) Update(_ context.Context, d Device) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	old, ok := f.devices[d.ID]
+	if !ok {
+		return ErrDeviceNotFound
+	}
+	d.LastSeen = old.LastSeen
+	f.devices[d.ID] = d
+	return nil
+}
+
+func (f *fakeStore) Get(_ context.Context, id string) (Device, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, ok := f.devices[id]
+	if !ok {
+		return Device{}, ErrDeviceNotFound
+	}
+	return d, nil
+}
+
+func (f *fakeStore) List(context.Context) ([]Device, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make([]Device, 0, len(f.devices))
+	for _, d := range f.devices {
+		out = append(out, d)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+func (f *fakeStore) Delete(_ context.Context, id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.devices[id]; !ok {
+		return ErrDeviceNotFound
+	}
+	delete(f.devices, id)
+	return nil
+}
+
+func (f *fakeStore) Touch(_ context.Context, id string, at time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, ok := f.devices[id]
+	if !ok {
+		return ErrDeviceNotFound
+	}
+	d.LastSeen = at
+	f.devices[id] = d
+	return nil
+}
+
+func rackInput() Input {
+	return Input{Name: "Rack ESP32", States: []StateRef{{Type: "switch", Key: "server_1"}, {Type: "switch", Key: "server_2"}}}
+}
+
+func TestCreateValidatesAndOwnsStates(t *testing.T) {
+	ctx := context.Background()
+	svc := NewService(newFakeStore(), nil)
+
+	if _, err := svc.Create(ctx, "esp32 rack", rackInput()); !errors.Is(err, ErrInvalidDevice) {
+		t.Fatalf("Create(bad id) error = %v, want %v", err, ErrInvalidDevice)
+	}
+	dup := Input{States: []StateRef{{Type: "switch", Key: "fan"}, {Type: "switch", Key: "fan"}}}
+	if _, err := svc.Create(ctx, "esp32-fan", dup); !errors.Is(err, ErrInvalidDevice) {
+		t.Fatalf("Create(duplicate state) error = %v, want %v", err, ErrInvalidDevice)
+	}
+
+	if _, err := svc.Create(ctx, "esp32-rack", rackInput()); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if _, err := svc.Create(ctx, "esp32-rack", rackInput()); !errors.Is(err, ErrDeviceAlreadyExists) {
+		t.Fatalf("Create(again) error = %v, want %v", err, ErrDeviceAlreadyExists)
+	}
+	other := Input{States: []StateRef{{Type: "switch", Key: "server_2"}}}
+	if _, err := svc.Create(ctx, "esp32-desk", other); !errors.Is(err, ErrStateOwned) {
+		t.Fatalf("Create(owned state) error = %v, want %v", err, ErrStateOwned)
+	}
+	// A device may keep its own states on update.
+	if _, err := svc.Update(ctx, "esp32-rack", rackInput()); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+
+	d, ok := svc.DeviceOf("switch", "server_1")
+	if !ok || d.ID != "esp32-rack" || d.Online {
+		t.Fatalf("DeviceOf() = %+v, %v, want esp32-rack offline", d, ok)
+	}
+	if _, ok := svc.DeviceOf("switch", "fan"); ok {
+		t.Fatalf("DeviceOf(unowned) ok = true")
+	}
+
+	// Moving a state to another device releases it.
+	if _, err := svc.Update(ctx, "esp32-rack", Input{States: []StateRef{{Type: "switch", Key: "server_1"}}}); err != nil {
+		t.Fatalf("Update(fewer states) error = %v", err)
+	}
+	if _, err := svc.Create(ctx, "esp32-desk", other); err != nil {
+		t.Fatalf("Create(released state) error = %v", err)
+	}
+	if d, _ := svc.DeviceOf("switch", "server_2"); d.ID != "esp32-desk" {
+		t.Fatalf("DeviceOf(server_2) = %+v, want esp32-desk", d)
+	}
+}
+
+func TestHeartbeatAndOnline(t *testing.T) {
+	ctx := context.Background()
+	store := newFakeStore()
+	svc := NewService(store, &ServiceConfig{OfflineAfter: time.Minute})
+
+	if _, err := svc.Heartbeat(ctx, "esp32-rack"); !errors.Is(err, ErrDeviceNotFound) {
+		t.Fatalf("Heartbeat(unknown) error = %v, want %v", err, ErrDeviceNotFound)
+	}
+	svc.Seen(ctx, "esp32-unknown")
+
+	if _, err := svc.Create(ctx, "esp32-rack", rackInput()); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	d, err := svc.Heartbeat(ctx, "esp32-rack")
+	if err != nil {
+		t.Fatalf("Heartbeat() error = %v", err)
+	}
+	if !svc.Online(d, time.Now()) {
+		t.Fatalf("Online() after heartbeat = false")
+	}
+	if svc.Online(d, d.LastSeen.Add(2*time.Minute)) {
+		t.Fatalf("Online() two minutes later = true")
+	}
+	if status, _ := svc.DeviceOf("switch", "server_1"); !status.Online {
+		t.Fatalf("DeviceOf() after heartbeat = %+v, want online", status)
+	}
+
+	// Another instance went quiet about the device: it goes offline on refresh.
+	store.Touch(ctx, "esp32-rack", time.Now().Add(-time.Hour))
+	if err := svc.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+	if status, _ := svc.DeviceOf("switch", "server_1"); status.Online {
+		t.Fatalf("DeviceOf() after silence = %+v, want offline", status)
+	}
+	svc.Seen(ctx, "esp32-rack")
+	if status, _ := svc.DeviceOf("switch", "server_1"); !status.Online {
+		t.Fatalf("DeviceOf() after Seen = %+v, want online", status)
+	}
+
+	// A device deleted elsewhere disappears on refresh.
+	store.Delete(ctx, "esp32-rack")
+	svc.Refresh(ctx)
+	if _, ok := svc.DeviceOf("switch", "server_1"); ok {
+		t.Fatalf("DeviceOf() after remote delete ok = true")
+	}
+}
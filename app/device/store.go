@@ -0,0 +1,244 @@
+package device
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel"
+)
+
+// Device is a board that controls a set of states, e.g. an ESP32 driving the
+// rack switches.
+type Device struct {
+	ID          string
+	Name        string
+	Description string
+	States      []StateRef
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	// LastSeen is the last heartbeat, batch sync or report; zero if the
+	// device was never seen.
+	LastSeen time.Time
+}
+
+// StateRef names a state a device controls.
+type StateRef struct {
+	Type string `json:"type"`
+	Key  string `json:"key"`
+}
+
+func (r StateRef) String() string {
+	return r.Type + "/" + r.Key
+}
+
+type Store interface {
+	// Create stores a new device. It returns ErrDeviceAlreadyExists if the
+	// id is taken.
+	Create(ctx context.Context, d Device) error
+	// Update replaces the definition of an existing device, keeping its
+	// last-seen time. It returns ErrDeviceNotFound if there is none.
+	Update(ctx context.Context, d Device) error
+	Get(ctx context.Context, id string) (Device, error)
+	List(ctx context.Context) ([]Device, error)
+	Delete(ctx context.Context, id string) error
+	// Touch sets the last-seen time of a registered device. It returns
+	// ErrDeviceNotFound if there is none.
+	Touch(ctx context.Context, id string, at time.Time) error
+}
+
+// deviceJSON is the stored definition. The last-seen time lives in its own
+// hash so heartbeats never rewrite the definition.
+type deviceJSON struct {
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	States      []StateRef `json:"states"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+func encodeDevice(d Device) ([]byte, error) {
+	return json.Marshal(deviceJSON{
+		ID:          d.ID,
+		Name:        d.Name,
+		Description: d.Description,
+		States:      d.States,
+		CreatedAt:   d.CreatedAt,
+		UpdatedAt:   d.UpdatedAt,
+	})
+}
+
+func decodeDevice(data []byte, seen string) (Device, error) {
+	var raw deviceJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return Device{}, err
+	}
+	d := Device{
+		ID:          raw.ID,
+		Name:        raw.Name,
+		Description: raw.Description,
+		States:      raw.States,
+		CreatedAt:   raw.CreatedAt,
+		UpdatedAt:   raw.UpdatedAt,
+	}
+	if seen != "" {
+		at, err := time.Parse(time.RFC3339Nano, seen)
+		if err != nil {
+			return Device{}, fmt.Errorf("parse last seen: %w", err)
+		}
+		d.LastSeen = at
+	}
+	return d, nil
+}
+
+type DeviceStore struct {
+	rdb    *redis.Client
+	prefix string
+}
+
+func NewStore(rdb *redis.Client, prefix string) *DeviceStore {
+	return &DeviceStore{
+		rdb:    rdb,
+		prefix: prefix,
+	}
+}
+
+func (s *DeviceStore) devicesKey() string {
+	return s.prefix + ":devices"
+}
+
+func (s *DeviceStore) seenKey() string {
+	return s.prefix + ":device_seen"
+}
+
+func (s *DeviceStore) Create(ctx context.Context, d Device) error {
+	ctx, span := otel.Tracer("device").Start(ctx, "store.Create")
+	defer span.End()
+
+	data, err := encodeDevice(d)
+	if err != nil {
+		return fmt.Errorf("marshal device: %w", err)
+	}
+	created, err := s.rdb.HSetNX(ctx, s.devicesKey(), d.ID, data).Result()
+	if err != nil {
+		return fmt.Errorf("redis HSETNX device: %w", err)
+	}
+	if !created {
+		return ErrDeviceAlreadyExists
+	}
+	return nil
+}
+
+// setIfExistsScript writes a hash field only while the device is registered,
+// so a concurrent delete is not undone. KEYS[1] is the devices hash, KEYS[2]
+// the hash written.
+var setIfExistsScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[2])
+return 1
+`)
+
+func (s *DeviceStore) Update(ctx context.Context, d Device) error {
+	ctx, span := otel.Tracer("device").Start(ctx, "store.Update")
+	defer span.End()
+
+	data, err := encodeDevice(d)
+	if err != nil {
+		return fmt.Errorf("marshal device: %w", err)
+	}
+	updated, err := setIfExistsScript.Run(ctx, s.rdb, []string{s.devicesKey(), s.devicesKey()}, d.ID, data).Int()
+	if err != nil {
+		return fmt.Errorf("redis update device script: %w", err)
+	}
+	if updated == 0 {
+		return ErrDeviceNotFound
+	}
+	return nil
+}
+
+func (s *DeviceStore) Touch(ctx context.Context, id string, at time.Time) error {
+	ctx, span := otel.Tracer("device").Start(ctx, "store.Touch")
+	defer span.End()
+
+	touched, err := setIfExistsScript.Run(ctx, s.rdb, []string{s.devicesKey(), s.seenKey()}, id, at.UTC().Format(time.RFC3339Nano)).Int()
+	if err != nil {
+		return fmt.Errorf("redis touch device script: %w", err)
+	}
+	if touched == 0 {
+		return ErrDeviceNotFound
+	}
+	return nil
+}
+
+func (s *DeviceStore) Get(ctx context.Context, id string) (Device, error) {
+	ctx, span := otel.Tracer("device").Start(ctx, "store.Get")
+	defer span.End()
+
+	pipe := s.rdb.Pipeline()
+	defCmd := pipe.HGet(ctx, s.devicesKey(), id)
+	seenCmd := pipe.HGet(ctx, s.seenKey(), id)
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return Device{}, fmt.Errorf("redis HGET device: %w", err)
+	}
+	data, err := defCmd.Bytes()
+	if errors.Is(err, redis.Nil) {
+		return Device{}, ErrDeviceNotFound
+	}
+	if err != nil {
+		return Device{}, fmt.Errorf("redis HGET device: %w", err)
+	}
+	d, err := decodeDevice(data, seenCmd.Val())
+	if err != nil {
+		return Device{}, fmt.Errorf("unmarshal device: %w", err)
+	}
+	return d, nil
+}
+
+// List returns all devices ordered by id.
+func (s *DeviceStore) List(ctx context.Context) ([]Device, error) {
+	ctx, span := otel.Tracer("device").Start(ctx, "store.List")
+	defer span.End()
+
+	pipe := s.rdb.Pipeline()
+	defsCmd := pipe.HGetAll(ctx, s.devicesKey())
+	seenCmd := pipe.HGetAll(ctx, s.seenKey())
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("redis HGETALL devices: %w", err)
+	}
+	seen := seenCmd.Val()
+	devices := make([]Device, 0, len(defsCmd.Val()))
+	for id, v := range defsCmd.Val() {
+		d, err := decodeDevice([]byte(v), seen[id])
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal device %s: %w", id, err)
+		}
+		devices = append(devices, d)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID < devices[j].ID })
+	return devices, nil
+}
+
+// Delete removes a device and its last-seen time. It returns
+// ErrDeviceNotFound if it does not exist.
+func (s *DeviceStore) Delete(ctx context.Context, id string) error {
+	ctx, span := otel.Tracer("device").Start(ctx, "store.Delete")
+	defer span.End()
+
+	pipe := s.rdb.TxPipeline()
+	removed := pipe.HDel(ctx, s.devicesKey(), id)
+	pipe.HDel(ctx, s.seenKey(), id)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("redis HDEL device: %w", err)
+	}
+	if removed.Val() == 0 {
+		return ErrDeviceNotFound
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package hmstt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog"
+)
+
+var ErrBatchEmpty = errors.New("NO STATES PROVIDED")
+var ErrBatchTooLarge = errors.New("BATCH TOO LARGE")
+var ErrBatchInvalid = errors.New("INVALID BATCH")
+
+// MaxBatchSize bounds the number of states in one batch write.
+const MaxBatchSize = 100
+
+const (
+	BATCH_STATUS_CREATED   = "created"
+	BATCH_STATUS_UPDATED   = "updated"
+	BATCH_STATUS_UNCHANGED = "unchanged"
+	BATCH_STATUS_INVALID   = "invalid"
+	BATCH_STATUS_SKIPPED   = "skipped"
+)
+
+// BatchSetItem is one state to write in a batch. A nil Description keeps the
+// existing one.
+type BatchSetItem struct {
+	Type        string
+	Key         string
+	Value       string
+	Description *string
+}
+
+// BatchSetResult reports what happened to one item of a batch.
+type BatchSetResult struct {
+	Entry  StateEntry
+	Status string
+	Error  string
+}
+
+// BatchSetStates writes several states across types at once. Every item is
+// validated first; if any is invalid nothing is written and ErrBatchInvalid is
+// returned with the per-item results. Likewise, if any state is locked nothing
+// is written and ErrStateLocked is returned. Otherwise all changes are
+// committed in a single atomic store write, which also requires the items
+// reported unchanged to be at the revision they were read at, and one event
+// is published per changed value.
+func (s *HmsttService) BatchSetStates(ctx context.Context, items []BatchSetItem) ([]BatchSetResult, error) {
+	l := zerolog.Ctx(ctx)
+	l.Info().Int("batch_size", len(items)).Msg("Handling BatchSetStates service")
+
+	if len(items) == 0 {
+		return nil, ErrBatchEmpty
+	}
+	if len(items) > MaxBatchSize {
+		return nil, fmt.Errorf("%w: %d states, at most %d allowed", ErrBatchTooLarge, len(items), MaxBatchSize)
+	}
+
+	results := make([]BatchSetResult, len(items))
+	prepared := make([]StateEntry, len(items))
+	seen := make(map[string]bool, len(items))
+	invalid := false
+	for i, item := range items {
+		results[i].Entry = StateEntry{Type: item.Type, K: item.Key, Value: item.Value}
+		id := item.Type + KEY_DELIMITER + item.Key
+		if seen[id] {
+			results[i].Status = BATCH_STATUS_INVALID
+			results[i].Error = fmt.Sprintf("%s/%s appears more than once", item.Type, item.Key)
+			invalid = true
+			continue
+		}
+		seen[id] = true
+
+		value, structured, err := s.prepareValue(item.Type, item.Key, item.Value)
+		if err != nil {
+			results[i].Status = BATCH_STATUS_INVALID
+			results[i].Error = err.Error()
+			invalid = true
+			continue
+		}
+		// Only new states must follow the naming policy.
+		if err := ValidateName(item.Type, item.Key); err != nil {
+			if _, gerr := s.store.GetState(ctx, item.Type, item.Key); gerr != nil {
+				results[i].Status = BATCH_STATUS_INVALID
+				results[i].Error = err.Error()
+				invalid = true
+				continue
+			}
+		}
+		prepared[i] = StateEntry{Type: item.Type, K: item.Key, Value: value, Structured: structured}
+	}
+	if invalid {
+		for i := range results {
+			if results[i].Status == "" {
+				results[i].Status = BATCH_STATUS_SKIPPED
+			}
+		}
+		l.Warn().Msg("BatchSetStates: invalid items, nothing written")
+		return results, ErrBatchInvalid
+	}
+
+	for attempt := 1; ; attempt++ {
+		var (
+			current   = make([]StateEntry, len(items))
+			existed   = make([]bool, len(items))
+			writes    []StateEntry
+			expected  []int64
+			indexes   []int
+			changes   []stateChange
+			locked    = make([]error, len(items))
+			anyLock   = false
+			unchanged []StateGuard
+		)
+		for i, item := range items {
+			entry := prepared[i]
+			cur, err := s.store.GetState(ctx, item.Type, item.Key)
+			existed[i] = err == nil
+			current[i] = cur
+			if err := checkUnlocked(cur); err != nil {
+				locked[i] = err
+				anyLock = true
+				continue
+			}
+			entry.Description = cur.Description
+			entry.Name = cur.Name
+			entry.Labels = cur.Labels
+			entry.Groups = cur.Groups
+			entry.Reported = cur.Reported
+			if item.Description != nil {
+				entry.Description = *item.Description
+			}
+			stampDesired(cur, &entry)
+
+			if existed[i] && cur.Value == entry.Value && cur.Description == entry.Description {
+				results[i] = BatchSetResult{Entry: cur, Status: BATCH_STATUS_UNCHANGED}
+				unchanged = append(unchanged, StateGuard{Type: cur.Type, K: cur.K, Revision: cur.Revision})
+				continue
+			}
+			writes = append(writes, entry)
+			expected = append(expected, cur.Revision)
+			indexes = append(indexes, i)
+			changes = append(changes, stateChange{before: cur, after: entry})
+		}
+		if anyLock {
+			for i := range items {
+				if locked[i] != nil {
+					results[i] = BatchSetResult{Entry: current[i], Status: BATCH_STATUS_LOCKED, Error: locked[i].Error()}
+				} else {
+					results[i] = BatchSetResult{Entry: StateEntry{Type: items[i].Type, K: items[i].Key, Value: items[i].Value}, Status: BATCH_STATUS_SKIPPED}
+				}
+			}
+			l.Warn().Msg("BatchSetStates: locked states, nothing written")
+			return results, ErrStateLocked
+		}
+		if len(writes) == 0 {
+			return results, nil
+		}
+		// The batch is checked as a whole, so it may e.g. switch one pump
+		// off and the other on in the same write.
+		guards, err := s.checkConstraints(ctx, changes)
+		if err != nil {
+			return nil, err
+		}
+		// Items reported unchanged must still be unchanged when the others
+		// are written.
+		guards = append(guards, unchanged...)
+
+		committed, err := s.store.SetStates(ctx, writes, expected, guards)
+		if errors.Is(err, ErrRevisionMismatch) {
+			if attempt < maxWriteAttempts {
+				l.Warn().Int("attempt", attempt).Msg("BatchSetStates: concurrent write, retrying")
+				continue
+			}
+			return nil, ErrRevisionMismatch
+		}
+		if err != nil {
+			l.Error().Err(err).Msg("BatchSetStates failed")
+			return nil, errors.New("SET STATES ERROR")
+		}
+
+		for n, entry := range committed {
+			i := indexes[n]
+			op, status := HISTORY_OP_SET, BATCH_STATUS_UPDATED
+			if !existed[i] {
+				op, status = HISTORY_OP_CREATE, BATCH_STATUS_CREATED
+			}
+			results[i] = BatchSetResult{Entry: entry, Status: status}
+			s.recordHistory(ctx, op, current[i], entry)
+			s.notifyWrite(ctx, entry)
+			if !existed[i] || current[i].Value != entry.Value {
+				s.publishChange(ctx, entry)
+			}
+		}
+		return results, nil
+	}
+}
@@ -1,10 +1,16 @@
 package hmstt
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"path"
+	"slices"
+	"sort"
+	"sync"
 	"testing"
 	"time"
 
@@ -12,10 +18,27 @@ import (
 )
 
 type fakeStateStore struct {
-	states map[string][]StateEntry
+	mu      sync.Mutex
+	states  map[string][]StateEntry
+	seq     int64
+	history int
+	records map[string][]HistoryRecord
+	// historyQuery is the last query passed to GetHistory.
+	historyQuery HistoryQuery
+	timers       map[string]Timer
+	leased       map[string]time.Time
+	// commands holds the encoded commands, so ResolveCommand compares like
+	// the Redis script does.
+	commands map[string]string
 }
 
 func (f *fakeStateStore) GetState(_ context.Context, tipe, k string) (StateEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.get(tipe, k)
+}
+
+func (f *fakeStateStore) get(tipe, k string) (StateEntry, error) {
 	for _, entry := range f.states[tipe] {
 		if entry.K == k {
 			return entry, nil
@@ -24,11 +47,129 @@ func (f *fakeStateStore) GetState(_ context.Context, tipe, k string) (StateEntry
 	return StateEntry{}, ErrStateNotFound
 }
 
-func (f *fakeStateStore) SetState(context.Context, string, string, string, string) error {
+func (f *fakeStateStore) CreateState(_ context.Context, entry StateEntry) (StateEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.get(entry.Type, entry.K); err == nil {
+		return StateEntry{}, ErrStateAlreadyExists
+	}
+	return f.put(entry), nil
+}
+
+func (f *fakeStateStore) SetState(_ context.Context, entry StateEntry, expectedRevision int64) (StateEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	current, _ := f.get(entry.Type, entry.K)
+	if current.Revision != expectedRevision {
+		return StateEntry{}, ErrRevisionMismatch
+	}
+	return f.put(entry), nil
+}
+
+func (f *fakeStateStore) SetStates(_ context.Context, entries []StateEntry, expectedRevisions []int64, guards []StateGuard) ([]StateEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, entry := range entries {
+		current, _ := f.get(entry.Type, entry.K)
+		if current.Revision != expectedRevisions[i] {
+			return nil, ErrRevisionMismatch
+		}
+	}
+	for _, g := range guards {
+		if g.Group != "" {
+			if f.groupSize(g.Group) != g.Members {
+				return nil, ErrRevisionMismatch
+			}
+			continue
+		}
+		if current, _ := f.get(g.Type, g.K); current.Revision != g.Revision {
+			return nil, ErrRevisionMismatch
+		}
+	}
+	committed := make([]StateEntry, 0, len(entries))
+	for _, entry := range entries {
+		committed = append(committed, f.put(entry))
+	}
+	return committed, nil
+}
+
+func (f *fakeStateStore) put(entry StateEntry) StateEntry {
+	if f.states == nil {
+		f.states = map[string][]StateEntry{}
+	}
+	f.seq++
+	entry.Revision = f.seq
+	entry.UpdatedAt = time.Now().UTC()
+	// Like the real store, writes keep the report and never set it.
+	entry.Reported = nil
+	for i, e := range f.states[entry.Type] {
+		if e.K == entry.K {
+			entry.Reported = e.Reported
+			f.states[entry.Type][i] = entry
+			return entry
+		}
+	}
+	f.states[entry.Type] = append(f.states[entry.Type], entry)
+	return entry
+}
+
+func (f *fakeStateStore) SetReported(_ context.Context, tipe, k string, r ReportedState) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, e := range f.states[tipe] {
+		if e.K == k {
+			f.states[tipe][i].Reported = &r
+			return nil
+		}
+	}
+	return ErrStateNotFound
+}
+
+func (f *fakeStateStore) DeleteState(_ context.Context, tipe, k string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, entry := range f.states[tipe] {
+		if entry.K == k {
+			f.states[tipe] = append(f.states[tipe][:i], f.states[tipe][i+1:]...)
+			return nil
+		}
+	}
+	return ErrStateNotFound
+}
+
+func (f *fakeStateStore) DeleteType(_ context.Context, tipe string) ([]StateEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	entries := f.states[tipe]
+	delete(f.states, tipe)
+	return entries, nil
+}
+
+func (f *fakeStateStore) AppendHistory(_ context.Context, tipe, k string, rec HistoryRecord) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.history++
+	if f.records == nil {
+		f.records = map[string][]HistoryRecord{}
+	}
+	f.records[timerID(tipe, k)] = append(f.records[timerID(tipe, k)], rec)
 	return nil
 }
 
+// GetHistory returns the records of the key newest first and keeps q for
+// the test to look at; it does not filter.
+func (f *fakeStateStore) GetHistory(_ context.Context, tipe, k string, q HistoryQuery) ([]HistoryRecord, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.historyQuery = q
+	records := slices.Clone(f.records[timerID(tipe, k)])
+	slices.Reverse(records)
+	return records, nil
+}
+
 func (f *fakeStateStore) GetAllByType(_ context.Context, tipe string) ([]StateEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	entries := f.states[tipe]
 	result := make([]StateEntry, len(entries))
 	copy(result, entries)
@@ -36,13 +177,262 @@ func (f *fakeStateStore) GetAllByType(_ context.Context, tipe string) ([]StateEn
 }
 
 func (f *fakeStateStore) GetAll(_ context.Context) ([]StateEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	var result []StateEntry
 	for _, entries := range f.states {
 		result = append(result, entries...)
 	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Type != result[j].Type {
+			return result[i].Type < result[j].Type
+		}
+		return result[i].K < result[j].K
+	})
 	return result, nil
 }
 
+func (f *fakeStateStore) ListTypes(context.Context) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var types []string
+	for tipe, entries := range f.states {
+		if len(entries) > 0 {
+			types = append(types, tipe)
+		}
+	}
+	sort.Strings(types)
+	return types, nil
+}
+
+// ScanStates walks the entries of tipe in slices of count, filtering each
+// slice like HSCAN MATCH does.
+func (f *fakeStateStore) ScanStates(_ context.Context, tipe string, cursor uint64, match string, count int64) ([]StateEntry, uint64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	entries := f.states[tipe]
+	end := min(int(cursor)+int(count), len(entries))
+	var batch []StateEntry
+	for _, e := range entries[min(int(cursor), end):end] {
+		if ok, _ := path.Match(match, e.K); ok {
+			batch = append(batch, e)
+		}
+	}
+	if end == len(entries) {
+		return batch, 0, nil
+	}
+	return batch, uint64(end), nil
+}
+
+func (f *fakeStateStore) PutTimer(_ context.Context, t Timer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.timers == nil {
+		f.timers = map[string]Timer{}
+	}
+	f.timers[timerID(t.Type, t.Key)] = t
+	delete(f.leased, timerID(t.Type, t.Key))
+	return nil
+}
+
+func (f *fakeStateStore) GetTimer(_ context.Context, tipe, k string) (Timer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t, ok := f.timers[timerID(tipe, k)]
+	if !ok {
+		return Timer{}, ErrTimerNotFound
+	}
+	return t, nil
+}
+
+func (f *fakeStateStore) ListTimers(context.Context) ([]Timer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	timers := make([]Timer, 0, len(f.timers))
+	for _, t := range f.timers {
+		timers = append(timers, t)
+	}
+	return timers, nil
+}
+
+func (f *fakeStateStore) DeleteTimer(_ context.Context, tipe, k string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.timers[timerID(tipe, k)]; !ok {
+		return ErrTimerNotFound
+	}
+	delete(f.timers, timerID(tipe, k))
+	delete(f.leased, timerID(tipe, k))
+	return nil
+}
+
+func (f *fakeStateStore) ClaimDueTimers(_ context.Context, now time.Time, lease time.Duration) ([]Timer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.leased == nil {
+		f.leased = map[string]time.Time{}
+	}
+	var due []Timer
+	for id, t := range f.timers {
+		dueAt := t.DueAt
+		if until, ok := f.leased[id]; ok {
+			dueAt = until
+		}
+		if !dueAt.After(now) {
+			due = append(due, t)
+			f.leased[id] = now.Add(lease)
+		}
+	}
+	return due, nil
+}
+
+func (f *fakeStateStore) FinishTimer(_ context.Context, t Timer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := timerID(t.Type, t.Key)
+	if f.timers[id] == t {
+		delete(f.timers, id)
+		delete(f.leased, id)
+	}
+	return nil
+}
+
+func (f *fakeStateStore) PutCommand(_ context.Context, c Command) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.commands == nil {
+		f.commands = map[string]string{}
+	}
+	data, err := encodeCommand(c)
+	if err != nil {
+		return err
+	}
+	f.commands[timerID(c.Type, c.Key)] = data
+	return nil
+}
+
+func (f *fakeStateStore) GetCommand(_ context.Context, tipe, k string) (Command, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.commands[timerID(tipe, k)]
+	if !ok {
+		return Command{}, ErrCommandNotFound
+	}
+	return decodeCommand(data)
+}
+
+func (f *fakeStateStore) ListCommands(context.Context) ([]Command, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	commands := make([]Command, 0, len(f.commands))
+	for _, data := range f.commands {
+		c, _ := decodeCommand(data)
+		commands = append(commands, c)
+	}
+	sort.Slice(commands, func(i, j int) bool {
+		return timerID(commands[i].Type, commands[i].Key) < timerID(commands[j].Type, commands[j].Key)
+	})
+	return commands, nil
+}
+
+func (f *fakeStateStore) DeleteCommand(_ context.Context, tipe, k string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.commands[timerID(tipe, k)]; !ok {
+		return ErrCommandNotFound
+	}
+	delete(f.commands, timerID(tipe, k))
+	return nil
+}
+
+// ClaimDueCommands returns the due pending commands without leasing them;
+// tests claim from one goroutine.
+func (f *fakeStateStore) ClaimDueCommands(_ context.Context, now time.Time, _ time.Duration) ([]Command, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var due []Command
+	for _, data := range f.commands {
+		c, _ := decodeCommand(data)
+		if c.Status == COMMAND_STATUS_PENDING && !c.NextAttemptAt.After(now) {
+			due = append(due, c)
+		}
+	}
+	return due, nil
+}
+
+func (f *fakeStateStore) ResolveCommand(_ context.Context, old Command, next *Command) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := timerID(old.Type, old.Key)
+	oldData, _ := encodeCommand(old)
+	if f.commands[id] != oldData {
+		return ErrCommandChanged
+	}
+	if next == nil {
+		delete(f.commands, id)
+		return nil
+	}
+	f.commands[id], _ = encodeCommand(*next)
+	return nil
+}
+
+// ListGroups and GetGroupMembers scan the states; the fake keeps no index.
+func (f *fakeStateStore) ListGroups(context.Context) ([]Group, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	counts := map[string]int64{}
+	for _, entries := range f.states {
+		for _, e := range entries {
+			for _, g := range e.Groups {
+				counts[g]++
+			}
+		}
+	}
+	groups := make([]Group, 0, len(counts))
+	for name, n := range counts {
+		groups = append(groups, Group{Name: name, Members: n})
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	return groups, nil
+}
+
+func (f *fakeStateStore) GroupSize(_ context.Context, group string) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.groupSize(group), nil
+}
+
+func (f *fakeStateStore) groupSize(group string) int64 {
+	var n int64
+	for _, entries := range f.states {
+		for _, e := range entries {
+			if slices.Contains(e.Groups, group) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func (f *fakeStateStore) GetGroupMembers(_ context.Context, group string) ([]StateEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var members []StateEntry
+	for _, entries := range f.states {
+		for _, e := range entries {
+			for _, g := range e.Groups {
+				if g == group {
+					members = append(members, e)
+				}
+			}
+		}
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return groupMember(members[i].Type, members[i].K) < groupMember(members[j].Type, members[j].K)
+	})
+	return members, nil
+}
+
 func TestGetStatesByKeysPreservesRequestOrder(t *testing.T) {
 	store := &fakeStateStore{states: map[string][]StateEntry{
 		"switch": {
@@ -52,7 +442,7 @@ func TestGetStatesByKeysPreservesRequestOrder(t *testing.T) {
 		},
 	}}
 
-	svc := NewService(store, nil)
+	svc := NewService(store, nil, nil)
 	entries, err := svc.GetStatesByKeys(context.Background(), "switch", []string{"server_3", "missing", "server_1"})
 	if err != nil {
 		t.Fatalf("GetStatesByKeys() error = %v", err)
@@ -73,7 +463,7 @@ func TestGetStatesByKeysHandler(t *testing.T) {
 		},
 	}}
 
-	svc := NewService(store, nil)
+	svc := NewService(store, nil, nil)
 	srv := server.NewWithConfig(":0", &server.ServerConfig{BearerToken: "test-token"})
 	RegisterHandlers(srv, svc)
 
@@ -126,3 +516,123 @@ func TestGetStatesByKeysHandler(t *testing.T) {
 		}
 	})
 }
+
+func TestBatchSetStates(t *testing.T) {
+	newStore := func() *fakeStateStore {
+		return &fakeStateStore{states: map[string][]StateEntry{
+			"switch": {
+				{Type: "switch", K: "relay_1", Value: "on", Description: "Relay 1", Revision: 1},
+				{Type: "switch", K: "relay_2", Value: "off", Description: "Relay 2", Revision: 2},
+			},
+		}, seq: 2}
+	}
+
+	t.Run("applies creates and updates and reports unchanged", func(t *testing.T) {
+		store := newStore()
+		svc := NewService(store, nil, nil)
+		results, err := svc.BatchSetStates(context.Background(), []BatchSetItem{
+			{Type: "switch", Key: "relay_1", Value: "off"},
+			{Type: "switch", Key: "relay_2", Value: "off"},
+			{Type: "switch", Key: "relay_3", Value: "off"},
+		})
+		if err != nil {
+			t.Fatalf("BatchSetStates() error = %v", err)
+		}
+		want := []string{BATCH_STATUS_UPDATED, BATCH_STATUS_UNCHANGED, BATCH_STATUS_CREATED}
+		for i, res := range results {
+			if res.Status != want[i] {
+				t.Fatalf("results[%d].Status = %q, want %q", i, res.Status, want[i])
+			}
+		}
+		if results[0].Entry.Description != "Relay 1" {
+			t.Fatalf("description = %q, want it kept", results[0].Entry.Description)
+		}
+		if store.history != 2 {
+			t.Fatalf("history records = %d, want 2", store.history)
+		}
+	})
+
+	t.Run("unchanged items are checked at write time", func(t *testing.T) {
+		store := &interleavingStore{fakeStateStore: newStore()}
+		svc := NewService(store, nil, nil)
+		// relay_2 is switched on after the batch read it as off.
+		store.between = func() {
+			if _, err := svc.SetState(context.Background(), "switch", "relay_2", "on", nil, nil, nil); err != nil {
+				t.Errorf("SetState(relay_2) error = %v", err)
+			}
+		}
+		results, err := svc.BatchSetStates(context.Background(), []BatchSetItem{
+			{Type: "switch", Key: "relay_1", Value: "off"},
+			{Type: "switch", Key: "relay_2", Value: "off"},
+		})
+		if err != nil {
+			t.Fatalf("BatchSetStates() error = %v", err)
+		}
+		if results[1].Status != BATCH_STATUS_UPDATED {
+			t.Fatalf("results[1].Status = %q, want %q after the concurrent write", results[1].Status, BATCH_STATUS_UPDATED)
+		}
+		if got, _ := store.GetState(context.Background(), "switch", "relay_2"); got.Value != "off" {
+			t.Fatalf("relay_2 = %q, want off as the batch set it", got.Value)
+		}
+	})
+
+	t.Run("invalid item writes nothing", func(t *testing.T) {
+		store := newStore()
+		svc := NewService(store, nil, nil)
+		results, err := svc.BatchSetStates(context.Background(), []BatchSetItem{
+			{Type: "switch", Key: "relay_1", Value: "off"},
+			{Type: "switch", Key: "relay_2", Value: "dim"},
+			{Type: "switch", Key: "relay_1", Value: "on"},
+		})
+		if !errors.Is(err, ErrBatchInvalid) {
+			t.Fatalf("BatchSetStates() error = %v, want %v", err, ErrBatchInvalid)
+		}
+		want := []string{BATCH_STATUS_SKIPPED, BATCH_STATUS_INVALID, BATCH_STATUS_INVALID}
+		for i, res := range results {
+			if res.Status != want[i] {
+				t.Fatalf("results[%d].Status = %q, want %q", i, res.Status, want[i])
+			}
+		}
+		if entry, _ := store.GetState(context.Background(), "switch", "relay_1"); entry.Value != "on" {
+			t.Fatalf("relay_1 = %q, want it untouched", entry.Value)
+		}
+	})
+
+	t.Run("handler", func(t *testing.T) {
+		svc := NewService(newStore(), nil, nil)
+		srv := server.NewWithConfig(":0", &server.ServerConfig{BearerToken: "test-token", MaxRequestSize: 1 << 20})
+		RegisterHandlers(srv, svc)
+
+		do := func(body string) (int, []BatchSetResultResponse) {
+			req := httptest.NewRequest(http.MethodPost, "/v1/states:batchSet", bytes.NewBufferString(body))
+			req.Header.Set("Authorization", "Bearer test-token")
+			rr := httptest.NewRecorder()
+			srv.GetRouter().ServeHTTP(rr, req)
+			var resp struct {
+				Data []BatchSetResultResponse `json:"data"`
+			}
+			_ = json.Unmarshal(rr.Body.Bytes(), &resp)
+			return rr.Code, resp.Data
+		}
+
+		code, data := do(`{"states":[{"type":"switch","key":"relay_1","value":"off"},{"type":"switch","key":"relay_2","value":"on"}]}`)
+		if code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", code, http.StatusOK)
+		}
+		if len(data) != 2 || data[0].Status != BATCH_STATUS_UPDATED || data[0].Revision == 0 {
+			t.Fatalf("unexpected results = %+v", data)
+		}
+
+		code, data = do(`{"states":[{"type":"switch","key":"relay_1","value":"dim"}]}`)
+		if code != http.StatusBadRequest {
+			t.Fatalf("invalid batch status = %d, want %d", code, http.StatusBadRequest)
+		}
+		if len(data) != 1 || data[0].Error == "" {
+			t.Fatalf("unexpected results = %+v", data)
+		}
+
+		if code, _ := do(`{"states":[]}`); code != http.StatusBadRequest {
+			t.Fatalf("empty batch status = %d, want %d", code, http.StatusBadRequest)
+		}
+	})
+}
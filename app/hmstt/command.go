@@ -0,0 +1,463 @@
+package hmstt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/nurhudajoantama/hmauto/internal/redisqueue"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+)
+
+var ErrCommandNotFound = errors.New("COMMAND NOT FOUND")
+var ErrCommandChanged = errors.New("COMMAND CHANGED")
+
+const (
+	COMMAND_STATUS_PENDING = "pending"
+	COMMAND_STATUS_FAILED  = "failed"
+
+	// commandLease is how long a claimed command is hidden from other
+	// workers; if the worker dies, it is retried after the lease.
+	commandLease      = 30 * time.Second
+	commandClaimBatch = 100
+	// maxCommandBackoff caps the wait between republishes.
+	maxCommandBackoff = time.Hour
+)
+
+var hmsttCommandRetriesTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "hmstt_command_retries_total",
+		Help: "Total number of state values republished because the device did not acknowledge them.",
+	},
+	[]string{"type"},
+)
+
+var hmsttCommandsUndeliveredTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "hmstt_commands_undelivered_total",
+		Help: "Total number of state values a device never acknowledged, after all retries.",
+	},
+	[]string{"type"},
+)
+
+// CommandConfig turns on delivery tracking of published values. A value is
+// acknowledged by a device report of the same value; until then it is
+// republished after AckTimeout, doubling the wait each time, up to
+// MaxRetries times.
+type CommandConfig struct {
+	AckTimeout time.Duration
+	MaxRetries int
+}
+
+// Command is a published desired value waiting for its device to report
+// it. There is at most one per state; a newer value replaces it. Failed
+// commands stay until the device reports the value or the state changes.
+type Command struct {
+	Type          string
+	Key           string
+	Value         string
+	Structured    bool
+	Revision      int64
+	Status        string
+	Attempts      int // publishes so far, the first one included
+	CreatedAt     time.Time
+	LastAttemptAt time.Time
+	NextAttemptAt time.Time // zero once failed
+}
+
+type commandJSON struct {
+	Type          string    `json:"type"`
+	Key           string    `json:"key"`
+	Value         string    `json:"value"`
+	Structured    bool      `json:"structured,omitempty"`
+	Revision      int64     `json:"revision"`
+	Status        string    `json:"status"`
+	Attempts      int       `json:"attempts"`
+	CreatedAt     time.Time `json:"created_at"`
+	LastAttemptAt time.Time `json:"last_attempt_at"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+}
+
+// encodeCommand is deterministic, so a stored command can be compared with
+// the encoding of the one read earlier.
+func encodeCommand(c Command) (string, error) {
+	c.CreatedAt = c.CreatedAt.UTC()
+	c.LastAttemptAt = c.LastAttemptAt.UTC()
+	c.NextAttemptAt = c.NextAttemptAt.UTC()
+	data, err := json.Marshal(commandJSON(c))
+	if err != nil {
+		return "", fmt.Errorf("marshal command: %w", err)
+	}
+	return string(data), nil
+}
+
+func decodeCommand(data string) (Command, error) {
+	var c commandJSON
+	if err := json.Unmarshal([]byte(data), &c); err != nil {
+		return Command{}, err
+	}
+	return Command(c), nil
+}
+
+func (s *HmsttStore) commandQueueKey() string {
+	return s.prefix + ":hmstt_commands"
+}
+
+func (s *HmsttStore) commandDataKey() string {
+	return s.prefix + ":hmstt_command_data"
+}
+
+// PutCommand stores c, replacing any command of the same state.
+func (s *HmsttStore) PutCommand(ctx context.Context, c Command) error {
+	ctx, span := otel.Tracer("hmstt").Start(ctx, "store.PutCommand")
+	defer span.End()
+
+	data, err := encodeCommand(c)
+	if err != nil {
+		return err
+	}
+	id := timerID(c.Type, c.Key)
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, s.commandDataKey(), id, data)
+		if c.Status == COMMAND_STATUS_PENDING {
+			pipe.ZAdd(ctx, s.commandQueueKey(), redis.Z{Score: float64(c.NextAttemptAt.UnixMilli()), Member: id})
+		} else {
+			pipe.ZRem(ctx, s.commandQueueKey(), id)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("redis ZADD/HSET command: %w", err)
+	}
+	return nil
+}
+
+// GetCommand returns the command of a state, or ErrCommandNotFound.
+func (s *HmsttStore) GetCommand(ctx context.Context, tipe, k string) (Command, error) {
+	ctx, span := otel.Tracer("hmstt").Start(ctx, "store.GetCommand")
+	defer span.End()
+
+	data, err := s.rdb.HGet(ctx, s.commandDataKey(), timerID(tipe, k)).Result()
+	if errors.Is(err, redis.Nil) {
+		return Command{}, ErrCommandNotFound
+	}
+	if err != nil {
+		return Command{}, fmt.Errorf("redis HGET command: %w", err)
+	}
+	c, err := decodeCommand(data)
+	if err != nil {
+		return Command{}, fmt.Errorf("unmarshal command: %w", err)
+	}
+	return c, nil
+}
+
+// ListCommands returns all pending and failed commands, oldest first.
+func (s *HmsttStore) ListCommands(ctx context.Context) ([]Command, error) {
+	ctx, span := otel.Tracer("hmstt").Start(ctx, "store.ListCommands")
+	defer span.End()
+
+	result, err := s.rdb.HGetAll(ctx, s.commandDataKey()).Result()
+	if err != nil {
+		return nil, fmt.Errorf("redis HGETALL commands: %w", err)
+	}
+	commands := make([]Command, 0, len(result))
+	for id, v := range result {
+		c, err := decodeCommand(v)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal command %s: %w", id, err)
+		}
+		commands = append(commands, c)
+	}
+	sort.Slice(commands, func(i, j int) bool { return commands[i].CreatedAt.Before(commands[j].CreatedAt) })
+	return commands, nil
+}
+
+// DeleteCommand drops the command of a state. It returns
+// ErrCommandNotFound if there is none.
+func (s *HmsttStore) DeleteCommand(ctx context.Context, tipe, k string) error {
+	ctx, span := otel.Tracer("hmstt").Start(ctx, "store.DeleteCommand")
+	defer span.End()
+
+	id := timerID(tipe, k)
+	var removed *redis.IntCmd
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, s.commandQueueKey(), id)
+		removed = pipe.HDel(ctx, s.commandDataKey(), id)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("redis ZREM/HDEL command: %w", err)
+	}
+	if removed.Val() == 0 {
+		return ErrCommandNotFound
+	}
+	return nil
+}
+
+func (s *HmsttStore) commandQueue() redisqueue.Queue {
+	return redisqueue.Queue{QueueKey: s.commandQueueKey(), DataKey: s.commandDataKey()}
+}
+
+// ClaimDueCommands returns the pending commands due at now and leases them
+// for lease.
+func (s *HmsttStore) ClaimDueCommands(ctx context.Context, now time.Time, lease time.Duration) ([]Command, error) {
+	ctx, span := otel.Tracer("hmstt").Start(ctx, "store.ClaimDueCommands")
+	defer span.End()
+
+	result, err := s.commandQueue().Claim(ctx, s.rdb, now, lease, commandClaimBatch)
+	if err != nil {
+		return nil, fmt.Errorf("redis claim commands script: %w", err)
+	}
+	commands := make([]Command, 0, len(result))
+	for _, v := range result {
+		c, err := decodeCommand(v)
+		if err != nil {
+			log.Error().Err(err).Msg("skipping undecodable command")
+			continue
+		}
+		commands = append(commands, c)
+	}
+	return commands, nil
+}
+
+// resolveCommandScript replaces (ARGV[3], due at ARGV[4] or off the queue if
+// empty) or, with an empty ARGV[3], removes the command ARGV[1] if it is
+// still exactly ARGV[2].
+var resolveCommandScript = redis.NewScript(`
+if redis.call('HGET', KEYS[2], ARGV[1]) ~= ARGV[2] then
+	return 0
+end
+if ARGV[3] == '' then
+	redis.call('HDEL', KEYS[2], ARGV[1])
+	redis.call('ZREM', KEYS[1], ARGV[1])
+	return 1
+end
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[3])
+if ARGV[4] == '' then
+	redis.call('ZREM', KEYS[1], ARGV[1])
+else
+	redis.call('ZADD', KEYS[1], ARGV[4], ARGV[1])
+end
+return 1
+`)
+
+// ResolveCommand replaces old with next, or removes it if next is nil, as
+// long as old is still the stored command. It returns ErrCommandChanged if
+// a newer value replaced it or it is gone.
+func (s *HmsttStore) ResolveCommand(ctx context.Context, old Command, next *Command) error {
+	ctx, span := otel.Tracer("hmstt").Start(ctx, "store.ResolveCommand")
+	defer span.End()
+
+	oldData, err := encodeCommand(old)
+	if err != nil {
+		return err
+	}
+	var nextData, due string
+	if next != nil {
+		if nextData, err = encodeCommand(*next); err != nil {
+			return err
+		}
+		if next.Status == COMMAND_STATUS_PENDING {
+			due = strconv.FormatInt(next.NextAttemptAt.UnixMilli(), 10)
+		}
+	}
+	ok, err := resolveCommandScript.Run(ctx, s.rdb, []string{s.commandQueueKey(), s.commandDataKey()},
+		timerID(old.Type, old.Key), oldData, nextData, due).Int()
+	if err != nil {
+		return fmt.Errorf("redis resolve command script: %w", err)
+	}
+	if ok == 0 {
+		return ErrCommandChanged
+	}
+	return nil
+}
+
+// commandBackoff is the wait for an acknowledgement after the given number
+// of publishes: AckTimeout, then doubling.
+func (c *CommandConfig) commandBackoff(attempts int) time.Duration {
+	d := c.AckTimeout
+	for i := 1; i < attempts && d < maxCommandBackoff; i++ {
+		d *= 2
+	}
+	return min(d, maxCommandBackoff)
+}
+
+// trackCommand starts waiting for the device to acknowledge a published
+// value, replacing the command of an older value.
+func (s *HmsttService) trackCommand(ctx context.Context, entry StateEntry) {
+	if s.commands == nil {
+		return
+	}
+	l := zerolog.Ctx(ctx)
+	if inSync, _ := entry.InSync(); inSync {
+		// The device already reported this value; nothing to wait for.
+		if err := s.store.DeleteCommand(ctx, entry.Type, entry.K); err != nil && !errors.Is(err, ErrCommandNotFound) {
+			l.Error().Err(err).Msg("dropping command failed")
+		}
+		return
+	}
+	now := time.Now().UTC()
+	c := Command{
+		Type:          entry.Type,
+		Key:           entry.K,
+		Value:         entry.Value,
+		Structured:    entry.Structured,
+		Revision:      entry.Revision,
+		Status:        COMMAND_STATUS_PENDING,
+		Attempts:      1,
+		CreatedAt:     now,
+		LastAttemptAt: now,
+		NextAttemptAt: now.Add(s.commands.commandBackoff(1)),
+	}
+	if err := s.store.PutCommand(ctx, c); err != nil {
+		l.Error().Err(err).Msg("tracking command failed")
+	}
+}
+
+// ackCommand settles the command of a state once its device reports the
+// commanded value.
+func (s *HmsttService) ackCommand(ctx context.Context, entry StateEntry) {
+	if s.commands == nil {
+		return
+	}
+	l := zerolog.Ctx(ctx)
+	c, err := s.store.GetCommand(ctx, entry.Type, entry.K)
+	if errors.Is(err, ErrCommandNotFound) {
+		return
+	}
+	if err != nil {
+		l.Error().Err(err).Msg("acknowledging command failed")
+		return
+	}
+	if c.Value != entry.Reported.Value {
+		return
+	}
+	if err := s.store.ResolveCommand(ctx, c, nil); err != nil && !errors.Is(err, ErrCommandChanged) {
+		l.Error().Err(err).Msg("acknowledging command failed")
+	}
+}
+
+// dropCommand forgets the command of a removed state.
+func (s *HmsttService) dropCommand(ctx context.Context, tipe, key string) {
+	if err := s.store.DeleteCommand(ctx, tipe, key); err != nil && !errors.Is(err, ErrCommandNotFound) {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("dropping command failed")
+	}
+}
+
+// ListCommands returns the commands still waiting for their device, oldest
+// first; status, if set, keeps only pending or only failed ones.
+func (s *HmsttService) ListCommands(ctx context.Context, status string) ([]Command, error) {
+	if status != "" && status != COMMAND_STATUS_PENDING && status != COMMAND_STATUS_FAILED {
+		return nil, fmt.Errorf("%w: status must be %s or %s", ErrInvalidListQuery, COMMAND_STATUS_PENDING, COMMAND_STATUS_FAILED)
+	}
+	commands, err := s.store.ListCommands(ctx)
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("ListCommands failed")
+		return nil, errors.New("LIST COMMANDS ERROR")
+	}
+	if status == "" {
+		return commands, nil
+	}
+	out := commands[:0]
+	for _, c := range commands {
+		if c.Status == status {
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+// RunCommands retries unacknowledged commands every interval until ctx is
+// cancelled. It returns at once if command tracking is off.
+func (s *HmsttService) RunCommands(ctx context.Context, interval time.Duration) error {
+	if s.commands == nil {
+		return nil
+	}
+	l := log.With().Str("component", "hmstt_commands").Logger()
+	ctx = l.WithContext(ctx)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		commands, err := s.store.ClaimDueCommands(ctx, time.Now(), commandLease)
+		if err != nil {
+			l.Error().Err(err).Msg("claiming due commands failed")
+			continue
+		}
+		for _, c := range commands {
+			s.retryCommand(ctx, c, time.Now().UTC())
+		}
+	}
+}
+
+// retryCommand handles a command whose acknowledgement is overdue: it is
+// dropped if the state moved on or the device caught up, republished while
+// retries are left, and marked failed after that. The command is rescheduled
+// before it is republished, so a newer value that replaced it meanwhile is
+// never overwritten by an old one; if a newer value slips in between, the
+// device reports the old value and the newer command is retried in turn.
+func (s *HmsttService) retryCommand(ctx context.Context, c Command, now time.Time) {
+	l := zerolog.Ctx(ctx).With().Str("hmstt_type", c.Type).Str("hmstt_key", c.Key).Int("attempts", c.Attempts).Logger()
+
+	entry, err := s.store.GetState(ctx, c.Type, c.Key)
+	missing := errors.Is(err, ErrStateNotFound) || errors.Is(err, redis.Nil)
+	if err != nil && !missing {
+		l.Error().Err(err).Msg("command retry: reading state failed")
+		return
+	}
+	inSync, _ := entry.InSync()
+	if missing || entry.Value != c.Value || inSync {
+		if err := s.store.ResolveCommand(ctx, c, nil); err != nil && !errors.Is(err, ErrCommandChanged) {
+			l.Error().Err(err).Msg("command retry: dropping command failed")
+		}
+		return
+	}
+
+	next := c
+	if c.Attempts > s.commands.MaxRetries {
+		next.Status = COMMAND_STATUS_FAILED
+		next.NextAttemptAt = time.Time{}
+		if err := s.store.ResolveCommand(ctx, c, &next); err != nil {
+			if !errors.Is(err, ErrCommandChanged) {
+				l.Error().Err(err).Msg("command retry: marking command failed failed")
+			}
+			return
+		}
+		hmsttCommandsUndeliveredTotal.WithLabelValues(c.Type).Inc()
+		l.Warn().Str("value", c.Value).Msg("device did not acknowledge command, giving up")
+		return
+	}
+
+	next.Attempts++
+	next.LastAttemptAt = now
+	next.NextAttemptAt = now.Add(s.commands.commandBackoff(next.Attempts))
+	if err := s.store.ResolveCommand(ctx, c, &next); err != nil {
+		if !errors.Is(err, ErrCommandChanged) {
+			l.Error().Err(err).Msg("command retry: rescheduling command failed")
+		}
+		return
+	}
+	if s.event != nil {
+		generatedKey := PREFIX_HMSTT + KEY_DELIMITER + c.Type + KEY_DELIMITER + c.Key
+		if err := s.event.StateChange(ctx, generatedKey, c.Value, c.Structured); err != nil {
+			l.Error().Err(err).Msg("command retry: republishing failed")
+		}
+	}
+	hmsttCommandRetriesTotal.WithLabelValues(c.Type).Inc()
+	l.Info().Str("value", c.Value).Time("next_attempt_at", next.NextAttemptAt).Msg("republished unacknowledged command")
+}
@@ -0,0 +1,157 @@
+package hmstt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nurhudajoantama/hmauto/app/server"
+)
+
+func TestCommandBackoff(t *testing.T) {
+	c := &CommandConfig{AckTimeout: 10 * time.Second}
+	for attempts, want := range map[int]time.Duration{1: 10 * time.Second, 2: 20 * time.Second, 3: 40 * time.Second, 20: maxCommandBackoff} {
+		if got := c.commandBackoff(attempts); got != want {
+			t.Fatalf("commandBackoff(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+}
+
+func TestCommandRetriesThenFails(t *testing.T) {
+	ctx := context.Background()
+	store := newSwitchStore()
+	svc := NewService(store, nil, &ServiceConfig{Commands: &CommandConfig{AckTimeout: time.Second, MaxRetries: 2}})
+
+	if _, err := svc.SetState(ctx, "switch", "modem", "off", nil, nil, nil); err != nil {
+		t.Fatalf("SetState() error = %v", err)
+	}
+	c, err := store.GetCommand(ctx, "switch", "modem")
+	if err != nil || c.Status != COMMAND_STATUS_PENDING || c.Value != "off" || c.Attempts != 1 {
+		t.Fatalf("command after SetState = %+v, %v, want pending off after one publish", c, err)
+	}
+
+	now := c.NextAttemptAt
+	for attempts := 2; attempts <= 3; attempts++ {
+		due, _ := store.ClaimDueCommands(ctx, now, commandLease)
+		if len(due) != 1 {
+			t.Fatalf("due commands = %d, want 1", len(due))
+		}
+		svc.retryCommand(ctx, due[0], now)
+		c, _ = store.GetCommand(ctx, "switch", "modem")
+		if c.Status != COMMAND_STATUS_PENDING || c.Attempts != attempts {
+			t.Fatalf("command after retry = %+v, want pending with %d attempts", c, attempts)
+		}
+		now = c.NextAttemptAt
+	}
+
+	due, _ := store.ClaimDueCommands(ctx, now, commandLease)
+	svc.retryCommand(ctx, due[0], now)
+	c, _ = store.GetCommand(ctx, "switch", "modem")
+	if c.Status != COMMAND_STATUS_FAILED || !c.NextAttemptAt.IsZero() {
+		t.Fatalf("command after last retry = %+v, want failed", c)
+	}
+	if due, _ := store.ClaimDueCommands(ctx, now.Add(time.Hour), commandLease); len(due) != 0 {
+		t.Fatalf("failed command is still due: %+v", due)
+	}
+
+	// A late report of the value still settles the failed command.
+	if _, err := svc.ReportState(ctx, "switch", "modem", "off"); err != nil {
+		t.Fatalf("ReportState() error = %v", err)
+	}
+	if _, err := store.GetCommand(ctx, "switch", "modem"); !errors.Is(err, ErrCommandNotFound) {
+		t.Fatalf("command after report error = %v, want %v", err, ErrCommandNotFound)
+	}
+}
+
+func TestCommandAcknowledgedOrSuperseded(t *testing.T) {
+	ctx := context.Background()
+	store := newSwitchStore()
+	svc := NewService(store, nil, &ServiceConfig{Commands: &CommandConfig{AckTimeout: time.Second, MaxRetries: 2}})
+
+	svc.SetState(ctx, "switch", "modem", "off", nil, nil, nil)
+	old, _ := store.GetCommand(ctx, "switch", "modem")
+
+	// A report of another value is no acknowledgement.
+	svc.ReportState(ctx, "switch", "modem", "on")
+	if _, err := store.GetCommand(ctx, "switch", "modem"); err != nil {
+		t.Fatalf("command after wrong report error = %v", err)
+	}
+
+	// A newer value replaces the command; the old one cannot be retried.
+	svc.SetState(ctx, "switch", "modem", "on", nil, nil, nil)
+	if _, err := store.GetCommand(ctx, "switch", "modem"); !errors.Is(err, ErrCommandNotFound) {
+		t.Fatalf("command for a value the device already reports error = %v, want none", err)
+	}
+	svc.retryCommand(ctx, old, old.NextAttemptAt)
+
+	svc.SetState(ctx, "switch", "modem", "off", nil, nil, nil)
+	if _, err := svc.ReportState(ctx, "switch", "modem", "off"); err != nil {
+		t.Fatalf("ReportState() error = %v", err)
+	}
+	if _, err := store.GetCommand(ctx, "switch", "modem"); !errors.Is(err, ErrCommandNotFound) {
+		t.Fatalf("command after acknowledgement error = %v, want %v", err, ErrCommandNotFound)
+	}
+
+	svc.SetState(ctx, "switch", "modem", "on", nil, nil, nil)
+	if _, err := svc.DeleteState(ctx, "switch", "modem"); err != nil {
+		t.Fatalf("DeleteState() error = %v", err)
+	}
+	if _, err := store.GetCommand(ctx, "switch", "modem"); !errors.Is(err, ErrCommandNotFound) {
+		t.Fatalf("command after delete error = %v, want %v", err, ErrCommandNotFound)
+	}
+}
+
+func TestCommandsOffByDefault(t *testing.T) {
+	ctx := context.Background()
+	store := newSwitchStore()
+	svc := NewService(store, nil, nil)
+
+	svc.SetState(ctx, "switch", "modem", "off", nil, nil, nil)
+	if len(store.commands) != 0 {
+		t.Fatalf("commands = %v, want none without CommandConfig", store.commands)
+	}
+	if err := svc.RunCommands(ctx, time.Second); err != nil {
+		t.Fatalf("RunCommands() error = %v", err)
+	}
+}
+
+func TestListCommandsHandler(t *testing.T) {
+	store := newSwitchStore()
+	store.commands = map[string]string{}
+	for _, c := range []Command{
+		{Type: "switch", Key: "fan", Value: "on", Status: COMMAND_STATUS_FAILED, Attempts: 4},
+		{Type: "switch", Key: "modem", Value: "off", Status: COMMAND_STATUS_PENDING, Attempts: 1, NextAttemptAt: time.Now()},
+	} {
+		store.PutCommand(context.Background(), c)
+	}
+	svc := NewService(store, nil, nil)
+	srv := server.NewWithConfig(":0", &server.ServerConfig{BearerToken: "test-token", MaxRequestSize: 1 << 20})
+	RegisterHandlers(srv, svc)
+
+	do := func(url string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("Authorization", "Bearer test-token")
+		rr := httptest.NewRecorder()
+		srv.GetRouter().ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := do("/v1/commands?status=failed")
+	var resp struct {
+		Data []CommandResponse `json:"data"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if rr.Code != http.StatusOK || len(resp.Data) != 1 || resp.Data[0].Key != "fan" || resp.Data[0].NextAttemptAt != "" {
+		t.Fatalf("GET /v1/commands?status=failed = %d %+v, want only fan", rr.Code, resp.Data)
+	}
+	if rr := do("/v1/commands"); rr.Code != http.StatusOK {
+		t.Fatalf("GET /v1/commands status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	if rr := do("/v1/commands?status=lost"); rr.Code != http.StatusBadRequest {
+		t.Fatalf("bad status = %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+}
@@ -10,4 +10,13 @@ const (
 	STATE_ON  = "on"
 
 	KEY_DELIMITER = "."
+
+	EVENT_STATE_DELETED = "hmstt.state.deleted"
+
+	KIND_ENUM  = "enum"
+	KIND_INT   = "int"
+	KIND_FLOAT = "float"
+	KIND_BOOL  = "bool"
+	KIND_TEXT  = "text"
+	KIND_JSON  = "json"
 )
@@ -0,0 +1,361 @@
+package hmstt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/nurhudajoantama/hmauto/internal/config"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+)
+
+var ErrConstraintViolation = errors.New("CONSTRAINT VIOLATION")
+
+const (
+	CONSTRAINT_EXCLUSIVE = "exclusive"
+	CONSTRAINT_REQUIRES  = "requires"
+	CONSTRAINT_MAX_ON    = "max_on"
+)
+
+// Constraint is a validated interlock between states. States and Requires
+// are type/key identifiers.
+type Constraint struct {
+	Name     string
+	Kind     string
+	States   []string
+	Requires string
+	Group    string
+	Max      int
+	Active   string
+}
+
+// ConstraintError reports a write rejected by a constraint. It wraps
+// ErrConstraintViolation.
+type ConstraintError struct {
+	Constraint Constraint
+	// Active lists the states that are active after the rejected write.
+	Active []string
+	Reason string
+}
+
+func (e *ConstraintError) Error() string {
+	return fmt.Sprintf("%s: %s (%s): %s", ErrConstraintViolation, e.Constraint.Name, e.Constraint.Kind, e.Reason)
+}
+
+func (e *ConstraintError) Unwrap() error {
+	return ErrConstraintViolation
+}
+
+// ConstraintSet holds the configured constraints. A nil set has none.
+type ConstraintSet struct {
+	constraints []Constraint
+}
+
+// NewConstraintSet validates the configured constraints.
+func NewConstraintSet(constraints []config.StateConstraint) (*ConstraintSet, error) {
+	set := &ConstraintSet{}
+	seen := make(map[string]bool, len(constraints))
+	for _, sc := range constraints {
+		c, err := compileConstraint(sc)
+		if err != nil {
+			return nil, err
+		}
+		if seen[c.Name] {
+			return nil, fmt.Errorf("constraints: duplicate constraint %q", c.Name)
+		}
+		seen[c.Name] = true
+		set.constraints = append(set.constraints, c)
+	}
+	return set, nil
+}
+
+func validStateID(id string) bool {
+	tipe, k, ok := strings.Cut(id, "/")
+	return ok && tipe != "" && k != "" && !strings.Contains(k, "/")
+}
+
+func compileConstraint(sc config.StateConstraint) (Constraint, error) {
+	if sc.Name == "" {
+		return Constraint{}, errors.New("constraints: name must be set")
+	}
+	c := Constraint{
+		Name:     sc.Name,
+		Kind:     sc.Kind,
+		States:   sc.States,
+		Requires: sc.Requires,
+		Group:    sc.Group,
+		Max:      sc.Max,
+		Active:   sc.Active,
+	}
+	if c.Active == "" {
+		c.Active = "on"
+	}
+	for _, id := range c.States {
+		if !validStateID(id) {
+			return Constraint{}, fmt.Errorf("constraints: %s state %q must be type/key", c.Name, id)
+		}
+	}
+	switch c.Kind {
+	case CONSTRAINT_EXCLUSIVE:
+		if len(c.States) < 2 {
+			return Constraint{}, fmt.Errorf("constraints: %s needs at least two states", c.Name)
+		}
+	case CONSTRAINT_REQUIRES:
+		if len(c.States) == 0 {
+			return Constraint{}, fmt.Errorf("constraints: %s needs at least one state", c.Name)
+		}
+		if !validStateID(c.Requires) {
+			return Constraint{}, fmt.Errorf("constraints: %s requires %q must be type/key", c.Name, c.Requires)
+		}
+		if slices.Contains(c.States, c.Requires) {
+			return Constraint{}, fmt.Errorf("constraints: %s state %s cannot require itself", c.Name, c.Requires)
+		}
+	case CONSTRAINT_MAX_ON:
+		if !groupNamePattern.MatchString(c.Group) {
+			return Constraint{}, fmt.Errorf("constraints: %s group %q is not a valid group name", c.Name, c.Group)
+		}
+		if c.Max < 1 {
+			return Constraint{}, fmt.Errorf("constraints: %s max must be at least 1", c.Name)
+		}
+	default:
+		return Constraint{}, fmt.Errorf("constraints: %s has unknown kind %q", c.Name, c.Kind)
+	}
+	return c, nil
+}
+
+// List returns the constraints in configuration order.
+func (cs *ConstraintSet) List() []Constraint {
+	if cs == nil {
+		return nil
+	}
+	return cs.constraints
+}
+
+// involves reports whether a write of entry can violate c.
+func (c Constraint) involves(entry StateEntry) bool {
+	id := groupMember(entry.Type, entry.K)
+	switch c.Kind {
+	case CONSTRAINT_MAX_ON:
+		return slices.Contains(entry.Groups, c.Group)
+	case CONSTRAINT_REQUIRES:
+		return id == c.Requires || slices.Contains(c.States, id)
+	default:
+		return slices.Contains(c.States, id)
+	}
+}
+
+// stateChange is a proposed write; before is the stored entry, zero if the
+// state does not exist yet.
+type stateChange struct {
+	before StateEntry
+	after  StateEntry
+}
+
+// checkConstraints rejects writes that would leave a constraint violated.
+// Only changes that activate a state, deactivate a required one or add a
+// state to a group are rejected, so a state already in violation (e.g.
+// after a constraint was added) can still be switched off. It returns the
+// stored states the check read, and the size of the groups it counted, as
+// guards; the write must include them, so that of two concurrent writes to
+// different states of one constraint, or a write and a state joining its
+// group, only one commits and the other is checked again.
+func (s *HmsttService) checkConstraints(ctx context.Context, changes []stateChange) ([]StateGuard, error) {
+	constraints := s.constraints.List()
+	if len(constraints) == 0 {
+		return nil, nil
+	}
+	changed := make(map[string]StateEntry, len(changes))
+	for _, c := range changes {
+		if c.before.Value == c.after.Value && groupsEqual(c.before.Groups, c.after.Groups) && c.before.Revision != 0 {
+			continue
+		}
+		changed[groupMember(c.after.Type, c.after.K)] = c.after
+	}
+
+	read := make(map[string]int64)
+	sizes := make(map[string]int64)
+	for _, c := range constraints {
+		relevant := false
+		for _, entry := range changed {
+			if c.involves(entry) {
+				relevant = true
+				break
+			}
+		}
+		if !relevant {
+			continue
+		}
+		var err error
+		switch c.Kind {
+		case CONSTRAINT_EXCLUSIVE:
+			err = s.checkExclusive(ctx, c, changed, read)
+		case CONSTRAINT_REQUIRES:
+			err = s.checkRequires(ctx, c, changed, read)
+		case CONSTRAINT_MAX_ON:
+			err = s.checkMaxOn(ctx, c, changed, read, sizes)
+		}
+		if err != nil {
+			var cerr *ConstraintError
+			if errors.As(err, &cerr) {
+				zerolog.Ctx(ctx).Warn().Str("constraint", c.Name).Str("reason", cerr.Reason).Msg("write rejected by constraint")
+			}
+			return nil, err
+		}
+	}
+
+	guards := make([]StateGuard, 0, len(read)+len(sizes))
+	for _, id := range slices.Sorted(maps.Keys(read)) {
+		tipe, k, _ := strings.Cut(id, "/")
+		guards = append(guards, StateGuard{Type: tipe, K: k, Revision: read[id]})
+	}
+	for _, group := range slices.Sorted(maps.Keys(sizes)) {
+		guards = append(guards, StateGuard{Group: group, Members: sizes[group]})
+	}
+	return guards, nil
+}
+
+// lookupState returns the proposed entry for id if it is being written,
+// otherwise the stored one, whose revision it records in read. ok is false
+// for a state that does not exist.
+func (s *HmsttService) lookupState(ctx context.Context, id string, changed map[string]StateEntry, read map[string]int64) (entry StateEntry, ok bool, err error) {
+	if entry, ok := changed[id]; ok {
+		return entry, true, nil
+	}
+	tipe, k, _ := strings.Cut(id, "/")
+	entry, err = s.store.GetState(ctx, tipe, k)
+	if errors.Is(err, ErrStateNotFound) || errors.Is(err, redis.Nil) {
+		read[id] = 0
+		return StateEntry{}, false, nil
+	}
+	if err != nil {
+		return StateEntry{}, false, fmt.Errorf("read %s for constraint check: %w", id, err)
+	}
+	read[id] = entry.Revision
+	return entry, true, nil
+}
+
+// writeState is store.SetState for a write that also depends on guards.
+func (s *HmsttService) writeState(ctx context.Context, entry StateEntry, expectedRevision int64, guards []StateGuard) (StateEntry, error) {
+	if len(guards) == 0 {
+		return s.store.SetState(ctx, entry, expectedRevision)
+	}
+	written, err := s.store.SetStates(ctx, []StateEntry{entry}, []int64{expectedRevision}, guards)
+	if err != nil {
+		return StateEntry{}, err
+	}
+	return written[0], nil
+}
+
+func (s *HmsttService) checkExclusive(ctx context.Context, c Constraint, changed map[string]StateEntry, read map[string]int64) error {
+	var active []string
+	activated := false
+	for _, id := range c.States {
+		entry, ok, err := s.lookupState(ctx, id, changed, read)
+		if err != nil {
+			return err
+		}
+		if !ok || entry.Value != c.Active {
+			continue
+		}
+		active = append(active, id)
+		if _, ok := changed[id]; ok {
+			activated = true
+		}
+	}
+	if len(active) > 1 && activated {
+		return &ConstraintError{
+			Constraint: c,
+			Active:     active,
+			Reason:     fmt.Sprintf("at most one of %s may be %s, got %s", strings.Join(c.States, ", "), c.Active, strings.Join(active, ", ")),
+		}
+	}
+	return nil
+}
+
+func (s *HmsttService) checkRequires(ctx context.Context, c Constraint, changed map[string]StateEntry, read map[string]int64) error {
+	req, ok, err := s.lookupState(ctx, c.Requires, changed, read)
+	if err != nil {
+		return err
+	}
+	if ok && req.Value == c.Active {
+		return nil
+	}
+	_, violating := changed[c.Requires]
+	var active []string
+	for _, id := range c.States {
+		entry, ok, err := s.lookupState(ctx, id, changed, read)
+		if err != nil {
+			return err
+		}
+		if !ok || entry.Value != c.Active {
+			continue
+		}
+		active = append(active, id)
+		if _, ok := changed[id]; ok {
+			violating = true
+		}
+	}
+	if len(active) > 0 && violating {
+		return &ConstraintError{
+			Constraint: c,
+			Active:     active,
+			Reason:     fmt.Sprintf("%s requires %s to be %s", strings.Join(active, ", "), c.Requires, c.Active),
+		}
+	}
+	return nil
+}
+
+// checkMaxOn records the size of the group in sizes before it reads the
+// members, so a state that joins after the count fails the size guard even
+// though its revision was never read.
+func (s *HmsttService) checkMaxOn(ctx context.Context, c Constraint, changed map[string]StateEntry, read, sizes map[string]int64) error {
+	size, err := s.store.GroupSize(ctx, c.Group)
+	if err != nil {
+		return fmt.Errorf("count group %s for constraint check: %w", c.Group, err)
+	}
+	sizes[c.Group] = size
+	members, err := s.store.GetGroupMembers(ctx, c.Group)
+	if err != nil {
+		return fmt.Errorf("read group %s for constraint check: %w", c.Group, err)
+	}
+	inGroup := make(map[string]StateEntry, len(members))
+	for _, m := range members {
+		id := groupMember(m.Type, m.K)
+		inGroup[id] = m
+		if _, ok := changed[id]; !ok {
+			read[id] = m.Revision
+		}
+	}
+	for id, entry := range changed {
+		if slices.Contains(entry.Groups, c.Group) {
+			inGroup[id] = entry
+		} else {
+			delete(inGroup, id)
+		}
+	}
+
+	var active []string
+	activated := false
+	for id, entry := range inGroup {
+		if entry.Value != c.Active {
+			continue
+		}
+		active = append(active, id)
+		if _, ok := changed[id]; ok {
+			activated = true
+		}
+	}
+	if len(active) > c.Max && activated {
+		slices.Sort(active)
+		return &ConstraintError{
+			Constraint: c,
+			Active:     active,
+			Reason:     fmt.Sprintf("at most %d states in group %s may be %s, got %d", c.Max, c.Group, c.Active, len(active)),
+		}
+	}
+	return nil
+}
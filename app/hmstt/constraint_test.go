@@ -0,0 +1,278 @@
+package hmstt
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/nurhudajoantama/hmauto/internal/config"
+)
+
+func TestNewConstraintSetValidates(t *testing.T) {
+	tests := []struct {
+		name string
+		c    config.StateConstraint
+	}{
+		{"missing name", config.StateConstraint{Kind: CONSTRAINT_EXCLUSIVE, States: []string{"switch/a", "switch/b"}}},
+		{"unknown kind", config.StateConstraint{Name: "x", Kind: "never", States: []string{"switch/a", "switch/b"}}},
+		{"exclusive with one state", config.StateConstraint{Name: "x", Kind: CONSTRAINT_EXCLUSIVE, States: []string{"switch/a"}}},
+		{"state without type", config.StateConstraint{Name: "x", Kind: CONSTRAINT_EXCLUSIVE, States: []string{"a", "switch/b"}}},
+		{"requires itself", config.StateConstraint{Name: "x", Kind: CONSTRAINT_REQUIRES, States: []string{"switch/a"}, Requires: "switch/a"}},
+		{"max_on without max", config.StateConstraint{Name: "x", Kind: CONSTRAINT_MAX_ON, Group: "rack"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewConstraintSet([]config.StateConstraint{tt.c}); err == nil {
+				t.Fatalf("NewConstraintSet() error = nil, want error")
+			}
+		})
+	}
+
+	set, err := NewConstraintSet([]config.StateConstraint{{Name: "x", Kind: CONSTRAINT_MAX_ON, Group: "rack", Max: 2}})
+	if err != nil {
+		t.Fatalf("NewConstraintSet() error = %v", err)
+	}
+	if got := set.List()[0].Active; got != "on" {
+		t.Fatalf("Active = %q, want default on", got)
+	}
+}
+
+func newConstrainedService(t *testing.T, constraints ...config.StateConstraint) (*HmsttService, *fakeStateStore) {
+	t.Helper()
+	set, err := NewConstraintSet(constraints)
+	if err != nil {
+		t.Fatalf("NewConstraintSet() error = %v", err)
+	}
+	store := &fakeStateStore{}
+	return NewService(store, nil, &ServiceConfig{Constraints: set}), store
+}
+
+func wantViolation(t *testing.T, err error, name string) {
+	t.Helper()
+	var cerr *ConstraintError
+	if !errors.As(err, &cerr) || !errors.Is(err, ErrConstraintViolation) {
+		t.Fatalf("error = %v, want constraint violation", err)
+	}
+	if cerr.Constraint.Name != name {
+		t.Fatalf("violated constraint = %q, want %q", cerr.Constraint.Name, name)
+	}
+}
+
+func TestExclusiveConstraint(t *testing.T) {
+	ctx := context.Background()
+	svc, store := newConstrainedService(t, config.StateConstraint{
+		Name: "pumps", Kind: CONSTRAINT_EXCLUSIVE, States: []string{"switch/pump_1", "switch/pump_2"},
+	})
+	svc.CreateState(ctx, "switch", "pump_1", "on", "", nil, nil)
+
+	_, err := svc.CreateState(ctx, "switch", "pump_2", "on", "", nil, nil)
+	wantViolation(t, err, "pumps")
+	if _, err := svc.CreateState(ctx, "switch", "pump_2", "off", "", nil, nil); err != nil {
+		t.Fatalf("CreateState(off) error = %v", err)
+	}
+	_, err = svc.SetState(ctx, "switch", "pump_2", "on", nil, nil, nil)
+	wantViolation(t, err, "pumps")
+	_, err = svc.ToggleState(ctx, "switch", "pump_2")
+	wantViolation(t, err, "pumps")
+	if got, _ := store.GetState(ctx, "switch", "pump_2"); got.Value != "off" {
+		t.Fatalf("pump_2 = %q, want off", got.Value)
+	}
+
+	// Swapping which pump runs in one batch is allowed.
+	if _, err := svc.BatchSetStates(ctx, []BatchSetItem{
+		{Type: "switch", Key: "pump_1", Value: "off"},
+		{Type: "switch", Key: "pump_2", Value: "on"},
+	}); err != nil {
+		t.Fatalf("BatchSetStates() error = %v", err)
+	}
+	_, err = svc.BatchSetStates(ctx, []BatchSetItem{{Type: "switch", Key: "pump_1", Value: "on"}})
+	wantViolation(t, err, "pumps")
+}
+
+func TestRequiresConstraint(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newConstrainedService(t, config.StateConstraint{
+		Name: "nas_needs_ups", Kind: CONSTRAINT_REQUIRES, States: []string{"switch/nas"}, Requires: "switch/ups",
+	})
+	svc.CreateState(ctx, "switch", "ups", "off", "", nil, nil)
+	svc.CreateState(ctx, "switch", "nas", "off", "", nil, nil)
+
+	_, err := svc.SetState(ctx, "switch", "nas", "on", nil, nil, nil)
+	wantViolation(t, err, "nas_needs_ups")
+
+	if _, err := svc.SetState(ctx, "switch", "ups", "on", nil, nil, nil); err != nil {
+		t.Fatalf("SetState(ups on) error = %v", err)
+	}
+	if _, err := svc.SetState(ctx, "switch", "nas", "on", nil, nil, nil); err != nil {
+		t.Fatalf("SetState(nas on) error = %v", err)
+	}
+	_, err = svc.SetState(ctx, "switch", "ups", "off", nil, nil, nil)
+	wantViolation(t, err, "nas_needs_ups")
+	v := "off"
+	_, err = svc.PatchState(ctx, "switch", "ups", &v, nil, nil, nil, nil)
+	wantViolation(t, err, "nas_needs_ups")
+}
+
+func TestMaxOnConstraint(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newConstrainedService(t, config.StateConstraint{
+		Name: "rack_budget", Kind: CONSTRAINT_MAX_ON, Group: "rack", Max: 1,
+	})
+	svc.CreateState(ctx, "switch", "server_1", "on", "", []string{"rack"}, nil)
+	svc.CreateState(ctx, "switch", "server_2", "off", "", []string{"rack"}, nil)
+	svc.CreateState(ctx, "switch", "lamp", "on", "", nil, nil)
+
+	_, err := svc.SetState(ctx, "switch", "server_2", "on", nil, nil, nil)
+	wantViolation(t, err, "rack_budget")
+	_, err = svc.PatchState(ctx, "switch", "lamp", nil, nil, []string{"rack"}, nil, nil)
+	wantViolation(t, err, "rack_budget")
+	_, err = svc.SetGroupValue(ctx, "rack", "on")
+	wantViolation(t, err, "rack_budget")
+
+	// Leaving the group, or switching off, is always allowed.
+	if _, err := svc.PatchState(ctx, "switch", "server_1", nil, nil, []string{}, nil, nil); err != nil {
+		t.Fatalf("PatchState(leave group) error = %v", err)
+	}
+	if _, err := svc.SetState(ctx, "switch", "server_2", "on", nil, nil, nil); err != nil {
+		t.Fatalf("SetState(server_2 on) error = %v", err)
+	}
+}
+
+func TestConstraintAllowsLeavingViolation(t *testing.T) {
+	ctx := context.Background()
+	svc, store := newConstrainedService(t, config.StateConstraint{
+		Name: "pumps", Kind: CONSTRAINT_EXCLUSIVE, States: []string{"switch/pump_1", "switch/pump_2"},
+	})
+	// Both on before the constraint existed.
+	store.CreateState(ctx, StateEntry{Type: "switch", K: "pump_1", Value: "on"})
+	store.CreateState(ctx, StateEntry{Type: "switch", K: "pump_2", Value: "on"})
+
+	desc := "main pump"
+	if _, err := svc.SetState(ctx, "switch", "pump_1", "on", &desc, nil, nil); err != nil {
+		t.Fatalf("SetState(unchanged value) error = %v", err)
+	}
+	if _, err := svc.SetState(ctx, "switch", "pump_2", "off", nil, nil, nil); err != nil {
+		t.Fatalf("SetState(off) error = %v", err)
+	}
+}
+
+// rendezvousStore holds the first two writes until both have been made, so
+// two writers check their constraints before either commits.
+type rendezvousStore struct {
+	*fakeStateStore
+	mu      sync.Mutex
+	pending int
+	arrived sync.WaitGroup
+}
+
+func (r *rendezvousStore) wait() {
+	r.mu.Lock()
+	hold := r.pending > 0
+	r.pending--
+	r.mu.Unlock()
+	if hold {
+		r.arrived.Done()
+		r.arrived.Wait()
+	}
+}
+
+func (r *rendezvousStore) SetState(ctx context.Context, entry StateEntry, expectedRevision int64) (StateEntry, error) {
+	r.wait()
+	return r.fakeStateStore.SetState(ctx, entry, expectedRevision)
+}
+
+func (r *rendezvousStore) SetStates(ctx context.Context, entries []StateEntry, expectedRevisions []int64, guards []StateGuard) ([]StateEntry, error) {
+	r.wait()
+	return r.fakeStateStore.SetStates(ctx, entries, expectedRevisions, guards)
+}
+
+func TestConcurrentWritesKeepExclusiveConstraint(t *testing.T) {
+	ctx := context.Background()
+	set, err := NewConstraintSet([]config.StateConstraint{
+		{Name: "pumps", Kind: CONSTRAINT_EXCLUSIVE, States: []string{"switch/pump_1", "switch/pump_2"}},
+	})
+	if err != nil {
+		t.Fatalf("NewConstraintSet() error = %v", err)
+	}
+	store := &rendezvousStore{fakeStateStore: &fakeStateStore{}}
+	store.fakeStateStore.CreateState(ctx, StateEntry{Type: "switch", K: "pump_1", Value: "off"})
+	store.fakeStateStore.CreateState(ctx, StateEntry{Type: "switch", K: "pump_2", Value: "off"})
+	svc := NewService(store, nil, &ServiceConfig{Constraints: set})
+
+	store.pending = 2
+	store.arrived.Add(2)
+	errs := make(chan error, 2)
+	for _, key := range []string{"pump_1", "pump_2"} {
+		go func() {
+			_, err := svc.SetState(ctx, "switch", key, "on", nil, nil, nil)
+			errs <- err
+		}()
+	}
+	var violations int
+	for range 2 {
+		if err := <-errs; err != nil {
+			wantViolation(t, err, "pumps")
+			violations++
+		}
+	}
+	if violations != 1 {
+		t.Fatalf("violations = %d, want 1", violations)
+	}
+	p1, _ := store.GetState(ctx, "switch", "pump_1")
+	p2, _ := store.GetState(ctx, "switch", "pump_2")
+	if p1.Value == "on" && p2.Value == "on" {
+		t.Fatalf("both pumps on after concurrent writes")
+	}
+}
+
+// interleavingStore runs between once, just before the first write commits,
+// as another writer that gets in between the check and the write would.
+type interleavingStore struct {
+	*fakeStateStore
+	between func()
+}
+
+func (s *interleavingStore) interleave() {
+	if f := s.between; f != nil {
+		s.between = nil
+		f()
+	}
+}
+
+func (s *interleavingStore) SetState(ctx context.Context, entry StateEntry, expectedRevision int64) (StateEntry, error) {
+	s.interleave()
+	return s.fakeStateStore.SetState(ctx, entry, expectedRevision)
+}
+
+func (s *interleavingStore) SetStates(ctx context.Context, entries []StateEntry, expectedRevisions []int64, guards []StateGuard) ([]StateEntry, error) {
+	s.interleave()
+	return s.fakeStateStore.SetStates(ctx, entries, expectedRevisions, guards)
+}
+
+func TestJoinBetweenCheckAndWriteKeepsMaxOnConstraint(t *testing.T) {
+	ctx := context.Background()
+	set, err := NewConstraintSet([]config.StateConstraint{
+		{Name: "rack_power", Kind: CONSTRAINT_MAX_ON, Group: "rack", Max: 1},
+	})
+	if err != nil {
+		t.Fatalf("NewConstraintSet() error = %v", err)
+	}
+	store := &interleavingStore{fakeStateStore: &fakeStateStore{}}
+	store.fakeStateStore.CreateState(ctx, StateEntry{Type: "switch", K: "server_1", Value: "off", Groups: []string{"rack"}})
+	store.fakeStateStore.CreateState(ctx, StateEntry{Type: "switch", K: "server_2", Value: "on"})
+	svc := NewService(store, nil, &ServiceConfig{Constraints: set})
+
+	// server_2, already on, joins the group after server_1 was checked but
+	// before it is written, so the check never saw it as a member.
+	store.between = func() {
+		if _, err := svc.PatchState(ctx, "switch", "server_2", nil, nil, []string{"rack"}, nil, nil); err != nil {
+			t.Errorf("PatchState(join) error = %v", err)
+		}
+	}
+	_, err = svc.SetState(ctx, "switch", "server_1", "on", nil, nil, nil)
+	wantViolation(t, err, "rack_power")
+	if got, _ := store.GetState(ctx, "switch", "server_1"); got.Value != "off" {
+		t.Fatalf("server_1 = %q after the join, want off", got.Value)
+	}
+}
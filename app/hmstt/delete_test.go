@@ -0,0 +1,52 @@
+package hmstt
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nurhudajoantama/hmauto/app/server"
+)
+
+func TestDeleteHandlers(t *testing.T) {
+	store := &fakeStateStore{states: map[string][]StateEntry{
+		"switch": {
+			{Type: "switch", K: "server_1", Value: "on"},
+			{Type: "switch", K: "server_2", Value: "off"},
+		},
+	}}
+
+	svc := NewService(store, nil, nil)
+	srv := server.NewWithConfig(":0", &server.ServerConfig{BearerToken: "test-token"})
+	RegisterHandlers(srv, svc)
+
+	do := func(method, url string) int {
+		req := httptest.NewRequest(method, url, nil)
+		req.Header.Set("Authorization", "Bearer test-token")
+		rr := httptest.NewRecorder()
+		srv.GetRouter().ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := do(http.MethodDelete, "/v1/states/switch/server_1"); code != http.StatusOK {
+		t.Fatalf("delete key status = %d, want %d", code, http.StatusOK)
+	}
+	if code := do(http.MethodDelete, "/v1/states/switch/server_1"); code != http.StatusNotFound {
+		t.Fatalf("delete missing key status = %d, want %d", code, http.StatusNotFound)
+	}
+	if code := do(http.MethodDelete, "/v1/states/switch"); code != http.StatusBadRequest {
+		t.Fatalf("delete type without confirm status = %d, want %d", code, http.StatusBadRequest)
+	}
+	if code := do(http.MethodDelete, "/v1/states/switch?confirm=relay"); code != http.StatusBadRequest {
+		t.Fatalf("delete type with wrong confirm status = %d, want %d", code, http.StatusBadRequest)
+	}
+	if len(store.states["switch"]) != 1 {
+		t.Fatalf("len(switch states) = %d, want 1 before confirmed delete", len(store.states["switch"]))
+	}
+	if code := do(http.MethodDelete, "/v1/states/switch?confirm=switch"); code != http.StatusOK {
+		t.Fatalf("delete type status = %d, want %d", code, http.StatusOK)
+	}
+	if len(store.states["switch"]) != 0 {
+		t.Fatalf("len(switch states) = %d, want 0", len(store.states["switch"]))
+	}
+}
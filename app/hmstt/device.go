@@ -0,0 +1,60 @@
+package hmstt
+
+import "context"
+
+// HEADER_DEVICE_ID identifies the device making a batch-sync call, so the
+// call counts as a sign of life.
+const HEADER_DEVICE_ID = "X-Device-ID"
+
+// DeviceStatus is the device that owns a state and whether it is online.
+type DeviceStatus struct {
+	ID     string
+	Online bool
+}
+
+// DeviceRegistry tells the state API which device owns a state and is told
+// when a device shows signs of life. app/device implements it; lookups must
+// not hit Redis, they run once per state in every response.
+type DeviceRegistry interface {
+	DeviceOf(tipe, key string) (DeviceStatus, bool)
+	Seen(ctx context.Context, id string)
+}
+
+// SetDeviceRegistry makes state responses carry their device. It must be
+// called before the service handles requests.
+func (s *HmsttService) SetDeviceRegistry(d DeviceRegistry) {
+	s.devices = d
+}
+
+// DeviceSeen records a sign of life from device id, e.g. a batch-sync call.
+// Unknown ids are ignored by the registry.
+func (s *HmsttService) DeviceSeen(ctx context.Context, id string) {
+	if s.devices != nil && id != "" {
+		s.devices.Seen(ctx, id)
+	}
+}
+
+// stateOwnerSeen records a sign of life from the device owning a state.
+func (s *HmsttService) stateOwnerSeen(ctx context.Context, tipe, key string) {
+	if s.devices == nil {
+		return
+	}
+	if d, ok := s.devices.DeviceOf(tipe, key); ok {
+		s.devices.Seen(ctx, d.ID)
+	}
+}
+
+// stateResponse converts an entry for the API, with its device if one owns
+// it.
+func (s *HmsttService) stateResponse(e StateEntry) StateResponse {
+	out := entryToResponse(e)
+	if s.devices == nil {
+		return out
+	}
+	if d, ok := s.devices.DeviceOf(e.Type, e.K); ok {
+		online := d.Online
+		out.DeviceID = d.ID
+		out.Online = &online
+	}
+	return out
+}
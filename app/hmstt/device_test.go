@@ -0,0 +1,74 @@
+package hmstt
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nurhudajoantama/hmauto/app/server"
+)
+
+// fakeDevices owns switch/modem as device esp32-rack and records sightings.
+type fakeDevices struct {
+	seen []string
+}
+
+func (f *fakeDevices) DeviceOf(tipe, key string) (DeviceStatus, bool) {
+	if tipe == "switch" && key == "modem" {
+		return DeviceStatus{ID: "esp32-rack", Online: true}, true
+	}
+	return DeviceStatus{}, false
+}
+
+func (f *fakeDevices) Seen(_ context.Context, id string) {
+	f.seen = append(f.seen, id)
+}
+
+func TestStateResponsesCarryDevice(t *testing.T) {
+	store := newSwitchStore()
+	svc := NewService(store, nil, nil)
+	devices := &fakeDevices{}
+	svc.SetDeviceRegistry(devices)
+	srv := server.NewWithConfig(":0", &server.ServerConfig{BearerToken: "test-token", MaxRequestSize: 1 << 20})
+	RegisterHandlers(srv, svc)
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/states/switch/batch?key=modem&key=fan", nil)
+	req.Header.Set("Authorization", "Bearer test-token")
+	req.Header.Set(HEADER_DEVICE_ID, "esp32-rack")
+	rr := httptest.NewRecorder()
+	srv.GetRouter().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("batch status = %d, want %d: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+	var resp struct {
+		Data []StateResponse `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode batch response: %v", err)
+	}
+	for _, st := range resp.Data {
+		switch st.Key {
+		case "modem":
+			if st.DeviceID != "esp32-rack" || st.Online == nil || !*st.Online {
+				t.Fatalf("modem = %+v, want device esp32-rack online", st)
+			}
+		default:
+			if st.DeviceID != "" || st.Online != nil {
+				t.Fatalf("%s = %+v, want no device", st.Key, st)
+			}
+		}
+	}
+	if len(devices.seen) != 1 || devices.seen[0] != "esp32-rack" {
+		t.Fatalf("seen = %v, want the batch sync to count for esp32-rack", devices.seen)
+	}
+
+	// A report counts as a sign of life of the owning device.
+	if _, err := svc.ReportState(context.Background(), "switch", "modem", "on"); err != nil {
+		t.Fatalf("ReportState() error = %v", err)
+	}
+	if len(devices.seen) != 2 {
+		t.Fatalf("seen after report = %v, want two sightings", devices.seen)
+	}
+}
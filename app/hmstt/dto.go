@@ -1,31 +1,216 @@
 package hmstt
 
+import "encoding/json"
+
 // StateResponse is the JSON representation of a single state entry.
+// Value is a string, or a JSON object for structured types.
 type StateResponse struct {
-	Type        string `json:"type"        example:"switch"`
-	Key         string `json:"key"         example:"modem"`
-	Value       string `json:"value"       example:"on"`
-	Description string `json:"description" example:"Controls the modem power switch"`
-	UpdatedAt   string `json:"updated_at"  example:"2026-03-16T12:34:56Z"`
+	Type        string            `json:"type"             example:"switch"`
+	Key         string            `json:"key"              example:"modem"`
+	Value       any               `json:"value"            swaggertype:"string" example:"on"`
+	Description string            `json:"description"      example:"Controls the modem power switch"`
+	Name        string            `json:"name,omitempty"   example:"Modem"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Groups      []string          `json:"groups,omitempty" example:"rack,living_room"`
+	UpdatedAt   string            `json:"updated_at"       example:"2026-03-16T12:34:56Z"`
+	Revision    int64             `json:"revision"         example:"42"`
+	// Locked is set while the state is in maintenance mode and rejects writes.
+	Locked        bool   `json:"locked"                    example:"false"`
+	LockReason    string `json:"lock_reason,omitempty"     example:"replacing the PSU"`
+	LockOwner     string `json:"lock_owner,omitempty"      example:"budi"`
+	LockExpiresAt string `json:"lock_expires_at,omitempty" example:"2026-03-16T18:00:00Z"`
+	// Reported is the value the device last reported and InSync whether it
+	// equals Value; all three are omitted until the device reports.
+	Reported   any    `json:"reported,omitempty"    swaggertype:"string" example:"on"`
+	ReportedAt string `json:"reported_at,omitempty" example:"2026-03-16T12:35:01Z"`
+	InSync     *bool  `json:"in_sync,omitempty"     example:"true"`
+	// DeviceID is the registered device that owns the state and Online
+	// whether it was seen recently; both are omitted for unowned states.
+	DeviceID string `json:"device_id,omitempty" example:"esp32-rack"`
+	Online   *bool  `json:"online,omitempty"    example:"true"`
+	// RevertAt is set when the write scheduled a revert (revert_after).
+	RevertAt string `json:"revert_at,omitempty" example:"2026-03-16T13:19:56Z"`
+}
+
+// ReportStateRequest is the request body a device sends to report the value
+// it has applied. Value is a string, or a JSON object for structured types.
+type ReportStateRequest struct {
+	Value json.RawMessage `json:"value" validate:"required" swaggertype:"string" example:"on"`
+}
+
+// LockStateRequest is the request body for locking a state. Owner defaults
+// to the caller; ExpiresIn, a duration such as "2h", makes the lock expire on
+// its own.
+type LockStateRequest struct {
+	Reason    string `json:"reason"     validate:"required,max=256" example:"replacing the PSU"`
+	Owner     string `json:"owner"      validate:"max=64"           example:"budi"`
+	ExpiresIn string `json:"expires_in" example:"2h"`
 }
 
 // SetStateRequest is the request body for setting a state value.
+// Value is a string, or a JSON object for structured types.
+// RevertAfter, a duration such as "45m", returns the state to its previous
+// value after that time. Name and Labels replace the stored ones when set.
 type SetStateRequest struct {
-	Value       string  `json:"value"       validate:"required" example:"on"`
-	Description *string `json:"description" example:"Controls the modem power switch"`
+	Value       json.RawMessage   `json:"value"        validate:"required" swaggertype:"string" example:"on"`
+	Description *string           `json:"description"  example:"Controls the modem power switch"`
+	Name        *string           `json:"name"         example:"Modem"`
+	Labels      map[string]string `json:"labels"`
+	RevertAfter string            `json:"revert_after" example:"45m"`
 }
 
 // PatchStateRequest is the request body for partially updating a state entry.
-// At least one field must be provided.
+// At least one field must be provided. For structured types value is a JSON
+// merge patch: listed members are replaced and null members are removed.
+// Groups and Labels replace the stored ones; an empty list or object removes
+// them all.
 type PatchStateRequest struct {
-	Value       *string `json:"value"       example:"on"`
-	Description *string `json:"description" example:"Controls the modem power switch"`
+	Value       json.RawMessage   `json:"value"       swaggertype:"string" example:"on"`
+	Description *string           `json:"description" example:"Controls the modem power switch"`
+	Name        *string           `json:"name"        example:"Modem"`
+	Labels      map[string]string `json:"labels"`
+	Groups      []string          `json:"groups"      example:"rack,living_room"`
 }
 
 // CreateStateRequest is the request body for creating a new state entry.
+// Type and Key must follow the naming policy (see ValidateName); the tags
+// catch the common mistakes before the service checks the rest.
 type CreateStateRequest struct {
-	Type        string `json:"type"        validate:"required" example:"switch"`
-	Key         string `json:"key"         validate:"required" example:"modem"`
-	Value       string `json:"value"       validate:"required" example:"on"`
-	Description string `json:"description" validate:"required" example:"Controls the modem power switch"`
+	Type        string            `json:"type"        validate:"required,max=32,lowercase,excludesall=.#*/+$" example:"switch"`
+	Key         string            `json:"key"         validate:"required,max=64,lowercase,excludesall=.#*/+$" example:"modem"`
+	Value       json.RawMessage   `json:"value"       validate:"required" swaggertype:"string" example:"on"`
+	Description string            `json:"description" validate:"required" example:"Controls the modem power switch"`
+	Name        string            `json:"name"        example:"Modem"`
+	Labels      map[string]string `json:"labels"`
+	Groups      []string          `json:"groups"      example:"rack,living_room"`
+}
+
+// NamingViolationResponse is a stored state whose type or key breaks the
+// naming policy, with what is wrong with each.
+type NamingViolationResponse struct {
+	Type         string   `json:"type"                    example:"Switch"`
+	Key          string   `json:"key"                     example:"living.room"`
+	TypeProblems []string `json:"type_problems,omitempty"`
+	KeyProblems  []string `json:"key_problems,omitempty"`
+}
+
+// GroupResponse is a group and how many states belong to it.
+type GroupResponse struct {
+	Name    string `json:"name"    example:"rack"`
+	Members int64  `json:"members" example:"4"`
+}
+
+// SetGroupValueRequest is the request body for setting every compatible
+// member of a group. Value is a string, or a JSON object for structured types.
+type SetGroupValueRequest struct {
+	Value json.RawMessage `json:"value" validate:"required" swaggertype:"string" example:"off"`
+}
+
+// TypeResponse is the JSON representation of a registered state type.
+type TypeResponse struct {
+	Name    string          `json:"name"              example:"switch"`
+	Kind    string          `json:"kind"              example:"enum"`
+	Values  []string        `json:"values,omitempty"  example:"on,off"`
+	Min     *float64        `json:"min,omitempty"     example:"0"`
+	Max     *float64        `json:"max,omitempty"     example:"100"`
+	Step    int64           `json:"step,omitempty"    example:"5"`
+	Pattern string          `json:"pattern,omitempty" example:"^[a-z]+$"`
+	Schema  json.RawMessage `json:"schema,omitempty"  swaggertype:"object"`
+}
+
+// ConstraintResponse is the JSON representation of a configured constraint.
+type ConstraintResponse struct {
+	Name     string   `json:"name"               example:"pumps_breaker"`
+	Kind     string   `json:"kind"               example:"exclusive"`
+	States   []string `json:"states,omitempty"   example:"switch/pump_1,switch/pump_2"`
+	Requires string   `json:"requires,omitempty" example:"switch/ups"`
+	Group    string   `json:"group,omitempty"    example:"rack"`
+	Max      int      `json:"max,omitempty"      example:"2"`
+	Active   string   `json:"active"             example:"on"`
+}
+
+// ConstraintViolationResponse names the constraint a rejected write would
+// have violated and the states that would have been active.
+type ConstraintViolationResponse struct {
+	Constraint ConstraintResponse `json:"constraint"`
+	Active     []string           `json:"active" example:"switch/pump_1,switch/pump_2"`
+	Reason     string             `json:"reason" example:"at most one of switch/pump_1, switch/pump_2 may be on, got switch/pump_1, switch/pump_2"`
+}
+
+// DeleteTypeResponse lists the keys removed by deleting a whole type.
+type DeleteTypeResponse struct {
+	Type    string   `json:"type"    example:"switch"`
+	Deleted []string `json:"deleted" example:"modem,server_1"`
+}
+
+// HistoryResponse is one recorded change of a state entry.
+type HistoryResponse struct {
+	ID             string `json:"id"                        example:"1776243296000-0"`
+	Time           string `json:"time"                      example:"2026-03-16T12:34:56Z"`
+	Op             string `json:"op"                        example:"set"`
+	OldValue       string `json:"old_value"                 example:"on"`
+	NewValue       string `json:"new_value"                 example:"off"`
+	OldDescription string `json:"old_description,omitempty" example:"Controls the modem power switch"`
+	NewDescription string `json:"new_description,omitempty" example:"Controls the modem power switch"`
+	RequestID      string `json:"request_id,omitempty"      example:"d0m5v7hc0f0s73ctg0a0"`
+	Caller         string `json:"caller"                    example:"http:192.168.1.20"`
+}
+
+// BatchSetStatesRequest is the request body for writing several states at once.
+type BatchSetStatesRequest struct {
+	States []BatchSetItemRequest `json:"states" validate:"required,min=1,dive"`
+}
+
+// BatchSetItemRequest is one state of a batch write. Value is a string, or a
+// JSON object for structured types. Omitting description keeps the existing one.
+type BatchSetItemRequest struct {
+	Type        string          `json:"type"        validate:"required" example:"switch"`
+	Key         string          `json:"key"         validate:"required" example:"relay_1"`
+	Value       json.RawMessage `json:"value"       validate:"required" swaggertype:"string" example:"off"`
+	Description *string         `json:"description" example:"Relay 1"`
+}
+
+// BatchSetResultResponse reports the outcome for one item of a batch write.
+// Status is one of created, updated, unchanged, invalid, skipped, locked or,
+// for group writes, incompatible.
+type BatchSetResultResponse struct {
+	Type     string `json:"type"               example:"switch"`
+	Key      string `json:"key"                example:"relay_1"`
+	Status   string `json:"status"             example:"updated"`
+	Value    any    `json:"value,omitempty"    swaggertype:"string" example:"off"`
+	Revision int64  `json:"revision,omitempty" example:"43"`
+	Error    string `json:"error,omitempty"    example:"INVALID VALUE: switch accepts one of [on, off], got \"dim\""`
+}
+
+// CycleResponse is returned when a power cycle has started.
+type CycleResponse struct {
+	State StateResponse `json:"state"`
+	OnAt  string        `json:"on_at" example:"2026-03-16T12:35:26Z"`
+}
+
+// CommandResponse is a published value its device has not acknowledged
+// yet. Status is pending while retries are left and failed after that.
+type CommandResponse struct {
+	Type          string `json:"type"                      example:"switch"`
+	Key           string `json:"key"                       example:"server_1"`
+	Value         any    `json:"value"                     swaggertype:"string" example:"on"`
+	Revision      int64  `json:"revision"                  example:"43"`
+	Status        string `json:"status"                    example:"pending"`
+	Attempts      int    `json:"attempts"                  example:"2"`
+	CreatedAt     string `json:"created_at"                example:"2026-03-16T12:34:56Z"`
+	LastAttemptAt string `json:"last_attempt_at"           example:"2026-03-16T12:35:06Z"`
+	NextAttemptAt string `json:"next_attempt_at,omitempty" example:"2026-03-16T12:35:26Z"`
+}
+
+// TimerResponse is a pending timed write of a state.
+// Op is revert (from revert_after) or cycle (switching back on after a power cycle).
+type TimerResponse struct {
+	Type      string `json:"type"       example:"switch"`
+	Key       string `json:"key"        example:"heater"`
+	Op        string `json:"op"         example:"revert"`
+	Value     string `json:"value"      example:"off"`
+	Revision  int64  `json:"revision"   example:"43"`
+	DueAt     string `json:"due_at"     example:"2026-03-16T13:19:56Z"`
+	CreatedAt string `json:"created_at" example:"2026-03-16T12:34:56Z"`
+	Caller    string `json:"caller"     example:"http:192.168.1.20"`
 }
@@ -20,7 +20,9 @@ func NewEvent(conn *amqp.Connection) *HmsttEvent {
 	}
 }
 
-func (e *HmsttEvent) StateChange(ctx context.Context, key string, value string) error {
+// StateChange publishes the new value of a state. Structured values are sent
+// as their JSON document with an application/json content type.
+func (e *HmsttEvent) StateChange(ctx context.Context, key string, value string, structured bool) error {
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
@@ -28,6 +30,11 @@ func (e *HmsttEvent) StateChange(ctx context.Context, key string, value string)
 
 	routing := MQ_CHANNEL_HMSTT + KEY_DELIMITER + key
 
+	contentType := "text/plain"
+	if structured {
+		contentType = "application/json"
+	}
+
 	err := e.ch.PublishWithContext(
 		ctx,
 		"amq.topic", // exchange
@@ -35,7 +42,7 @@ func (e *HmsttEvent) StateChange(ctx context.Context, key string, value string)
 		false,       // mandatory
 		false,       // immediate
 		amqp.Publishing{
-			ContentType: "text/plain",
+			ContentType: contentType,
 			Body:        []byte(value),
 		},
 	)
@@ -46,3 +53,34 @@ func (e *HmsttEvent) StateChange(ctx context.Context, key string, value string)
 
 	return err
 }
+
+// StateDeleted publishes a tombstone for a removed state: an empty body on the
+// same routing key, marked with the x-hmstt-deleted header, so subscribers
+// (and MQTT retained topics) can forget the key.
+func (e *HmsttEvent) StateDeleted(ctx context.Context, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	l := zerolog.Ctx(ctx)
+
+	routing := MQ_CHANNEL_HMSTT + KEY_DELIMITER + key
+
+	err := e.ch.PublishWithContext(
+		ctx,
+		"amq.topic", // exchange
+		routing,     // routing key
+		false,       // mandatory
+		false,       // immediate
+		amqp.Publishing{
+			ContentType: "text/plain",
+			Type:        EVENT_STATE_DELETED,
+			Headers:     amqp.Table{"x-hmstt-deleted": true},
+		},
+	)
+	if err != nil {
+		l.Error().Err(err).Msg("Failed to publish a message")
+	}
+	l.Info().Msgf("Published state deleted event %s", key)
+
+	return err
+}
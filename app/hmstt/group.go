@@ -0,0 +1,229 @@
+package hmstt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+)
+
+var ErrInvalidGroup = errors.New("INVALID GROUP")
+var ErrGroupNotFound = errors.New("GROUP NOT FOUND")
+var ErrNoCompatibleMembers = errors.New("NO GROUP MEMBER ACCEPTS THE VALUE")
+
+// MaxGroupsPerState bounds how many groups one state may belong to.
+const MaxGroupsPerState = 16
+
+// BATCH_STATUS_INCOMPATIBLE marks group members whose type does not accept
+// the value; they are left unchanged.
+const BATCH_STATUS_INCOMPATIBLE = "incompatible"
+
+var groupNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Group is a named set of states, e.g. a room or a rack.
+type Group struct {
+	Name    string
+	Members int64
+}
+
+// normalizeGroups validates group names and returns them sorted and
+// deduplicated. A nil slice stays nil.
+func normalizeGroups(groups []string) ([]string, error) {
+	if groups == nil {
+		return nil, nil
+	}
+	seen := make(map[string]bool, len(groups))
+	out := make([]string, 0, len(groups))
+	for _, g := range groups {
+		if !groupNamePattern.MatchString(g) {
+			return nil, fmt.Errorf("%w: %q must be 1-64 letters, digits, '_' or '-'", ErrInvalidGroup, g)
+		}
+		if !seen[g] {
+			seen[g] = true
+			out = append(out, g)
+		}
+	}
+	if len(out) > MaxGroupsPerState {
+		return nil, fmt.Errorf("%w: %d groups, at most %d allowed", ErrInvalidGroup, len(out), MaxGroupsPerState)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+func groupsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// groupMember is how a state is listed in a group set.
+func groupMember(tipe, k string) string {
+	return tipe + "/" + k
+}
+
+func (s *HmsttStore) groupsKey() string {
+	return s.prefix + ":hmstt_groups"
+}
+
+func (s *HmsttStore) groupKeyPrefix() string {
+	return s.prefix + ":hmstt_group:"
+}
+
+// ListGroups returns every non-empty group with its member count, by name.
+func (s *HmsttStore) ListGroups(ctx context.Context) ([]Group, error) {
+	ctx, span := otel.Tracer("hmstt").Start(ctx, "store.ListGroups")
+	defer span.End()
+
+	names, err := s.rdb.SMembers(ctx, s.groupsKey()).Result()
+	if err != nil {
+		return nil, fmt.Errorf("redis SMEMBERS groups: %w", err)
+	}
+	sort.Strings(names)
+	cmds := make([]*redis.IntCmd, len(names))
+	_, err = s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, name := range names {
+			cmds[i] = pipe.SCard(ctx, s.groupKeyPrefix()+name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("redis SCARD groups: %w", err)
+	}
+	groups := make([]Group, 0, len(names))
+	for i, name := range names {
+		groups = append(groups, Group{Name: name, Members: cmds[i].Val()})
+	}
+	return groups, nil
+}
+
+func (s *HmsttStore) GetGroupMembers(ctx context.Context, group string) ([]StateEntry, error) {
+	ctx, span := otel.Tracer("hmstt").Start(ctx, "store.GetGroupMembers")
+	defer span.End()
+
+	members, err := s.rdb.SMembers(ctx, s.groupKeyPrefix()+group).Result()
+	if err != nil {
+		return nil, fmt.Errorf("redis SMEMBERS group: %w", err)
+	}
+	sort.Strings(members)
+	cmds := make([]*redis.StringCmd, len(members))
+	reported := make([]*redis.StringCmd, len(members))
+	_, err = s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, m := range members {
+			tipe, k, _ := strings.Cut(m, "/")
+			cmds[i] = pipe.HGet(ctx, s.redisKey(tipe), k)
+			reported[i] = pipe.HGet(ctx, s.reportedKey(tipe), k)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, fmt.Errorf("redis HGET group members: %w", err)
+	}
+	entries := make([]StateEntry, 0, len(members))
+	for i, m := range members {
+		data, err := cmds[i].Bytes()
+		if err != nil {
+			continue
+		}
+		tipe, k, _ := strings.Cut(m, "/")
+		entry, err := decodeEntry(tipe, k, data)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal state entry %s: %w", m, err)
+		}
+		entry.Reported = decodeReported(reported[i].Val())
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (s *HmsttStore) GroupSize(ctx context.Context, group string) (int64, error) {
+	n, err := s.rdb.SCard(ctx, s.groupKeyPrefix()+group).Result()
+	if err != nil {
+		return 0, fmt.Errorf("redis SCARD group: %w", err)
+	}
+	return n, nil
+}
+
+func (s *HmsttService) ListGroups(ctx context.Context) ([]Group, error) {
+	groups, err := s.store.ListGroups(ctx)
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("ListGroups failed")
+		return nil, errors.New("LIST GROUPS ERROR")
+	}
+	return groups, nil
+}
+
+// GetGroupStates returns the states in group. It returns ErrGroupNotFound if
+// no state belongs to it.
+func (s *HmsttService) GetGroupStates(ctx context.Context, group string) ([]StateEntry, error) {
+	l := zerolog.Ctx(ctx)
+	l.Info().Str("hmstt_group", group).Msg("Handling GetGroupStates service")
+
+	entries, err := s.store.GetGroupMembers(ctx, group)
+	if err != nil {
+		l.Error().Err(err).Msg("GetGroupStates failed")
+		return nil, errors.New("GET GROUP STATES ERROR")
+	}
+	if len(entries) == 0 {
+		return nil, ErrGroupNotFound
+	}
+	return entries, nil
+}
+
+// SetGroupValue sets every member of group whose type accepts value, in one
+// atomic batch write. Members that do not accept it are reported as
+// incompatible, locked members as locked, and both are left alone. Results
+// are in member order.
+func (s *HmsttService) SetGroupValue(ctx context.Context, group, value string) ([]BatchSetResult, error) {
+	l := zerolog.Ctx(ctx)
+	l.Info().Str("hmstt_group", group).Str("hmstt_value", value).Msg("Handling SetGroupValue service")
+
+	members, err := s.GetGroupStates(ctx, group)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]BatchSetResult, len(members))
+	items := make([]BatchSetItem, 0, len(members))
+	indexes := make([]int, 0, len(members))
+	locked := 0
+	for i, m := range members {
+		if err := checkUnlocked(m); err != nil {
+			results[i] = BatchSetResult{Entry: m, Status: BATCH_STATUS_LOCKED, Error: err.Error()}
+			locked++
+			continue
+		}
+		if _, _, err := s.prepareValue(m.Type, m.K, value); err != nil {
+			results[i] = BatchSetResult{Entry: m, Status: BATCH_STATUS_INCOMPATIBLE, Error: err.Error()}
+			continue
+		}
+		items = append(items, BatchSetItem{Type: m.Type, Key: m.K, Value: value})
+		indexes = append(indexes, i)
+	}
+	if len(items) == 0 {
+		if locked > 0 {
+			return results, ErrStateLocked
+		}
+		return results, ErrNoCompatibleMembers
+	}
+
+	written, err := s.BatchSetStates(ctx, items)
+	for n, res := range written {
+		results[indexes[n]] = res
+	}
+	if err != nil {
+		return results, err
+	}
+	return results, nil
+}
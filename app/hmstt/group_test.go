@@ -0,0 +1,86 @@
+package hmstt
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/nurhudajoantama/hmauto/internal/config"
+)
+
+func TestGroups(t *testing.T) {
+	types, err := NewTypeRegistry([]config.StateType{{Name: "dimmer", Kind: KIND_INT, Min: float64Ptr(0), Max: float64Ptr(100)}})
+	if err != nil {
+		t.Fatalf("NewTypeRegistry() error = %v", err)
+	}
+	store := &fakeStateStore{}
+	svc := NewService(store, nil, &ServiceConfig{Types: types})
+	ctx := context.Background()
+
+	if _, err := svc.CreateState(ctx, "switch", "lamp", "on", "Lamp", []string{"living room"}, nil); !errors.Is(err, ErrInvalidGroup) {
+		t.Fatalf("CreateState() with bad group error = %v, want ErrInvalidGroup", err)
+	}
+	lamp, err := svc.CreateState(ctx, "switch", "lamp", "on", "Lamp", []string{"living_room", "downstairs", "living_room"}, nil)
+	if err != nil {
+		t.Fatalf("CreateState() error = %v", err)
+	}
+	if !groupsEqual(lamp.Groups, []string{"downstairs", "living_room"}) {
+		t.Fatalf("Groups = %v, want sorted and deduplicated", lamp.Groups)
+	}
+	if _, err := svc.CreateState(ctx, "switch", "tv", "on", "TV", []string{"living_room"}, nil); err != nil {
+		t.Fatalf("CreateState() error = %v", err)
+	}
+	if _, err := svc.CreateState(ctx, "dimmer", "ceiling", "80", "Ceiling light", []string{"living_room"}, nil); err != nil {
+		t.Fatalf("CreateState() error = %v", err)
+	}
+
+	t.Run("writes keep memberships", func(t *testing.T) {
+		if _, err := svc.SetState(ctx, "switch", "lamp", "off", nil, nil, nil); err != nil {
+			t.Fatalf("SetState() error = %v", err)
+		}
+		if _, err := svc.ToggleState(ctx, "switch", "lamp"); err != nil {
+			t.Fatalf("ToggleState() error = %v", err)
+		}
+		got, _ := store.GetState(ctx, "switch", "lamp")
+		if !groupsEqual(got.Groups, lamp.Groups) {
+			t.Fatalf("Groups = %v, want %v", got.Groups, lamp.Groups)
+		}
+	})
+
+	t.Run("sets compatible members only", func(t *testing.T) {
+		results, err := svc.SetGroupValue(ctx, "living_room", "off")
+		if err != nil {
+			t.Fatalf("SetGroupValue() error = %v", err)
+		}
+		status := map[string]string{}
+		for _, res := range results {
+			status[res.Entry.K] = res.Status
+		}
+		if status["lamp"] != BATCH_STATUS_UPDATED || status["tv"] != BATCH_STATUS_UPDATED || status["ceiling"] != BATCH_STATUS_INCOMPATIBLE {
+			t.Fatalf("statuses = %v", status)
+		}
+		if got, _ := store.GetState(ctx, "dimmer", "ceiling"); got.Value != "80" {
+			t.Fatalf("dimmer value = %q, want unchanged 80", got.Value)
+		}
+		if _, err := svc.SetGroupValue(ctx, "living_room", "dim"); !errors.Is(err, ErrNoCompatibleMembers) {
+			t.Fatalf("SetGroupValue() error = %v, want ErrNoCompatibleMembers", err)
+		}
+		if _, err := svc.SetGroupValue(ctx, "attic", "off"); !errors.Is(err, ErrGroupNotFound) {
+			t.Fatalf("SetGroupValue() error = %v, want ErrGroupNotFound", err)
+		}
+	})
+
+	t.Run("patch with no groups leaves every group", func(t *testing.T) {
+		entry, err := svc.PatchState(ctx, "switch", "tv", nil, nil, []string{}, nil, nil)
+		if err != nil {
+			t.Fatalf("PatchState() error = %v", err)
+		}
+		if len(entry.Groups) != 0 {
+			t.Fatalf("Groups = %v, want none", entry.Groups)
+		}
+		members, _ := svc.GetGroupStates(ctx, "living_room")
+		if len(members) != 2 {
+			t.Fatalf("members = %d, want 2", len(members))
+		}
+	})
+}
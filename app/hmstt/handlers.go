@@ -1,8 +1,13 @@
 package hmstt
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/nurhudajoantama/hmauto/app/server"
@@ -15,14 +20,316 @@ type HmsttHandler struct {
 	service *HmsttService
 }
 
+// listQueryFromRequest parses the filter, sort and paging query parameters
+// of the list endpoints. Several label parameters are combined like one
+// comma-separated selector.
+func listQueryFromRequest(r *http.Request, tipe string) (ListQuery, error) {
+	qs := r.URL.Query()
+	q := ListQuery{
+		Type:   tipe,
+		Value:  qs.Get("value"),
+		Prefix: qs.Get("prefix"),
+		Search: qs.Get("q"),
+		Sort:   qs.Get("sort"),
+		Cursor: qs.Get("cursor"),
+	}
+	if v := qs.Get("out_of_sync"); v != "" {
+		outOfSync, err := strconv.ParseBool(v)
+		if err != nil {
+			return q, fmt.Errorf("%w: out_of_sync must be true or false", ErrInvalidListQuery)
+		}
+		q.OutOfSync = outOfSync
+	}
+	sel, err := ParseLabelSelector(strings.Join(qs["label"], ","))
+	if err != nil {
+		return q, err
+	}
+	q.Labels = sel
+	switch qs.Get("order") {
+	case "", "asc":
+	case "desc":
+		q.Desc = true
+	default:
+		return q, fmt.Errorf("%w: order must be asc or desc", ErrInvalidListQuery)
+	}
+	if v := qs.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return q, fmt.Errorf("%w: limit must be a positive number", ErrInvalidListQuery)
+		}
+		q.Limit = n
+	}
+	return q, nil
+}
+
+// listStates writes one page of q, or an error status.
+func (h *HmsttHandler) listStates(w http.ResponseWriter, r *http.Request, tipe string) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+
+	rep, ok := negotiate(w, r)
+	if !ok {
+		return
+	}
+	q, err := listQueryFromRequest(r, tipe)
+	if err != nil {
+		response.ErrorResponse(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	page, err := h.service.ListStates(ctx, q)
+	if err != nil {
+		if errors.Is(err, ErrInvalidListQuery) || errors.Is(err, ErrInvalidCursor) {
+			response.ErrorResponse(w, http.StatusBadRequest, err.Error(), err)
+			return
+		}
+		l.Error().Err(err).Msg("listing states failed")
+		response.ErrorResponse(w, http.StatusInternalServerError, "failed to get states", err)
+		return
+	}
+	// A type with no states at all is not found; filters that match nothing
+	// give an empty list.
+	if tipe != "" && q.Cursor == "" && !q.filtered() && len(page.Entries) == 0 {
+		response.ErrorResponse(w, http.StatusNotFound, "no states found for type", nil)
+		return
+	}
+
+	data := make([]StateResponse, 0, len(page.Entries))
+	for _, e := range page.Entries {
+		data = append(data, h.service.stateResponse(e))
+	}
+	rep.PageResponse(w, data, page.NextCursor)
+}
+
 func entryToResponse(e StateEntry) StateResponse {
-	return StateResponse{
+	var value any = e.Value
+	if e.Structured {
+		value = json.RawMessage(e.Value)
+	}
+	out := StateResponse{
 		Type:        e.Type,
 		Key:         e.K,
-		Value:       e.Value,
+		Value:       value,
 		Description: e.Description,
+		Name:        e.Name,
+		Labels:      e.Labels,
+		Groups:      e.Groups,
 		UpdatedAt:   e.UpdatedAt.UTC().Format("2006-01-02T15:04:05Z"),
+		Revision:    e.Revision,
+	}
+	if e.Locked() {
+		out.Locked = true
+		out.LockReason = e.Lock.Reason
+		out.LockOwner = e.Lock.Owner
+		if !e.Lock.ExpiresAt.IsZero() {
+			out.LockExpiresAt = e.Lock.ExpiresAt.UTC().Format(time.RFC3339)
+		}
+	}
+	if inSync, known := e.InSync(); known {
+		out.Reported = e.Reported.Value
+		if e.Reported.Structured {
+			out.Reported = json.RawMessage(e.Reported.Value)
+		}
+		out.ReportedAt = e.Reported.ReportedAt.UTC().Format(time.RFC3339)
+		out.InSync = &inSync
+	}
+	return out
+}
+
+// BatchResultToResponse converts a batch result for the API; scene activation
+// reports its results the same way.
+func BatchResultToResponse(res BatchSetResult) BatchSetResultResponse {
+	out := BatchSetResultResponse{
+		Type:   res.Entry.Type,
+		Key:    res.Entry.K,
+		Status: res.Status,
+		Error:  res.Error,
+	}
+	if res.Status != BATCH_STATUS_INVALID && res.Status != BATCH_STATUS_SKIPPED {
+		entry := entryToResponse(res.Entry)
+		out.Value = entry.Value
+		out.Revision = entry.Revision
+	}
+	return out
+}
+
+func timerToResponse(t Timer) TimerResponse {
+	return TimerResponse{
+		Type:      t.Type,
+		Key:       t.Key,
+		Op:        t.Op,
+		Value:     t.Value,
+		Revision:  t.Revision,
+		DueAt:     t.DueAt.UTC().Format(time.RFC3339),
+		CreatedAt: t.CreatedAt.UTC().Format(time.RFC3339),
+		Caller:    t.Caller,
+	}
+}
+
+func historyToResponse(rec HistoryRecord) HistoryResponse {
+	return HistoryResponse{
+		ID:             rec.ID,
+		Time:           rec.Time.UTC().Format("2006-01-02T15:04:05Z"),
+		Op:             rec.Op,
+		OldValue:       rec.OldValue,
+		NewValue:       rec.NewValue,
+		OldDescription: rec.OldDescription,
+		NewDescription: rec.NewDescription,
+		RequestID:      rec.RequestID,
+		Caller:         rec.Caller,
+	}
+}
+
+func commandToResponse(c Command) CommandResponse {
+	var value any = c.Value
+	if c.Structured {
+		value = json.RawMessage(c.Value)
+	}
+	out := CommandResponse{
+		Type:          c.Type,
+		Key:           c.Key,
+		Value:         value,
+		Revision:      c.Revision,
+		Status:        c.Status,
+		Attempts:      c.Attempts,
+		CreatedAt:     c.CreatedAt.UTC().Format(time.RFC3339),
+		LastAttemptAt: c.LastAttemptAt.UTC().Format(time.RFC3339),
+	}
+	if !c.NextAttemptAt.IsZero() {
+		out.NextAttemptAt = c.NextAttemptAt.UTC().Format(time.RFC3339)
+	}
+	return out
+}
+
+// setETag exposes the entry revision as a strong ETag.
+func setETag(w http.ResponseWriter, e StateEntry) {
+	w.Header().Set("ETag", `"`+strconv.FormatInt(e.Revision, 10)+`"`)
+}
+
+// parseIfMatch reads the If-Match header as RFC 9110 defines it: "*" or a
+// list of entity tags. A missing header means no precondition. ETags are
+// compared strongly, so weak tags and tags that are not a revision match no
+// state; a list of only such tags still fails the write with 412.
+func parseIfMatch(r *http.Request) (*Precondition, error) {
+	header := strings.TrimSpace(strings.Join(r.Header.Values("If-Match"), ","))
+	if header == "" {
+		return nil, nil
+	}
+	if header == "*" {
+		return &Precondition{Any: true}, nil
+	}
+	p := &Precondition{}
+	rest := header
+	for {
+		rest = strings.TrimLeft(rest, " \t,")
+		if rest == "" {
+			return p, nil
+		}
+		weak := strings.HasPrefix(rest, "W/")
+		rest = strings.TrimPrefix(rest, "W/")
+		if !strings.HasPrefix(rest, `"`) {
+			return nil, fmt.Errorf("expected a quoted entity tag at %q", rest)
+		}
+		end := strings.IndexByte(rest[1:], '"') + 1
+		if end == 0 {
+			return nil, fmt.Errorf("unterminated entity tag %q", rest)
+		}
+		tag := rest[1:end]
+		if strings.ContainsFunc(tag, func(c rune) bool { return c <= ' ' || c == 0x7f }) {
+			return nil, fmt.Errorf("invalid entity tag %q", tag)
+		}
+		rest = strings.TrimLeft(rest[end+1:], " \t")
+		if rest != "" && rest[0] != ',' {
+			return nil, fmt.Errorf("expected a comma after entity tag %q", tag)
+		}
+		if weak {
+			continue
+		}
+		if rev, err := strconv.ParseInt(tag, 10, 64); err == nil && strconv.FormatInt(rev, 10) == tag {
+			p.Revisions = append(p.Revisions, rev)
+		}
+	}
+}
+
+// waitWriteSlack is the time a long poll leaves itself to write the
+// response after waiting.
+const waitWriteSlack = 10 * time.Second
+
+// waitFromRequest parses the long poll parameters of the batch read. A zero
+// wait means no waiting; since is nil if not given.
+func waitFromRequest(r *http.Request) (time.Duration, *int64, error) {
+	qs := r.URL.Query()
+	var wait time.Duration
+	if v := qs.Get("wait"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || d > MaxWait {
+			return 0, nil, fmt.Errorf("wait must be a duration up to %s, got %q", MaxWait, v)
+		}
+		wait = d
+	}
+	var since *int64
+	if v := qs.Get("since"); v != "" {
+		rev, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || rev < 0 {
+			return 0, nil, fmt.Errorf("since must be a revision, got %q", v)
+		}
+		since = &rev
+	}
+	return wait, since, nil
+}
+
+// negotiate reads the representation a list endpoint answers in, or writes
+// 406 or 400 and returns false.
+func negotiate(w http.ResponseWriter, r *http.Request) (response.Representation, bool) {
+	rep, err := response.Negotiate(r)
+	switch {
+	case err == nil:
+		return rep, true
+	case errors.Is(err, response.ErrNotAcceptable):
+		response.ErrorResponse(w, http.StatusNotAcceptable, err.Error(), err)
+	default:
+		response.ErrorResponse(w, http.StatusBadRequest, err.Error(), err)
+	}
+	return rep, false
+}
+
+func typeToResponse(t TypeDef) TypeResponse {
+	return TypeResponse{
+		Name:    t.Name,
+		Kind:    t.Kind,
+		Values:  t.Values,
+		Min:     t.Min,
+		Max:     t.Max,
+		Step:    t.Step,
+		Pattern: t.Pattern,
+		Schema:  t.Schema,
+	}
+}
+
+func constraintToResponse(c Constraint) ConstraintResponse {
+	return ConstraintResponse{
+		Name:     c.Name,
+		Kind:     c.Kind,
+		States:   c.States,
+		Requires: c.Requires,
+		Group:    c.Group,
+		Max:      c.Max,
+		Active:   c.Active,
+	}
+}
+
+// RespondConstraintViolation writes a 409 naming the violated constraint.
+func RespondConstraintViolation(w http.ResponseWriter, err error) {
+	var cerr *ConstraintError
+	if !errors.As(err, &cerr) {
+		response.ErrorResponse(w, http.StatusConflict, err.Error(), err)
+		return
 	}
+	response.ErrorDataResponse(w, http.StatusConflict, err.Error(), err, ConstraintViolationResponse{
+		Constraint: constraintToResponse(cerr.Constraint),
+		Active:     cerr.Active,
+		Reason:     cerr.Reason,
+	})
 }
 
 func RegisterHandlers(s *server.Server, svc *HmsttService) {
@@ -30,42 +337,135 @@ func RegisterHandlers(s *server.Server, svc *HmsttService) {
 
 	v1 := s.GetRouter().PathPrefix("/v1").Subrouter()
 	s.ApplyAuthMiddleware(v1)
+	v1.Use(callerMiddleware(s.GetConfig().TrustedProxies))
 
+	v1.HandleFunc("/types", h.listTypes).Methods("GET")
+	v1.HandleFunc("/constraints", h.listConstraints).Methods("GET")
 	v1.HandleFunc("/states", h.listAllStates).Methods("GET")
 	v1.HandleFunc("/states", h.createState).Methods("POST")
+	v1.HandleFunc("/states:batchSet", h.batchSetStates).Methods("POST")
+	v1.HandleFunc("/states:namingViolations", h.namingViolations).Methods("GET")
 	v1.HandleFunc("/states/{type}", h.listStatesByType).Methods("GET")
+	v1.HandleFunc("/states/{type}", h.deleteType).Methods("DELETE")
 	v1.HandleFunc("/states/{type}/batch", h.getStatesByKeys).Methods("GET")
+	v1.HandleFunc("/states/{type}/{key}/history", h.getStateHistory).Methods("GET")
+	v1.HandleFunc("/states/{type}/{key}/toggle", h.toggleState).Methods("POST")
+	v1.HandleFunc("/states/{type}/{key}/cycle", h.cycleState).Methods("POST")
+	v1.HandleFunc("/states/{type}/{key}/lock", h.lockState).Methods("POST")
+	v1.HandleFunc("/states/{type}/{key}/lock", h.unlockState).Methods("DELETE")
+	v1.HandleFunc("/states/{type}/{key}/reported", h.reportState).Methods("POST")
 	v1.HandleFunc("/states/{type}/{key}", h.getState).Methods("GET")
 	v1.HandleFunc("/states/{type}/{key}", h.setState).Methods("PUT")
 	v1.HandleFunc("/states/{type}/{key}", h.patchState).Methods("PATCH")
+	v1.HandleFunc("/states/{type}/{key}", h.deleteState).Methods("DELETE")
+	v1.HandleFunc("/commands", h.listCommands).Methods("GET")
+	v1.HandleFunc("/timers", h.listTimers).Methods("GET")
+	v1.HandleFunc("/timers/{type}/{key}", h.cancelTimer).Methods("DELETE")
+	v1.HandleFunc("/groups", h.listGroups).Methods("GET")
+	v1.HandleFunc("/groups/{group}/states", h.getGroupStates).Methods("GET")
+	v1.HandleFunc("/groups/{group}/value", h.setGroupValue).Methods("PUT")
+}
+
+// listTypes godoc
+//
+//	@Summary		List state types
+//	@Description	Returns every registered state type and the values it accepts
+//	@Tags			types
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Success		200	{object}	response.JsonResponse{data=[]TypeResponse}	"List of types"
+//	@Failure		401	{object}	response.JsonResponse						"Unauthorized"
+//	@Router			/types [get]
+func (h *HmsttHandler) listTypes(w http.ResponseWriter, r *http.Request) {
+	l := zerolog.Ctx(r.Context())
+	l.Info().Msg("Handling listTypes request")
+
+	types := h.service.Types()
+	data := make([]TypeResponse, 0, len(types))
+	for _, t := range types {
+		data = append(data, typeToResponse(t))
+	}
+	response.SuccessResponse(w, data)
+}
+
+// listConstraints godoc
+//
+//	@Summary		List constraints
+//	@Description	Returns the configured interlocks between states (exclusive, requires, max_on)
+//	@Tags			types
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Success		200	{object}	response.JsonResponse{data=[]ConstraintResponse}	"List of constraints"
+//	@Failure		401	{object}	response.JsonResponse								"Unauthorized"
+//	@Router			/constraints [get]
+func (h *HmsttHandler) listConstraints(w http.ResponseWriter, r *http.Request) {
+	l := zerolog.Ctx(r.Context())
+	l.Info().Msg("Handling listConstraints request")
+
+	constraints := h.service.Constraints()
+	data := make([]ConstraintResponse, 0, len(constraints))
+	for _, c := range constraints {
+		data = append(data, constraintToResponse(c))
+	}
+	response.SuccessResponse(w, data)
 }
 
 // listAllStates godoc
 //
 //	@Summary		List all states
-//	@Description	Returns all states across every type
+//	@Description	Returns one page of the states across every type, optionally filtered and sorted. Follow next_cursor for the next page.
 //	@Tags			states
-//	@Produce		json
+//	@Produce		json,plain,application/cbor,application/msgpack
 //	@Security		BearerAuth
-//	@Success		200	{object}	response.JsonResponse{data=[]StateResponse}	"List of states"
-//	@Failure		401	{object}	response.JsonResponse						"Unauthorized"
-//	@Failure		500	{object}	response.JsonResponse						"Internal error"
+//	@Param			value	query		string									false	"Only states with exactly this value"	example(on)
+//	@Param			prefix	query		string									false	"Only keys starting with this prefix"	example(lamp_)
+//	@Param			q		query		string									false	"Only keys containing this substring"	example(office)
+//	@Param			label	query		string									false	"Label selector: comma-separated key=value, key!=value or key"	example(room=office,critical=true)
+//	@Param			out_of_sync	query	bool								false	"Only states whose device reported a value other than the desired one"
+//	@Param			sort	query		string									false	"Sort by key or updated_at; unsorted pages follow Redis scan order"	Enums(key, updated_at)
+//	@Param			order	query		string									false	"Sort order"	Enums(asc, desc)	default(asc)
+//	@Param			limit	query		int										false	"Page size, 1-1000"	default(100)
+//	@Param			cursor	query		string									false	"next_cursor of the previous page"
+//	@Param			fields	query		string									false	"Comma-separated members to keep of each state; text/plain defaults to key,value"	example(key,value)
+//	@Success		200		{object}	response.JsonResponse{data=[]StateResponse}	"Page of states"
+//	@Failure		400		{object}	response.JsonResponse						"Invalid query parameter or cursor"
+//	@Failure		401		{object}	response.JsonResponse						"Unauthorized"
+//	@Failure		406		{object}	response.JsonResponse						"Accept allows none of the supported types"
+//	@Failure		500		{object}	response.JsonResponse						"Internal error"
 //	@Router			/states [get]
 func (h *HmsttHandler) listAllStates(w http.ResponseWriter, r *http.Request) {
+	l := zerolog.Ctx(r.Context())
+	l.Info().Msg("Handling listAllStates request")
+
+	h.listStates(w, r, "")
+}
+
+// namingViolations godoc
+//
+//	@Summary		List states with invalid names
+//	@Description	Returns the stored states whose type or key breaks the naming policy (lowercase letters, digits, '_' or '-'; types up to 32 and keys up to 64 characters; "batch" is reserved). Such names break AMQP routing keys and MQTT topics; new states must follow the policy.
+//	@Tags			states
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Success		200	{object}	response.JsonResponse{data=[]NamingViolationResponse}	"States with invalid names"
+//	@Failure		401	{object}	response.JsonResponse								"Unauthorized"
+//	@Failure		500	{object}	response.JsonResponse								"Internal error"
+//	@Router			/states:namingViolations [get]
+func (h *HmsttHandler) namingViolations(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	l := zerolog.Ctx(ctx)
-	l.Info().Msg("Handling listAllStates request")
+	l.Info().Msg("Handling namingViolations request")
 
-	entries, err := h.service.GetAllStates(ctx)
+	violations, err := h.service.NamingViolations(ctx)
 	if err != nil {
-		l.Error().Err(err).Msg("listAllStates failed")
+		l.Error().Err(err).Msg("namingViolations failed")
 		response.ErrorResponse(w, http.StatusInternalServerError, "failed to get states", err)
 		return
 	}
 
-	data := make([]StateResponse, 0, len(entries))
-	for _, e := range entries {
-		data = append(data, entryToResponse(e))
+	data := make([]NamingViolationResponse, 0, len(violations))
+	for _, v := range violations {
+		data = append(data, NamingViolationResponse{Type: v.Type, Key: v.Key, TypeProblems: v.TypeProblems, KeyProblems: v.KeyProblems})
 	}
 	response.SuccessResponse(w, data)
 }
@@ -73,19 +473,30 @@ func (h *HmsttHandler) listAllStates(w http.ResponseWriter, r *http.Request) {
 // listStatesByType godoc
 //
 //	@Summary		List states by type
-//	@Description	Returns all states for a given type (e.g. switch)
+//	@Description	Returns one page of the states of a given type (e.g. switch), optionally filtered and sorted. Follow next_cursor for the next page.
 //	@Tags			states
-//	@Produce		json
+//	@Produce		json,plain,application/cbor,application/msgpack
 //	@Security		BearerAuth
 //	@Param			type	path		string									true	"State type"	example(switch)
-//	@Success		200		{object}	response.JsonResponse{data=[]StateResponse}	"List of states"
+//	@Param			value	query		string									false	"Only states with exactly this value"	example(on)
+//	@Param			prefix	query		string									false	"Only keys starting with this prefix"	example(lamp_)
+//	@Param			q		query		string									false	"Only keys containing this substring"	example(office)
+//	@Param			label	query		string									false	"Label selector: comma-separated key=value, key!=value or key"	example(room=office,critical=true)
+//	@Param			out_of_sync	query	bool								false	"Only states whose device reported a value other than the desired one"
+//	@Param			sort	query		string									false	"Sort by key or updated_at; unsorted pages follow Redis scan order"	Enums(key, updated_at)
+//	@Param			order	query		string									false	"Sort order"	Enums(asc, desc)	default(asc)
+//	@Param			limit	query		int										false	"Page size, 1-1000"	default(100)
+//	@Param			cursor	query		string									false	"next_cursor of the previous page"
+//	@Param			fields	query		string									false	"Comma-separated members to keep of each state; text/plain defaults to key,value"	example(key,value)
+//	@Success		200		{object}	response.JsonResponse{data=[]StateResponse}	"Page of states"
+//	@Failure		400		{object}	response.JsonResponse						"Invalid query parameter or cursor"
 //	@Failure		401		{object}	response.JsonResponse						"Unauthorized"
 //	@Failure		404		{object}	response.JsonResponse						"No states found for type"
+//	@Failure		406		{object}	response.JsonResponse						"Accept allows none of the supported types"
 //	@Failure		500		{object}	response.JsonResponse						"Internal error"
 //	@Router			/states/{type} [get]
 func (h *HmsttHandler) listStatesByType(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	l := zerolog.Ctx(ctx)
+	l := zerolog.Ctx(r.Context())
 	tipe := mux.Vars(r)["type"]
 
 	l.UpdateContext(func(c zerolog.Context) zerolog.Context {
@@ -93,22 +504,7 @@ func (h *HmsttHandler) listStatesByType(w http.ResponseWriter, r *http.Request)
 	})
 	l.Info().Msg("Handling listStatesByType request")
 
-	entries, err := h.service.GetAllByType(ctx, tipe)
-	if err != nil {
-		l.Error().Err(err).Msg("listStatesByType failed")
-		response.ErrorResponse(w, http.StatusInternalServerError, "failed to get states", err)
-		return
-	}
-	if len(entries) == 0 {
-		response.ErrorResponse(w, http.StatusNotFound, "no states found for type", nil)
-		return
-	}
-
-	data := make([]StateResponse, 0, len(entries))
-	for _, e := range entries {
-		data = append(data, entryToResponse(e))
-	}
-	response.SuccessResponse(w, data)
+	h.listStates(w, r, tipe)
 }
 
 // getState godoc
@@ -121,6 +517,7 @@ func (h *HmsttHandler) listStatesByType(w http.ResponseWriter, r *http.Request)
 //	@Param			type	path		string									true	"State type"	example(switch)
 //	@Param			key		path		string									true	"State key"		example(modem)
 //	@Success		200		{object}	response.JsonResponse{data=StateResponse}	"State entry"
+//	@Header			200		{string}	ETag									"Revision of the state"
 //	@Failure		401		{object}	response.JsonResponse						"Unauthorized"
 //	@Failure		404		{object}	response.JsonResponse						"State not found"
 //	@Router			/states/{type}/{key} [get]
@@ -143,9 +540,29 @@ func (h *HmsttHandler) getState(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	response.SuccessResponse(w, entryToResponse(entry))
+	setETag(w, entry)
+	response.SuccessResponse(w, h.service.stateResponse(entry))
 }
 
+// getStatesByKeys godoc
+//
+//	@Summary		Get several states of a type
+//	@Description	Returns the listed keys of a type; missing keys are left out. With wait the request is a long poll: it answers at once if since is set and one of the states has a newer revision, otherwise when one of the keys is written or deleted, on this or another instance, or when wait elapses. Any write that bumps the revision counts, including description, label and lock changes; device reports do not. Either way it returns the states as they are then.
+//	@Tags			states
+//	@Produce		json,plain,application/cbor,application/msgpack
+//	@Security		BearerAuth
+//	@Param			type		path		string										true	"State type"	example(switch)
+//	@Param			key			query		[]string									true	"State keys"	collectionFormat(multi)
+//	@Param			wait		query		string										false	"Wait up to this long for a change, at most 1m"	example(30s)
+//	@Param			since		query		int											false	"Highest revision the client has seen"	example(42)
+//	@Param			fields		query		string										false	"Comma-separated members to keep of each state; text/plain defaults to key,value"	example(key,value)
+//	@Param			X-Device-ID	header		string										false	"Id of the registered device syncing, counts as a sign of life"
+//	@Success		200			{object}	response.JsonResponse{data=[]StateResponse}	"States"
+//	@Failure		400			{object}	response.JsonResponse						"Missing key, or invalid wait, since or fields"
+//	@Failure		401			{object}	response.JsonResponse						"Unauthorized"
+//	@Failure		406			{object}	response.JsonResponse						"Accept allows none of the supported types"
+//	@Failure		500			{object}	response.JsonResponse						"Internal error"
+//	@Router			/states/{type}/batch [get]
 func (h *HmsttHandler) getStatesByKeys(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	l := zerolog.Ctx(ctx)
@@ -161,8 +578,31 @@ func (h *HmsttHandler) getStatesByKeys(w http.ResponseWriter, r *http.Request) {
 		response.ErrorResponse(w, http.StatusBadRequest, "at least one key query parameter is required", nil)
 		return
 	}
+	wait, since, err := waitFromRequest(r)
+	if err != nil {
+		response.ErrorResponse(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	rep, ok := negotiate(w, r)
+	if !ok {
+		return
+	}
+	h.service.DeviceSeen(ctx, r.Header.Get(HEADER_DEVICE_ID))
 
-	entries, err := h.service.GetStatesByKeys(ctx, tipe, keys)
+	var entries []StateEntry
+	if wait > 0 {
+		// The server write timeout is shorter than a long poll.
+		if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(wait + waitWriteSlack)); err != nil {
+			l.Warn().Err(err).Msg("extending the write deadline failed")
+		}
+		entries, err = h.service.WaitStatesByKeys(ctx, tipe, keys, since, wait)
+		if err != nil && ctx.Err() != nil {
+			l.Info().Msg("client left while waiting")
+			return
+		}
+	} else {
+		entries, err = h.service.GetStatesByKeys(ctx, tipe, keys)
+	}
 	if err != nil {
 		l.Error().Err(err).Msg("getStatesByKeys failed")
 		response.ErrorResponse(w, http.StatusInternalServerError, "failed to get states", err)
@@ -171,25 +611,25 @@ func (h *HmsttHandler) getStatesByKeys(w http.ResponseWriter, r *http.Request) {
 
 	data := make([]StateResponse, 0, len(entries))
 	for _, entry := range entries {
-		data = append(data, entryToResponse(entry))
+		data = append(data, h.service.stateResponse(entry))
 	}
 
-	response.SuccessResponse(w, data)
+	rep.SuccessResponse(w, data)
 }
 
 // createState godoc
 //
 //	@Summary		Create a state entry
-//	@Description	Creates a new state for the given type and key. Returns 409 if the key already exists.
+//	@Description	Creates a new state for the given type and key, optionally in some groups (rooms, racks). Returns 409 if the key already exists.
 //	@Tags			states
 //	@Accept			json
 //	@Produce		json
 //	@Security		BearerAuth
 //	@Param			body	body		CreateStateRequest							true	"State to create"
 //	@Success		201		{object}	response.JsonResponse{data=StateResponse}	"Created state"
-//	@Failure		400		{object}	response.JsonResponse						"Invalid type/key/value/description"
+//	@Failure		400		{object}	response.JsonResponse						"Unknown type or value rejected by the type registry"
 //	@Failure		401		{object}	response.JsonResponse						"Unauthorized"
-//	@Failure		409		{object}	response.JsonResponse						"State already exists"
+//	@Failure		409		{object}	response.JsonResponse{data=ConstraintViolationResponse}	"State already exists, or a constraint would be violated"
 //	@Failure		500		{object}	response.JsonResponse						"Internal error"
 //	@Router			/states [post]
 func (h *HmsttHandler) createState(w http.ResponseWriter, r *http.Request) {
@@ -208,30 +648,91 @@ func (h *HmsttHandler) createState(w http.ResponseWriter, r *http.Request) {
 		return c.Str("hmstt_type", body.Type).Str("hmstt_key", body.Key)
 	})
 
-	if err := h.service.CreateState(ctx, body.Type, body.Key, body.Value, body.Description); err != nil {
+	entry, err := h.service.CreateState(ctx, body.Type, body.Key, valueFromRaw(body.Value), body.Description, body.Groups, newMeta(&body.Name, body.Labels))
+	if err != nil {
 		if errors.Is(err, ErrStateAlreadyExists) {
 			response.ErrorResponse(w, http.StatusConflict, "state already exists", err)
 			return
 		}
+		if errors.Is(err, ErrConstraintViolation) {
+			RespondConstraintViolation(w, err)
+			return
+		}
 		l.Error().Err(err).Msg("createState failed")
 		response.ErrorResponse(w, http.StatusBadRequest, err.Error(), err)
 		return
 	}
 
-	entry, err := h.service.GetState(ctx, body.Type, body.Key)
+	setETag(w, entry)
+	response.CreatedResponse(w, h.service.stateResponse(entry))
+}
+
+// batchSetStates godoc
+//
+//	@Summary		Set several states at once
+//	@Description	Validates every item, then writes all of them atomically or none. Items may span types. Fires one MQTT event per changed value.
+//	@Tags			states
+//	@Accept			json
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			body		body		BatchSetStatesRequest									true	"States to write"
+//	@Param			X-Device-ID	header		string													false	"Registered device making the call; marks it seen"
+//	@Success		200		{object}	response.JsonResponse{data=[]BatchSetResultResponse}	"Per-item results, in request order"
+//	@Failure		400		{object}	response.JsonResponse{data=[]BatchSetResultResponse}	"Invalid items; nothing was written"
+//	@Failure		401		{object}	response.JsonResponse									"Unauthorized"
+//	@Failure		409		{object}	response.JsonResponse{data=ConstraintViolationResponse}					"Concurrent writes kept conflicting, or a constraint would be violated; nothing was written"
+//	@Failure		423		{object}	response.JsonResponse{data=[]BatchSetResultResponse}	"Some states are locked; nothing was written"
+//	@Failure		500		{object}	response.JsonResponse									"Internal error"
+//	@Router			/states:batchSet [post]
+func (h *HmsttHandler) batchSetStates(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+	l.Info().Msg("Handling batchSetStates request")
+	h.service.DeviceSeen(ctx, r.Header.Get(HEADER_DEVICE_ID))
+
+	var body BatchSetStatesRequest
+	if err := request.DecodeAndValidate(r, &body); err != nil {
+		l.Error().Err(err).Msg("batchSetStates: validation failed")
+		response.ErrorResponse(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	items := make([]BatchSetItem, 0, len(body.States))
+	for _, st := range body.States {
+		items = append(items, BatchSetItem{Type: st.Type, Key: st.Key, Value: valueFromRaw(st.Value), Description: st.Description})
+	}
+
+	results, err := h.service.BatchSetStates(ctx, items)
+	data := make([]BatchSetResultResponse, 0, len(results))
+	for _, res := range results {
+		data = append(data, BatchResultToResponse(res))
+	}
 	if err != nil {
-		l.Error().Err(err).Msg("createState: get state after create failed")
-		response.ErrorResponse(w, http.StatusInternalServerError, "failed to retrieve created state", err)
+		switch {
+		case errors.Is(err, ErrBatchInvalid):
+			response.ErrorDataResponse(w, http.StatusBadRequest, "invalid states in batch, nothing was written", err, data)
+		case errors.Is(err, ErrBatchEmpty), errors.Is(err, ErrBatchTooLarge):
+			response.ErrorResponse(w, http.StatusBadRequest, err.Error(), err)
+		case errors.Is(err, ErrRevisionMismatch):
+			response.ErrorResponse(w, http.StatusConflict, "states kept changing during the batch, nothing was written", err)
+		case errors.Is(err, ErrConstraintViolation):
+			RespondConstraintViolation(w, err)
+		case errors.Is(err, ErrStateLocked):
+			response.ErrorDataResponse(w, http.StatusLocked, "some states are locked, nothing was written", err, data)
+		default:
+			l.Error().Err(err).Msg("batchSetStates failed")
+			response.ErrorResponse(w, http.StatusInternalServerError, "failed to set states", err)
+		}
 		return
 	}
 
-	response.CreatedResponse(w, entryToResponse(entry))
+	response.SuccessResponse(w, data)
 }
 
 // setState godoc
 //
 //	@Summary		Set a state value
-//	@Description	Updates the value (and optionally description) of an existing state. Fires MQTT event only if value changes.
+//	@Description	Updates the value (and optionally description) of an existing state. Fires MQTT event only if value changes. With revert_after the state returns to its previous value after that duration, unless someone else changes it first.
 //	@Tags			states
 //	@Accept			json
 //	@Produce		json
@@ -239,9 +740,15 @@ func (h *HmsttHandler) createState(w http.ResponseWriter, r *http.Request) {
 //	@Param			type	path		string									true	"State type"	example(switch)
 //	@Param			key		path		string									true	"State key"		example(modem)
 //	@Param			body	body		SetStateRequest							true	"State value"
+//	@Param			If-Match	header	string									false	"Only update if the state is at one of these revisions (ETags), or exists for *"
 //	@Success		200		{object}	response.JsonResponse{data=StateResponse}	"Updated state"
-//	@Failure		400		{object}	response.JsonResponse						"Invalid type/key/value"
+//	@Header			200		{string}	ETag									"Revision of the updated state"
+//	@Failure		400		{object}	response.JsonResponse						"Unknown type, value rejected by the type registry or invalid revert_after"
 //	@Failure		401		{object}	response.JsonResponse						"Unauthorized"
+//	@Failure		404		{object}	response.JsonResponse						"State not found (revert_after needs an existing state)"
+//	@Failure		409		{object}	response.JsonResponse{data=ConstraintViolationResponse}	"A constraint would be violated"
+//	@Failure		412		{object}	response.JsonResponse						"If-Match does not match the current revision"
+//	@Failure		423		{object}	response.JsonResponse						"State is locked"
 //	@Failure		500		{object}	response.JsonResponse						"Internal error"
 //	@Router			/states/{type}/{key} [put]
 func (h *HmsttHandler) setState(w http.ResponseWriter, r *http.Request) {
@@ -263,26 +770,55 @@ func (h *HmsttHandler) setState(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.service.SetState(ctx, tipe, key, body.Value, body.Description); err != nil {
-		l.Error().Err(err).Msg("setState failed")
-		response.ErrorResponse(w, http.StatusBadRequest, err.Error(), err)
+	ifMatch, err := parseIfMatch(r)
+	if err != nil {
+		response.ErrorResponse(w, http.StatusBadRequest, "invalid If-Match header", err)
 		return
 	}
 
-	entry, err := h.service.GetState(ctx, tipe, key)
+	var (
+		entry StateEntry
+		timer Timer
+	)
+	if body.RevertAfter != "" {
+		revertAfter, perr := time.ParseDuration(body.RevertAfter)
+		if perr != nil {
+			response.ErrorResponse(w, http.StatusBadRequest, "revert_after must be a duration such as 45m", perr)
+			return
+		}
+		entry, timer, err = h.service.SetStateFor(ctx, tipe, key, valueFromRaw(body.Value), body.Description, newMeta(body.Name, body.Labels), ifMatch, revertAfter)
+	} else {
+		entry, err = h.service.SetState(ctx, tipe, key, valueFromRaw(body.Value), body.Description, newMeta(body.Name, body.Labels), ifMatch)
+	}
 	if err != nil {
-		l.Error().Err(err).Msg("setState: get state after set failed")
-		response.ErrorResponse(w, http.StatusInternalServerError, "failed to retrieve updated state", err)
+		switch {
+		case errors.Is(err, ErrRevisionMismatch):
+			response.ErrorResponse(w, http.StatusPreconditionFailed, "state was modified by another client", err)
+		case errors.Is(err, ErrStateNotFound):
+			response.ErrorResponse(w, http.StatusNotFound, "state not found", err)
+		case errors.Is(err, ErrConstraintViolation):
+			RespondConstraintViolation(w, err)
+		case errors.Is(err, ErrStateLocked):
+			response.ErrorResponse(w, http.StatusLocked, err.Error(), err)
+		default:
+			l.Error().Err(err).Msg("setState failed")
+			response.ErrorResponse(w, http.StatusBadRequest, err.Error(), err)
+		}
 		return
 	}
 
-	response.SuccessResponse(w, entryToResponse(entry))
+	setETag(w, entry)
+	resp := h.service.stateResponse(entry)
+	if !timer.DueAt.IsZero() {
+		resp.RevertAt = timer.DueAt.UTC().Format(time.RFC3339)
+	}
+	response.SuccessResponse(w, resp)
 }
 
 // patchState godoc
 //
 //	@Summary		Partially update a state entry
-//	@Description	Updates value and/or description independently. Fields not provided are left unchanged. MQTT event fired only if value changes.
+//	@Description	Updates value and/or description independently. Fields not provided are left unchanged. For structured (json) types the value is merged into the current object. MQTT event fired only if value changes.
 //	@Tags			states
 //	@Accept			json
 //	@Produce		json
@@ -290,10 +826,15 @@ func (h *HmsttHandler) setState(w http.ResponseWriter, r *http.Request) {
 //	@Param			type	path		string									true	"State type"	example(switch)
 //	@Param			key		path		string									true	"State key"		example(modem)
 //	@Param			body	body		PatchStateRequest						true	"Fields to update"
+//	@Param			If-Match	header	string									false	"Only update if the state is at one of these revisions (ETags), or exists for *"
 //	@Success		200		{object}	response.JsonResponse{data=StateResponse}	"Updated state"
+//	@Header			200		{string}	ETag									"Revision of the updated state"
 //	@Failure		400		{object}	response.JsonResponse						"Invalid input or nothing to update"
 //	@Failure		401		{object}	response.JsonResponse						"Unauthorized"
 //	@Failure		404		{object}	response.JsonResponse						"State not found"
+//	@Failure		409		{object}	response.JsonResponse{data=ConstraintViolationResponse}	"A constraint would be violated"
+//	@Failure		412		{object}	response.JsonResponse						"If-Match does not match the current revision"
+//	@Failure		423		{object}	response.JsonResponse						"State is locked"
 //	@Failure		500		{object}	response.JsonResponse						"Internal error"
 //	@Router			/states/{type}/{key} [patch]
 func (h *HmsttHandler) patchState(w http.ResponseWriter, r *http.Request) {
@@ -315,7 +856,24 @@ func (h *HmsttHandler) patchState(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.service.PatchState(ctx, tipe, key, body.Value, body.Description); err != nil {
+	var value *string
+	if len(body.Value) > 0 && string(body.Value) != "null" {
+		v := valueFromRaw(body.Value)
+		value = &v
+	}
+
+	ifMatch, err := parseIfMatch(r)
+	if err != nil {
+		response.ErrorResponse(w, http.StatusBadRequest, "invalid If-Match header", err)
+		return
+	}
+
+	entry, err := h.service.PatchState(ctx, tipe, key, value, body.Description, body.Groups, newMeta(body.Name, body.Labels), ifMatch)
+	if err != nil {
+		if errors.Is(err, ErrRevisionMismatch) {
+			response.ErrorResponse(w, http.StatusPreconditionFailed, "state was modified by another client", err)
+			return
+		}
 		if errors.Is(err, ErrStateNotFound) {
 			response.ErrorResponse(w, http.StatusNotFound, "state not found", err)
 			return
@@ -324,17 +882,695 @@ func (h *HmsttHandler) patchState(w http.ResponseWriter, r *http.Request) {
 			response.ErrorResponse(w, http.StatusBadRequest, "nothing to update", err)
 			return
 		}
+		if errors.Is(err, ErrConstraintViolation) {
+			RespondConstraintViolation(w, err)
+			return
+		}
+		if errors.Is(err, ErrStateLocked) {
+			response.ErrorResponse(w, http.StatusLocked, err.Error(), err)
+			return
+		}
 		l.Error().Err(err).Msg("patchState failed")
 		response.ErrorResponse(w, http.StatusBadRequest, err.Error(), err)
 		return
 	}
 
-	entry, err := h.service.GetState(ctx, tipe, key)
+	setETag(w, entry)
+	response.SuccessResponse(w, h.service.stateResponse(entry))
+}
+
+// toggleErrorResponse maps toggle and cycle errors to HTTP responses.
+func toggleErrorResponse(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrStateNotFound):
+		response.ErrorResponse(w, http.StatusNotFound, "state not found", err)
+	case errors.Is(err, ErrUnknownType), errors.Is(err, ErrNotToggleable), errors.Is(err, ErrInvalidDuration):
+		response.ErrorResponse(w, http.StatusBadRequest, err.Error(), err)
+	case errors.Is(err, ErrCycleInProgress), errors.Is(err, ErrRevisionMismatch):
+		response.ErrorResponse(w, http.StatusConflict, err.Error(), err)
+	case errors.Is(err, ErrConstraintViolation):
+		RespondConstraintViolation(w, err)
+	case errors.Is(err, ErrStateLocked):
+		response.ErrorResponse(w, http.StatusLocked, err.Error(), err)
+	default:
+		response.ErrorResponse(w, http.StatusInternalServerError, "failed to update state", err)
+	}
+}
+
+// toggleState godoc
+//
+//	@Summary		Toggle a state
+//	@Description	Flips a bool or two-valued enum state (e.g. a switch from on to off) in one atomic step. Fires MQTT event.
+//	@Tags			states
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			type	path		string									true	"State type"	example(switch)
+//	@Param			key		path		string									true	"State key"		example(modem)
+//	@Success		200		{object}	response.JsonResponse{data=StateResponse}	"Toggled state"
+//	@Header			200		{string}	ETag									"Revision of the toggled state"
+//	@Failure		400		{object}	response.JsonResponse						"Type cannot be toggled"
+//	@Failure		401		{object}	response.JsonResponse						"Unauthorized"
+//	@Failure		404		{object}	response.JsonResponse						"State not found"
+//	@Failure		409		{object}	response.JsonResponse{data=ConstraintViolationResponse}	"Concurrent writes kept conflicting, or a constraint would be violated"
+//	@Failure		423		{object}	response.JsonResponse						"State is locked"
+//	@Failure		500		{object}	response.JsonResponse						"Internal error"
+//	@Router			/states/{type}/{key}/toggle [post]
+func (h *HmsttHandler) toggleState(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+	p := mux.Vars(r)
+	tipe := p["type"]
+	key := p["key"]
+
+	l.UpdateContext(func(c zerolog.Context) zerolog.Context {
+		return c.Str("hmstt_type", tipe).Str("hmstt_key", key)
+	})
+	l.Info().Msg("Handling toggleState request")
+
+	entry, err := h.service.ToggleState(ctx, tipe, key)
+	if err != nil {
+		l.Error().Err(err).Msg("toggleState failed")
+		toggleErrorResponse(w, err)
+		return
+	}
+
+	setETag(w, entry)
+	response.SuccessResponse(w, h.service.stateResponse(entry))
+}
+
+// cycleState godoc
+//
+//	@Summary		Power-cycle a state
+//	@Description	Switches a switch-like state off now and back on after off_for. Switching back on is a stored timer (see /timers), so the client may disconnect and the server may restart. If the state is changed by someone else meanwhile it is left as they set it.
+//	@Tags			states
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			type	path		string									true	"State type"	example(switch)
+//	@Param			key		path		string									true	"State key"		example(modem)
+//	@Param			off_for	query		string									false	"How long to stay off (Go duration, default 10s, max 10m)"	example(30s)
+//	@Success		202		{object}	response.JsonResponse{data=CycleResponse}	"Switched off; on_at tells when it switches back on"
+//	@Failure		400		{object}	response.JsonResponse						"Type has no on/off values or invalid off_for"
+//	@Failure		401		{object}	response.JsonResponse						"Unauthorized"
+//	@Failure		404		{object}	response.JsonResponse						"State not found"
+//	@Failure		409		{object}	response.JsonResponse{data=ConstraintViolationResponse}	"A cycle is already in progress for this state, or a constraint would be violated"
+//	@Failure		423		{object}	response.JsonResponse						"State is locked"
+//	@Failure		500		{object}	response.JsonResponse						"Internal error"
+//	@Router			/states/{type}/{key}/cycle [post]
+func (h *HmsttHandler) cycleState(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+	p := mux.Vars(r)
+	tipe := p["type"]
+	key := p["key"]
+
+	l.UpdateContext(func(c zerolog.Context) zerolog.Context {
+		return c.Str("hmstt_type", tipe).Str("hmstt_key", key)
+	})
+	l.Info().Msg("Handling cycleState request")
+
+	var offFor time.Duration
+	if v := r.URL.Query().Get("off_for"); v != "" {
+		var err error
+		if offFor, err = time.ParseDuration(v); err != nil {
+			response.ErrorResponse(w, http.StatusBadRequest, "off_for must be a duration such as 30s", err)
+			return
+		}
+	}
+
+	entry, timer, err := h.service.CycleState(ctx, tipe, key, offFor)
 	if err != nil {
-		l.Error().Err(err).Msg("patchState: get state after patch failed")
-		response.ErrorResponse(w, http.StatusInternalServerError, "failed to retrieve updated state", err)
+		l.Error().Err(err).Msg("cycleState failed")
+		toggleErrorResponse(w, err)
 		return
 	}
 
-	response.SuccessResponse(w, entryToResponse(entry))
+	response.AcceptedResponse(w, CycleResponse{
+		State: h.service.stateResponse(entry),
+		OnAt:  timer.DueAt.UTC().Format(time.RFC3339),
+	})
+}
+
+// lockState godoc
+//
+//	@Summary		Lock a state
+//	@Description	Puts a state in maintenance mode: every write to it is rejected with 423 until it is unlocked or the lock expires. The owner defaults to the caller; a lock held by another owner is not replaced, the same owner may renew it.
+//	@Tags			states
+//	@Accept			json
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			type	path		string									true	"State type"	example(switch)
+//	@Param			key		path		string									true	"State key"		example(modem)
+//	@Param			body	body		LockStateRequest						true	"Lock"
+//	@Success		200		{object}	response.JsonResponse{data=StateResponse}	"Locked state"
+//	@Header			200		{string}	ETag									"Revision of the locked state"
+//	@Failure		400		{object}	response.JsonResponse						"Missing reason or invalid expires_in"
+//	@Failure		401		{object}	response.JsonResponse						"Unauthorized"
+//	@Failure		404		{object}	response.JsonResponse						"State not found"
+//	@Failure		409		{object}	response.JsonResponse						"Concurrent writes kept conflicting"
+//	@Failure		423		{object}	response.JsonResponse						"State is locked by another owner"
+//	@Failure		500		{object}	response.JsonResponse						"Internal error"
+//	@Router			/states/{type}/{key}/lock [post]
+func (h *HmsttHandler) lockState(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+	p := mux.Vars(r)
+	tipe := p["type"]
+	key := p["key"]
+
+	l.UpdateContext(func(c zerolog.Context) zerolog.Context {
+		return c.Str("hmstt_type", tipe).Str("hmstt_key", key)
+	})
+	l.Info().Msg("Handling lockState request")
+
+	var body LockStateRequest
+	if err := request.DecodeAndValidate(r, &body); err != nil {
+		l.Error().Err(err).Msg("lockState: validation failed")
+		response.ErrorResponse(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	var expiresIn time.Duration
+	if body.ExpiresIn != "" {
+		var err error
+		if expiresIn, err = time.ParseDuration(body.ExpiresIn); err != nil {
+			response.ErrorResponse(w, http.StatusBadRequest, "expires_in must be a duration such as 2h", err)
+			return
+		}
+	}
+
+	entry, err := h.service.LockState(ctx, tipe, key, body.Reason, body.Owner, expiresIn)
+	if err != nil {
+		l.Error().Err(err).Msg("lockState failed")
+		lockErrorResponse(w, err)
+		return
+	}
+
+	setETag(w, entry)
+	response.SuccessResponse(w, h.service.stateResponse(entry))
+}
+
+// reportState godoc
+//
+//	@Summary		Report the value a device applied
+//	@Description	Records the value a device reports for a state, next to the desired value set through the API. The desired value is not changed and no event is published; in_sync tells whether the two agree. Locks and constraints do not apply to reports.
+//	@Tags			states
+//	@Accept			json
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			type	path		string									true	"State type"	example(switch)
+//	@Param			key		path		string									true	"State key"		example(modem)
+//	@Param			body	body		ReportStateRequest						true	"Reported value"
+//	@Success		200		{object}	response.JsonResponse{data=StateResponse}	"State with the reported value"
+//	@Header			200		{string}	ETag									"Revision of the state"
+//	@Failure		400		{object}	response.JsonResponse						"Value rejected by the type registry"
+//	@Failure		401		{object}	response.JsonResponse						"Unauthorized"
+//	@Failure		404		{object}	response.JsonResponse						"State not found"
+//	@Failure		409		{object}	response.JsonResponse						"Concurrent writes kept conflicting"
+//	@Router			/states/{type}/{key}/reported [post]
+func (h *HmsttHandler) reportState(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+	p := mux.Vars(r)
+	tipe := p["type"]
+	key := p["key"]
+
+	l.UpdateContext(func(c zerolog.Context) zerolog.Context {
+		return c.Str("hmstt_type", tipe).Str("hmstt_key", key)
+	})
+	l.Info().Msg("Handling reportState request")
+
+	var body ReportStateRequest
+	if err := request.DecodeAndValidate(r, &body); err != nil {
+		l.Error().Err(err).Msg("reportState: validation failed")
+		response.ErrorResponse(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	entry, err := h.service.ReportState(ctx, tipe, key, valueFromRaw(body.Value))
+	if err != nil {
+		l.Error().Err(err).Msg("reportState failed")
+		switch {
+		case errors.Is(err, ErrStateNotFound):
+			response.ErrorResponse(w, http.StatusNotFound, "state not found", err)
+		case errors.Is(err, ErrRevisionMismatch):
+			response.ErrorResponse(w, http.StatusConflict, "state kept changing, report not recorded", err)
+		default:
+			response.ErrorResponse(w, http.StatusBadRequest, err.Error(), err)
+		}
+		return
+	}
+
+	setETag(w, entry)
+	response.SuccessResponse(w, h.service.stateResponse(entry))
+}
+
+// unlockState godoc
+//
+//	@Summary		Unlock a state
+//	@Description	Removes the lock of a state, whoever holds it. Unlocking a state that is not locked changes nothing.
+//	@Tags			states
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			type	path		string									true	"State type"	example(switch)
+//	@Param			key		path		string									true	"State key"		example(modem)
+//	@Success		200		{object}	response.JsonResponse{data=StateResponse}	"Unlocked state"
+//	@Header			200		{string}	ETag									"Revision of the unlocked state"
+//	@Failure		401		{object}	response.JsonResponse						"Unauthorized"
+//	@Failure		404		{object}	response.JsonResponse						"State not found"
+//	@Failure		409		{object}	response.JsonResponse						"Concurrent writes kept conflicting"
+//	@Failure		500		{object}	response.JsonResponse						"Internal error"
+//	@Router			/states/{type}/{key}/lock [delete]
+func (h *HmsttHandler) unlockState(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+	p := mux.Vars(r)
+	tipe := p["type"]
+	key := p["key"]
+
+	l.UpdateContext(func(c zerolog.Context) zerolog.Context {
+		return c.Str("hmstt_type", tipe).Str("hmstt_key", key)
+	})
+	l.Info().Msg("Handling unlockState request")
+
+	entry, err := h.service.UnlockState(ctx, tipe, key)
+	if err != nil {
+		l.Error().Err(err).Msg("unlockState failed")
+		lockErrorResponse(w, err)
+		return
+	}
+
+	setETag(w, entry)
+	response.SuccessResponse(w, h.service.stateResponse(entry))
+}
+
+// lockErrorResponse maps lock and unlock errors to HTTP responses.
+func lockErrorResponse(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrStateNotFound):
+		response.ErrorResponse(w, http.StatusNotFound, "state not found", err)
+	case errors.Is(err, ErrInvalidLock):
+		response.ErrorResponse(w, http.StatusBadRequest, err.Error(), err)
+	case errors.Is(err, ErrStateLocked):
+		response.ErrorResponse(w, http.StatusLocked, err.Error(), err)
+	case errors.Is(err, ErrRevisionMismatch):
+		response.ErrorResponse(w, http.StatusConflict, err.Error(), err)
+	default:
+		response.ErrorResponse(w, http.StatusInternalServerError, "failed to update lock", err)
+	}
+}
+
+// deleteState godoc
+//
+//	@Summary		Delete a state entry
+//	@Description	Removes the state for a type and key and publishes a tombstone event (empty body, x-hmstt-deleted header) on its routing key.
+//	@Tags			states
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			type	path		string									true	"State type"	example(switch)
+//	@Param			key		path		string									true	"State key"		example(modem)
+//	@Success		200		{object}	response.JsonResponse{data=StateResponse}	"Deleted state"
+//	@Failure		401		{object}	response.JsonResponse						"Unauthorized"
+//	@Failure		404		{object}	response.JsonResponse						"State not found"
+//	@Failure		423		{object}	response.JsonResponse						"State is locked"
+//	@Failure		500		{object}	response.JsonResponse						"Internal error"
+//	@Router			/states/{type}/{key} [delete]
+func (h *HmsttHandler) deleteState(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+	p := mux.Vars(r)
+	tipe := p["type"]
+	key := p["key"]
+
+	l.UpdateContext(func(c zerolog.Context) zerolog.Context {
+		return c.Str("hmstt_type", tipe).Str("hmstt_key", key)
+	})
+	l.Info().Msg("Handling deleteState request")
+
+	entry, err := h.service.DeleteState(ctx, tipe, key)
+	if err != nil {
+		if errors.Is(err, ErrStateNotFound) {
+			response.ErrorResponse(w, http.StatusNotFound, "state not found", err)
+			return
+		}
+		if errors.Is(err, ErrStateLocked) {
+			response.ErrorResponse(w, http.StatusLocked, err.Error(), err)
+			return
+		}
+		l.Error().Err(err).Msg("deleteState failed")
+		response.ErrorResponse(w, http.StatusInternalServerError, "failed to delete state", err)
+		return
+	}
+
+	response.SuccessResponse(w, h.service.stateResponse(entry))
+}
+
+// deleteType godoc
+//
+//	@Summary		Delete all states of a type
+//	@Description	Removes every state of the type. The confirm query parameter must repeat the type name. A tombstone event is published for each removed key.
+//	@Tags			states
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			type	path		string										true	"State type"					example(switch)
+//	@Param			confirm	query		string										true	"Must equal the type name"	example(switch)
+//	@Success		200		{object}	response.JsonResponse{data=DeleteTypeResponse}	"Deleted keys"
+//	@Failure		400		{object}	response.JsonResponse							"Missing or wrong confirmation"
+//	@Failure		401		{object}	response.JsonResponse							"Unauthorized"
+//	@Failure		404		{object}	response.JsonResponse							"No states found for type"
+//	@Failure		423		{object}	response.JsonResponse							"Some states of the type are locked; nothing was deleted"
+//	@Failure		500		{object}	response.JsonResponse							"Internal error"
+//	@Router			/states/{type} [delete]
+func (h *HmsttHandler) deleteType(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+	tipe := mux.Vars(r)["type"]
+
+	l.UpdateContext(func(c zerolog.Context) zerolog.Context {
+		return c.Str("hmstt_type", tipe)
+	})
+	l.Info().Msg("Handling deleteType request")
+
+	keys, err := h.service.DeleteType(ctx, tipe, r.URL.Query().Get("confirm"))
+	if err != nil {
+		if errors.Is(err, ErrConfirmationRequired) {
+			response.ErrorResponse(w, http.StatusBadRequest, "confirm query parameter must equal the type name", err)
+			return
+		}
+		if errors.Is(err, ErrStateNotFound) {
+			response.ErrorResponse(w, http.StatusNotFound, "no states found for type", err)
+			return
+		}
+		if errors.Is(err, ErrStateLocked) {
+			response.ErrorResponse(w, http.StatusLocked, err.Error(), err)
+			return
+		}
+		l.Error().Err(err).Msg("deleteType failed")
+		response.ErrorResponse(w, http.StatusInternalServerError, "failed to delete states", err)
+		return
+	}
+
+	response.SuccessResponse(w, DeleteTypeResponse{Type: tipe, Deleted: keys})
+}
+
+// getStateHistory godoc
+//
+//	@Summary		Get the change history of a state
+//	@Description	Returns recorded value/description changes of a state, newest first, with the caller and request ID of each change.
+//	@Tags			states
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			type	path		string										true	"State type"						example(switch)
+//	@Param			key		path		string										true	"State key"							example(modem)
+//	@Param			from	query		string										false	"Oldest change to include (RFC3339)"	example(2026-03-16T00:00:00Z)
+//	@Param			to		query		string										false	"Newest change to include (RFC3339)"	example(2026-03-17T00:00:00Z)
+//	@Param			limit	query		int											false	"Max records (default 50, max 1000)"	example(50)
+//	@Success		200		{object}	response.JsonResponse{data=[]HistoryResponse}	"History records"
+//	@Failure		400		{object}	response.JsonResponse							"Invalid query parameter"
+//	@Failure		401		{object}	response.JsonResponse							"Unauthorized"
+//	@Failure		500		{object}	response.JsonResponse							"Internal error"
+//	@Router			/states/{type}/{key}/history [get]
+func (h *HmsttHandler) getStateHistory(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+	p := mux.Vars(r)
+	tipe := p["type"]
+	key := p["key"]
+	q := r.URL.Query()
+
+	l.UpdateContext(func(c zerolog.Context) zerolog.Context {
+		return c.Str("hmstt_type", tipe).Str("hmstt_key", key)
+	})
+	l.Info().Msg("Handling getStateHistory request")
+
+	var from, to time.Time
+	var limit int64
+	var err error
+	if v := q.Get("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			response.ErrorResponse(w, http.StatusBadRequest, "from must be an RFC3339 timestamp", err)
+			return
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			response.ErrorResponse(w, http.StatusBadRequest, "to must be an RFC3339 timestamp", err)
+			return
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.ParseInt(v, 10, 64); err != nil {
+			response.ErrorResponse(w, http.StatusBadRequest, "limit must be an integer", err)
+			return
+		}
+	}
+
+	records, err := h.service.GetHistory(ctx, tipe, key, from, to, limit)
+	if err != nil {
+		l.Error().Err(err).Msg("getStateHistory failed")
+		response.ErrorResponse(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	data := make([]HistoryResponse, 0, len(records))
+	for _, rec := range records {
+		data = append(data, historyToResponse(rec))
+	}
+	response.SuccessResponse(w, data)
+}
+
+// listCommands godoc
+//
+//	@Summary		List unacknowledged commands
+//	@Description	Returns published values their devices have not reported back yet, oldest first: pending ones are republished with backoff, failed ones ran out of retries. Empty unless command tracking is enabled.
+//	@Tags			commands
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			status	query		string										false	"pending or failed"
+//	@Success		200		{object}	response.JsonResponse{data=[]CommandResponse}	"Commands"
+//	@Failure		400		{object}	response.JsonResponse							"Invalid status"
+//	@Failure		401		{object}	response.JsonResponse							"Unauthorized"
+//	@Failure		500		{object}	response.JsonResponse							"Internal error"
+//	@Router			/commands [get]
+func (h *HmsttHandler) listCommands(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+	l.Info().Msg("Handling listCommands request")
+
+	commands, err := h.service.ListCommands(ctx, r.URL.Query().Get("status"))
+	if err != nil {
+		if errors.Is(err, ErrInvalidListQuery) {
+			response.ErrorResponse(w, http.StatusBadRequest, err.Error(), err)
+			return
+		}
+		l.Error().Err(err).Msg("listCommands failed")
+		response.ErrorResponse(w, http.StatusInternalServerError, "failed to list commands", err)
+		return
+	}
+
+	data := make([]CommandResponse, 0, len(commands))
+	for _, c := range commands {
+		data = append(data, commandToResponse(c))
+	}
+	response.SuccessResponse(w, data)
+}
+
+// listTimers godoc
+//
+//	@Summary		List pending timers
+//	@Description	Returns pending timed writes (reverts from revert_after and power cycles), soonest first
+//	@Tags			timers
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Success		200	{object}	response.JsonResponse{data=[]TimerResponse}	"Pending timers"
+//	@Failure		401	{object}	response.JsonResponse						"Unauthorized"
+//	@Failure		500	{object}	response.JsonResponse						"Internal error"
+//	@Router			/timers [get]
+func (h *HmsttHandler) listTimers(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+	l.Info().Msg("Handling listTimers request")
+
+	timers, err := h.service.ListTimers(ctx)
+	if err != nil {
+		l.Error().Err(err).Msg("listTimers failed")
+		response.ErrorResponse(w, http.StatusInternalServerError, "failed to list timers", err)
+		return
+	}
+
+	data := make([]TimerResponse, 0, len(timers))
+	for _, t := range timers {
+		data = append(data, timerToResponse(t))
+	}
+	response.SuccessResponse(w, data)
+}
+
+// cancelTimer godoc
+//
+//	@Summary		Cancel a pending timer
+//	@Description	Removes the pending timer of a state. The state keeps its current value.
+//	@Tags			timers
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			type	path		string									true	"State type"	example(switch)
+//	@Param			key		path		string									true	"State key"		example(heater)
+//	@Success		200		{object}	response.JsonResponse{data=TimerResponse}	"Cancelled timer"
+//	@Failure		401		{object}	response.JsonResponse						"Unauthorized"
+//	@Failure		404		{object}	response.JsonResponse						"No pending timer for this state"
+//	@Failure		500		{object}	response.JsonResponse						"Internal error"
+//	@Router			/timers/{type}/{key} [delete]
+func (h *HmsttHandler) cancelTimer(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+	p := mux.Vars(r)
+	tipe := p["type"]
+	key := p["key"]
+
+	l.UpdateContext(func(c zerolog.Context) zerolog.Context {
+		return c.Str("hmstt_type", tipe).Str("hmstt_key", key)
+	})
+	l.Info().Msg("Handling cancelTimer request")
+
+	timer, err := h.service.CancelTimer(ctx, tipe, key)
+	if err != nil {
+		if errors.Is(err, ErrTimerNotFound) {
+			response.ErrorResponse(w, http.StatusNotFound, "no pending timer for this state", err)
+			return
+		}
+		l.Error().Err(err).Msg("cancelTimer failed")
+		response.ErrorResponse(w, http.StatusInternalServerError, "failed to cancel timer", err)
+		return
+	}
+
+	response.SuccessResponse(w, timerToResponse(timer))
+}
+
+// listGroups godoc
+//
+//	@Summary		List groups
+//	@Description	Returns every group that has at least one state, with its member count
+//	@Tags			groups
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Success		200	{object}	response.JsonResponse{data=[]GroupResponse}	"List of groups"
+//	@Failure		401	{object}	response.JsonResponse						"Unauthorized"
+//	@Failure		500	{object}	response.JsonResponse						"Internal error"
+//	@Router			/groups [get]
+func (h *HmsttHandler) listGroups(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+	l.Info().Msg("Handling listGroups request")
+
+	groups, err := h.service.ListGroups(ctx)
+	if err != nil {
+		response.ErrorResponse(w, http.StatusInternalServerError, "failed to list groups", err)
+		return
+	}
+
+	data := make([]GroupResponse, 0, len(groups))
+	for _, g := range groups {
+		data = append(data, GroupResponse(g))
+	}
+	response.SuccessResponse(w, data)
+}
+
+// getGroupStates godoc
+//
+//	@Summary		List the states in a group
+//	@Tags			groups
+//	@Produce		json,plain,application/cbor,application/msgpack
+//	@Security		BearerAuth
+//	@Param			group	path		string										true	"Group name"	example(rack)
+//	@Param			fields	query		string									false	"Comma-separated members to keep of each state; text/plain defaults to key,value"	example(key,value)
+//	@Success		200		{object}	response.JsonResponse{data=[]StateResponse}	"States in the group"
+//	@Failure		400		{object}	response.JsonResponse						"Invalid fields"
+//	@Failure		401		{object}	response.JsonResponse						"Unauthorized"
+//	@Failure		404		{object}	response.JsonResponse						"No state belongs to the group"
+//	@Failure		406		{object}	response.JsonResponse						"Accept allows none of the supported types"
+//	@Failure		500		{object}	response.JsonResponse						"Internal error"
+//	@Router			/groups/{group}/states [get]
+func (h *HmsttHandler) getGroupStates(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+	group := mux.Vars(r)["group"]
+	l.Info().Str("hmstt_group", group).Msg("Handling getGroupStates request")
+
+	rep, ok := negotiate(w, r)
+	if !ok {
+		return
+	}
+
+	entries, err := h.service.GetGroupStates(ctx, group)
+	if err != nil {
+		if errors.Is(err, ErrGroupNotFound) {
+			response.ErrorResponse(w, http.StatusNotFound, "group not found", err)
+			return
+		}
+		response.ErrorResponse(w, http.StatusInternalServerError, "failed to get group states", err)
+		return
+	}
+
+	data := make([]StateResponse, 0, len(entries))
+	for _, e := range entries {
+		data = append(data, h.service.stateResponse(e))
+	}
+	rep.SuccessResponse(w, data)
+}
+
+// setGroupValue godoc
+//
+//	@Summary		Set every state in a group
+//	@Description	Sets the value on every unlocked member whose type accepts it, in one atomic batch write. Other members are reported as incompatible or locked and left unchanged. Fires one MQTT event per changed value.
+//	@Tags			groups
+//	@Accept			json
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			group	path		string												true	"Group name"	example(rack)
+//	@Param			body	body		SetGroupValueRequest								true	"Value"
+//	@Success		200		{object}	response.JsonResponse{data=[]BatchSetResultResponse}	"Per-member results"
+//	@Failure		400		{object}	response.JsonResponse{data=[]BatchSetResultResponse}	"No member accepts the value, or too many members"
+//	@Failure		401		{object}	response.JsonResponse									"Unauthorized"
+//	@Failure		404		{object}	response.JsonResponse									"No state belongs to the group"
+//	@Failure		409		{object}	response.JsonResponse{data=ConstraintViolationResponse}					"Concurrent writes kept conflicting, or a constraint would be violated; nothing was written"
+//	@Failure		423		{object}	response.JsonResponse{data=[]BatchSetResultResponse}	"Every member that accepts the value is locked"
+//	@Failure		500		{object}	response.JsonResponse									"Internal error"
+//	@Router			/groups/{group}/value [put]
+func (h *HmsttHandler) setGroupValue(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+	group := mux.Vars(r)["group"]
+	l.Info().Str("hmstt_group", group).Msg("Handling setGroupValue request")
+
+	var body SetGroupValueRequest
+	if err := request.DecodeAndValidate(r, &body); err != nil {
+		l.Error().Err(err).Msg("setGroupValue: validation failed")
+		response.ErrorResponse(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	results, err := h.service.SetGroupValue(ctx, group, valueFromRaw(body.Value))
+	data := make([]BatchSetResultResponse, 0, len(results))
+	for _, res := range results {
+		data = append(data, BatchResultToResponse(res))
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrGroupNotFound):
+			response.ErrorResponse(w, http.StatusNotFound, "group not found", err)
+		case errors.Is(err, ErrNoCompatibleMembers), errors.Is(err, ErrBatchInvalid):
+			response.ErrorDataResponse(w, http.StatusBadRequest, err.Error(), err, data)
+		case errors.Is(err, ErrBatchTooLarge):
+			response.ErrorResponse(w, http.StatusBadRequest, err.Error(), err)
+		case errors.Is(err, ErrRevisionMismatch):
+			response.ErrorResponse(w, http.StatusConflict, "states kept changing during the write, nothing was written", err)
+		case errors.Is(err, ErrConstraintViolation):
+			RespondConstraintViolation(w, err)
+		case errors.Is(err, ErrStateLocked):
+			response.ErrorDataResponse(w, http.StatusLocked, "group states are locked, nothing was written", err, data)
+		default:
+			l.Error().Err(err).Msg("setGroupValue failed")
+			response.ErrorResponse(w, http.StatusInternalServerError, "failed to set group value", err)
+		}
+		return
+	}
+
+	response.SuccessResponse(w, data)
 }
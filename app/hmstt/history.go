@@ -0,0 +1,181 @@
+package hmstt
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nurhudajoantama/hmauto/internal/middleware"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/hlog"
+	"go.opentelemetry.io/otel"
+)
+
+const (
+	HISTORY_OP_CREATE = "create"
+	HISTORY_OP_SET    = "set"
+	HISTORY_OP_PATCH  = "patch"
+	HISTORY_OP_DELETE = "delete"
+	HISTORY_OP_TOGGLE = "toggle"
+	HISTORY_OP_CYCLE  = "cycle"
+	HISTORY_OP_LOCK   = "lock"
+	HISTORY_OP_UNLOCK = "unlock"
+
+	CALLER_UNKNOWN = "unknown"
+)
+
+// HistoryRecord is one change of a state entry.
+type HistoryRecord struct {
+	ID             string
+	Time           time.Time
+	Op             string
+	OldValue       string
+	NewValue       string
+	OldDescription string
+	NewDescription string
+	RequestID      string
+	Caller         string
+}
+
+// HistoryQuery bounds a history lookup. Zero From/To leave that side open.
+type HistoryQuery struct {
+	From  time.Time
+	To    time.Time
+	Limit int64
+}
+
+type callerKey struct{}
+
+// WithCaller tags ctx with who is making a change; it is recorded in state history.
+func WithCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+// CallerFromContext returns the caller set by WithCaller.
+func CallerFromContext(ctx context.Context) string {
+	if c, ok := ctx.Value(callerKey{}).(string); ok && c != "" {
+		return c
+	}
+	return CALLER_UNKNOWN
+}
+
+// callerMiddleware tags HTTP requests with an "http:<client ip>" caller.
+// X-Forwarded-For is only believed from trusted proxies.
+func callerMiddleware(trusted middleware.TrustedProxies) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := trusted.ClientIP(r)
+			next.ServeHTTP(w, r.WithContext(WithCaller(r.Context(), "http:"+ip)))
+		})
+	}
+}
+
+// RequestIDFromContext returns the ID of the request that started the
+// change, or "" outside a request.
+func RequestIDFromContext(ctx context.Context) string {
+	if id, ok := hlog.IDFromCtx(ctx); ok {
+		return id.String()
+	}
+	return ""
+}
+
+// WithRequestID restores a request ID saved with RequestIDFromContext, so
+// work deferred past the request is still recorded under it. Invalid IDs
+// are ignored.
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	id, err := xid.FromString(requestID)
+	if err != nil {
+		return ctx
+	}
+	return hlog.CtxWithID(ctx, id)
+}
+
+func (s *HmsttStore) historyKey(tipe, k string) string {
+	return s.prefix + ":hmstt_history:" + tipe + ":" + k
+}
+
+// AppendHistory adds rec to the per-key stream and trims it to the configured retention.
+func (s *HmsttStore) AppendHistory(ctx context.Context, tipe, k string, rec HistoryRecord) error {
+	ctx, span := otel.Tracer("hmstt").Start(ctx, "store.AppendHistory")
+	defer span.End()
+
+	key := s.historyKey(tipe, k)
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: key,
+			MaxLen: s.historyMaxLen,
+			Approx: true,
+			Values: map[string]any{
+				"op":              rec.Op,
+				"old_value":       rec.OldValue,
+				"new_value":       rec.NewValue,
+				"old_description": rec.OldDescription,
+				"new_description": rec.NewDescription,
+				"request_id":      rec.RequestID,
+				"caller":          rec.Caller,
+			},
+		})
+		if s.historyMaxAge > 0 {
+			minID := strconv.FormatInt(time.Now().Add(-s.historyMaxAge).UnixMilli(), 10)
+			pipe.XTrimMinIDApprox(ctx, key, minID, 0)
+			pipe.Expire(ctx, key, s.historyMaxAge)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("redis XADD: %w", err)
+	}
+	return nil
+}
+
+// GetHistory returns the changes of a key, newest first.
+func (s *HmsttStore) GetHistory(ctx context.Context, tipe, k string, q HistoryQuery) ([]HistoryRecord, error) {
+	ctx, span := otel.Tracer("hmstt").Start(ctx, "store.GetHistory")
+	defer span.End()
+
+	start, end := "-", "+"
+	if !q.From.IsZero() {
+		start = strconv.FormatInt(q.From.UnixMilli(), 10)
+	}
+	if !q.To.IsZero() {
+		end = strconv.FormatInt(q.To.UnixMilli(), 10)
+	}
+
+	msgs, err := s.rdb.XRevRangeN(ctx, s.historyKey(tipe, k), end, start, q.Limit).Result()
+	if err != nil {
+		return nil, fmt.Errorf("redis XREVRANGE: %w", err)
+	}
+
+	records := make([]HistoryRecord, 0, len(msgs))
+	for _, m := range msgs {
+		records = append(records, historyFromMessage(m))
+	}
+	return records, nil
+}
+
+func historyFromMessage(m redis.XMessage) HistoryRecord {
+	field := func(name string) string {
+		v, _ := m.Values[name].(string)
+		return v
+	}
+	rec := HistoryRecord{
+		ID:             m.ID,
+		Op:             field("op"),
+		OldValue:       field("old_value"),
+		NewValue:       field("new_value"),
+		OldDescription: field("old_description"),
+		NewDescription: field("new_description"),
+		RequestID:      field("request_id"),
+		Caller:         field("caller"),
+	}
+	if ms, _, ok := strings.Cut(m.ID, "-"); ok {
+		if n, err := strconv.ParseInt(ms, 10, 64); err == nil {
+			rec.Time = time.UnixMilli(n).UTC()
+		}
+	}
+	return rec
+}
@@ -0,0 +1,143 @@
+package hmstt
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nurhudajoantama/hmauto/app/server"
+	"github.com/nurhudajoantama/hmauto/internal/middleware"
+)
+
+func TestCallerMiddleware(t *testing.T) {
+	trusted, _ := middleware.ParseTrustedProxies([]string{"10.0.0.1"})
+	var caller string
+	h := callerMiddleware(trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caller = CallerFromContext(r.Context())
+	}))
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		want       string
+	}{
+		{"client cannot name itself", "192.168.1.20:40000", "http:192.168.1.20"},
+		{"trusted proxy forwards the client", "10.0.0.1:40000", "http:192.168.1.30"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/states", nil)
+			r.RemoteAddr = tt.remoteAddr
+			r.Header.Set("X-Forwarded-For", "192.168.1.30")
+			h.ServeHTTP(httptest.NewRecorder(), r)
+			if caller != tt.want {
+				t.Fatalf("caller = %q, want %q", caller, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordHistory(t *testing.T) {
+	ctx := WithCaller(context.Background(), "test")
+	store := newSwitchStore()
+	svc := NewService(store, nil, nil)
+
+	// Writing the same value and description is not a change.
+	desc := "Modem"
+	if _, err := svc.SetState(ctx, "switch", "modem", "on", &desc, nil, nil); err != nil {
+		t.Fatalf("SetState(no-op) error = %v", err)
+	}
+	if n := len(store.records["switch/modem"]); n != 0 {
+		t.Fatalf("history after a no-op write = %d records, want none", n)
+	}
+
+	if _, err := svc.SetState(ctx, "switch", "modem", "off", nil, nil, nil); err != nil {
+		t.Fatalf("SetState() error = %v", err)
+	}
+	if _, err := svc.CreateState(ctx, "switch", "fan", "on", "Fan", nil, nil); err != nil {
+		t.Fatalf("CreateState() error = %v", err)
+	}
+	if _, err := svc.DeleteState(ctx, "switch", "fan"); err != nil {
+		t.Fatalf("DeleteState() error = %v", err)
+	}
+
+	want := map[string][]HistoryRecord{
+		"switch/modem": {{Op: HISTORY_OP_SET, OldValue: "on", NewValue: "off", OldDescription: "Modem", NewDescription: "Modem", Caller: "test"}},
+		"switch/fan": {
+			{Op: HISTORY_OP_CREATE, NewValue: "on", NewDescription: "Fan", Caller: "test"},
+			{Op: HISTORY_OP_DELETE, OldValue: "on", OldDescription: "Fan", Caller: "test"},
+		},
+	}
+	for id, recs := range want {
+		got := store.records[id]
+		if len(got) != len(recs) {
+			t.Fatalf("history of %s = %+v, want %+v", id, got, recs)
+		}
+		for i := range recs {
+			if got[i] != recs[i] {
+				t.Fatalf("history of %s [%d] = %+v, want %+v", id, i, got[i], recs[i])
+			}
+		}
+	}
+}
+
+func TestGetHistory(t *testing.T) {
+	ctx := context.Background()
+	store := newSwitchStore()
+	svc := NewService(store, nil, nil)
+
+	for _, tt := range []struct{ limit, want int64 }{{0, 50}, {-1, 50}, {20, 20}, {5000, 1000}} {
+		if _, err := svc.GetHistory(ctx, "switch", "modem", time.Time{}, time.Time{}, tt.limit); err != nil {
+			t.Fatalf("GetHistory(limit %d) error = %v", tt.limit, err)
+		}
+		if store.historyQuery.Limit != tt.want {
+			t.Fatalf("GetHistory(limit %d) queried %d, want %d", tt.limit, store.historyQuery.Limit, tt.want)
+		}
+	}
+
+	from := time.Date(2026, 3, 16, 12, 0, 0, 0, time.UTC)
+	if _, err := svc.GetHistory(ctx, "switch", "modem", from, from.Add(-time.Second), 0); err == nil {
+		t.Fatalf("GetHistory(from after to) error = nil, want error")
+	}
+	if _, err := svc.GetHistory(ctx, "switch", "modem", from, from, 0); err != nil {
+		t.Fatalf("GetHistory(from equal to) error = %v", err)
+	}
+}
+
+func TestHistoryHandler(t *testing.T) {
+	store := newSwitchStore()
+	svc := NewService(store, nil, nil)
+	srv := server.NewWithConfig(":0", &server.ServerConfig{BearerToken: "test-token", MaxRequestSize: 1 << 20})
+	RegisterHandlers(srv, svc)
+	if _, err := svc.SetState(context.Background(), "switch", "modem", "off", nil, nil, nil); err != nil {
+		t.Fatalf("SetState() error = %v", err)
+	}
+
+	get := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/v1/states/switch/modem/history"+query, nil)
+		req.Header.Set("Authorization", "Bearer test-token")
+		rr := httptest.NewRecorder()
+		srv.GetRouter().ServeHTTP(rr, req)
+		return rr
+	}
+
+	for _, query := range []string{
+		"?from=yesterday",
+		"?to=2026-03-16",
+		"?limit=ten",
+		"?from=2026-03-16T12:00:00Z&to=2026-03-16T11:00:00Z",
+	} {
+		if rr := get(query); rr.Code != http.StatusBadRequest {
+			t.Fatalf("GET history%s status = %d, want %d", query, rr.Code, http.StatusBadRequest)
+		}
+	}
+	rr := get("?from=2026-03-16T11:00:00Z&limit=10")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("GET history status = %d, want %d: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+	if store.historyQuery.Limit != 10 || !store.historyQuery.From.Equal(time.Date(2026, 3, 16, 11, 0, 0, 0, time.UTC)) {
+		t.Fatalf("history query = %+v, want from 11:00 and limit 10", store.historyQuery)
+	}
+}
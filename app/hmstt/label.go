@@ -0,0 +1,161 @@
+package hmstt
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"strings"
+)
+
+var ErrInvalidLabel = errors.New("INVALID LABEL")
+var ErrInvalidSelector = errors.New("INVALID LABEL SELECTOR")
+
+const (
+	// MaxLabelsPerState bounds how many labels one state may carry.
+	MaxLabelsPerState = 32
+	// MaxNameLength bounds the display name of a state.
+	MaxNameLength = 128
+)
+
+var labelKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// Label values may hold anything but the separators of a selector.
+var labelValuePattern = regexp.MustCompile(`^[^,=!]{1,128}$`)
+
+// StateMeta is the display metadata of a state: a human-readable name and
+// free-form labels such as room=office or critical=true. In updates a nil
+// Name or Labels keeps the stored one; an empty Labels map removes them all.
+type StateMeta struct {
+	Name   *string
+	Labels map[string]string
+}
+
+// newMeta returns the metadata update for an optional name and labels, or nil
+// if neither is given.
+func newMeta(name *string, labels map[string]string) *StateMeta {
+	if name == nil && labels == nil {
+		return nil
+	}
+	return &StateMeta{Name: name, Labels: labels}
+}
+
+// empty reports whether meta changes nothing.
+func (m *StateMeta) empty() bool {
+	return m == nil || (m.Name == nil && m.Labels == nil)
+}
+
+// validate checks the name length and every label.
+func (m *StateMeta) validate() error {
+	if m == nil {
+		return nil
+	}
+	if m.Name != nil && len(*m.Name) > MaxNameLength {
+		return fmt.Errorf("%w: name must be at most %d characters", ErrInvalidLabel, MaxNameLength)
+	}
+	if len(m.Labels) > MaxLabelsPerState {
+		return fmt.Errorf("%w: %d labels, at most %d allowed", ErrInvalidLabel, len(m.Labels), MaxLabelsPerState)
+	}
+	for k, v := range m.Labels {
+		if !labelKeyPattern.MatchString(k) {
+			return fmt.Errorf("%w: key %q must be 1-64 letters, digits, '_', '.' or '-'", ErrInvalidLabel, k)
+		}
+		if !labelValuePattern.MatchString(v) {
+			return fmt.Errorf("%w: value of %q must be 1-128 characters without ',', '=' or '!'", ErrInvalidLabel, k)
+		}
+	}
+	return nil
+}
+
+// apply copies the fields set in meta onto e.
+func (m *StateMeta) apply(e *StateEntry) {
+	if m == nil {
+		return
+	}
+	if m.Name != nil {
+		e.Name = *m.Name
+	}
+	if m.Labels != nil {
+		e.Labels = nil
+		if len(m.Labels) > 0 {
+			e.Labels = maps.Clone(m.Labels)
+		}
+	}
+}
+
+type labelRequirement struct {
+	key   string
+	value string
+	// exists matches on the key alone; otherwise negate selects != over =.
+	exists bool
+	negate bool
+}
+
+func (r labelRequirement) matches(labels map[string]string) bool {
+	v, ok := labels[r.key]
+	switch {
+	case r.exists:
+		return ok
+	case r.negate:
+		return !ok || v != r.value
+	default:
+		return ok && v == r.value
+	}
+}
+
+// LabelSelector selects states by their labels. It is parsed from a
+// comma-separated list of requirements that must all hold: key=value,
+// key!=value, or a bare key for states that have the label at all. The zero
+// selector matches every state.
+type LabelSelector []labelRequirement
+
+// ParseLabelSelector parses a selector such as "room=office,critical=true".
+func ParseLabelSelector(s string) (LabelSelector, error) {
+	var sel LabelSelector
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		var req labelRequirement
+		if k, v, ok := strings.Cut(term, "!="); ok {
+			req = labelRequirement{key: k, value: v, negate: true}
+		} else if k, v, ok := strings.Cut(term, "="); ok {
+			req = labelRequirement{key: k, value: v}
+		} else {
+			req = labelRequirement{key: term, exists: true}
+		}
+		if !labelKeyPattern.MatchString(req.key) {
+			return nil, fmt.Errorf("%w: bad key in %q", ErrInvalidSelector, term)
+		}
+		if !req.exists && !labelValuePattern.MatchString(req.value) {
+			return nil, fmt.Errorf("%w: bad value in %q", ErrInvalidSelector, term)
+		}
+		sel = append(sel, req)
+	}
+	return sel, nil
+}
+
+// Matches reports whether labels satisfy every requirement.
+func (sel LabelSelector) Matches(labels map[string]string) bool {
+	for _, r := range sel {
+		if !r.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// Filter returns the entries whose labels match, in order.
+func (sel LabelSelector) Filter(entries []StateEntry) []StateEntry {
+	if len(sel) == 0 {
+		return entries
+	}
+	out := make([]StateEntry, 0, len(entries))
+	for _, e := range entries {
+		if sel.Matches(e.Labels) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
@@ -0,0 +1,150 @@
+package hmstt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nurhudajoantama/hmauto/app/server"
+)
+
+func TestParseLabelSelector(t *testing.T) {
+	labels := map[string]string{"room": "office", "critical": "true"}
+	tests := []struct {
+		selector string
+		want     bool
+	}{
+		{"", true},
+		{"room=office", true},
+		{"room=office,critical=true", true},
+		{"room=office, critical=false", false},
+		{"room!=kitchen", true},
+		{"room!=office", false},
+		{"vendor!=tplink", true},
+		{"critical", true},
+		{"vendor", false},
+	}
+	for _, tt := range tests {
+		sel, err := ParseLabelSelector(tt.selector)
+		if err != nil {
+			t.Fatalf("ParseLabelSelector(%q) error = %v", tt.selector, err)
+		}
+		if got := sel.Matches(labels); got != tt.want {
+			t.Fatalf("ParseLabelSelector(%q).Matches() = %v, want %v", tt.selector, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"=office", "room=", "room office", "room==office"} {
+		if _, err := ParseLabelSelector(bad); !errors.Is(err, ErrInvalidSelector) {
+			t.Fatalf("ParseLabelSelector(%q) error = %v, want %v", bad, err, ErrInvalidSelector)
+		}
+	}
+}
+
+func TestStateMeta(t *testing.T) {
+	ctx := context.Background()
+	store := &fakeStateStore{}
+	svc := NewService(store, nil, nil)
+
+	name := "Modem"
+	if _, err := svc.CreateState(ctx, "switch", "modem", "on", "", nil, &StateMeta{Labels: map[string]string{"room": "a,b"}}); !errors.Is(err, ErrInvalidLabel) {
+		t.Fatalf("CreateState(bad label) error = %v, want %v", err, ErrInvalidLabel)
+	}
+	entry, err := svc.CreateState(ctx, "switch", "modem", "on", "", nil, &StateMeta{Name: &name, Labels: map[string]string{"room": "office", "critical": "true"}})
+	if err != nil {
+		t.Fatalf("CreateState() error = %v", err)
+	}
+	if entry.Name != "Modem" || entry.Labels["room"] != "office" {
+		t.Fatalf("CreateState() = %+v, want name and labels", entry)
+	}
+
+	// Writes that do not mention the metadata keep it.
+	if _, err := svc.SetState(ctx, "switch", "modem", "off", nil, nil, nil); err != nil {
+		t.Fatalf("SetState() error = %v", err)
+	}
+	if _, err := svc.ToggleState(ctx, "switch", "modem"); err != nil {
+		t.Fatalf("ToggleState() error = %v", err)
+	}
+	if _, err := svc.BatchSetStates(ctx, []BatchSetItem{{Type: "switch", Key: "modem", Value: "off"}}); err != nil {
+		t.Fatalf("BatchSetStates() error = %v", err)
+	}
+	if got, _ := store.GetState(ctx, "switch", "modem"); got.Name != "Modem" || len(got.Labels) != 2 {
+		t.Fatalf("after writes = %+v, want name and labels kept", got)
+	}
+
+	entry, err = svc.SetState(ctx, "switch", "modem", "on", nil, &StateMeta{Labels: map[string]string{"room": "rack"}}, nil)
+	if err != nil {
+		t.Fatalf("SetState(labels) error = %v", err)
+	}
+	if entry.Name != "Modem" || len(entry.Labels) != 1 || entry.Labels["room"] != "rack" {
+		t.Fatalf("SetState(labels) = %+v, want labels replaced and name kept", entry)
+	}
+
+	entry, err = svc.PatchState(ctx, "switch", "modem", nil, nil, nil, &StateMeta{Labels: map[string]string{}}, nil)
+	if err != nil {
+		t.Fatalf("PatchState(no labels) error = %v", err)
+	}
+	if entry.Labels != nil || entry.Value != "on" {
+		t.Fatalf("PatchState(no labels) = %+v, want labels removed and value kept", entry)
+	}
+}
+
+func TestListStatesLabelSelector(t *testing.T) {
+	store := &fakeStateStore{states: map[string][]StateEntry{
+		"switch": {
+			{Type: "switch", K: "nas", Value: "on", Labels: map[string]string{"room": "office", "critical": "true"}},
+			{Type: "switch", K: "lamp", Value: "on", Labels: map[string]string{"room": "office"}},
+			{Type: "switch", K: "fan", Value: "off"},
+		},
+	}}
+	svc := NewService(store, nil, nil)
+	srv := server.NewWithConfig(":0", &server.ServerConfig{BearerToken: "test-token"})
+	RegisterHandlers(srv, svc)
+
+	list := func(url string) (int, []string) {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("Authorization", "Bearer test-token")
+		rr := httptest.NewRecorder()
+		srv.GetRouter().ServeHTTP(rr, req)
+		var resp struct {
+			Data []StateResponse `json:"data"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		keys := make([]string, 0, len(resp.Data))
+		for _, s := range resp.Data {
+			keys = append(keys, s.Key)
+		}
+		return rr.Code, keys
+	}
+
+	if code, keys := list("/v1/states?label=room=office,critical=true"); code != http.StatusOK || len(keys) != 1 || keys[0] != "nas" {
+		t.Fatalf("GET /v1/states?label=room=office,critical=true = %d %v, want 200 [nas]", code, keys)
+	}
+	if code, keys := list("/v1/states/switch?label=room=office"); code != http.StatusOK || len(keys) != 2 {
+		t.Fatalf("GET /v1/states/switch?label=room=office = %d %v, want 200 with 2 states", code, keys)
+	}
+	if code, keys := list("/v1/states/switch?label=room=kitchen"); code != http.StatusOK || len(keys) != 0 {
+		t.Fatalf("GET /v1/states/switch?label=room=kitchen = %d %v, want 200 []", code, keys)
+	}
+	if code, _ := list("/v1/states?label=room=a=b"); code != http.StatusBadRequest {
+		t.Fatalf("GET with bad selector status = %d, want %d", code, http.StatusBadRequest)
+	}
+}
+
+func TestEntryEncodingKeepsLabels(t *testing.T) {
+	want := StateEntry{Type: "switch", K: "nas", Value: "on", Name: "NAS", Labels: map[string]string{"room": "office"}}
+	data, err := encodeEntry(want)
+	if err != nil {
+		t.Fatalf("encodeEntry() error = %v", err)
+	}
+	got, err := decodeEntry("switch", "nas", data)
+	if err != nil {
+		t.Fatalf("decodeEntry() error = %v", err)
+	}
+	if got.Name != want.Name || len(got.Labels) != 1 || got.Labels["room"] != "office" {
+		t.Fatalf("round trip = %+v, want name and labels", got)
+	}
+}
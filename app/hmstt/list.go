@@ -0,0 +1,304 @@
+package hmstt
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+)
+
+var ErrInvalidListQuery = errors.New("INVALID LIST QUERY")
+var ErrInvalidCursor = errors.New("INVALID CURSOR")
+
+const (
+	SORT_KEY        = "key"
+	SORT_UPDATED_AT = "updated_at"
+
+	// DefaultListLimit is the page size when a listing sets none.
+	DefaultListLimit = 100
+	// MaxListLimit bounds the page size of a listing.
+	MaxListLimit = 1000
+)
+
+// ListQuery selects, orders and pages states. All filters must hold. Without
+// Sort states come in Redis scan order.
+type ListQuery struct {
+	// Type limits the listing to one type; empty lists every type.
+	Type string
+	// Value matches the value exactly.
+	Value string
+	// Prefix and Search match the key by prefix and by substring.
+	Prefix string
+	Search string
+	Labels LabelSelector
+	// OutOfSync keeps only states whose device reported another value.
+	OutOfSync bool
+	// Sort is SORT_KEY or SORT_UPDATED_AT; Desc reverses it.
+	Sort   string
+	Desc   bool
+	Limit  int
+	Cursor string
+}
+
+// filtered reports whether the query selects less than the whole type.
+func (q ListQuery) filtered() bool {
+	return q.Value != "" || q.Prefix != "" || q.Search != "" || len(q.Labels) > 0 || q.OutOfSync
+}
+
+func (q ListQuery) matches(e StateEntry) bool {
+	return (q.Value == "" || e.Value == q.Value) &&
+		strings.HasPrefix(e.K, q.Prefix) &&
+		strings.Contains(e.K, q.Search) &&
+		q.Labels.Matches(e.Labels) &&
+		(!q.OutOfSync || e.OutOfSync())
+}
+
+// match is the HSCAN pattern for the key filters; the rest is checked on the
+// decoded entries.
+func (q ListQuery) match() string {
+	switch {
+	case q.Prefix != "":
+		return globEscape(q.Prefix) + "*"
+	case q.Search != "":
+		return "*" + globEscape(q.Search) + "*"
+	default:
+		return "*"
+	}
+}
+
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// StatePage is one page of a listing. NextCursor is empty on the last page.
+type StatePage struct {
+	Entries    []StateEntry
+	NextCursor string
+}
+
+// listCursor is where the next page starts. Unsorted listings resume inside
+// an HSCAN batch of Type: the batch is fetched again with the same scan
+// cursor and COUNT and its first Offset entries are skipped. Sorted listings
+// resume after the entry Type/Key (and UpdatedAt) in sort order.
+type listCursor struct {
+	Sort      string    `json:"s,omitempty"`
+	Type      string    `json:"t"`
+	Scan      uint64    `json:"c,omitempty"`
+	Count     int64     `json:"n,omitempty"`
+	Offset    int       `json:"o,omitempty"`
+	Key       string    `json:"k,omitempty"`
+	UpdatedAt time.Time `json:"u,omitzero"`
+}
+
+func (c listCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeListCursor(s string) (listCursor, error) {
+	var c listCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	if err := json.Unmarshal(b, &c); err != nil || c.Type == "" {
+		return c, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// ScanStates returns one HSCAN batch of the states of tipe whose keys match
+// the glob pattern, and the cursor of the next batch; 0 when the scan is done.
+// count is a hint: small hashes come back whole.
+func (s *HmsttStore) ScanStates(ctx context.Context, tipe string, cursor uint64, match string, count int64) ([]StateEntry, uint64, error) {
+	ctx, span := otel.Tracer("hmstt").Start(ctx, "store.ScanStates")
+	defer span.End()
+
+	kv, next, err := s.rdb.HScan(ctx, s.redisKey(tipe), cursor, match, count).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, 0, fmt.Errorf("redis HSCAN: %w", err)
+	}
+	entries := make([]StateEntry, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		entry, err := decodeEntry(tipe, kv[i], []byte(kv[i+1]))
+		if err != nil {
+			return nil, 0, fmt.Errorf("unmarshal state entry for key %s: %w", kv[i], err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := s.attachReported(ctx, tipe, entries); err != nil {
+		return nil, 0, err
+	}
+	return entries, next, nil
+}
+
+// ListStates returns one page of the states matching q. Unsorted pages are
+// read batch by batch with HSCAN, so a page costs about its own size however
+// many states there are. Like SCAN, paging is weakly consistent: states
+// added or removed meanwhile may be missed or repeated. A sorted listing has
+// to see every match to order them, so each of its pages scans the whole
+// type (or all types) and keeps the matches in memory.
+func (s *HmsttService) ListStates(ctx context.Context, q ListQuery) (StatePage, error) {
+	l := zerolog.Ctx(ctx)
+
+	if q.Limit == 0 {
+		q.Limit = DefaultListLimit
+	}
+	if q.Limit < 0 || q.Limit > MaxListLimit {
+		return StatePage{}, fmt.Errorf("%w: limit must be between 1 and %d", ErrInvalidListQuery, MaxListLimit)
+	}
+	if q.Sort != "" && q.Sort != SORT_KEY && q.Sort != SORT_UPDATED_AT {
+		return StatePage{}, fmt.Errorf("%w: sort must be %q or %q", ErrInvalidListQuery, SORT_KEY, SORT_UPDATED_AT)
+	}
+	if q.Desc && q.Sort == "" {
+		return StatePage{}, fmt.Errorf("%w: descending order needs a sort", ErrInvalidListQuery)
+	}
+	var cur listCursor
+	if q.Cursor != "" {
+		var err error
+		if cur, err = decodeListCursor(q.Cursor); err != nil {
+			return StatePage{}, err
+		}
+		if cur.Sort != q.Sort {
+			return StatePage{}, fmt.Errorf("%w: cursor belongs to a listing with another sort", ErrInvalidCursor)
+		}
+	}
+
+	types := []string{q.Type}
+	if q.Type == "" {
+		var err error
+		if types, err = s.store.ListTypes(ctx); err != nil {
+			l.Error().Err(err).Msg("ListStates: listing types failed")
+			return StatePage{}, errors.New("LIST STATES ERROR")
+		}
+	}
+
+	var (
+		page StatePage
+		err  error
+	)
+	if q.Sort == "" {
+		page, err = s.scanPage(ctx, q, types, cur)
+	} else {
+		page, err = s.sortedPage(ctx, q, types, cur)
+	}
+	if err != nil {
+		l.Error().Err(err).Msg("ListStates failed")
+		return StatePage{}, errors.New("LIST STATES ERROR")
+	}
+	return page, nil
+}
+
+// scanPage collects up to q.Limit matches in scan order, starting at cur.
+// The cursor it returns points at the first match that did not fit, so the
+// last page never comes back empty.
+func (s *HmsttService) scanPage(ctx context.Context, q ListQuery, types []string, cur listCursor) (StatePage, error) {
+	start := 0
+	if cur.Type != "" {
+		// Types are sorted; a type removed since the last page is skipped.
+		start = sort.SearchStrings(types, cur.Type)
+	}
+	match := q.match()
+	entries := make([]StateEntry, 0, q.Limit)
+	for _, tipe := range types[start:] {
+		scan, count, offset := uint64(0), int64(q.Limit), 0
+		if tipe == cur.Type {
+			scan, count, offset = cur.Scan, cur.Count, cur.Offset
+		}
+		for {
+			batch, next, err := s.store.ScanStates(ctx, tipe, scan, match, count)
+			if err != nil {
+				return StatePage{}, err
+			}
+			for i := offset; i < len(batch); i++ {
+				if !q.matches(batch[i]) {
+					continue
+				}
+				if len(entries) == q.Limit {
+					next := listCursor{Type: tipe, Scan: scan, Count: count, Offset: i}
+					return StatePage{Entries: entries, NextCursor: next.encode()}, nil
+				}
+				entries = append(entries, batch[i])
+			}
+			if next == 0 {
+				break
+			}
+			scan, offset = next, 0
+		}
+	}
+	return StatePage{Entries: entries}, nil
+}
+
+// sortedPage scans every match, orders them and returns the q.Limit that
+// follow cur.
+func (s *HmsttService) sortedPage(ctx context.Context, q ListQuery, types []string, cur listCursor) (StatePage, error) {
+	match := q.match()
+	seen := make(map[string]bool)
+	var all []StateEntry
+	for _, tipe := range types {
+		var scan uint64
+		for {
+			batch, next, err := s.store.ScanStates(ctx, tipe, scan, match, MaxListLimit)
+			if err != nil {
+				return StatePage{}, err
+			}
+			for _, e := range batch {
+				// HSCAN may return an entry twice while the hash is resized.
+				if id := groupMember(e.Type, e.K); q.matches(e) && !seen[id] {
+					seen[id] = true
+					all = append(all, e)
+				}
+			}
+			if next == 0 {
+				break
+			}
+			scan = next
+		}
+	}
+
+	before := func(a, b StateEntry) bool {
+		if q.Desc {
+			a, b = b, a
+		}
+		if q.Sort == SORT_UPDATED_AT && !a.UpdatedAt.Equal(b.UpdatedAt) {
+			return a.UpdatedAt.Before(b.UpdatedAt)
+		}
+		if a.K != b.K {
+			return a.K < b.K
+		}
+		return a.Type < b.Type
+	}
+	sort.Slice(all, func(i, j int) bool { return before(all[i], all[j]) })
+
+	start := 0
+	if cur.Type != "" {
+		last := StateEntry{Type: cur.Type, K: cur.Key, UpdatedAt: cur.UpdatedAt}
+		start = sort.Search(len(all), func(i int) bool { return before(last, all[i]) })
+	}
+	end := min(start+q.Limit, len(all))
+	page := StatePage{Entries: all[start:end]}
+	if end < len(all) {
+		last := all[end-1]
+		next := listCursor{Sort: q.Sort, Type: last.Type, Key: last.K}
+		if q.Sort == SORT_UPDATED_AT {
+			next.UpdatedAt = last.UpdatedAt
+		}
+		page.NextCursor = next.encode()
+	}
+	return page, nil
+}
@@ -0,0 +1,218 @@
+package hmstt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/nurhudajoantama/hmauto/app/server"
+)
+
+func newListStore() *fakeStateStore {
+	base := time.Date(2026, 3, 16, 8, 0, 0, 0, time.UTC)
+	store := &fakeStateStore{states: map[string][]StateEntry{}}
+	for i := range 25 {
+		value := "off"
+		if i%2 == 0 {
+			value = "on"
+		}
+		tipe := "switch"
+		if i%5 == 0 {
+			tipe = "dimmer"
+		}
+		store.states[tipe] = append(store.states[tipe], StateEntry{
+			Type:      tipe,
+			K:         fmt.Sprintf("lamp_%02d", i),
+			Value:     value,
+			UpdatedAt: base.Add(time.Duration(25-i) * time.Minute),
+		})
+	}
+	store.states["switch"] = append(store.states["switch"], StateEntry{Type: "switch", K: "modem", Value: "on", UpdatedAt: base})
+	return store
+}
+
+// collect follows next cursors until the last page and returns the keys seen.
+func collect(t *testing.T, svc *HmsttService, q ListQuery) []string {
+	t.Helper()
+	var keys []string
+	for range 100 {
+		page, err := svc.ListStates(context.Background(), q)
+		if err != nil {
+			t.Fatalf("ListStates(%+v) error = %v", q, err)
+		}
+		if len(page.Entries) > q.Limit {
+			t.Fatalf("ListStates() returned %d entries, limit %d", len(page.Entries), q.Limit)
+		}
+		if page.NextCursor != "" && len(page.Entries) != q.Limit {
+			t.Fatalf("ListStates() returned a short page of %d with a next cursor", len(page.Entries))
+		}
+		for _, e := range page.Entries {
+			keys = append(keys, e.Type+"/"+e.K)
+		}
+		if page.NextCursor == "" {
+			return keys
+		}
+		q.Cursor = page.NextCursor
+	}
+	t.Fatalf("ListStates() did not reach the last page")
+	return nil
+}
+
+func TestListStatesScanPages(t *testing.T) {
+	svc := NewService(newListStore(), nil, nil)
+
+	keys := collect(t, svc, ListQuery{Limit: 4})
+	if len(keys) != 26 {
+		t.Fatalf("all pages = %d states, want 26", len(keys))
+	}
+	seen := map[string]bool{}
+	for _, k := range keys {
+		if seen[k] {
+			t.Fatalf("state %s listed twice", k)
+		}
+		seen[k] = true
+	}
+
+	keys = collect(t, svc, ListQuery{Type: "switch", Prefix: "lamp_", Value: "on", Limit: 3})
+	want := []string{"switch/lamp_02", "switch/lamp_04", "switch/lamp_06", "switch/lamp_08", "switch/lamp_12",
+		"switch/lamp_14", "switch/lamp_16", "switch/lamp_18", "switch/lamp_22", "switch/lamp_24"}
+	if !slices.Equal(keys, want) {
+		t.Fatalf("filtered pages = %v, want %v", keys, want)
+	}
+
+	keys = collect(t, svc, ListQuery{Search: "1", Limit: 100})
+	if len(keys) != 12 {
+		t.Fatalf("search pages = %v, want the 12 keys containing 1", keys)
+	}
+}
+
+func TestListStatesSorted(t *testing.T) {
+	svc := NewService(newListStore(), nil, nil)
+
+	keys := collect(t, svc, ListQuery{Sort: SORT_KEY, Limit: 7})
+	if len(keys) != 26 || keys[0] != "dimmer/lamp_00" || keys[1] != "switch/lamp_01" || keys[25] != "switch/modem" {
+		t.Fatalf("sorted by key = %v", keys)
+	}
+
+	keys = collect(t, svc, ListQuery{Sort: SORT_UPDATED_AT, Desc: true, Value: "off", Limit: 5})
+	if len(keys) != 12 || keys[0] != "switch/lamp_01" || keys[11] != "switch/lamp_23" {
+		t.Fatalf("sorted by updated_at desc = %v", keys)
+	}
+}
+
+func TestListStatesRejectsBadQueries(t *testing.T) {
+	ctx := context.Background()
+	svc := NewService(newListStore(), nil, nil)
+
+	bad := []ListQuery{
+		{Limit: MaxListLimit + 1},
+		{Sort: "value"},
+		{Desc: true},
+	}
+	for _, q := range bad {
+		if _, err := svc.ListStates(ctx, q); !errors.Is(err, ErrInvalidListQuery) {
+			t.Fatalf("ListStates(%+v) error = %v, want %v", q, err, ErrInvalidListQuery)
+		}
+	}
+
+	if _, err := svc.ListStates(ctx, ListQuery{Cursor: "not a cursor"}); !errors.Is(err, ErrInvalidCursor) {
+		t.Fatalf("ListStates(bad cursor) error = %v, want %v", err, ErrInvalidCursor)
+	}
+	page, err := svc.ListStates(ctx, ListQuery{Sort: SORT_KEY, Limit: 1})
+	if err != nil {
+		t.Fatalf("ListStates() error = %v", err)
+	}
+	if _, err := svc.ListStates(ctx, ListQuery{Cursor: page.NextCursor}); !errors.Is(err, ErrInvalidCursor) {
+		t.Fatalf("ListStates(cursor of another sort) error = %v, want %v", err, ErrInvalidCursor)
+	}
+}
+
+func TestListStatesHandlerPages(t *testing.T) {
+	svc := NewService(newListStore(), nil, nil)
+	srv := server.NewWithConfig(":0", &server.ServerConfig{BearerToken: "test-token"})
+	RegisterHandlers(srv, svc)
+
+	type listResponse struct {
+		Data       []StateResponse `json:"data"`
+		NextCursor string          `json:"next_cursor"`
+	}
+	list := func(url string) (int, listResponse) {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("Authorization", "Bearer test-token")
+		rr := httptest.NewRecorder()
+		srv.GetRouter().ServeHTTP(rr, req)
+		var resp listResponse
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		return rr.Code, resp
+	}
+
+	code, resp := list("/v1/states/switch?sort=key&order=desc&limit=2")
+	if code != http.StatusOK || len(resp.Data) != 2 || resp.Data[0].Key != "modem" || resp.NextCursor == "" {
+		t.Fatalf("first page = %d %+v, want modem first and a next cursor", code, resp)
+	}
+	code, resp = list("/v1/states/switch?sort=key&order=desc&limit=2&cursor=" + url.QueryEscape(resp.NextCursor))
+	if code != http.StatusOK || len(resp.Data) != 2 || resp.Data[0].Key != "lamp_23" {
+		t.Fatalf("second page = %d %+v, want lamp_23 first", code, resp)
+	}
+
+	if code, resp := list("/v1/states?prefix=modem"); code != http.StatusOK || len(resp.Data) != 1 || resp.NextCursor != "" {
+		t.Fatalf("GET /v1/states?prefix=modem = %d %+v, want one state and no cursor", code, resp)
+	}
+	if code, _ := list("/v1/states/switch?value=dim"); code != http.StatusOK {
+		t.Fatalf("filter matching nothing status = %d, want %d", code, http.StatusOK)
+	}
+	if code, _ := list("/v1/states/fan"); code != http.StatusNotFound {
+		t.Fatalf("unknown type status = %d, want %d", code, http.StatusNotFound)
+	}
+	for _, bad := range []string{"limit=0", "limit=x", "order=up", "sort=value", "cursor=abc"} {
+		if code, _ := list("/v1/states?" + bad); code != http.StatusBadRequest {
+			t.Fatalf("GET /v1/states?%s status = %d, want %d", bad, code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestStateListsNegotiateFormat(t *testing.T) {
+	svc := NewService(newListStore(), nil, nil)
+	srv := server.NewWithConfig(":0", &server.ServerConfig{BearerToken: "test-token"})
+	RegisterHandlers(srv, svc)
+
+	get := func(url, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("Authorization", "Bearer test-token")
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rr := httptest.NewRecorder()
+		srv.GetRouter().ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := get("/v1/states/switch/batch?key=modem", "text/plain")
+	if rr.Code != http.StatusOK || rr.Body.String() != "modem=on\n" {
+		t.Fatalf("text batch = %d %q, want modem=on", rr.Code, rr.Body.String())
+	}
+
+	rr = get("/v1/states/switch?sort=key&limit=2", "text/plain")
+	if rr.Code != http.StatusOK || rr.Body.String() != "lamp_01=off\nlamp_02=on\n" || rr.Header().Get("X-Next-Cursor") == "" {
+		t.Fatalf("text page = %d %q %v, want two lines and a next cursor header", rr.Code, rr.Body.String(), rr.Header())
+	}
+
+	rr = get("/v1/states/switch?prefix=modem&fields=key,revision", "")
+	if got, want := rr.Body.String(), `{"message":"success","data":[{"key":"modem","revision":0}]}`; rr.Code != http.StatusOK || got != want {
+		t.Fatalf("projected list = %d %s, want %s", rr.Code, got, want)
+	}
+
+	if rr := get("/v1/states/switch/batch?key=modem", "text/html"); rr.Code != http.StatusNotAcceptable {
+		t.Fatalf("text/html status = %d, want %d", rr.Code, http.StatusNotAcceptable)
+	}
+	if rr := get("/v1/states?fields=Key", ""); rr.Code != http.StatusBadRequest {
+		t.Fatalf("bad fields status = %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+}
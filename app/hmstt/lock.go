@@ -0,0 +1,138 @@
+package hmstt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+var ErrStateLocked = errors.New("STATE LOCKED")
+var ErrInvalidLock = errors.New("INVALID LOCK")
+
+const (
+	// MaxLockReasonLength bounds the reason given for a lock.
+	MaxLockReasonLength = 256
+
+	// BATCH_STATUS_LOCKED marks batch items and group members that were not
+	// written because the state is locked.
+	BATCH_STATUS_LOCKED = "locked"
+)
+
+// StateLock puts a state in maintenance mode: while it is active every write
+// to the state is rejected, whoever makes it. A zero ExpiresAt keeps the lock
+// until it is removed.
+type StateLock struct {
+	Reason    string
+	Owner     string
+	LockedAt  time.Time
+	ExpiresAt time.Time
+}
+
+func (l *StateLock) activeAt(now time.Time) bool {
+	return l != nil && (l.ExpiresAt.IsZero() || now.Before(l.ExpiresAt))
+}
+
+// Locked reports whether the entry has a lock that has not expired.
+func (e StateEntry) Locked() bool {
+	return e.Lock.activeAt(time.Now())
+}
+
+// checkUnlocked returns an error wrapping ErrStateLocked that explains who
+// locked the entry and why.
+func checkUnlocked(e StateEntry) error {
+	if !e.Locked() {
+		return nil
+	}
+	msg := fmt.Sprintf("%s/%s is locked by %s: %s", e.Type, e.K, e.Lock.Owner, e.Lock.Reason)
+	if !e.Lock.ExpiresAt.IsZero() {
+		msg += " (until " + e.Lock.ExpiresAt.UTC().Format(time.RFC3339) + ")"
+	}
+	return fmt.Errorf("%w: %s", ErrStateLocked, msg)
+}
+
+// LockState locks a state against all writes until UnlockState or, if
+// expiresIn is positive, until it expires. owner defaults to the caller. A
+// lock held by another owner is not replaced; the same owner may renew it.
+func (s *HmsttService) LockState(ctx context.Context, tipe, key, reason, owner string, expiresIn time.Duration) (StateEntry, error) {
+	l := zerolog.Ctx(ctx)
+	l.UpdateContext(func(c zerolog.Context) zerolog.Context {
+		return c.Str("hmstt_type", tipe).Str("hmstt_key", key)
+	})
+	l.Info().Str("lock_reason", reason).Msg("Handling LockState service")
+
+	if reason == "" || len(reason) > MaxLockReasonLength {
+		return StateEntry{}, fmt.Errorf("%w: reason must be 1-%d characters", ErrInvalidLock, MaxLockReasonLength)
+	}
+	if expiresIn < 0 {
+		return StateEntry{}, fmt.Errorf("%w: expiry must not be negative", ErrInvalidLock)
+	}
+	if owner == "" {
+		owner = CallerFromContext(ctx)
+	}
+
+	return s.updateLock(ctx, tipe, key, HISTORY_OP_LOCK, func(current StateEntry) (*StateLock, error) {
+		if current.Locked() && current.Lock.Owner != owner {
+			return nil, checkUnlocked(current)
+		}
+		now := time.Now().UTC()
+		lock := &StateLock{Reason: reason, Owner: owner, LockedAt: now}
+		if expiresIn > 0 {
+			lock.ExpiresAt = now.Add(expiresIn)
+		}
+		return lock, nil
+	})
+}
+
+// UnlockState removes the lock of a state. Unlocking a state that is not
+// locked succeeds and changes nothing.
+func (s *HmsttService) UnlockState(ctx context.Context, tipe, key string) (StateEntry, error) {
+	l := zerolog.Ctx(ctx)
+	l.UpdateContext(func(c zerolog.Context) zerolog.Context {
+		return c.Str("hmstt_type", tipe).Str("hmstt_key", key)
+	})
+	l.Info().Msg("Handling UnlockState service")
+
+	return s.updateLock(ctx, tipe, key, HISTORY_OP_UNLOCK, func(StateEntry) (*StateLock, error) {
+		return nil, nil
+	})
+}
+
+// updateLock replaces the lock of an existing state with next(current) in a
+// compare-and-set, like updateValue. The value is left as it is.
+func (s *HmsttService) updateLock(ctx context.Context, tipe, key, op string, next func(StateEntry) (*StateLock, error)) (StateEntry, error) {
+	l := zerolog.Ctx(ctx)
+	for attempt := 1; ; attempt++ {
+		current, err := s.store.GetState(ctx, tipe, key)
+		if err != nil {
+			return StateEntry{}, ErrStateNotFound
+		}
+		lock, err := next(current)
+		if err != nil {
+			return StateEntry{}, err
+		}
+		if lock == nil && current.Lock == nil {
+			return current, nil
+		}
+
+		entry := current
+		entry.Lock = lock
+		entry, err = s.store.SetState(ctx, entry, current.Revision)
+		if errors.Is(err, ErrRevisionMismatch) {
+			if attempt < maxWriteAttempts {
+				l.Warn().Int("attempt", attempt).Str("op", op).Msg("concurrent write, retrying")
+				continue
+			}
+			return StateEntry{}, ErrRevisionMismatch
+		}
+		if err != nil {
+			l.Error().Err(err).Str("op", op).Msg("set state lock failed")
+			return StateEntry{}, errors.New("SET STATE ERROR")
+		}
+		s.recordHistory(ctx, op, current, entry)
+		s.notifyWrite(ctx, entry)
+		return entry, nil
+	}
+}
@@ -0,0 +1,203 @@
+package hmstt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nurhudajoantama/hmauto/app/server"
+)
+
+func TestLockRejectsEveryWritePath(t *testing.T) {
+	ctx := WithCaller(context.Background(), "http:10.0.0.2")
+	store := &fakeStateStore{states: map[string][]StateEntry{
+		"switch": {
+			{Type: "switch", K: "modem", Value: "on", Groups: []string{"rack"}, Revision: 1},
+			{Type: "switch", K: "router", Value: "on", Groups: []string{"rack"}, Revision: 2},
+		},
+	}, seq: 2}
+	svc := NewService(store, nil, nil)
+
+	entry, err := svc.LockState(ctx, "switch", "modem", "replacing the PSU", "", 0)
+	if err != nil {
+		t.Fatalf("LockState() error = %v", err)
+	}
+	if !entry.Locked() || entry.Lock.Owner != "http:10.0.0.2" {
+		t.Fatalf("LockState() = %+v, want locked by the caller", entry.Lock)
+	}
+	if entry.Value != "on" {
+		t.Fatalf("LockState() value = %q, want on", entry.Value)
+	}
+
+	value := "off"
+	writes := map[string]func() error{
+		"SetState": func() error { _, err := svc.SetState(ctx, "switch", "modem", "off", nil, nil, nil); return err },
+		"PatchState": func() error {
+			_, err := svc.PatchState(ctx, "switch", "modem", &value, nil, nil, nil, nil)
+			return err
+		},
+		"ToggleState": func() error { _, err := svc.ToggleState(ctx, "switch", "modem"); return err },
+		"CycleState": func() error {
+			_, _, err := svc.CycleState(ctx, "switch", "modem", time.Second)
+			return err
+		},
+		"DeleteState": func() error { _, err := svc.DeleteState(ctx, "switch", "modem"); return err },
+		"DeleteType":  func() error { _, err := svc.DeleteType(ctx, "switch", "switch"); return err },
+	}
+	for name, write := range writes {
+		if err := write(); !errors.Is(err, ErrStateLocked) {
+			t.Fatalf("%s error = %v, want %v", name, err, ErrStateLocked)
+		}
+	}
+
+	results, err := svc.BatchSetStates(ctx, []BatchSetItem{
+		{Type: "switch", Key: "router", Value: "off"},
+		{Type: "switch", Key: "modem", Value: "off"},
+	})
+	if !errors.Is(err, ErrStateLocked) {
+		t.Fatalf("BatchSetStates() error = %v, want %v", err, ErrStateLocked)
+	}
+	if results[0].Status != BATCH_STATUS_SKIPPED || results[1].Status != BATCH_STATUS_LOCKED {
+		t.Fatalf("BatchSetStates() statuses = %q, %q, want skipped, locked", results[0].Status, results[1].Status)
+	}
+	if got, _ := store.GetState(ctx, "switch", "router"); got.Value != "on" {
+		t.Fatalf("router = %q, want on after a rejected batch", got.Value)
+	}
+
+	results, err = svc.SetGroupValue(ctx, "rack", "off")
+	if err != nil {
+		t.Fatalf("SetGroupValue() error = %v", err)
+	}
+	for _, res := range results {
+		want := BATCH_STATUS_UPDATED
+		if res.Entry.K == "modem" {
+			want = BATCH_STATUS_LOCKED
+		}
+		if res.Status != want {
+			t.Fatalf("SetGroupValue() %s status = %q, want %q", res.Entry.K, res.Status, want)
+		}
+	}
+
+	if got, _ := store.GetState(ctx, "switch", "modem"); got.Value != "on" || !got.Locked() {
+		t.Fatalf("modem = %+v, want on and still locked", got)
+	}
+	if _, err := svc.UnlockState(ctx, "switch", "modem"); err != nil {
+		t.Fatalf("UnlockState() error = %v", err)
+	}
+	entry, err = svc.SetState(ctx, "switch", "modem", "off", nil, nil, nil)
+	if err != nil || entry.Value != "off" {
+		t.Fatalf("SetState() after unlock = (%q, %v), want off", entry.Value, err)
+	}
+}
+
+func TestLockOwnerAndExpiry(t *testing.T) {
+	ctx := context.Background()
+	svc := NewService(newSwitchStore(), nil, nil)
+
+	if _, err := svc.LockState(ctx, "switch", "modem", "", "budi", 0); !errors.Is(err, ErrInvalidLock) {
+		t.Fatalf("LockState(no reason) error = %v, want %v", err, ErrInvalidLock)
+	}
+	if _, err := svc.LockState(ctx, "switch", "missing", "maintenance", "budi", 0); !errors.Is(err, ErrStateNotFound) {
+		t.Fatalf("LockState(missing) error = %v, want %v", err, ErrStateNotFound)
+	}
+
+	if _, err := svc.LockState(ctx, "switch", "modem", "maintenance", "budi", time.Hour); err != nil {
+		t.Fatalf("LockState() error = %v", err)
+	}
+	if _, err := svc.LockState(ctx, "switch", "modem", "mine now", "sari", 0); !errors.Is(err, ErrStateLocked) {
+		t.Fatalf("LockState(other owner) error = %v, want %v", err, ErrStateLocked)
+	}
+	entry, err := svc.LockState(ctx, "switch", "modem", "still working", "budi", 0)
+	if err != nil {
+		t.Fatalf("LockState(renew) error = %v", err)
+	}
+	if entry.Lock.Reason != "still working" || !entry.Lock.ExpiresAt.IsZero() {
+		t.Fatalf("renewed lock = %+v, want new reason and no expiry", entry.Lock)
+	}
+
+	expired := &StateLock{Reason: "old", Owner: "budi", ExpiresAt: time.Now().Add(-time.Minute)}
+	if expired.activeAt(time.Now()) {
+		t.Fatalf("expired lock is active")
+	}
+	entry.Lock = expired
+	if err := checkUnlocked(entry); err != nil {
+		t.Fatalf("checkUnlocked(expired) error = %v", err)
+	}
+}
+
+func TestEntryEncodingKeepsLock(t *testing.T) {
+	until := time.Date(2026, 3, 16, 18, 0, 0, 0, time.UTC)
+	want := StateEntry{Type: "switch", K: "modem", Value: "on", Lock: &StateLock{
+		Reason: "replacing the PSU", Owner: "budi", LockedAt: until.Add(-2 * time.Hour), ExpiresAt: until,
+	}}
+	data, err := encodeEntry(want)
+	if err != nil {
+		t.Fatalf("encodeEntry() error = %v", err)
+	}
+	got, err := decodeEntry("switch", "modem", data)
+	if err != nil {
+		t.Fatalf("decodeEntry() error = %v", err)
+	}
+	if got.Lock == nil || *got.Lock != *want.Lock {
+		t.Fatalf("round trip lock = %+v, want %+v", got.Lock, want.Lock)
+	}
+
+	data, _ = encodeEntry(StateEntry{Type: "switch", K: "modem", Value: "on"})
+	if strings.Contains(string(data), "lock") {
+		t.Fatalf("encodeEntry() = %s, want no lock field", data)
+	}
+}
+
+func TestLockHandlers(t *testing.T) {
+	svc := NewService(newSwitchStore(), nil, nil)
+	srv := server.NewWithConfig(":0", &server.ServerConfig{BearerToken: "test-token", MaxRequestSize: 1 << 20})
+	RegisterHandlers(srv, svc)
+
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer test-token")
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		srv.GetRouter().ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := do(http.MethodPost, "/v1/states/switch/modem/lock", `{"reason":"x","expires_in":"soon"}`); rr.Code != http.StatusBadRequest {
+		t.Fatalf("lock with bad expires_in status = %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+	rr := do(http.MethodPost, "/v1/states/switch/modem/lock", `{"reason":"replacing the PSU","owner":"budi","expires_in":"2h"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("lock status = %d, want %d: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+	var resp struct {
+		Data StateResponse `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode lock response: %v", err)
+	}
+	if !resp.Data.Locked || resp.Data.LockReason != "replacing the PSU" || resp.Data.LockOwner != "budi" || resp.Data.LockExpiresAt == "" {
+		t.Fatalf("lock response = %+v, want lock fields set", resp.Data)
+	}
+
+	if rr := do(http.MethodPut, "/v1/states/switch/modem", `{"value":"off"}`); rr.Code != http.StatusLocked {
+		t.Fatalf("set locked state status = %d, want %d", rr.Code, http.StatusLocked)
+	}
+	if rr := do(http.MethodPost, "/v1/states/switch/modem/toggle", ""); rr.Code != http.StatusLocked {
+		t.Fatalf("toggle locked state status = %d, want %d", rr.Code, http.StatusLocked)
+	}
+	if rr := do(http.MethodDelete, "/v1/states/switch/modem", ""); rr.Code != http.StatusLocked {
+		t.Fatalf("delete locked state status = %d, want %d", rr.Code, http.StatusLocked)
+	}
+
+	if rr := do(http.MethodDelete, "/v1/states/switch/modem/lock", ""); rr.Code != http.StatusOK {
+		t.Fatalf("unlock status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	if rr := do(http.MethodPut, "/v1/states/switch/modem", `{"value":"off"}`); rr.Code != http.StatusOK {
+		t.Fatalf("set unlocked state status = %d, want %d: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+}
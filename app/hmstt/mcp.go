@@ -3,12 +3,19 @@ package hmstt
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"time"
 
 	"github.com/modelcontextprotocol/go-sdk/mcp"
 )
 
+type listAllStatesInput struct {
+	Label string `json:"label,omitempty" jsonschema:"Optional: label selector, e.g. room=office,critical=true; key!=value and a bare key are also accepted"`
+}
+
 type listStatesByTypeInput struct {
-	Type string `json:"type" jsonschema:"State type, e.g. switch"`
+	Type  string `json:"type"            jsonschema:"State type, e.g. switch"`
+	Label string `json:"label,omitempty" jsonschema:"Optional: label selector, e.g. room=office,critical=true; key!=value and a bare key are also accepted"`
 }
 
 type getStateInput struct {
@@ -17,24 +24,106 @@ type getStateInput struct {
 }
 
 type createStateInput struct {
-	Type        string `json:"type"        jsonschema:"State type, e.g. switch"`
-	Key         string `json:"key"         jsonschema:"State key, e.g. modem"`
-	Value       string `json:"value"       jsonschema:"State value, e.g. on or off"`
-	Description string `json:"description" jsonschema:"Human-readable description of what this state controls, e.g. Controls the modem power switch"`
+	Type        string            `json:"type"        jsonschema:"State type, e.g. switch"`
+	Key         string            `json:"key"         jsonschema:"State key, e.g. modem"`
+	Value       any               `json:"value"       jsonschema:"State value, e.g. on or off, or a JSON object for json types; must be accepted by the type (see list_state_types)"`
+	Description string            `json:"description"      jsonschema:"Human-readable description of what this state controls, e.g. Controls the modem power switch"`
+	Name        string            `json:"name,omitempty"   jsonschema:"Optional: display name, e.g. Modem"`
+	Labels      map[string]string `json:"labels,omitempty" jsonschema:"Optional: labels such as room=office, vendor=tplink or critical=true"`
+	Groups      []string          `json:"groups,omitempty" jsonschema:"Optional: groups the state belongs to, e.g. rooms or racks such as living_room or rack"`
 }
 
 type setStateInput struct {
-	Type        string  `json:"type"        jsonschema:"State type, e.g. switch"`
-	Key         string  `json:"key"         jsonschema:"State key, e.g. modem"`
-	Value       string  `json:"value"       jsonschema:"State value, e.g. on or off"`
-	Description *string `json:"description" jsonschema:"Optional: update the description of this state"`
+	Type        string            `json:"type"        jsonschema:"State type, e.g. switch"`
+	Key         string            `json:"key"         jsonschema:"State key, e.g. modem"`
+	Value       any               `json:"value"       jsonschema:"State value, e.g. on or off, or a JSON object for json types; must be accepted by the type (see list_state_types)"`
+	Description *string           `json:"description" jsonschema:"Optional: update the description of this state"`
+	Name        *string           `json:"name,omitempty"   jsonschema:"Optional: update the display name of this state"`
+	Labels      map[string]string `json:"labels,omitempty" jsonschema:"Optional: replace the labels of this state, e.g. room=office"`
+	IfRevision  *int64            `json:"if_revision,omitempty" jsonschema:"Optional: only update if the state is still at this revision (from a previous read); fails if someone else changed it"`
+	RevertAfter string            `json:"revert_after,omitempty" jsonschema:"Optional: return the state to its previous value after this duration, e.g. 45m; the state must already exist"`
 }
 
 type patchStateInput struct {
+	Type        string            `json:"type"        jsonschema:"State type, e.g. switch"`
+	Key         string            `json:"key"         jsonschema:"State key, e.g. modem"`
+	Value       any               `json:"value"       jsonschema:"Optional: new state value, e.g. on or off; for json types an object whose members are merged into the current value (null removes a member)"`
+	Description *string           `json:"description" jsonschema:"Optional: new description for this state"`
+	Name        *string           `json:"name,omitempty"   jsonschema:"Optional: new display name for this state"`
+	Labels      map[string]string `json:"labels,omitempty" jsonschema:"Optional: replace the labels of this state, e.g. room=office; an empty object removes them all"`
+	Groups      []string          `json:"groups,omitempty" jsonschema:"Optional: replace the groups the state belongs to, e.g. living_room; an empty list removes it from all groups"`
+	IfRevision  *int64            `json:"if_revision,omitempty" jsonschema:"Optional: only update if the state is still at this revision (from a previous read); fails if someone else changed it"`
+}
+
+type batchSetStateItem struct {
 	Type        string  `json:"type"        jsonschema:"State type, e.g. switch"`
-	Key         string  `json:"key"         jsonschema:"State key, e.g. modem"`
-	Value       *string `json:"value"       jsonschema:"Optional: new state value, e.g. on or off"`
-	Description *string `json:"description" jsonschema:"Optional: new description for this state"`
+	Key         string  `json:"key"         jsonschema:"State key, e.g. relay_1"`
+	Value       any     `json:"value"       jsonschema:"State value, e.g. on or off, or a JSON object for json types; must be accepted by the type (see list_state_types)"`
+	Description *string `json:"description" jsonschema:"Optional: update the description of this state"`
+}
+
+type batchSetStatesInput struct {
+	States []batchSetStateItem `json:"states" jsonschema:"States to write; may span types. Either all are written or none"`
+}
+
+type toggleStateInput struct {
+	Type string `json:"type" jsonschema:"State type, e.g. switch"`
+	Key  string `json:"key"  jsonschema:"State key, e.g. modem"`
+}
+
+type cycleStateInput struct {
+	Type   string `json:"type"              jsonschema:"State type, e.g. switch"`
+	Key    string `json:"key"               jsonschema:"State key, e.g. modem"`
+	OffFor string `json:"off_for,omitempty" jsonschema:"Optional: how long to stay off, e.g. 30s (default 10s, max 10m)"`
+}
+
+type listCommandsInput struct {
+	Status string `json:"status,omitempty" jsonschema:"Only pending or only failed commands; both if empty"`
+}
+
+type cancelTimerInput struct {
+	Type string `json:"type" jsonschema:"State type, e.g. switch"`
+	Key  string `json:"key"  jsonschema:"State key, e.g. heater"`
+}
+
+type groupInput struct {
+	Group string `json:"group" jsonschema:"Group name, e.g. rack or living_room (see list_groups)"`
+}
+
+type setGroupValueInput struct {
+	Group string `json:"group" jsonschema:"Group name, e.g. rack or living_room (see list_groups)"`
+	Value any    `json:"value" jsonschema:"Value to set on every member whose type accepts it, e.g. off"`
+}
+
+type lockStateInput struct {
+	Type      string `json:"type"                 jsonschema:"State type, e.g. switch"`
+	Key       string `json:"key"                  jsonschema:"State key, e.g. modem"`
+	Reason    string `json:"reason"               jsonschema:"Why the state is locked, e.g. replacing the PSU"`
+	Owner     string `json:"owner,omitempty"      jsonschema:"Optional: who holds the lock (default mcp); only this owner can renew it"`
+	ExpiresIn string `json:"expires_in,omitempty" jsonschema:"Optional: unlock automatically after this duration, e.g. 2h"`
+}
+
+type unlockStateInput struct {
+	Type string `json:"type" jsonschema:"State type, e.g. switch"`
+	Key  string `json:"key"  jsonschema:"State key, e.g. modem"`
+}
+
+type deleteStateInput struct {
+	Type string `json:"type" jsonschema:"State type, e.g. switch"`
+	Key  string `json:"key"  jsonschema:"State key, e.g. modem"`
+}
+
+type deleteStatesByTypeInput struct {
+	Type    string `json:"type"    jsonschema:"State type whose states should all be removed, e.g. switch"`
+	Confirm string `json:"confirm" jsonschema:"Must repeat the type name exactly to confirm the deletion"`
+}
+
+type getStateHistoryInput struct {
+	Type  string `json:"type"            jsonschema:"State type, e.g. switch"`
+	Key   string `json:"key"             jsonschema:"State key, e.g. modem"`
+	From  string `json:"from,omitempty"  jsonschema:"Optional: oldest change to include, RFC3339 timestamp"`
+	To    string `json:"to,omitempty"    jsonschema:"Optional: newest change to include, RFC3339 timestamp"`
+	Limit int64  `json:"limit,omitempty" jsonschema:"Optional: max records to return (default 50, max 1000)"`
 }
 
 func textResult(v any) *mcp.CallToolResult {
@@ -53,32 +142,72 @@ func errResult(msg string) *mcp.CallToolResult {
 
 // RegisterMCPTools registers all hmstt tools on the given MCP server.
 func RegisterMCPTools(s *mcp.Server, svc *HmsttService) {
+	s.AddReceivingMiddleware(func(next mcp.MethodHandler) mcp.MethodHandler {
+		return func(ctx context.Context, method string, req mcp.Request) (mcp.Result, error) {
+			return next(WithCaller(ctx, "mcp"), method, req)
+		}
+	})
+
 	mcp.AddTool(s, &mcp.Tool{
-		Name:        "list_all_states",
-		Description: "List all IoT states across every type. Each state includes a description explaining its purpose.",
+		Name:        "list_state_types",
+		Description: "List the registered state types and the values each accepts (enum values, numeric ranges, text patterns). Check this before creating or setting a state.",
 	}, func(ctx context.Context, _ *mcp.CallToolRequest, _ struct{}) (*mcp.CallToolResult, any, error) {
+		types := svc.Types()
+		data := make([]TypeResponse, 0, len(types))
+		for _, t := range types {
+			data = append(data, typeToResponse(t))
+		}
+		return textResult(data), nil, nil
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "list_constraints",
+		Description: "List the interlocks between states: exclusive (at most one may be on), requires (a state may only be on while another is) and max_on (at most N states of a group on). Writes that would break one are rejected with the violated constraint.",
+	}, func(ctx context.Context, _ *mcp.CallToolRequest, _ struct{}) (*mcp.CallToolResult, any, error) {
+		constraints := svc.Constraints()
+		data := make([]ConstraintResponse, 0, len(constraints))
+		for _, c := range constraints {
+			data = append(data, constraintToResponse(c))
+		}
+		return textResult(data), nil, nil
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "list_all_states",
+		Description: "List all IoT states across every type, optionally only those matching a label selector such as room=office. Each state includes a description explaining its purpose.",
+	}, func(ctx context.Context, _ *mcp.CallToolRequest, input listAllStatesInput) (*mcp.CallToolResult, any, error) {
+		sel, err := ParseLabelSelector(input.Label)
+		if err != nil {
+			return errResult(err.Error()), nil, nil
+		}
 		entries, err := svc.GetAllStates(ctx)
 		if err != nil {
 			return errResult(err.Error()), nil, nil
 		}
+		entries = sel.Filter(entries)
 		data := make([]StateResponse, 0, len(entries))
 		for _, e := range entries {
-			data = append(data, entryToResponse(e))
+			data = append(data, svc.stateResponse(e))
 		}
 		return textResult(data), nil, nil
 	})
 
 	mcp.AddTool(s, &mcp.Tool{
 		Name:        "list_states_by_type",
-		Description: "List all IoT states for a given type (e.g. switch). Each state includes a description explaining its purpose.",
+		Description: "List all IoT states for a given type (e.g. switch), optionally only those matching a label selector such as critical=true. Each state includes a description explaining its purpose.",
 	}, func(ctx context.Context, _ *mcp.CallToolRequest, input listStatesByTypeInput) (*mcp.CallToolResult, any, error) {
+		sel, err := ParseLabelSelector(input.Label)
+		if err != nil {
+			return errResult(err.Error()), nil, nil
+		}
 		entries, err := svc.GetAllByType(ctx, input.Type)
 		if err != nil {
 			return errResult(err.Error()), nil, nil
 		}
+		entries = sel.Filter(entries)
 		data := make([]StateResponse, 0, len(entries))
 		for _, e := range entries {
-			data = append(data, entryToResponse(e))
+			data = append(data, svc.stateResponse(e))
 		}
 		return textResult(data), nil, nil
 	})
@@ -91,48 +220,296 @@ func RegisterMCPTools(s *mcp.Server, svc *HmsttService) {
 		if err != nil {
 			return errResult(err.Error()), nil, nil
 		}
-		return textResult(entryToResponse(entry)), nil, nil
+		return textResult(svc.stateResponse(entry)), nil, nil
 	})
 
 	mcp.AddTool(s, &mcp.Tool{
 		Name:        "create_state",
-		Description: "Create a new IoT state entry with a description. Returns error if the key already exists.",
+		Description: "Create a new IoT state entry with a description and optional groups (rooms, racks). Type and key must be lowercase letters, digits, '_' or '-'. Returns error if the key already exists.",
 	}, func(ctx context.Context, _ *mcp.CallToolRequest, input createStateInput) (*mcp.CallToolResult, any, error) {
-		if err := svc.CreateState(ctx, input.Type, input.Key, input.Value, input.Description); err != nil {
+		value, err := valueFromAny(input.Value)
+		if err != nil {
 			return errResult(err.Error()), nil, nil
 		}
-		entry, err := svc.GetState(ctx, input.Type, input.Key)
+		entry, err := svc.CreateState(ctx, input.Type, input.Key, value, input.Description, input.Groups, newMeta(&input.Name, input.Labels))
 		if err != nil {
 			return errResult(err.Error()), nil, nil
 		}
-		return textResult(entryToResponse(entry)), nil, nil
+		return textResult(svc.stateResponse(entry)), nil, nil
 	})
 
 	mcp.AddTool(s, &mcp.Tool{
 		Name:        "set_state",
-		Description: "Update the value of an existing IoT state. Optionally update the description. MQTT event is fired only if the value changes.",
+		Description: "Update the value of an existing IoT state. Optionally update the description. Set revert_after to make the change temporary, e.g. heater on for 45m. MQTT event is fired only if the value changes.",
 	}, func(ctx context.Context, _ *mcp.CallToolRequest, input setStateInput) (*mcp.CallToolResult, any, error) {
-		if err := svc.SetState(ctx, input.Type, input.Key, input.Value, input.Description); err != nil {
+		value, err := valueFromAny(input.Value)
+		if err != nil {
 			return errResult(err.Error()), nil, nil
 		}
-		entry, err := svc.GetState(ctx, input.Type, input.Key)
+		if input.RevertAfter != "" {
+			revertAfter, err := time.ParseDuration(input.RevertAfter)
+			if err != nil {
+				return errResult("revert_after must be a duration such as 45m"), nil, nil
+			}
+			entry, timer, err := svc.SetStateFor(ctx, input.Type, input.Key, value, input.Description, newMeta(input.Name, input.Labels), IfRevision(input.IfRevision), revertAfter)
+			if err != nil {
+				return errResult(err.Error()), nil, nil
+			}
+			resp := svc.stateResponse(entry)
+			resp.RevertAt = timer.DueAt.UTC().Format(time.RFC3339)
+			return textResult(resp), nil, nil
+		}
+		entry, err := svc.SetState(ctx, input.Type, input.Key, value, input.Description, newMeta(input.Name, input.Labels), IfRevision(input.IfRevision))
 		if err != nil {
 			return errResult(err.Error()), nil, nil
 		}
-		return textResult(entryToResponse(entry)), nil, nil
+		return textResult(svc.stateResponse(entry)), nil, nil
 	})
 
 	mcp.AddTool(s, &mcp.Tool{
 		Name:        "patch_state",
-		Description: "Partially update an IoT state. Provide value, description, or both — fields not provided are left unchanged. MQTT event is fired only if the value changes.",
+		Description: "Partially update an IoT state. Provide value, description, groups, or several — fields not provided are left unchanged. MQTT event is fired only if the value changes.",
 	}, func(ctx context.Context, _ *mcp.CallToolRequest, input patchStateInput) (*mcp.CallToolResult, any, error) {
-		if err := svc.PatchState(ctx, input.Type, input.Key, input.Value, input.Description); err != nil {
+		var value *string
+		if input.Value != nil {
+			v, err := valueFromAny(input.Value)
+			if err != nil {
+				return errResult(err.Error()), nil, nil
+			}
+			value = &v
+		}
+		entry, err := svc.PatchState(ctx, input.Type, input.Key, value, input.Description, input.Groups, newMeta(input.Name, input.Labels), IfRevision(input.IfRevision))
+		if err != nil {
 			return errResult(err.Error()), nil, nil
 		}
-		entry, err := svc.GetState(ctx, input.Type, input.Key)
+		return textResult(svc.stateResponse(entry)), nil, nil
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "batch_set_states",
+		Description: "Set several IoT states at once, e.g. turn off every relay. All values are validated first and then written together: if any item is invalid nothing changes. Missing keys are created. MQTT event is fired for each value that changes.",
+	}, func(ctx context.Context, _ *mcp.CallToolRequest, input batchSetStatesInput) (*mcp.CallToolResult, any, error) {
+		items := make([]BatchSetItem, 0, len(input.States))
+		for _, st := range input.States {
+			value, err := valueFromAny(st.Value)
+			if err != nil {
+				return errResult(err.Error()), nil, nil
+			}
+			items = append(items, BatchSetItem{Type: st.Type, Key: st.Key, Value: value, Description: st.Description})
+		}
+		results, err := svc.BatchSetStates(ctx, items)
+		data := make([]BatchSetResultResponse, 0, len(results))
+		for _, res := range results {
+			data = append(data, BatchResultToResponse(res))
+		}
+		if errors.Is(err, ErrBatchInvalid) || errors.Is(err, ErrStateLocked) {
+			b, _ := json.Marshal(data)
+			return errResult(err.Error() + ": " + string(b)), nil, nil
+		}
+		if err != nil {
+			return errResult(err.Error()), nil, nil
+		}
+		return textResult(data), nil, nil
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "toggle_state",
+		Description: "Flip an on/off style IoT state (e.g. a switch from on to off or back) in one atomic step. MQTT event is fired.",
+	}, func(ctx context.Context, _ *mcp.CallToolRequest, input toggleStateInput) (*mcp.CallToolResult, any, error) {
+		entry, err := svc.ToggleState(ctx, input.Type, input.Key)
+		if err != nil {
+			return errResult(err.Error()), nil, nil
+		}
+		return textResult(svc.stateResponse(entry)), nil, nil
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "cycle_state",
+		Description: "Power-cycle a device, e.g. reboot the modem: switch its state off now and back on automatically after off_for. Returns immediately; the server switches it back on, even across restarts. Use this instead of two set_state calls.",
+	}, func(ctx context.Context, _ *mcp.CallToolRequest, input cycleStateInput) (*mcp.CallToolResult, any, error) {
+		var offFor time.Duration
+		if input.OffFor != "" {
+			var err error
+			if offFor, err = time.ParseDuration(input.OffFor); err != nil {
+				return errResult("off_for must be a duration such as 30s"), nil, nil
+			}
+		}
+		entry, timer, err := svc.CycleState(ctx, input.Type, input.Key, offFor)
 		if err != nil {
 			return errResult(err.Error()), nil, nil
 		}
-		return textResult(entryToResponse(entry)), nil, nil
+		return textResult(CycleResponse{State: svc.stateResponse(entry), OnAt: timer.DueAt.UTC().Format(time.RFC3339)}), nil, nil
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "lock_state",
+		Description: "Lock an IoT state for maintenance: every change to it is refused, by anyone, until unlock_state or until expires_in passes. Use before working on a device so automations leave it alone.",
+	}, func(ctx context.Context, _ *mcp.CallToolRequest, input lockStateInput) (*mcp.CallToolResult, any, error) {
+		var expiresIn time.Duration
+		if input.ExpiresIn != "" {
+			var err error
+			if expiresIn, err = time.ParseDuration(input.ExpiresIn); err != nil {
+				return errResult("expires_in must be a duration such as 2h"), nil, nil
+			}
+		}
+		entry, err := svc.LockState(ctx, input.Type, input.Key, input.Reason, input.Owner, expiresIn)
+		if err != nil {
+			return errResult(err.Error()), nil, nil
+		}
+		return textResult(svc.stateResponse(entry)), nil, nil
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "unlock_state",
+		Description: "Remove the maintenance lock of an IoT state so it can be changed again.",
+	}, func(ctx context.Context, _ *mcp.CallToolRequest, input unlockStateInput) (*mcp.CallToolResult, any, error) {
+		entry, err := svc.UnlockState(ctx, input.Type, input.Key)
+		if err != nil {
+			return errResult(err.Error()), nil, nil
+		}
+		return textResult(svc.stateResponse(entry)), nil, nil
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "list_timers",
+		Description: "List pending timed changes, soonest first: temporary states waiting to revert (revert_after) and power cycles waiting to switch back on.",
+	}, func(ctx context.Context, _ *mcp.CallToolRequest, _ struct{}) (*mcp.CallToolResult, any, error) {
+		timers, err := svc.ListTimers(ctx)
+		if err != nil {
+			return errResult(err.Error()), nil, nil
+		}
+		data := make([]TimerResponse, 0, len(timers))
+		for _, t := range timers {
+			data = append(data, timerToResponse(t))
+		}
+		return textResult(data), nil, nil
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "list_commands",
+		Description: "List state changes whose devices have not confirmed them, oldest first: pending ones are still being retried, failed ones were given up on. Use when the user asks whether a device actually switched.",
+	}, func(ctx context.Context, _ *mcp.CallToolRequest, input listCommandsInput) (*mcp.CallToolResult, any, error) {
+		commands, err := svc.ListCommands(ctx, input.Status)
+		if err != nil {
+			return errResult(err.Error()), nil, nil
+		}
+		data := make([]CommandResponse, 0, len(commands))
+		for _, c := range commands {
+			data = append(data, commandToResponse(c))
+		}
+		return textResult(data), nil, nil
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "cancel_timer",
+		Description: "Cancel the pending timed change of an IoT state, e.g. keep the heater on instead of reverting. The state keeps its current value.",
+	}, func(ctx context.Context, _ *mcp.CallToolRequest, input cancelTimerInput) (*mcp.CallToolResult, any, error) {
+		timer, err := svc.CancelTimer(ctx, input.Type, input.Key)
+		if err != nil {
+			return errResult(err.Error()), nil, nil
+		}
+		return textResult(timerToResponse(timer)), nil, nil
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "list_groups",
+		Description: "List groups of IoT states, such as rooms and racks, with how many states each contains.",
+	}, func(ctx context.Context, _ *mcp.CallToolRequest, _ struct{}) (*mcp.CallToolResult, any, error) {
+		groups, err := svc.ListGroups(ctx)
+		if err != nil {
+			return errResult(err.Error()), nil, nil
+		}
+		data := make([]GroupResponse, 0, len(groups))
+		for _, g := range groups {
+			data = append(data, GroupResponse(g))
+		}
+		return textResult(data), nil, nil
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "get_group_states",
+		Description: "Get every IoT state in a group, e.g. everything in the rack or all living room lights.",
+	}, func(ctx context.Context, _ *mcp.CallToolRequest, input groupInput) (*mcp.CallToolResult, any, error) {
+		entries, err := svc.GetGroupStates(ctx, input.Group)
+		if err != nil {
+			return errResult(err.Error()), nil, nil
+		}
+		data := make([]StateResponse, 0, len(entries))
+		for _, e := range entries {
+			data = append(data, svc.stateResponse(e))
+		}
+		return textResult(data), nil, nil
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "set_group_value",
+		Description: "Set a value on every state in a group whose type accepts it, e.g. turn off everything in the living room. Written all at once; members that do not accept the value are left unchanged and reported as incompatible.",
+	}, func(ctx context.Context, _ *mcp.CallToolRequest, input setGroupValueInput) (*mcp.CallToolResult, any, error) {
+		value, err := valueFromAny(input.Value)
+		if err != nil {
+			return errResult(err.Error()), nil, nil
+		}
+		results, err := svc.SetGroupValue(ctx, input.Group, value)
+		data := make([]BatchSetResultResponse, 0, len(results))
+		for _, res := range results {
+			data = append(data, BatchResultToResponse(res))
+		}
+		if errors.Is(err, ErrNoCompatibleMembers) || errors.Is(err, ErrStateLocked) {
+			b, _ := json.Marshal(data)
+			return errResult(err.Error() + ": " + string(b)), nil, nil
+		}
+		if err != nil {
+			return errResult(err.Error()), nil, nil
+		}
+		return textResult(data), nil, nil
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "delete_state",
+		Description: "Permanently delete a single IoT state by type and key. Subscribers receive a tombstone event so they can forget the key.",
+	}, func(ctx context.Context, _ *mcp.CallToolRequest, input deleteStateInput) (*mcp.CallToolResult, any, error) {
+		entry, err := svc.DeleteState(ctx, input.Type, input.Key)
+		if err != nil {
+			return errResult(err.Error()), nil, nil
+		}
+		return textResult(svc.stateResponse(entry)), nil, nil
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "delete_states_by_type",
+		Description: "Permanently delete every IoT state of a type. Set confirm to the type name. Only use when the user explicitly asks to remove a whole type.",
+	}, func(ctx context.Context, _ *mcp.CallToolRequest, input deleteStatesByTypeInput) (*mcp.CallToolResult, any, error) {
+		keys, err := svc.DeleteType(ctx, input.Type, input.Confirm)
+		if err != nil {
+			return errResult(err.Error()), nil, nil
+		}
+		return textResult(DeleteTypeResponse{Type: input.Type, Deleted: keys}), nil, nil
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "get_state_history",
+		Description: "Get the change history of an IoT state, newest first: old and new value, when it changed, and who changed it (caller and request ID).",
+	}, func(ctx context.Context, _ *mcp.CallToolRequest, input getStateHistoryInput) (*mcp.CallToolResult, any, error) {
+		var from, to time.Time
+		var err error
+		if input.From != "" {
+			if from, err = time.Parse(time.RFC3339, input.From); err != nil {
+				return errResult("from must be an RFC3339 timestamp"), nil, nil
+			}
+		}
+		if input.To != "" {
+			if to, err = time.Parse(time.RFC3339, input.To); err != nil {
+				return errResult("to must be an RFC3339 timestamp"), nil, nil
+			}
+		}
+		records, err := svc.GetHistory(ctx, input.Type, input.Key, from, to, input.Limit)
+		if err != nil {
+			return errResult(err.Error()), nil, nil
+		}
+		data := make([]HistoryResponse, 0, len(records))
+		for _, rec := range records {
+			data = append(data, historyToResponse(rec))
+		}
+		return textResult(data), nil, nil
 	})
 }
@@ -0,0 +1,91 @@
+package hmstt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/rs/zerolog"
+)
+
+var ErrInvalidName = errors.New("INVALID TYPE OR KEY NAME")
+
+const (
+	// MaxTypeLength and MaxKeyLength bound the names of types and keys.
+	MaxTypeLength = 32
+	MaxKeyLength  = 64
+)
+
+// Types and keys become segments of the AMQP routing key
+// hmstt_channel.hmstt.{type}.{key} and of the MQTT topics bridged from it, so
+// they must not contain the separators '.' and '/', the wildcards '*', '#'
+// and '+', or spaces. Upper case is rejected as well because topic matching
+// is case-sensitive and the firmware uses lower case.
+var namePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// reservedNames collide with routes such as GET /v1/states/{type}/batch.
+var reservedNames = map[string]bool{"batch": true}
+
+// nameProblems returns what is wrong with name under the naming policy; none
+// if it is valid.
+func nameProblems(name string, maxLen int) []string {
+	var problems []string
+	if len(name) > maxLen {
+		problems = append(problems, fmt.Sprintf("longer than %d characters", maxLen))
+	}
+	if !namePattern.MatchString(name) {
+		problems = append(problems, "must be lowercase letters, digits, '_' or '-', starting with a letter or digit")
+	}
+	if reservedNames[name] {
+		problems = append(problems, fmt.Sprintf("%q is reserved", name))
+	}
+	return problems
+}
+
+// ValidateName checks a type and key against the naming policy. New states
+// must pass it; states created before the policy stay writable and are
+// listed by NamingViolations.
+func ValidateName(tipe, key string) error {
+	if p := nameProblems(tipe, MaxTypeLength); len(p) > 0 {
+		return fmt.Errorf("%w: type %q %s", ErrInvalidName, tipe, p[0])
+	}
+	if p := nameProblems(key, MaxKeyLength); len(p) > 0 {
+		return fmt.Errorf("%w: key %q %s", ErrInvalidName, key, p[0])
+	}
+	return nil
+}
+
+// NamingViolation is a stored state whose type or key breaks the naming
+// policy.
+type NamingViolation struct {
+	Type         string
+	Key          string
+	TypeProblems []string
+	KeyProblems  []string
+}
+
+// NamingViolations lists the stored states that break the naming policy,
+// sorted by type and key, so they can be renamed before they break routing.
+func (s *HmsttService) NamingViolations(ctx context.Context) ([]NamingViolation, error) {
+	l := zerolog.Ctx(ctx)
+
+	entries, err := s.store.GetAll(ctx)
+	if err != nil {
+		l.Error().Err(err).Msg("NamingViolations: GetAll failed")
+		return nil, errors.New("GET ALL STATES ERROR")
+	}
+	var violations []NamingViolation
+	for _, e := range entries {
+		v := NamingViolation{
+			Type:         e.Type,
+			Key:          e.K,
+			TypeProblems: nameProblems(e.Type, MaxTypeLength),
+			KeyProblems:  nameProblems(e.K, MaxKeyLength),
+		}
+		if len(v.TypeProblems) > 0 || len(v.KeyProblems) > 0 {
+			violations = append(violations, v)
+		}
+	}
+	return violations, nil
+}
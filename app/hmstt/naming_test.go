@@ -0,0 +1,126 @@
+package hmstt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nurhudajoantama/hmauto/app/server"
+)
+
+func TestValidateName(t *testing.T) {
+	valid := [][2]string{{"switch", "modem"}, {"switch", "server_1"}, {"dimmer", "living-room"}, {"sensor", "0x1f"}}
+	for _, n := range valid {
+		if err := ValidateName(n[0], n[1]); err != nil {
+			t.Fatalf("ValidateName(%q, %q) error = %v", n[0], n[1], err)
+		}
+	}
+
+	invalid := [][2]string{
+		{"switch", "living.room"},
+		{"switch", "lamp/1"},
+		{"switch", "lamp#"},
+		{"switch", "lamp*"},
+		{"switch", "lamp+"},
+		{"switch", "desk lamp"},
+		{"switch", "Modem"},
+		{"switch", "_modem"},
+		{"switch", "batch"},
+		{"switch", ""},
+		{"switch", strings.Repeat("k", MaxKeyLength+1)},
+		{strings.Repeat("t", MaxTypeLength+1), "modem"},
+		{"sw.itch", "modem"},
+	}
+	for _, n := range invalid {
+		if err := ValidateName(n[0], n[1]); !errors.Is(err, ErrInvalidName) {
+			t.Fatalf("ValidateName(%q, %q) error = %v, want %v", n[0], n[1], err, ErrInvalidName)
+		}
+	}
+}
+
+func TestNamingPolicyOnlyForNewStates(t *testing.T) {
+	ctx := context.Background()
+	store := &fakeStateStore{states: map[string][]StateEntry{
+		"switch": {{Type: "switch", K: "living.room", Value: "on", Revision: 1}},
+	}, seq: 1}
+	svc := NewService(store, nil, nil)
+
+	if _, err := svc.CreateState(ctx, "switch", "desk lamp", "on", "", nil, nil); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("CreateState(bad key) error = %v, want %v", err, ErrInvalidName)
+	}
+	if _, err := svc.SetState(ctx, "switch", "desk.lamp", "on", nil, nil, nil); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("SetState(new bad key) error = %v, want %v", err, ErrInvalidName)
+	}
+	results, err := svc.BatchSetStates(ctx, []BatchSetItem{
+		{Type: "switch", Key: "living.room", Value: "off"},
+		{Type: "switch", Key: "desk#lamp", Value: "off"},
+	})
+	if !errors.Is(err, ErrBatchInvalid) || results[1].Status != BATCH_STATUS_INVALID {
+		t.Fatalf("BatchSetStates(new bad key) = %+v, %v, want the new key invalid", results, err)
+	}
+
+	// A state stored before the policy stays writable.
+	if _, err := svc.SetState(ctx, "switch", "living.room", "off", nil, nil, nil); err != nil {
+		t.Fatalf("SetState(existing bad key) error = %v", err)
+	}
+	if _, err := svc.BatchSetStates(ctx, []BatchSetItem{{Type: "switch", Key: "living.room", Value: "on"}}); err != nil {
+		t.Fatalf("BatchSetStates(existing bad key) error = %v", err)
+	}
+}
+
+func TestNamingViolationsReport(t *testing.T) {
+	store := &fakeStateStore{states: map[string][]StateEntry{
+		"switch": {
+			{Type: "switch", K: "modem", Value: "on"},
+			{Type: "switch", K: "living.room", Value: "on"},
+			{Type: "switch", K: "batch", Value: "on"},
+		},
+		"Sensor": {{Type: "Sensor", K: "temp", Value: "21"}},
+	}}
+	svc := NewService(store, nil, nil)
+	srv := server.NewWithConfig(":0", &server.ServerConfig{BearerToken: "test-token", MaxRequestSize: 1 << 20})
+	RegisterHandlers(srv, svc)
+
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer test-token")
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		srv.GetRouter().ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := do(http.MethodGet, "/v1/states:namingViolations", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("report status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	var resp struct {
+		Data []NamingViolationResponse `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode report: %v", err)
+	}
+	if len(resp.Data) != 3 {
+		t.Fatalf("report = %+v, want 3 violations", resp.Data)
+	}
+	if v := resp.Data[0]; v.Type != "Sensor" || len(v.TypeProblems) != 1 || len(v.KeyProblems) != 0 {
+		t.Fatalf("report[0] = %+v, want the Sensor type", v)
+	}
+	if v := resp.Data[1]; v.Key != "batch" || len(v.KeyProblems) != 1 {
+		t.Fatalf("report[1] = %+v, want the reserved key", v)
+	}
+
+	for _, body := range []string{
+		`{"type":"switch","key":"desk.lamp","value":"on","description":"d"}`,
+		`{"type":"switch","key":"Desk","value":"on","description":"d"}`,
+		`{"type":"switch","key":"batch","value":"on","description":"d"}`,
+	} {
+		if rr := do(http.MethodPost, "/v1/states", body); rr.Code != http.StatusBadRequest {
+			t.Fatalf("create %s status = %d, want %d", body, rr.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package hmstt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+)
+
+var hmsttStateReportsTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "hmstt_state_reports_total",
+		Help: "Total number of values reported by devices.",
+	},
+	[]string{"type", "in_sync"},
+)
+
+var hmsttReportAckLatency = promauto.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "hmstt_report_ack_latency_seconds",
+		Help:    "Time from a desired value change until a device reports it.",
+		Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300},
+	},
+	[]string{"type"},
+)
+
+// errReportGet and errReportSet are store failures of ReportState, such as
+// Redis being unreachable; unlike its other errors they may pass when the
+// report is tried again.
+var errReportGet = errors.New("GET STATE ERROR")
+var errReportSet = errors.New("SET STATE ERROR")
+
+// ReportedState is the value a device last reported for a state, as opposed
+// to the desired Value set through the API.
+type ReportedState struct {
+	Value      string
+	Structured bool
+	ReportedAt time.Time
+}
+
+// InSync reports whether the device has reported the desired value. known is
+// false for states no device has ever reported; they are neither in nor out
+// of sync.
+func (e StateEntry) InSync() (inSync, known bool) {
+	if e.Reported == nil {
+		return false, false
+	}
+	return e.Reported.Value == e.Value, true
+}
+
+// OutOfSync reports whether a device has reported a value other than the
+// desired one, e.g. because it has not applied the last command yet.
+func (e StateEntry) OutOfSync() bool {
+	inSync, known := e.InSync()
+	return known && !inSync
+}
+
+// stampDesired sets after.DesiredAt: now if the write changes the desired
+// value, otherwise the time carried over from before.
+func stampDesired(before StateEntry, after *StateEntry) {
+	if before.Value != after.Value {
+		after.DesiredAt = time.Now().UTC()
+		return
+	}
+	after.DesiredAt = before.DesiredAt
+}
+
+// ReportState records the value a device reports for an existing state. The
+// desired value is left alone and nothing is published, so a report never
+// turns into a command. Reports are kept apart from the entry, so they do not
+// change its revision: timers, If-Match writes and waits on the revision are
+// not disturbed by them. The first report that matches a new desired value
+// is its acknowledgement; the time since DesiredAt is recorded as ack
+// latency. Reports are facts about the device, so locks and constraints do
+// not apply; the value must still be valid for the type.
+func (s *HmsttService) ReportState(ctx context.Context, tipe, key, value string) (StateEntry, error) {
+	l := zerolog.Ctx(ctx)
+	l.UpdateContext(func(c zerolog.Context) zerolog.Context {
+		return c.Str("hmstt_type", tipe).Str("hmstt_key", key).Str("hmstt_reported", value)
+	})
+	l.Info().Msg("Handling ReportState service")
+
+	value, structured, err := s.prepareValue(tipe, key, value)
+	if err != nil {
+		return StateEntry{}, err
+	}
+
+	current, err := s.store.GetState(ctx, tipe, key)
+	if errors.Is(err, ErrStateNotFound) || errors.Is(err, redis.Nil) {
+		return StateEntry{}, ErrStateNotFound
+	}
+	if errors.Is(err, ErrCorruptState) {
+		l.Error().Err(err).Msg("ReportState: stored state cannot be decoded")
+		return StateEntry{}, ErrCorruptState
+	}
+	if err != nil {
+		l.Error().Err(err).Msg("ReportState failed")
+		return StateEntry{}, errReportGet
+	}
+	entry := current
+	entry.Reported = &ReportedState{Value: value, Structured: structured, ReportedAt: time.Now().UTC()}
+	err = s.store.SetReported(ctx, tipe, key, *entry.Reported)
+	if errors.Is(err, ErrStateNotFound) {
+		return StateEntry{}, ErrStateNotFound
+	}
+	if err != nil {
+		l.Error().Err(err).Msg("ReportState failed")
+		return StateEntry{}, errReportSet
+	}
+
+	s.stateOwnerSeen(ctx, tipe, key)
+	inSync, _ := entry.InSync()
+	if inSync {
+		s.ackCommand(ctx, entry)
+	}
+	hmsttStateReportsTotal.WithLabelValues(tipe, strconv.FormatBool(inSync)).Inc()
+	if wasInSync, _ := current.InSync(); inSync && !wasInSync && !entry.DesiredAt.IsZero() {
+		hmsttReportAckLatency.WithLabelValues(tipe).Observe(entry.Reported.ReportedAt.Sub(entry.DesiredAt).Seconds())
+	}
+	return entry, nil
+}
+
+// reportedKey is the hash of the reports of tipe, one field per key. It is
+// kept apart from the type hash so that a report does not rewrite the entry.
+func (s *HmsttStore) reportedKey(tipe string) string {
+	return s.prefix + ":hmstt_reported:" + tipe
+}
+
+type reportedJSON struct {
+	Value      json.RawMessage `json:"value"`
+	ReportedAt time.Time       `json:"reported_at"`
+}
+
+func encodeReported(r ReportedState) ([]byte, error) {
+	v, err := encodeValue(r.Value, r.Structured)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(reportedJSON{Value: v, ReportedAt: r.ReportedAt})
+}
+
+// decodeReported returns nil for a missing or undecodable report, so a bad
+// report never hides the state itself.
+func decodeReported(data string) *ReportedState {
+	if data == "" {
+		return nil
+	}
+	var raw reportedJSON
+	if err := json.Unmarshal([]byte(data), &raw); err != nil {
+		return nil
+	}
+	r := &ReportedState{ReportedAt: raw.ReportedAt}
+	r.Value, r.Structured = decodeValue(raw.Value)
+	return r
+}
+
+// setReportedScript writes a report only while its state exists, so a report
+// racing a delete does not leave an orphan behind.
+// KEYS: hash, reported hash. ARGV: field, report.
+var setReportedScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[2])
+return 1
+`)
+
+func (s *HmsttStore) SetReported(ctx context.Context, tipe, k string, r ReportedState) error {
+	ctx, span := otel.Tracer("hmstt").Start(ctx, "store.SetReported")
+	defer span.End()
+
+	data, err := encodeReported(r)
+	if err != nil {
+		return fmt.Errorf("marshal reported state: %w", err)
+	}
+	n, err := setReportedScript.Run(ctx, s.rdb, []string{s.redisKey(tipe), s.reportedKey(tipe)}, k, data).Int()
+	if err != nil {
+		return fmt.Errorf("redis set reported script: %w", err)
+	}
+	if n == 0 {
+		return ErrStateNotFound
+	}
+	return nil
+}
+
+// attachReported sets Reported on entries of tipe from the reported hash.
+func (s *HmsttStore) attachReported(ctx context.Context, tipe string, entries []StateEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	keys := make([]string, len(entries))
+	for i, e := range entries {
+		keys[i] = e.K
+	}
+	vals, err := s.rdb.HMGet(ctx, s.reportedKey(tipe), keys...).Result()
+	if err != nil {
+		return fmt.Errorf("redis HMGET reported: %w", err)
+	}
+	for i, v := range vals {
+		data, _ := v.(string)
+		entries[i].Reported = decodeReported(data)
+	}
+	return nil
+}
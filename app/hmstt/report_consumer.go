@@ -0,0 +1,59 @@
+package hmstt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/nurhudajoantama/hmauto/internal/rabbitmq"
+	amqp "github.com/rabbitmq/amqp091-go"
+	log "github.com/rs/zerolog/log"
+)
+
+// parseReportRoutingKey takes the type and key from the last two segments of
+// a report routing key, e.g. hmstt_report.hmstt.switch.modem, which is what
+// an MQTT bridge makes of the topic hmstt_report/hmstt/switch/modem.
+func parseReportRoutingKey(routing string) (tipe, key string, err error) {
+	parts := strings.Split(routing, KEY_DELIMITER)
+	if len(parts) < 2 || parts[len(parts)-2] == "" || parts[len(parts)-1] == "" {
+		return "", "", fmt.Errorf("routing key %q does not end in {type}.{key}", routing)
+	}
+	return parts[len(parts)-2], parts[len(parts)-1], nil
+}
+
+// HandleReport is the rabbitmq.Handler for device reports. The body is the
+// reported value: plain text, or a JSON document for json-kind types.
+// Tombstones and empty bodies (a cleared retained topic) are ignored. A bad
+// routing key, a missing or corrupt state or an invalid value is a permanent
+// error and drops the delivery; a store failure is returned as is, so it is
+// requeued.
+func (s *HmsttService) HandleReport(ctx context.Context, d amqp.Delivery) error {
+	if deleted, _ := d.Headers["x-hmstt-deleted"].(bool); deleted || d.Type == EVENT_STATE_DELETED {
+		return nil
+	}
+	tipe, key, err := parseReportRoutingKey(d.RoutingKey)
+	if err != nil {
+		return rabbitmq.Permanent(err)
+	}
+	body := d.Body
+	if d.ContentType != "application/json" {
+		body = bytes.TrimSpace(body)
+	}
+	if len(body) == 0 {
+		return nil
+	}
+
+	l := log.With().Str("component", "hmstt_reports").Logger()
+	ctx = l.WithContext(ctx)
+	_, err = s.ReportState(ctx, tipe, key, string(body))
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, errReportGet), errors.Is(err, errReportSet):
+		return fmt.Errorf("report %s/%s: %w", tipe, key, err)
+	default:
+		return rabbitmq.Permanent(fmt.Errorf("report %s/%s: %w", tipe, key, err))
+	}
+}
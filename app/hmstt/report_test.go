@@ -0,0 +1,265 @@
+package hmstt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nurhudajoantama/hmauto/app/server"
+	"github.com/nurhudajoantama/hmauto/internal/rabbitmq"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type countingListener struct{ n int }
+
+func (c *countingListener) StateChanged(context.Context, StateEntry) { c.n++ }
+
+func TestReportState(t *testing.T) {
+	ctx := context.Background()
+	store := newSwitchStore()
+	svc := NewService(store, nil, nil)
+	listener := &countingListener{}
+	svc.AddChangeListener(listener)
+
+	if _, known := (StateEntry{Value: "on"}).InSync(); known {
+		t.Fatalf("InSync() known for a state without reports")
+	}
+	if _, err := svc.ReportState(ctx, "switch", "missing", "on"); !errors.Is(err, ErrStateNotFound) {
+		t.Fatalf("ReportState(missing) error = %v, want %v", err, ErrStateNotFound)
+	}
+
+	entry, err := svc.ReportState(ctx, "switch", "modem", "off")
+	if err != nil {
+		t.Fatalf("ReportState() error = %v", err)
+	}
+	if entry.Value != "on" || entry.Reported.Value != "off" || entry.Reported.ReportedAt.IsZero() {
+		t.Fatalf("ReportState() = %+v, want desired on and reported off", entry)
+	}
+	if !entry.OutOfSync() {
+		t.Fatalf("OutOfSync() = false, want true")
+	}
+	if listener.n != 0 {
+		t.Fatalf("ReportState() notified %d listeners, want none", listener.n)
+	}
+
+	// Changing the desired value keeps the report until the device reports again.
+	entry, err = svc.SetState(ctx, "switch", "modem", "off", nil, nil, nil)
+	if err != nil {
+		t.Fatalf("SetState() error = %v", err)
+	}
+	if inSync, known := entry.InSync(); !known || !inSync {
+		t.Fatalf("InSync() after SetState = %v, %v, want true, true", inSync, known)
+	}
+	if _, err := svc.ToggleState(ctx, "switch", "modem"); err != nil {
+		t.Fatalf("ToggleState() error = %v", err)
+	}
+	if got, _ := store.GetState(ctx, "switch", "modem"); got.Reported == nil || !got.OutOfSync() {
+		t.Fatalf("after toggle = %+v, want the report kept and out of sync", got)
+	}
+
+	// Reports are facts about the device; locks do not stop them.
+	if _, err := svc.LockState(ctx, "switch", "modem", "maintenance", "budi", 0); err != nil {
+		t.Fatalf("LockState() error = %v", err)
+	}
+	if _, err := svc.ReportState(ctx, "switch", "modem", "on"); err != nil {
+		t.Fatalf("ReportState(locked) error = %v", err)
+	}
+}
+
+func TestReportedEncoding(t *testing.T) {
+	at := time.Date(2026, 3, 16, 12, 35, 1, 0, time.UTC)
+	for _, want := range []ReportedState{
+		{Value: "off", ReportedAt: at},
+		{Value: `{"r":1}`, Structured: true, ReportedAt: at},
+	} {
+		data, err := encodeReported(want)
+		if err != nil {
+			t.Fatalf("encodeReported() error = %v", err)
+		}
+		if got := decodeReported(string(data)); got == nil || *got != want {
+			t.Fatalf("round trip reported = %+v, want %+v", got, want)
+		}
+	}
+	if got := decodeReported(""); got != nil {
+		t.Fatalf("decodeReported(\"\") = %+v, want nil", got)
+	}
+}
+
+func TestReportHandlers(t *testing.T) {
+	store := &fakeStateStore{states: map[string][]StateEntry{
+		"switch": {
+			{Type: "switch", K: "modem", Value: "on", Revision: 1},
+			{Type: "switch", K: "router", Value: "on", Revision: 2},
+			{Type: "switch", K: "fan", Value: "off", Revision: 3},
+		},
+	}, seq: 3}
+	svc := NewService(store, nil, nil)
+	srv := server.NewWithConfig(":0", &server.ServerConfig{BearerToken: "test-token", MaxRequestSize: 1 << 20})
+	RegisterHandlers(srv, svc)
+
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer test-token")
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		srv.GetRouter().ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := do(http.MethodPost, "/v1/states/switch/missing/reported", `{"value":"on"}`); rr.Code != http.StatusNotFound {
+		t.Fatalf("report missing status = %d, want %d", rr.Code, http.StatusNotFound)
+	}
+	if rr := do(http.MethodPost, "/v1/states/switch/modem/reported", `{}`); rr.Code != http.StatusBadRequest {
+		t.Fatalf("report without value status = %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+	rr := do(http.MethodPost, "/v1/states/switch/modem/reported", `{"value":"off"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("report status = %d, want %d: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+	var resp struct {
+		Data StateResponse `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode report response: %v", err)
+	}
+	if resp.Data.Value != "on" || resp.Data.Reported != "off" || resp.Data.InSync == nil || *resp.Data.InSync || resp.Data.ReportedAt == "" {
+		t.Fatalf("report response = %+v, want desired on, reported off, not in sync", resp.Data)
+	}
+	do(http.MethodPost, "/v1/states/switch/router/reported", `{"value":"on"}`)
+
+	rr = do(http.MethodGet, "/v1/states?out_of_sync=true", "")
+	var list struct {
+		Data []StateResponse `json:"data"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &list)
+	if rr.Code != http.StatusOK || len(list.Data) != 1 || list.Data[0].Key != "modem" {
+		t.Fatalf("GET /v1/states?out_of_sync=true = %d %+v, want only modem", rr.Code, list.Data)
+	}
+	if rr := do(http.MethodGet, "/v1/states/switch?out_of_sync=maybe", ""); rr.Code != http.StatusBadRequest {
+		t.Fatalf("bad out_of_sync status = %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+
+	rr = do(http.MethodGet, "/v1/states/switch/fan", "")
+	if strings.Contains(rr.Body.String(), "in_sync") {
+		t.Fatalf("state without reports = %s, want no in_sync field", rr.Body)
+	}
+}
+
+func TestDesiredAtOnlyMovesWithValue(t *testing.T) {
+	ctx := context.Background()
+	store := newSwitchStore()
+	svc := NewService(store, nil, nil)
+
+	entry, err := svc.SetState(ctx, "switch", "modem", "off", nil, nil, nil)
+	if err != nil {
+		t.Fatalf("SetState() error = %v", err)
+	}
+	desiredAt := entry.DesiredAt
+	if desiredAt.IsZero() {
+		t.Fatalf("SetState() DesiredAt is zero")
+	}
+
+	desc := "cable modem"
+	if entry, _ = svc.SetState(ctx, "switch", "modem", "off", &desc, nil, nil); !entry.DesiredAt.Equal(desiredAt) {
+		t.Fatalf("DesiredAt after same value = %v, want %v", entry.DesiredAt, desiredAt)
+	}
+	if entry, _ = svc.ReportState(ctx, "switch", "modem", "on"); !entry.DesiredAt.Equal(desiredAt) {
+		t.Fatalf("DesiredAt after report = %v, want %v", entry.DesiredAt, desiredAt)
+	}
+	if entry, _ = svc.ToggleState(ctx, "switch", "modem"); entry.DesiredAt.Before(desiredAt) || entry.DesiredAt.Equal(desiredAt) {
+		t.Fatalf("DesiredAt after toggle = %v, want later than %v", entry.DesiredAt, desiredAt)
+	}
+
+	data, _ := encodeEntry(entry)
+	if got, _ := decodeEntry("switch", "modem", data); !got.DesiredAt.Equal(entry.DesiredAt) {
+		t.Fatalf("round trip DesiredAt = %v, want %v", got.DesiredAt, entry.DesiredAt)
+	}
+}
+
+func TestParseReportRoutingKey(t *testing.T) {
+	tipe, key, err := parseReportRoutingKey("hmstt_report.hmstt.switch.modem")
+	if err != nil || tipe != "switch" || key != "modem" {
+		t.Fatalf("parseReportRoutingKey() = %q, %q, %v, want switch, modem", tipe, key, err)
+	}
+	for _, routing := range []string{"modem", "hmstt_report.hmstt.switch.", ""} {
+		if _, _, err := parseReportRoutingKey(routing); err == nil {
+			t.Fatalf("parseReportRoutingKey(%q) error = nil", routing)
+		}
+	}
+}
+
+func TestHandleReport(t *testing.T) {
+	ctx := context.Background()
+	store := newSwitchStore()
+	svc := NewService(store, nil, nil)
+
+	if err := svc.HandleReport(ctx, amqp.Delivery{RoutingKey: "hmstt_report.hmstt.switch.modem", Body: []byte("off\n")}); err != nil {
+		t.Fatalf("HandleReport() error = %v", err)
+	}
+	if got, _ := store.GetState(ctx, "switch", "modem"); got.Reported == nil || got.Reported.Value != "off" {
+		t.Fatalf("after report = %+v, want reported off", got.Reported)
+	}
+
+	tombstone := amqp.Delivery{RoutingKey: "hmstt_report.hmstt.switch.modem", Headers: amqp.Table{"x-hmstt-deleted": true}}
+	if err := svc.HandleReport(ctx, tombstone); err != nil {
+		t.Fatalf("HandleReport(tombstone) error = %v", err)
+	}
+	err := svc.HandleReport(ctx, amqp.Delivery{RoutingKey: "hmstt_report.hmstt.switch.missing", Body: []byte("on")})
+	if !errors.Is(err, ErrStateNotFound) || !errors.Is(err, rabbitmq.ErrPermanent) {
+		t.Fatalf("HandleReport(missing) error = %v, want permanent %v", err, ErrStateNotFound)
+	}
+	err = svc.HandleReport(ctx, amqp.Delivery{RoutingKey: "hmstt_report.hmstt.switch.modem", Body: []byte("dim")})
+	if !errors.Is(err, ErrInvalidValue) || !errors.Is(err, rabbitmq.ErrPermanent) {
+		t.Fatalf("HandleReport(invalid) error = %v, want permanent %v", err, ErrInvalidValue)
+	}
+	err = svc.HandleReport(ctx, amqp.Delivery{RoutingKey: "modem", Body: []byte("on")})
+	if !errors.Is(err, rabbitmq.ErrPermanent) {
+		t.Fatalf("HandleReport(bad routing key) error = %v, want permanent", err)
+	}
+}
+
+// unavailableReportStore fails every report write, like a store that is down.
+type unavailableReportStore struct{ StateStore }
+
+func (unavailableReportStore) SetReported(context.Context, string, string, ReportedState) error {
+	return errors.New("connection refused")
+}
+
+// unreachableStore fails every read, like a store that cannot be reached.
+type unreachableStore struct{ StateStore }
+
+func (unreachableStore) GetState(context.Context, string, string) (StateEntry, error) {
+	return StateEntry{}, errors.New("redis HGET: connection refused")
+}
+
+func TestHandleReportStoreFailureIsRequeued(t *testing.T) {
+	delivery := amqp.Delivery{RoutingKey: "hmstt_report.hmstt.switch.modem", Body: []byte("off")}
+	for name, store := range map[string]StateStore{
+		"write": unavailableReportStore{newSwitchStore()},
+		"read":  unreachableStore{newSwitchStore()},
+	} {
+		err := NewService(store, nil, nil).HandleReport(context.Background(), delivery)
+		if err == nil || errors.Is(err, rabbitmq.ErrPermanent) {
+			t.Fatalf("HandleReport() with a failing %s error = %v, want a transient error", name, err)
+		}
+	}
+}
+
+func TestHandleReportCorruptStateIsDropped(t *testing.T) {
+	ctx := context.Background()
+	store := newRedisStore(t)
+	if err := store.rdb.HSet(ctx, store.redisKey("switch"), "modem", "{not json").Err(); err != nil {
+		t.Fatalf("HSET error = %v", err)
+	}
+	svc := NewService(store, nil, nil)
+
+	err := svc.HandleReport(ctx, amqp.Delivery{RoutingKey: "hmstt_report.hmstt.switch.modem", Body: []byte("off")})
+	if !errors.Is(err, ErrCorruptState) || !errors.Is(err, rabbitmq.ErrPermanent) {
+		t.Fatalf("HandleReport(corrupt) error = %v, want permanent %v", err, ErrCorruptState)
+	}
+}
@@ -0,0 +1,137 @@
+package hmstt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/nurhudajoantama/hmauto/app/server"
+)
+
+func TestIfMatchHandlers(t *testing.T) {
+	store := &fakeStateStore{}
+	svc := NewService(store, nil, nil)
+	srv := server.NewWithConfig(":0", &server.ServerConfig{BearerToken: "test-token", MaxRequestSize: 1 << 20})
+	RegisterHandlers(srv, svc)
+
+	do := func(method, url, body, ifMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer test-token")
+		req.Header.Set("Content-Type", "application/json")
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		rr := httptest.NewRecorder()
+		srv.GetRouter().ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := do(http.MethodPost, "/v1/states", `{"type":"switch","key":"modem","value":"on","description":"Modem power"}`, "")
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create status = %d, want %d: %s", rr.Code, http.StatusCreated, rr.Body)
+	}
+	etag := rr.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("create response has no ETag")
+	}
+
+	rr = do(http.MethodPut, "/v1/states/switch/modem", `{"value":"off"}`, etag)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("put with current revision status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	if rr.Header().Get("ETag") == etag {
+		t.Fatal("ETag did not change after update")
+	}
+
+	if rr := do(http.MethodPut, "/v1/states/switch/modem", `{"value":"on"}`, etag); rr.Code != http.StatusPreconditionFailed {
+		t.Fatalf("put with stale revision status = %d, want %d", rr.Code, http.StatusPreconditionFailed)
+	}
+	if rr := do(http.MethodPatch, "/v1/states/switch/modem", `{"description":"x"}`, etag); rr.Code != http.StatusPreconditionFailed {
+		t.Fatalf("patch with stale revision status = %d, want %d", rr.Code, http.StatusPreconditionFailed)
+	}
+	if rr := do(http.MethodPut, "/v1/states/switch/modem", `{"value":"on"}`, "nope"); rr.Code != http.StatusBadRequest {
+		t.Fatalf("put with malformed If-Match status = %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+	if rr := do(http.MethodPut, "/v1/states/switch/modem", `{"value":"on"}`, ""); rr.Code != http.StatusOK {
+		t.Fatalf("put without If-Match status = %d, want %d", rr.Code, http.StatusOK)
+	}
+}
+
+func TestConcurrentCreateStateHasOneWinner(t *testing.T) {
+	store := &fakeStateStore{}
+	svc := NewService(store, nil, nil)
+
+	const n = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := svc.CreateState(context.Background(), "switch", "modem", "on", "Modem power", nil, nil)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	created := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			created++
+		case !errors.Is(err, ErrStateAlreadyExists):
+			t.Fatalf("CreateState() error = %v, want %v", err, ErrStateAlreadyExists)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("successful creates = %d, want 1", created)
+	}
+	if store.history != 1 {
+		t.Fatalf("history records = %d, want 1", store.history)
+	}
+}
+
+func TestIfMatchHeaderForms(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		url     string
+		ifMatch string
+		want    int
+	}{
+		{"current revision", http.MethodPut, "/v1/states/switch/modem", `"1"`, http.StatusOK},
+		{"weak tag never matches", http.MethodPut, "/v1/states/switch/modem", `W/"1"`, http.StatusPreconditionFailed},
+		{"list containing the revision", http.MethodPut, "/v1/states/switch/modem", `"3", "1"`, http.StatusOK},
+		{"list of other tags", http.MethodPut, "/v1/states/switch/modem", `"3",W/"1" , "x"`, http.StatusPreconditionFailed},
+		{"star on existing state", http.MethodPut, "/v1/states/switch/modem", `*`, http.StatusOK},
+		{"star on missing state", http.MethodPut, "/v1/states/switch/new", `*`, http.StatusPreconditionFailed},
+		{"tag on missing state", http.MethodPut, "/v1/states/switch/new", `"0"`, http.StatusPreconditionFailed},
+		{"star on missing state for patch", http.MethodPatch, "/v1/states/switch/new", `*`, http.StatusNotFound},
+		{"unquoted tag", http.MethodPut, "/v1/states/switch/modem", `1`, http.StatusBadRequest},
+		{"unterminated tag", http.MethodPut, "/v1/states/switch/modem", `"1`, http.StatusBadRequest},
+		{"tags without comma", http.MethodPut, "/v1/states/switch/modem", `"1" "2"`, http.StatusBadRequest},
+		{"star in a list", http.MethodPut, "/v1/states/switch/modem", `"1", *`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := NewService(newSwitchStore(), nil, nil)
+			srv := server.NewWithConfig(":0", &server.ServerConfig{BearerToken: "test-token", MaxRequestSize: 1 << 20})
+			RegisterHandlers(srv, svc)
+
+			req := httptest.NewRequest(tt.method, tt.url, bytes.NewBufferString(`{"value":"off"}`))
+			req.Header.Set("Authorization", "Bearer test-token")
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("If-Match", tt.ifMatch)
+			rr := httptest.NewRecorder()
+			srv.GetRouter().ServeHTTP(rr, req)
+			if rr.Code != tt.want {
+				t.Fatalf("If-Match %s status = %d, want %d: %s", tt.ifMatch, rr.Code, tt.want, rr.Body)
+			}
+		})
+	}
+}
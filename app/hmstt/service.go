@@ -3,15 +3,55 @@ package hmstt
 import (
 	"context"
 	"errors"
+	"slices"
+	"sort"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/xid"
 	"github.com/rs/zerolog"
 )
 
 var ErrStateAlreadyExists = errors.New("STATE ALREADY EXISTS")
 var ErrStateNotFound = errors.New("STATE NOT FOUND")
 var ErrNothingToUpdate = errors.New("NOTHING TO UPDATE")
+var ErrConfirmationRequired = errors.New("CONFIRMATION REQUIRED")
+var ErrRevisionMismatch = errors.New("REVISION MISMATCH")
+
+// Precondition limits a write to certain revisions of a state, as If-Match
+// does. Any ("*") only requires the state to exist; otherwise it must be at
+// one of Revisions. A nil *Precondition always holds.
+type Precondition struct {
+	Any       bool
+	Revisions []int64
+}
+
+// IfRevision is the precondition that the state is at rev, or none if rev is
+// nil.
+func IfRevision(rev *int64) *Precondition {
+	if rev == nil {
+		return nil
+	}
+	return &Precondition{Revisions: []int64{*rev}}
+}
+
+// holds reports whether current, which exists or not, meets p.
+func (p *Precondition) holds(current StateEntry, exists bool) bool {
+	if p == nil {
+		return true
+	}
+	if !exists {
+		return false
+	}
+	return p.Any || slices.Contains(p.Revisions, current.Revision)
+}
+
+// maxWriteAttempts bounds how often a write is retried when another writer
+// commits between our read and our compare-and-set. An If-Match write is
+// retried too, since it may have lost to a write of a state its constraints
+// read; if its own state changed, the next read fails the If-Match.
+const maxWriteAttempts = 5
 
 var hmsttStateChangesTotal = promauto.NewCounterVec(
 	prometheus.CounterOpts{
@@ -21,18 +61,81 @@ var hmsttStateChangesTotal = promauto.NewCounterVec(
 	[]string{"type"},
 )
 
+var hmsttStateDeletionsTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "hmstt_state_deletions_total",
+		Help: "Total number of deleted states.",
+	},
+	[]string{"type"},
+)
+
+// ServiceConfig holds optional collaborators for the service.
+type ServiceConfig struct {
+	Types       *TypeRegistry
+	Constraints *ConstraintSet
+	// Commands turns on delivery tracking of published values; nil leaves
+	// it off.
+	Commands *CommandConfig
+	// Relay shares changes with other instances for waiting batch reads;
+	// nil only wakes the waits of this instance.
+	Relay ChangeRelay
+}
+
+// ChangeListener is notified after a value change has been committed and
+// published. It runs on the writer's goroutine with the writer's context.
+type ChangeListener interface {
+	StateChanged(ctx context.Context, entry StateEntry)
+}
+
 type HmsttService struct {
-	store StateStore
-	event *HmsttEvent
+	store       StateStore
+	event       *HmsttEvent
+	types       *TypeRegistry
+	constraints *ConstraintSet
+	listeners   []ChangeListener
+	devices     DeviceRegistry
+	commands    *CommandConfig
+	notifier    *ChangeNotifier
+	relay       ChangeRelay
+	origin      string // tells this instance's change notices from others
 }
 
-func NewService(hmsttStore StateStore, hmsttEvent *HmsttEvent) *HmsttService {
+func NewService(hmsttStore StateStore, hmsttEvent *HmsttEvent, cfg *ServiceConfig) *HmsttService {
+	if cfg == nil {
+		cfg = &ServiceConfig{}
+	}
+	if cfg.Types == nil {
+		cfg.Types = DefaultTypeRegistry()
+	}
 	return &HmsttService{
-		store: hmsttStore,
-		event: hmsttEvent,
+		store:       hmsttStore,
+		event:       hmsttEvent,
+		types:       cfg.Types,
+		constraints: cfg.Constraints,
+		commands:    cfg.Commands,
+		notifier:    NewChangeNotifier(),
+		relay:       cfg.Relay,
+		origin:      xid.New().String(),
 	}
 }
 
+// Types returns the registered state types.
+func (s *HmsttService) Types() []TypeDef {
+	return s.types.List()
+}
+
+// Constraints returns the configured constraints.
+func (s *HmsttService) Constraints() []Constraint {
+	return s.constraints.List()
+}
+
+// ValidateValue reports whether value is acceptable for the type, without
+// writing anything.
+func (s *HmsttService) ValidateValue(tipe, key, value string) error {
+	_, _, err := s.prepareValue(tipe, key, value)
+	return err
+}
+
 func (s *HmsttService) GetState(ctx context.Context, tipe, key string) (StateEntry, error) {
 	l := zerolog.Ctx(ctx)
 
@@ -99,135 +202,443 @@ func (s *HmsttService) GetStatesByKeys(ctx context.Context, tipe string, keys []
 	return results, nil
 }
 
-func (s *HmsttService) CreateState(ctx context.Context, tipe, key, value, description string) error {
+// prepareValue validates value against the type registry and returns it in
+// stored form: structured values are canonicalized so equal documents compare
+// equal.
+func (s *HmsttService) prepareValue(tipe, key, value string) (string, bool, error) {
+	if err := s.types.Validate(tipe, key, value); err != nil {
+		return "", false, err
+	}
+	def, _ := s.types.Lookup(tipe)
+	if !def.Structured() {
+		return value, false, nil
+	}
+	canonical, err := canonicalJSON(value)
+	if err != nil {
+		return "", false, err
+	}
+	return canonical, true, nil
+}
+
+// AddChangeListener registers l for committed value changes. Listeners must
+// be added before the service handles requests.
+func (s *HmsttService) AddChangeListener(l ChangeListener) {
+	s.listeners = append(s.listeners, l)
+}
+
+// publishChange records and publishes a committed value change, then
+// notifies the change listeners.
+func (s *HmsttService) publishChange(ctx context.Context, entry StateEntry) {
+	hmsttStateChangesTotal.WithLabelValues(entry.Type).Inc()
+	if s.event != nil {
+		generatedKey := PREFIX_HMSTT + KEY_DELIMITER + entry.Type + KEY_DELIMITER + entry.K
+		if err := s.event.StateChange(ctx, generatedKey, entry.Value, entry.Structured); err != nil {
+			zerolog.Ctx(ctx).Error().Err(err).Msg("StateChange event failed")
+		}
+	}
+	s.trackCommand(ctx, entry)
+	for _, l := range s.listeners {
+		l.StateChanged(ctx, entry)
+	}
+}
+
+// recordHistory appends a change to the key's history. Failures are logged
+// and do not fail the write that has already been committed.
+func (s *HmsttService) recordHistory(ctx context.Context, op string, before, after StateEntry) {
+	if op != HISTORY_OP_CREATE && op != HISTORY_OP_DELETE && op != HISTORY_OP_LOCK && op != HISTORY_OP_UNLOCK &&
+		before.Value == after.Value && before.Description == after.Description {
+		return
+	}
+	tipe, key := after.Type, after.K
+	if op == HISTORY_OP_DELETE {
+		tipe, key = before.Type, before.K
+	}
+	rec := HistoryRecord{
+		Op:             op,
+		OldValue:       before.Value,
+		NewValue:       after.Value,
+		OldDescription: before.Description,
+		NewDescription: after.Description,
+		RequestID:      RequestIDFromContext(ctx),
+		Caller:         CallerFromContext(ctx),
+	}
+	if err := s.store.AppendHistory(ctx, tipe, key, rec); err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("AppendHistory failed")
+	}
+}
+
+// publishDelete records and publishes the removal of a state.
+func (s *HmsttService) publishDelete(ctx context.Context, tipe, key string) {
+	hmsttStateDeletionsTotal.WithLabelValues(tipe).Inc()
+	s.notifyChange(ctx, ChangeNotice{Type: tipe, Key: key, Deleted: true})
+	if s.event == nil {
+		return
+	}
+	generatedKey := PREFIX_HMSTT + KEY_DELIMITER + tipe + KEY_DELIMITER + key
+	if err := s.event.StateDeleted(ctx, generatedKey); err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("StateDeleted event failed")
+	}
+}
+
+// CreateState creates a state, optionally in some groups and with a display
+// name and labels from meta.
+func (s *HmsttService) CreateState(ctx context.Context, tipe, key, value, description string, groups []string, meta *StateMeta) (StateEntry, error) {
 	l := zerolog.Ctx(ctx)
 	l.UpdateContext(func(c zerolog.Context) zerolog.Context {
 		return c.Str("hmstt_type", tipe).Str("hmstt_key", key).Str("hmstt_value", value).Str("hmstt_description", description)
 	})
 	l.Info().Msg("Handling CreateState service")
 
-	if !canTypeChangedWithKey(tipe, key, value) {
-		l.Error().Msg("CreateState: invalid type or key")
-		return errors.New("INVALID TYPE OR KEY")
+	if err := ValidateName(tipe, key); err != nil {
+		return StateEntry{}, err
 	}
-
-	if _, err := s.store.GetState(ctx, tipe, key); err == nil {
-		return ErrStateAlreadyExists
+	value, structured, err := s.prepareValue(tipe, key, value)
+	if err != nil {
+		l.Error().Err(err).Msg("CreateState: invalid value")
+		return StateEntry{}, err
 	}
-
-	if err := s.store.SetState(ctx, tipe, key, value, description); err != nil {
-		l.Error().Err(err).Msg("CreateState failed")
-		return errors.New("SET STATE ERROR")
+	groups, err = normalizeGroups(groups)
+	if err != nil {
+		return StateEntry{}, err
 	}
-	hmsttStateChangesTotal.WithLabelValues(tipe).Inc()
-
-	generatedKey := PREFIX_HMSTT + KEY_DELIMITER + tipe + KEY_DELIMITER + key
-	if err := s.event.StateChange(ctx, generatedKey, value); err != nil {
-		l.Error().Err(err).Msg("StateChange event failed")
+	if err := meta.validate(); err != nil {
+		return StateEntry{}, err
 	}
 
-	return nil
+	// The store checks for an existing key in the same step as the write, so
+	// of concurrent creates only one succeeds and publishes.
+	proposed := StateEntry{Type: tipe, K: key, Value: value, Structured: structured, Description: description, Groups: groups}
+	meta.apply(&proposed)
+	stampDesired(StateEntry{}, &proposed)
+	for attempt := 1; ; attempt++ {
+		guards, err := s.checkConstraints(ctx, []stateChange{{after: proposed}})
+		if err != nil {
+			return StateEntry{}, err
+		}
+
+		var entry StateEntry
+		if len(guards) == 0 {
+			entry, err = s.store.CreateState(ctx, proposed)
+		} else {
+			// A guarded write expecting revision 0 fails if the key exists.
+			entry, err = s.writeState(ctx, proposed, 0, guards)
+			if errors.Is(err, ErrRevisionMismatch) {
+				if _, err := s.store.GetState(ctx, tipe, key); err == nil {
+					return StateEntry{}, ErrStateAlreadyExists
+				}
+				if attempt < maxWriteAttempts {
+					l.Warn().Int("attempt", attempt).Msg("CreateState: concurrent write, retrying")
+					continue
+				}
+				return StateEntry{}, ErrRevisionMismatch
+			}
+		}
+		if err != nil {
+			if errors.Is(err, ErrStateAlreadyExists) {
+				return StateEntry{}, ErrStateAlreadyExists
+			}
+			l.Error().Err(err).Msg("CreateState failed")
+			return StateEntry{}, errors.New("SET STATE ERROR")
+		}
+		s.recordHistory(ctx, HISTORY_OP_CREATE, StateEntry{}, entry)
+		s.notifyWrite(ctx, entry)
+		s.publishChange(ctx, entry)
+
+		return entry, nil
+	}
 }
 
 // SetState updates the value of an existing state entry (creates if not exists).
-// If description is nil, the existing description is preserved.
+// If description is nil, the existing description is preserved; likewise the
+// name and labels unless meta sets them.
+// Structured values are replaced as a whole; use PatchState to merge.
+// If ifMatch is set the write only happens while the entry meets it,
+// otherwise ErrRevisionMismatch is returned; a state that does not exist yet
+// meets no precondition.
 // MQTT event is fired only when the value actually changes.
-func (s *HmsttService) SetState(ctx context.Context, tipe, key, value string, description *string) error {
+func (s *HmsttService) SetState(ctx context.Context, tipe, key, value string, description *string, meta *StateMeta, ifMatch *Precondition) (StateEntry, error) {
 	l := zerolog.Ctx(ctx)
 	l.UpdateContext(func(c zerolog.Context) zerolog.Context {
 		return c.Str("hmstt_type", tipe).Str("hmstt_key", key).Str("hmstt_value", value)
 	})
 	l.Info().Msg("Handling SetState service")
 
-	if !canTypeChangedWithKey(tipe, key, value) {
-		l.Error().Err(errors.New("invalid type or key")).Msg("SetState failed")
-		return errors.New("INVALID TYPE OR KEY")
+	value, structured, err := s.prepareValue(tipe, key, value)
+	if err != nil {
+		l.Error().Err(err).Msg("SetState: invalid value")
+		return StateEntry{}, err
+	}
+	if err := meta.validate(); err != nil {
+		return StateEntry{}, err
 	}
-
-	current, err := s.store.GetState(ctx, tipe, key)
-	valueChanged := err != nil || current.Value != value
-
-	desc := current.Description
 	if description != nil {
-		desc = *description
 		l.UpdateContext(func(c zerolog.Context) zerolog.Context {
-			return c.Str("hmstt_description", desc)
+			return c.Str("hmstt_description", *description)
 		})
 	}
 
-	if err := s.store.SetState(ctx, tipe, key, value, desc); err != nil {
-		l.Error().Err(err).Msg("SetState failed")
-		return errors.New("SET STATE ERROR")
-	}
+	for attempt := 1; ; attempt++ {
+		current, err := s.store.GetState(ctx, tipe, key)
+		exists := err == nil
+		if !ifMatch.holds(current, exists) {
+			return StateEntry{}, ErrRevisionMismatch
+		}
+		if !exists {
+			if err := ValidateName(tipe, key); err != nil {
+				return StateEntry{}, err
+			}
+		}
+		if err := checkUnlocked(current); err != nil {
+			return StateEntry{}, err
+		}
 
-	if valueChanged {
-		hmsttStateChangesTotal.WithLabelValues(tipe).Inc()
-		generatedKey := PREFIX_HMSTT + KEY_DELIMITER + tipe + KEY_DELIMITER + key
-		if err := s.event.StateChange(ctx, generatedKey, value); err != nil {
-			l.Error().Err(err).Msg("StateChange event failed")
+		entry := StateEntry{Type: tipe, K: key, Value: value, Structured: structured, Description: current.Description,
+			Name: current.Name, Labels: current.Labels, Groups: current.Groups, Reported: current.Reported}
+		if description != nil {
+			entry.Description = *description
+		}
+		meta.apply(&entry)
+		stampDesired(current, &entry)
+		guards, err := s.checkConstraints(ctx, []stateChange{{before: current, after: entry}})
+		if err != nil {
+			return StateEntry{}, err
 		}
-	}
 
-	return nil
+		entry, err = s.writeState(ctx, entry, current.Revision, guards)
+		if errors.Is(err, ErrRevisionMismatch) {
+			if attempt < maxWriteAttempts {
+				l.Warn().Int("attempt", attempt).Msg("SetState: concurrent write, retrying")
+				continue
+			}
+			return StateEntry{}, ErrRevisionMismatch
+		}
+		if err != nil {
+			l.Error().Err(err).Msg("SetState failed")
+			return StateEntry{}, errors.New("SET STATE ERROR")
+		}
+
+		op := HISTORY_OP_SET
+		if !exists {
+			op = HISTORY_OP_CREATE
+		}
+		s.recordHistory(ctx, op, current, entry)
+		s.notifyWrite(ctx, entry)
+		if !exists || current.Value != entry.Value {
+			s.publishChange(ctx, entry)
+		}
+		return entry, nil
+	}
 }
 
-// PatchState partially updates value and/or description of an existing state entry.
-// At least one of value or description must be non-nil.
+// PatchState partially updates value, description, groups and/or the name
+// and labels in meta of an existing state entry. At least one of them must be
+// non-nil; a non-nil empty groups slice removes the state from all groups. For structured types value
+// is a JSON merge patch applied to the current object.
+// ifMatch works as in SetState.
 // MQTT event is fired only when the value actually changes.
-func (s *HmsttService) PatchState(ctx context.Context, tipe, key string, value *string, description *string) error {
+func (s *HmsttService) PatchState(ctx context.Context, tipe, key string, value *string, description *string, groups []string, meta *StateMeta, ifMatch *Precondition) (StateEntry, error) {
 	l := zerolog.Ctx(ctx)
 	l.UpdateContext(func(c zerolog.Context) zerolog.Context {
 		return c.Str("hmstt_type", tipe).Str("hmstt_key", key)
 	})
 	l.Info().Msg("Handling PatchState service")
 
-	if value == nil && description == nil {
-		return ErrNothingToUpdate
+	if value == nil && description == nil && groups == nil && meta.empty() {
+		return StateEntry{}, ErrNothingToUpdate
 	}
-
-	current, err := s.store.GetState(ctx, tipe, key)
+	groups, err := normalizeGroups(groups)
 	if err != nil {
-		l.Error().Err(err).Msg("PatchState: state not found")
-		return ErrStateNotFound
+		return StateEntry{}, err
+	}
+	if err := meta.validate(); err != nil {
+		return StateEntry{}, err
 	}
 
-	newValue := current.Value
-	newDesc := current.Description
-	valueChanged := false
+	for attempt := 1; ; attempt++ {
+		current, err := s.store.GetState(ctx, tipe, key)
+		if err != nil {
+			l.Error().Err(err).Msg("PatchState: state not found")
+			return StateEntry{}, ErrStateNotFound
+		}
+		if !ifMatch.holds(current, true) {
+			return StateEntry{}, ErrRevisionMismatch
+		}
+		if err := checkUnlocked(current); err != nil {
+			return StateEntry{}, err
+		}
 
-	if value != nil {
-		if !canTypeChangedWithKey(tipe, key, *value) {
-			l.Error().Msg("PatchState: invalid type or key")
-			return errors.New("INVALID TYPE OR KEY")
+		// An expired lock is dropped with the write.
+		entry := current
+		entry.Lock = nil
+		if value != nil {
+			newValue := *value
+			if def, ok := s.types.Lookup(tipe); ok && def.Structured() && current.Structured {
+				merged, err := mergePatch(current.Value, newValue)
+				if err != nil {
+					l.Error().Err(err).Msg("PatchState: invalid merge patch")
+					return StateEntry{}, err
+				}
+				newValue = merged
+			}
+			newValue, structured, err := s.prepareValue(tipe, key, newValue)
+			if err != nil {
+				l.Error().Err(err).Msg("PatchState: invalid value")
+				return StateEntry{}, err
+			}
+			entry.Value = newValue
+			entry.Structured = structured
+			l.UpdateContext(func(c zerolog.Context) zerolog.Context {
+				return c.Str("hmstt_value", entry.Value)
+			})
 		}
-		if current.Value != *value {
-			valueChanged = true
-			newValue = *value
+
+		if description != nil {
+			entry.Description = *description
+			l.UpdateContext(func(c zerolog.Context) zerolog.Context {
+				return c.Str("hmstt_description", entry.Description)
+			})
 		}
-		l.UpdateContext(func(c zerolog.Context) zerolog.Context {
-			return c.Str("hmstt_value", newValue)
-		})
+		if groups != nil {
+			entry.Groups = groups
+		}
+		meta.apply(&entry)
+		stampDesired(current, &entry)
+		guards, err := s.checkConstraints(ctx, []stateChange{{before: current, after: entry}})
+		if err != nil {
+			return StateEntry{}, err
+		}
+
+		entry, err = s.writeState(ctx, entry, current.Revision, guards)
+		if errors.Is(err, ErrRevisionMismatch) {
+			if attempt < maxWriteAttempts {
+				l.Warn().Int("attempt", attempt).Msg("PatchState: concurrent write, retrying")
+				continue
+			}
+			return StateEntry{}, ErrRevisionMismatch
+		}
+		if err != nil {
+			l.Error().Err(err).Msg("PatchState failed")
+			return StateEntry{}, errors.New("SET STATE ERROR")
+		}
+
+		s.recordHistory(ctx, HISTORY_OP_PATCH, current, entry)
+		s.notifyWrite(ctx, entry)
+		if current.Value != entry.Value {
+			s.publishChange(ctx, entry)
+		}
+		return entry, nil
 	}
+}
 
-	if description != nil {
-		newDesc = *description
-		l.UpdateContext(func(c zerolog.Context) zerolog.Context {
-			return c.Str("hmstt_description", newDesc)
-		})
+// DeleteState removes a single state entry and publishes a tombstone event.
+// It returns the entry as it was before deletion.
+func (s *HmsttService) DeleteState(ctx context.Context, tipe, key string) (StateEntry, error) {
+	l := zerolog.Ctx(ctx)
+	l.UpdateContext(func(c zerolog.Context) zerolog.Context {
+		return c.Str("hmstt_type", tipe).Str("hmstt_key", key)
+	})
+	l.Info().Msg("Handling DeleteState service")
+
+	if tipe == "" || key == "" {
+		return StateEntry{}, errors.New("INVALID TYPE OR KEY")
+	}
+
+	current, err := s.store.GetState(ctx, tipe, key)
+	if err != nil {
+		l.Error().Err(err).Msg("DeleteState: state not found")
+		return StateEntry{}, ErrStateNotFound
+	}
+	if err := checkUnlocked(current); err != nil {
+		return StateEntry{}, err
 	}
 
-	if err := s.store.SetState(ctx, tipe, key, newValue, newDesc); err != nil {
-		l.Error().Err(err).Msg("PatchState failed")
-		return errors.New("SET STATE ERROR")
+	if err := s.store.DeleteState(ctx, tipe, key); err != nil {
+		if errors.Is(err, ErrStateNotFound) {
+			return StateEntry{}, ErrStateNotFound
+		}
+		l.Error().Err(err).Msg("DeleteState failed")
+		return StateEntry{}, errors.New("DELETE STATE ERROR")
+	}
+	s.recordHistory(ctx, HISTORY_OP_DELETE, current, StateEntry{})
+	s.publishDelete(ctx, tipe, key)
+	if err := s.store.DeleteTimer(ctx, tipe, key); err != nil && !errors.Is(err, ErrTimerNotFound) {
+		l.Error().Err(err).Msg("DeleteState: cancelling timer failed")
 	}
+	s.dropCommand(ctx, tipe, key)
+
+	return current, nil
+}
+
+// DeleteType removes every state of tipe. confirm must repeat the type name
+// so a whole type cannot be dropped by accident. A tombstone event is
+// published for each removed key.
+func (s *HmsttService) DeleteType(ctx context.Context, tipe, confirm string) ([]string, error) {
+	l := zerolog.Ctx(ctx)
+	l.UpdateContext(func(c zerolog.Context) zerolog.Context {
+		return c.Str("hmstt_type", tipe)
+	})
+	l.Info().Msg("Handling DeleteType service")
 
-	if valueChanged {
-		hmsttStateChangesTotal.WithLabelValues(tipe).Inc()
-		generatedKey := PREFIX_HMSTT + KEY_DELIMITER + tipe + KEY_DELIMITER + key
-		if err := s.event.StateChange(ctx, generatedKey, newValue); err != nil {
-			l.Error().Err(err).Msg("StateChange event failed")
+	if tipe == "" {
+		return nil, errors.New("INVALID TYPE")
+	}
+	if confirm != tipe {
+		return nil, ErrConfirmationRequired
+	}
+	entries, err := s.store.GetAllByType(ctx, tipe)
+	if err != nil {
+		l.Error().Err(err).Msg("DeleteType: listing states failed")
+		return nil, errors.New("DELETE TYPE ERROR")
+	}
+	for _, entry := range entries {
+		if err := checkUnlocked(entry); err != nil {
+			return nil, err
 		}
 	}
 
-	return nil
+	deleted, err := s.store.DeleteType(ctx, tipe)
+	if err != nil {
+		l.Error().Err(err).Msg("DeleteType failed")
+		return nil, errors.New("DELETE TYPE ERROR")
+	}
+	if len(deleted) == 0 {
+		return nil, ErrStateNotFound
+	}
+	keys := make([]string, 0, len(deleted))
+	for _, entry := range deleted {
+		s.recordHistory(ctx, HISTORY_OP_DELETE, entry, StateEntry{})
+		s.publishDelete(ctx, tipe, entry.K)
+		s.dropCommand(ctx, tipe, entry.K)
+		keys = append(keys, entry.K)
+	}
+	sort.Strings(keys)
+	l.Info().Int("deleted", len(keys)).Msg("DeleteType removed states")
+
+	return keys, nil
+}
+
+// GetHistory returns recorded changes of a state, newest first. limit is
+// clamped to [1, 1000] and defaults to 50.
+func (s *HmsttService) GetHistory(ctx context.Context, tipe, key string, from, to time.Time, limit int64) ([]HistoryRecord, error) {
+	l := zerolog.Ctx(ctx)
+
+	if tipe == "" || key == "" {
+		return nil, errors.New("INVALID TYPE OR KEY")
+	}
+	if !from.IsZero() && !to.IsZero() && from.After(to) {
+		return nil, errors.New("INVALID TIME RANGE")
+	}
+	if limit <= 0 {
+		limit = 50
+	}
+	if limit > 1000 {
+		limit = 1000
+	}
+
+	records, err := s.store.GetHistory(ctx, tipe, key, HistoryQuery{From: from, To: to, Limit: limit})
+	if err != nil {
+		l.Error().Err(err).Msg("GetHistory failed")
+		return nil, errors.New("GET HISTORY ERROR")
+	}
+	return records, nil
 }
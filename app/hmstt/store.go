@@ -3,48 +3,253 @@ package hmstt
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/redis/go-redis/v9"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// ErrCorruptState is returned for a stored entry that cannot be decoded.
+// Reading it again does not help.
+var ErrCorruptState = errors.New("CORRUPT STATE")
+
+var hmsttStoreGetAllDuration = promauto.NewHistogram(
+	prometheus.HistogramOpts{
+		Name:    "hmstt_store_get_all_duration_seconds",
+		Help:    "Duration of reading every state from Redis in seconds.",
+		Buckets: prometheus.DefBuckets,
+	},
+)
+
+var hmsttStoreGetAllStates = promauto.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "hmstt_store_get_all_states",
+		Help: "Number of states returned by the last read of every state.",
+	},
 )
 
 type StateEntry struct {
-	Type        string
-	K           string
-	Value       string
+	Type  string
+	K     string
+	Value string
+	// Structured is set when Value holds a JSON object (types of kind json)
+	// rather than a plain string.
+	Structured  bool
 	Description string
-	UpdatedAt   time.Time
+	// Name is an optional display name and Labels free-form key/value
+	// metadata such as room=office; see StateMeta.
+	Name   string
+	Labels map[string]string
+	// Groups are the rooms, racks or other groups the state belongs to,
+	// sorted. The store keeps a set per group in sync with every write.
+	Groups []string
+	// Lock is set while the state is in maintenance mode; see StateLock.
+	Lock *StateLock
+	// Value is the desired value; Reported is what the device last reported,
+	// nil until it reports. Reports are kept apart from the entry and do not
+	// change its revision or UpdatedAt. See ReportState.
+	Reported *ReportedState
+	// DesiredAt is when Value last changed; UpdatedAt changes with every
+	// write.
+	DesiredAt time.Time
+	UpdatedAt time.Time
+	// Revision is assigned by the store on every write from a store-wide
+	// counter, so it grows with each change and is comparable across keys.
+	// Entries written before revisions existed have revision 0.
+	Revision int64
+}
+
+// StateGuard is a state a write depends on without changing it, such as the
+// other pump of an exclusive constraint. The write only happens while the
+// state is still at Revision; 0 means it must not exist. A guard with Group
+// set is on that group instead: the write only happens while the group still
+// has Members members, so no state joined it since it was read.
+type StateGuard struct {
+	Type     string
+	K        string
+	Revision int64
+	Group    string
+	Members  int64
 }
 
 type StateStore interface {
 	GetState(ctx context.Context, tipe, k string) (StateEntry, error)
-	SetState(ctx context.Context, tipe, k, value, description string) error
+	// CreateState writes entry only if the key does not exist yet and returns
+	// the committed entry. It returns ErrStateAlreadyExists otherwise.
+	CreateState(ctx context.Context, entry StateEntry) (StateEntry, error)
+	// SetState writes entry only if the stored revision equals
+	// expectedRevision (0 for a missing entry) and returns the committed
+	// entry. It returns ErrRevisionMismatch otherwise.
+	SetState(ctx context.Context, entry StateEntry, expectedRevision int64) (StateEntry, error)
+	// SetStates is SetState for several entries, applied all-or-nothing.
+	// The write also requires each guarded state to be at its revision.
+	SetStates(ctx context.Context, entries []StateEntry, expectedRevisions []int64, guards []StateGuard) ([]StateEntry, error)
+	// SetReported records what the device reported for an existing state,
+	// leaving the entry and its revision alone. It returns ErrStateNotFound
+	// if the state does not exist.
+	SetReported(ctx context.Context, tipe, k string, r ReportedState) error
+	DeleteState(ctx context.Context, tipe, k string) error
+	DeleteType(ctx context.Context, tipe string) ([]StateEntry, error)
+	AppendHistory(ctx context.Context, tipe, k string, rec HistoryRecord) error
+	GetHistory(ctx context.Context, tipe, k string, q HistoryQuery) ([]HistoryRecord, error)
 	GetAllByType(ctx context.Context, tipe string) ([]StateEntry, error)
 	GetAll(ctx context.Context) ([]StateEntry, error)
+	// ListTypes returns the types that have states, sorted.
+	ListTypes(ctx context.Context) ([]string, error)
+	// ScanStates returns one HSCAN-style batch of the states of tipe whose
+	// keys match the glob pattern, and the cursor of the next batch; 0 when
+	// the scan is done.
+	ScanStates(ctx context.Context, tipe string, cursor uint64, match string, count int64) ([]StateEntry, uint64, error)
+	PutTimer(ctx context.Context, t Timer) error
+	GetTimer(ctx context.Context, tipe, k string) (Timer, error)
+	ListTimers(ctx context.Context) ([]Timer, error)
+	DeleteTimer(ctx context.Context, tipe, k string) error
+	// ClaimDueTimers returns the timers due at now and leases them, so no
+	// other claim returns them until lease has passed.
+	ClaimDueTimers(ctx context.Context, now time.Time, lease time.Duration) ([]Timer, error)
+	// FinishTimer removes a claimed timer unless it was replaced meanwhile.
+	FinishTimer(ctx context.Context, t Timer) error
+	PutCommand(ctx context.Context, c Command) error
+	GetCommand(ctx context.Context, tipe, k string) (Command, error)
+	ListCommands(ctx context.Context) ([]Command, error)
+	DeleteCommand(ctx context.Context, tipe, k string) error
+	ClaimDueCommands(ctx context.Context, now time.Time, lease time.Duration) ([]Command, error)
+	// ResolveCommand replaces old with next, or removes it if next is nil,
+	// only while old is still stored. It returns ErrCommandChanged otherwise.
+	ResolveCommand(ctx context.Context, old Command, next *Command) error
+	ListGroups(ctx context.Context) ([]Group, error)
+	// GetGroupMembers returns the states in group; none if it is empty.
+	GetGroupMembers(ctx context.Context, group string) ([]StateEntry, error)
+	// GroupSize returns the number of states in group.
+	GroupSize(ctx context.Context, group string) (int64, error)
 }
 
+// stateEntryJSON is the hash field value. Value is a JSON string for plain
+// types and the JSON object itself for structured types.
 type stateEntryJSON struct {
-	Value       string    `json:"value"`
-	Description string    `json:"description"`
-	UpdatedAt   time.Time `json:"updated_at"`
+	Value       json.RawMessage   `json:"value"`
+	Description string            `json:"description"`
+	Name        string            `json:"name,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Groups      []string          `json:"groups,omitempty"`
+	Lock        *stateLockJSON    `json:"lock,omitempty"`
+	DesiredAt   time.Time         `json:"desired_at,omitzero"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+	Revision    int64             `json:"revision,omitempty"`
+}
+
+type stateLockJSON struct {
+	Reason    string     `json:"reason"`
+	Owner     string     `json:"owner"`
+	LockedAt  time.Time  `json:"locked_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// encodeValue encodes a value as a JSON string, or as itself if structured.
+func encodeValue(value string, structured bool) (json.RawMessage, error) {
+	if structured {
+		return json.RawMessage(value), nil
+	}
+	return json.Marshal(value)
+}
+
+// decodeValue is the inverse of encodeValue.
+func decodeValue(raw json.RawMessage) (value string, structured bool) {
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return string(raw), true
+	}
+	return value, false
+}
+
+func encodeEntry(e StateEntry) ([]byte, error) {
+	value, err := encodeValue(e.Value, e.Structured)
+	if err != nil {
+		return nil, err
+	}
+	var lock *stateLockJSON
+	if e.Lock != nil {
+		lock = &stateLockJSON{Reason: e.Lock.Reason, Owner: e.Lock.Owner, LockedAt: e.Lock.LockedAt}
+		if !e.Lock.ExpiresAt.IsZero() {
+			lock.ExpiresAt = &e.Lock.ExpiresAt
+		}
+	}
+	return json.Marshal(stateEntryJSON{
+		Value:       value,
+		Description: e.Description,
+		Name:        e.Name,
+		Labels:      e.Labels,
+		Groups:      e.Groups,
+		Lock:        lock,
+		DesiredAt:   e.DesiredAt,
+		UpdatedAt:   e.UpdatedAt,
+		Revision:    e.Revision,
+	})
+}
+
+func decodeEntry(tipe, k string, data []byte) (StateEntry, error) {
+	var raw stateEntryJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return StateEntry{}, fmt.Errorf("%w: %w", ErrCorruptState, err)
+	}
+	entry := StateEntry{Type: tipe, K: k, Description: raw.Description, Name: raw.Name, Labels: raw.Labels, Groups: raw.Groups, DesiredAt: raw.DesiredAt, UpdatedAt: raw.UpdatedAt, Revision: raw.Revision}
+	if raw.Lock != nil {
+		entry.Lock = &StateLock{Reason: raw.Lock.Reason, Owner: raw.Lock.Owner, LockedAt: raw.Lock.LockedAt}
+		if raw.Lock.ExpiresAt != nil {
+			entry.Lock.ExpiresAt = *raw.Lock.ExpiresAt
+		}
+	}
+	entry.Value, entry.Structured = decodeValue(raw.Value)
+	return entry, nil
+}
+
+// StoreConfig holds retention settings for the store.
+type StoreConfig struct {
+	HistoryMaxLen int64
+	HistoryMaxAge time.Duration
 }
 
 type HmsttStore struct {
 	rdb    *redis.Client
 	prefix string
+
+	historyMaxLen int64
+	historyMaxAge time.Duration
 }
 
-func NewStore(rdb *redis.Client, prefix string) *HmsttStore {
-	return &HmsttStore{rdb: rdb, prefix: prefix}
+func NewStore(rdb *redis.Client, prefix string, cfg *StoreConfig) *HmsttStore {
+	if cfg == nil {
+		cfg = &StoreConfig{HistoryMaxLen: 1000}
+	}
+	return &HmsttStore{
+		rdb:           rdb,
+		prefix:        prefix,
+		historyMaxLen: cfg.HistoryMaxLen,
+		historyMaxAge: cfg.HistoryMaxAge,
+	}
 }
 
 func (s *HmsttStore) redisKey(tipe string) string {
 	return s.prefix + ":hmstt:" + tipe
 }
 
+func (s *HmsttStore) seqKey() string {
+	return s.prefix + ":hmstt_seq"
+}
+
+// typesKey is the set of types that have at least one state. The write
+// scripts keep it in sync with the hashes; IndexTypes rebuilds it.
+func (s *HmsttStore) typesKey() string {
+	return s.prefix + ":hmstt_types"
+}
+
 func (s *HmsttStore) redisKeyPattern() string {
 	return s.prefix + ":hmstt:*"
 }
@@ -53,75 +258,457 @@ func (s *HmsttStore) trimKeyPrefix(key string) string {
 	return strings.TrimPrefix(key, s.prefix+":hmstt:")
 }
 
-func (s *HmsttStore) SetState(ctx context.Context, tipe, k, value, description string) error {
+// luaRevisionOf decodes the revision from a stored entry; missing entries and
+// entries written before revisions existed are at revision 0.
+const luaRevisionOf = `
+local function revisionOf(cur)
+	if not cur then
+		return 0
+	end
+	local ok, doc = pcall(cjson.decode, cur)
+	if ok and type(doc) == 'table' and type(doc.revision) == 'number' then
+		return doc.revision
+	end
+	return 0
+end
+`
+
+// luaSyncGroups moves member between group sets when a write changes the
+// groups of an entry. ARGV carries the group key prefix; the group sets are
+// derived from it because the groups are only known once the current entry
+// has been read. A group that becomes empty is dropped from the registry.
+const luaSyncGroups = `
+local function groupsOf(data)
+	if not data then
+		return {}
+	end
+	local ok, doc = pcall(cjson.decode, data)
+	if ok and type(doc) == 'table' and type(doc.groups) == 'table' then
+		return doc.groups
+	end
+	return {}
+end
+
+local function syncGroups(prefix, registry, member, old, new)
+	local keep = {}
+	for _, g in ipairs(new) do
+		keep[g] = true
+	end
+	local had = {}
+	for _, g in ipairs(old) do
+		had[g] = true
+		if not keep[g] then
+			redis.call('SREM', prefix .. g, member)
+			if redis.call('SCARD', prefix .. g) == 0 then
+				redis.call('SREM', registry, g)
+			end
+		end
+	end
+	for _, g in ipairs(new) do
+		if not had[g] then
+			redis.call('SADD', prefix .. g, member)
+			redis.call('SADD', registry, g)
+		end
+	end
+end
+`
+
+// setStateScript compares the stored revision with the expected one and, if
+// they match, writes the entry with a fresh revision from the sequence key.
+// ARGV[3] is the encoded entry without its closing brace; the script appends
+// the revision so the value is written in one step.
+// KEYS: hash, sequence, group registry, type index. ARGV: field, expected
+// revision, entry, group member, group key prefix, type.
+var setStateScript = redis.NewScript(luaRevisionOf + luaSyncGroups + `
+local cur = redis.call('HGET', KEYS[1], ARGV[1])
+if revisionOf(cur) ~= tonumber(ARGV[2]) then
+	return -1
+end
+local next = redis.call('INCR', KEYS[2])
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[3] .. ',"revision":' .. next .. '}')
+redis.call('SADD', KEYS[4], ARGV[6])
+syncGroups(ARGV[5], KEYS[3], ARGV[4], groupsOf(cur), groupsOf(ARGV[3] .. '}'))
+return next
+`)
+
+// setStatesScript is setStateScript for several entries at once, optionally
+// guarded by states it reads but does not write. KEYS[1] is the sequence key,
+// KEYS[2] the group registry, KEYS[3] the type index, KEYS[i+3] the hash of
+// entry i and KEYS[n+3+j] the hash of guard j, or the set of a group guard;
+// ARGV[1] is the group key prefix and ARGV[2] the entry count n, followed by
+// a field/expected revision/entry/group member/type quintuple per entry and a
+// field/expected revision pair per guard, with an empty field and the member
+// count for a group guard. Nothing is written unless every guard holds; a
+// mismatch returns an empty list.
+var setStatesScript = redis.NewScript(luaRevisionOf + luaSyncGroups + `
+local n = tonumber(ARGV[2])
+local cur = {}
+for i = 1, n do
+	local a = 5 * i - 2
+	cur[i] = redis.call('HGET', KEYS[i + 3], ARGV[a])
+	if revisionOf(cur[i]) ~= tonumber(ARGV[a + 1]) then
+		return {}
+	end
+end
+for j = 1, #KEYS - n - 3 do
+	local a = 5 * n + 2 * j + 1
+	local got
+	if ARGV[a] == '' then
+		got = redis.call('SCARD', KEYS[n + j + 3])
+	else
+		got = revisionOf(redis.call('HGET', KEYS[n + j + 3], ARGV[a]))
+	end
+	if got ~= tonumber(ARGV[a + 1]) then
+		return {}
+	end
+end
+local revs = {}
+for i = 1, n do
+	local a = 5 * i - 2
+	local next = redis.call('INCR', KEYS[1])
+	redis.call('HSET', KEYS[i + 3], ARGV[a], ARGV[a + 2] .. ',"revision":' .. next .. '}')
+	redis.call('SADD', KEYS[3], ARGV[a + 4])
+	syncGroups(ARGV[1], KEYS[2], ARGV[a + 3], groupsOf(cur[i]), groupsOf(ARGV[a + 2] .. '}'))
+	revs[i] = next
+end
+return revs
+`)
+
+// createStateScript writes the entry only if the field is absent, taking a
+// revision from the sequence key like setStateScript.
+// KEYS: hash, sequence, group registry, type index. ARGV: field, entry,
+// group member, group key prefix, type.
+var createStateScript = redis.NewScript(luaSyncGroups + `
+if redis.call('HEXISTS', KEYS[1], ARGV[1]) == 1 then
+	return -1
+end
+local next = redis.call('INCR', KEYS[2])
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2] .. ',"revision":' .. next .. '}')
+redis.call('SADD', KEYS[4], ARGV[5])
+syncGroups(ARGV[4], KEYS[3], ARGV[3], {}, groupsOf(ARGV[2] .. '}'))
+return next
+`)
+
+// deleteStateScript removes a field, its report and its group memberships,
+// and drops the type from the index once its hash is empty.
+// KEYS: hash, group registry, type index, reported hash. ARGV: field, group
+// member, group key prefix, type.
+var deleteStateScript = redis.NewScript(luaSyncGroups + `
+local cur = redis.call('HGET', KEYS[1], ARGV[1])
+if not cur then
+	return 0
+end
+redis.call('HDEL', KEYS[1], ARGV[1])
+redis.call('HDEL', KEYS[4], ARGV[1])
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	redis.call('SREM', KEYS[3], ARGV[4])
+end
+syncGroups(ARGV[3], KEYS[2], ARGV[2], groupsOf(cur), {})
+return 1
+`)
+
+// deleteTypeScript removes a whole hash, its reports and the group
+// memberships of its entries, returning the hash as a flat field/value list.
+// KEYS: hash, group registry, type index, reported hash. ARGV: type, group
+// key prefix.
+var deleteTypeScript = redis.NewScript(luaSyncGroups + `
+local all = redis.call('HGETALL', KEYS[1])
+for i = 1, #all, 2 do
+	syncGroups(ARGV[2], KEYS[2], ARGV[1] .. '/' .. all[i], groupsOf(all[i + 1]), {})
+end
+redis.call('DEL', KEYS[1], KEYS[4])
+redis.call('SREM', KEYS[3], ARGV[1])
+return all
+`)
+
+// encodeForScript encodes entry without revision and strips the closing brace
+// so a script can append the revision it assigns.
+func encodeForScript(entry StateEntry) (string, error) {
+	entry.Revision = 0
+	data, err := encodeEntry(entry)
+	if err != nil {
+		return "", err
+	}
+	return string(data[:len(data)-1]), nil
+}
+
+func (s *HmsttStore) CreateState(ctx context.Context, entry StateEntry) (StateEntry, error) {
+	ctx, span := otel.Tracer("hmstt").Start(ctx, "store.CreateState")
+	defer span.End()
+
+	entry.UpdatedAt = time.Now().UTC()
+	data, err := encodeForScript(entry)
+	if err != nil {
+		return StateEntry{}, fmt.Errorf("marshal state entry: %w", err)
+	}
+	rev, err := createStateScript.Run(ctx, s.rdb, []string{s.redisKey(entry.Type), s.seqKey(), s.groupsKey(), s.typesKey()},
+		entry.K, data, groupMember(entry.Type, entry.K), s.groupKeyPrefix(), entry.Type).Int64()
+	if err != nil {
+		return StateEntry{}, fmt.Errorf("redis create state script: %w", err)
+	}
+	if rev < 0 {
+		return StateEntry{}, ErrStateAlreadyExists
+	}
+	entry.Revision = rev
+	return entry, nil
+}
+
+func (s *HmsttStore) SetState(ctx context.Context, entry StateEntry, expectedRevision int64) (StateEntry, error) {
 	ctx, span := otel.Tracer("hmstt").Start(ctx, "store.SetState")
 	defer span.End()
 
-	entry := stateEntryJSON{
-		Value:       value,
-		Description: description,
-		UpdatedAt:   time.Now().UTC(),
+	entry.UpdatedAt = time.Now().UTC()
+	data, err := encodeForScript(entry)
+	if err != nil {
+		return StateEntry{}, fmt.Errorf("marshal state entry: %w", err)
 	}
-	data, err := json.Marshal(entry)
+	rev, err := setStateScript.Run(ctx, s.rdb, []string{s.redisKey(entry.Type), s.seqKey(), s.groupsKey(), s.typesKey()},
+		entry.K, expectedRevision, data, groupMember(entry.Type, entry.K), s.groupKeyPrefix(), entry.Type).Int64()
 	if err != nil {
-		return fmt.Errorf("marshal state entry: %w", err)
+		return StateEntry{}, fmt.Errorf("redis set state script: %w", err)
 	}
-	if err := s.rdb.HSet(ctx, s.redisKey(tipe), k, data).Err(); err != nil {
-		return fmt.Errorf("redis HSET: %w", err)
+	if rev < 0 {
+		return StateEntry{}, ErrRevisionMismatch
+	}
+	entry.Revision = rev
+	return entry, nil
+}
+
+func (s *HmsttStore) SetStates(ctx context.Context, entries []StateEntry, expectedRevisions []int64, guards []StateGuard) ([]StateEntry, error) {
+	ctx, span := otel.Tracer("hmstt").Start(ctx, "store.SetStates")
+	defer span.End()
+
+	entries = append([]StateEntry(nil), entries...)
+	now := time.Now().UTC()
+	keys := make([]string, 0, len(entries)+len(guards)+3)
+	args := make([]any, 0, 5*len(entries)+2*len(guards)+2)
+	keys = append(keys, s.seqKey(), s.groupsKey(), s.typesKey())
+	args = append(args, s.groupKeyPrefix(), len(entries))
+	for i := range entries {
+		entries[i].UpdatedAt = now
+		data, err := encodeForScript(entries[i])
+		if err != nil {
+			return nil, fmt.Errorf("marshal state entry %s: %w", entries[i].K, err)
+		}
+		keys = append(keys, s.redisKey(entries[i].Type))
+		args = append(args, entries[i].K, expectedRevisions[i], data, groupMember(entries[i].Type, entries[i].K), entries[i].Type)
+	}
+	for _, g := range guards {
+		if g.Group != "" {
+			keys = append(keys, s.groupKeyPrefix()+g.Group)
+			args = append(args, "", g.Members)
+			continue
+		}
+		keys = append(keys, s.redisKey(g.Type))
+		args = append(args, g.K, g.Revision)
+	}
+
+	revs, err := setStatesScript.Run(ctx, s.rdb, keys, args...).Int64Slice()
+	if err != nil {
+		return nil, fmt.Errorf("redis set states script: %w", err)
+	}
+	if len(revs) != len(entries) {
+		return nil, ErrRevisionMismatch
+	}
+	for i := range entries {
+		entries[i].Revision = revs[i]
+	}
+	return entries, nil
+}
+
+// DeleteState removes a single key. It returns ErrStateNotFound if the key does not exist.
+func (s *HmsttStore) DeleteState(ctx context.Context, tipe, k string) error {
+	ctx, span := otel.Tracer("hmstt").Start(ctx, "store.DeleteState")
+	defer span.End()
+
+	n, err := deleteStateScript.Run(ctx, s.rdb, []string{s.redisKey(tipe), s.groupsKey(), s.typesKey(), s.reportedKey(tipe)},
+		k, groupMember(tipe, k), s.groupKeyPrefix(), tipe).Int()
+	if err != nil {
+		return fmt.Errorf("redis delete state script: %w", err)
+	}
+	if n == 0 {
+		return ErrStateNotFound
 	}
 	return nil
 }
 
+// DeleteType removes the whole hash for tipe and returns the entries it held.
+func (s *HmsttStore) DeleteType(ctx context.Context, tipe string) ([]StateEntry, error) {
+	ctx, span := otel.Tracer("hmstt").Start(ctx, "store.DeleteType")
+	defer span.End()
+
+	all, err := deleteTypeScript.Run(ctx, s.rdb, []string{s.redisKey(tipe), s.groupsKey(), s.typesKey(), s.reportedKey(tipe)},
+		tipe, s.groupKeyPrefix()).StringSlice()
+	if err != nil {
+		return nil, fmt.Errorf("redis delete type script: %w", err)
+	}
+
+	entries := make([]StateEntry, 0, len(all)/2)
+	for i := 0; i+1 < len(all); i += 2 {
+		k, v := all[i], all[i+1]
+		entry, err := decodeEntry(tipe, k, []byte(v))
+		if err != nil {
+			entry = StateEntry{Type: tipe, K: k}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
 func (s *HmsttStore) GetState(ctx context.Context, tipe, k string) (StateEntry, error) {
 	ctx, span := otel.Tracer("hmstt").Start(ctx, "store.GetState")
 	defer span.End()
 
-	data, err := s.rdb.HGet(ctx, s.redisKey(tipe), k).Bytes()
+	var get, reported *redis.StringCmd
+	_, err := s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		get = pipe.HGet(ctx, s.redisKey(tipe), k)
+		reported = pipe.HGet(ctx, s.reportedKey(tipe), k)
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return StateEntry{}, fmt.Errorf("redis HGET: %w", err)
+	}
+	data, err := get.Bytes()
 	if err != nil {
 		return StateEntry{}, fmt.Errorf("redis HGET: %w", err)
 	}
-	var entry stateEntryJSON
-	if err := json.Unmarshal(data, &entry); err != nil {
+	entry, err := decodeEntry(tipe, k, data)
+	if err != nil {
 		return StateEntry{}, fmt.Errorf("unmarshal state entry: %w", err)
 	}
-	return StateEntry{Type: tipe, K: k, Value: entry.Value, Description: entry.Description, UpdatedAt: entry.UpdatedAt}, nil
+	entry.Reported = decodeReported(reported.Val())
+	return entry, nil
 }
 
+// GetAllByType returns the states of tipe sorted by key.
 func (s *HmsttStore) GetAllByType(ctx context.Context, tipe string) ([]StateEntry, error) {
 	ctx, span := otel.Tracer("hmstt").Start(ctx, "store.GetAllByType")
 	defer span.End()
 
-	result, err := s.rdb.HGetAll(ctx, s.redisKey(tipe)).Result()
+	var all, reported *redis.MapStringStringCmd
+	_, err := s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		all = pipe.HGetAll(ctx, s.redisKey(tipe))
+		reported = pipe.HGetAll(ctx, s.reportedKey(tipe))
+		return nil
+	})
 	if err != nil {
 		return nil, fmt.Errorf("redis HGETALL: %w", err)
 	}
-	entries := make([]StateEntry, 0, len(result))
-	for k, v := range result {
-		var entry stateEntryJSON
-		if err := json.Unmarshal([]byte(v), &entry); err != nil {
+	return decodeHash(tipe, all.Val(), reported.Val())
+}
+
+// decodeHash decodes the fields of a type hash with the reports of the
+// reported hash, sorted by key.
+func decodeHash(tipe string, fields, reported map[string]string) ([]StateEntry, error) {
+	entries := make([]StateEntry, 0, len(fields))
+	for k, v := range fields {
+		entry, err := decodeEntry(tipe, k, []byte(v))
+		if err != nil {
 			return nil, fmt.Errorf("unmarshal state entry for key %s: %w", k, err)
 		}
-		entries = append(entries, StateEntry{Type: tipe, K: k, Value: entry.Value, Description: entry.Description, UpdatedAt: entry.UpdatedAt})
+		entry.Reported = decodeReported(reported[k])
+		entries = append(entries, entry)
 	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].K < entries[j].K })
 	return entries, nil
 }
 
+// ListTypes returns the types that have states, sorted, from the type index.
+func (s *HmsttStore) ListTypes(ctx context.Context) ([]string, error) {
+	ctx, span := otel.Tracer("hmstt").Start(ctx, "store.ListTypes")
+	defer span.End()
+
+	types, err := s.rdb.SMembers(ctx, s.typesKey()).Result()
+	if err != nil {
+		return nil, fmt.Errorf("redis SMEMBERS types: %w", err)
+	}
+	sort.Strings(types)
+	return types, nil
+}
+
+// IndexTypes rebuilds the type index from the hashes, walking them with SCAN
+// so Redis is never blocked. It adds types written before the index existed
+// and drops types whose hash is gone; run it once at startup.
+func (s *HmsttStore) IndexTypes(ctx context.Context) error {
+	ctx, span := otel.Tracer("hmstt").Start(ctx, "store.IndexTypes")
+	defer span.End()
+
+	found := make(map[string]bool)
+	iter := s.rdb.Scan(ctx, 0, s.redisKeyPattern(), 100).Iterator()
+	for iter.Next(ctx) {
+		found[s.trimKeyPrefix(iter.Val())] = true
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("redis SCAN: %w", err)
+	}
+	indexed, err := s.rdb.SMembers(ctx, s.typesKey()).Result()
+	if err != nil {
+		return fmt.Errorf("redis SMEMBERS types: %w", err)
+	}
+
+	_, err = s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for tipe := range found {
+			pipe.SAdd(ctx, s.typesKey(), tipe)
+		}
+		for _, tipe := range indexed {
+			if !found[tipe] {
+				// The hash may have been created since the SCAN; only drop
+				// the type if it is still missing.
+				pipe.Eval(ctx, `if redis.call('EXISTS', KEYS[1]) == 0 then redis.call('SREM', KEYS[2], ARGV[1]) end return 0`,
+					[]string{s.redisKey(tipe), s.typesKey()}, tipe)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("redis index types: %w", err)
+	}
+	return nil
+}
+
+// GetAll returns every state, sorted by type and key. The types come from
+// the index and their hashes are read in one pipelined round trip.
 func (s *HmsttStore) GetAll(ctx context.Context) ([]StateEntry, error) {
 	ctx, span := otel.Tracer("hmstt").Start(ctx, "store.GetAll")
 	defer span.End()
+	start := time.Now()
 
-	keys, err := s.rdb.Keys(ctx, s.redisKeyPattern()).Result()
+	all, types, err := s.getAll(ctx)
+	hmsttStoreGetAllDuration.Observe(time.Since(start).Seconds())
 	if err != nil {
-		return nil, fmt.Errorf("redis KEYS: %w", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("hmstt.types", types), attribute.Int("hmstt.states", len(all)))
+	hmsttStoreGetAllStates.Set(float64(len(all)))
+	return all, nil
+}
+
+func (s *HmsttStore) getAll(ctx context.Context) ([]StateEntry, int, error) {
+	types, err := s.ListTypes(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	cmds := make([]*redis.MapStringStringCmd, len(types))
+	reported := make([]*redis.MapStringStringCmd, len(types))
+	_, err = s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, tipe := range types {
+			cmds[i] = pipe.HGetAll(ctx, s.redisKey(tipe))
+			reported[i] = pipe.HGetAll(ctx, s.reportedKey(tipe))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("redis HGETALL: %w", err)
 	}
 	var all []StateEntry
-	for _, key := range keys {
-		tipe := s.trimKeyPrefix(key)
-		entries, err := s.GetAllByType(ctx, tipe)
+	for i, tipe := range types {
+		entries, err := decodeHash(tipe, cmds[i].Val(), reported[i].Val())
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 		all = append(all, entries...)
 	}
-	return all, nil
+	return all, len(types), nil
 }
@@ -0,0 +1,154 @@
+package hmstt
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newRedisStore(t *testing.T) *HmsttStore {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	return NewStore(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "test", nil)
+}
+
+func TestStoreSetStatesConflict(t *testing.T) {
+	ctx := context.Background()
+	store := newRedisStore(t)
+	modem, err := store.CreateState(ctx, StateEntry{Type: "switch", K: "modem", Value: "on"})
+	if err != nil {
+		t.Fatalf("CreateState() error = %v", err)
+	}
+
+	// A one-item batch with a stale revision must not look like a write.
+	stale := modem
+	stale.Value = "off"
+	if _, err := store.SetStates(ctx, []StateEntry{stale}, []int64{modem.Revision + 1}, nil); !errors.Is(err, ErrRevisionMismatch) {
+		t.Fatalf("SetStates() with a stale revision error = %v, want %v", err, ErrRevisionMismatch)
+	}
+	got, _ := store.GetState(ctx, "switch", "modem")
+	if got.Value != "on" || got.Revision != modem.Revision {
+		t.Fatalf("state after conflict = %+v, want unchanged", got)
+	}
+
+	// A guard on another state must hold as well.
+	router, _ := store.CreateState(ctx, StateEntry{Type: "switch", K: "router", Value: "off"})
+	guard := StateGuard{Type: "switch", K: "router", Revision: router.Revision + 1}
+	if _, err := store.SetStates(ctx, []StateEntry{stale}, []int64{modem.Revision}, []StateGuard{guard}); !errors.Is(err, ErrRevisionMismatch) {
+		t.Fatalf("SetStates() with a stale guard error = %v, want %v", err, ErrRevisionMismatch)
+	}
+	missing := StateGuard{Type: "switch", K: "fan"}
+	guard.Revision = router.Revision
+	written, err := store.SetStates(ctx, []StateEntry{stale}, []int64{modem.Revision}, []StateGuard{guard, missing})
+	if err != nil || len(written) != 1 || written[0].Revision <= modem.Revision {
+		t.Fatalf("SetStates() = %+v, %v, want a newer revision", written, err)
+	}
+
+	// A group guard holds while the group keeps its size.
+	if _, err := store.CreateState(ctx, StateEntry{Type: "switch", K: "server_1", Value: "off", Groups: []string{"rack"}}); err != nil {
+		t.Fatalf("CreateState() error = %v", err)
+	}
+	size, err := store.GroupSize(ctx, "rack")
+	if err != nil || size != 1 {
+		t.Fatalf("GroupSize() = %d, %v, want 1", size, err)
+	}
+	modem = written[0]
+	stale = modem
+	rack := StateGuard{Group: "rack", Members: size + 1}
+	if _, err := store.SetStates(ctx, []StateEntry{stale}, []int64{modem.Revision}, []StateGuard{rack}); !errors.Is(err, ErrRevisionMismatch) {
+		t.Fatalf("SetStates() with a stale group guard error = %v, want %v", err, ErrRevisionMismatch)
+	}
+	rack.Members = size
+	if _, err := store.SetStates(ctx, []StateEntry{stale}, []int64{modem.Revision}, []StateGuard{rack}); err != nil {
+		t.Fatalf("SetStates() with a group guard error = %v", err)
+	}
+}
+
+func TestStoreSetReported(t *testing.T) {
+	ctx := context.Background()
+	store := newRedisStore(t)
+	modem, err := store.CreateState(ctx, StateEntry{Type: "switch", K: "modem", Value: "on", Groups: []string{"rack"}})
+	if err != nil {
+		t.Fatalf("CreateState() error = %v", err)
+	}
+
+	report := ReportedState{Value: "off", ReportedAt: time.Date(2026, 3, 16, 12, 35, 1, 0, time.UTC)}
+	if err := store.SetReported(ctx, "switch", "modem", report); err != nil {
+		t.Fatalf("SetReported() error = %v", err)
+	}
+	if err := store.SetReported(ctx, "switch", "missing", report); !errors.Is(err, ErrStateNotFound) {
+		t.Fatalf("SetReported(missing) error = %v, want %v", err, ErrStateNotFound)
+	}
+
+	// Every read path sees the report, and the entry is untouched.
+	got, _ := store.GetState(ctx, "switch", "modem")
+	if got.Revision != modem.Revision || !got.UpdatedAt.Equal(modem.UpdatedAt) {
+		t.Fatalf("GetState() after report = %+v, want revision %d and UpdatedAt unchanged", got, modem.Revision)
+	}
+	byType, _ := store.GetAllByType(ctx, "switch")
+	all, _ := store.GetAll(ctx)
+	scanned, _, _ := store.ScanStates(ctx, "switch", 0, "*", 10)
+	members, _ := store.GetGroupMembers(ctx, "rack")
+	for name, entries := range map[string][]StateEntry{"GetState": {got}, "GetAllByType": byType, "GetAll": all, "ScanStates": scanned, "GetGroupMembers": members} {
+		if len(entries) != 1 || entries[0].Reported == nil || *entries[0].Reported != report {
+			t.Fatalf("%s() = %+v, want the report", name, entries)
+		}
+	}
+
+	// Writes keep the report; a new state of the same key starts without one.
+	if _, err := store.SetState(ctx, StateEntry{Type: "switch", K: "modem", Value: "off"}, modem.Revision); err != nil {
+		t.Fatalf("SetState() error = %v", err)
+	}
+	if got, _ := store.GetState(ctx, "switch", "modem"); got.Reported == nil {
+		t.Fatalf("report lost after SetState")
+	}
+	if err := store.DeleteState(ctx, "switch", "modem"); err != nil {
+		t.Fatalf("DeleteState() error = %v", err)
+	}
+	if _, err := store.CreateState(ctx, StateEntry{Type: "switch", K: "modem", Value: "on"}); err != nil {
+		t.Fatalf("CreateState() error = %v", err)
+	}
+	if got, _ := store.GetState(ctx, "switch", "modem"); got.Reported != nil {
+		t.Fatalf("recreated state has report %+v, want none", got.Reported)
+	}
+}
+
+func TestStoreTimerLease(t *testing.T) {
+	ctx := context.Background()
+	store := newRedisStore(t)
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	timer := Timer{Type: "switch", Key: "modem", Op: TIMER_OP_REVERT, Value: "on", Revision: 3, DueAt: now, CreatedAt: now}
+	if err := store.PutTimer(ctx, timer); err != nil {
+		t.Fatalf("PutTimer() error = %v", err)
+	}
+
+	claimed, err := store.ClaimDueTimers(ctx, now, time.Minute)
+	if err != nil || len(claimed) != 1 {
+		t.Fatalf("ClaimDueTimers() = %+v, %v, want the timer", claimed, err)
+	}
+	if again, _ := store.ClaimDueTimers(ctx, now.Add(time.Second), time.Minute); len(again) != 0 {
+		t.Fatalf("ClaimDueTimers() during the lease = %+v, want none", again)
+	}
+	if again, _ := store.ClaimDueTimers(ctx, now.Add(time.Minute), time.Minute); len(again) != 1 {
+		t.Fatalf("ClaimDueTimers() after the lease = %+v, want the timer", again)
+	}
+
+	// A timer replaced after the claim survives finishing the claimed one.
+	replaced := timer
+	replaced.Revision = 4
+	store.PutTimer(ctx, replaced)
+	if err := store.FinishTimer(ctx, claimed[0]); err != nil {
+		t.Fatalf("FinishTimer() error = %v", err)
+	}
+	if got, err := store.GetTimer(ctx, "switch", "modem"); err != nil || got.Revision != 4 {
+		t.Fatalf("GetTimer() = %+v, %v, want the replacement", got, err)
+	}
+	store.FinishTimer(ctx, replaced)
+	if _, err := store.GetTimer(ctx, "switch", "modem"); !errors.Is(err, ErrTimerNotFound) {
+		t.Fatalf("GetTimer() after finish error = %v, want %v", err, ErrTimerNotFound)
+	}
+}
@@ -0,0 +1,341 @@
+package hmstt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/nurhudajoantama/hmauto/internal/redisqueue"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+)
+
+var ErrTimerNotFound = errors.New("TIMER NOT FOUND")
+
+const (
+	TIMER_OP_REVERT = "revert"
+	TIMER_OP_CYCLE  = "cycle"
+
+	CALLER_TIMER = "timer"
+
+	// MaxRevertAfter bounds how far ahead a revert can be scheduled.
+	MaxRevertAfter = 7 * 24 * time.Hour
+
+	// timerLease is how long a claimed timer is hidden from other claims. A
+	// timer that is not finished by then, because applying it failed or the
+	// instance stopped, is claimed again.
+	timerLease      = 10 * time.Second
+	timerClaimBatch = 100
+)
+
+// Timer is a pending write that sets a state to Value at DueAt. It only
+// applies while the state is still at Revision, so a state changed by
+// someone else in the meantime is left alone. There is at most one timer per
+// state.
+type Timer struct {
+	Type      string
+	Key       string
+	Op        string
+	Value     string
+	Revision  int64
+	DueAt     time.Time
+	CreatedAt time.Time
+	Caller    string
+}
+
+type timerJSON struct {
+	Type      string    `json:"type"`
+	Key       string    `json:"key"`
+	Op        string    `json:"op"`
+	Value     string    `json:"value"`
+	Revision  int64     `json:"revision"`
+	DueAt     time.Time `json:"due_at"`
+	CreatedAt time.Time `json:"created_at"`
+	Caller    string    `json:"caller"`
+}
+
+func timerID(tipe, k string) string {
+	return tipe + "/" + k
+}
+
+func (s *HmsttStore) timerQueueKey() string {
+	return s.prefix + ":hmstt_timers"
+}
+
+func (s *HmsttStore) timerDataKey() string {
+	return s.prefix + ":hmstt_timer_data"
+}
+
+// PutTimer schedules t, replacing any pending timer of the same state.
+func (s *HmsttStore) PutTimer(ctx context.Context, t Timer) error {
+	ctx, span := otel.Tracer("hmstt").Start(ctx, "store.PutTimer")
+	defer span.End()
+
+	data, err := json.Marshal(timerJSON(t))
+	if err != nil {
+		return fmt.Errorf("marshal timer: %w", err)
+	}
+	id := timerID(t.Type, t.Key)
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, s.timerDataKey(), id, data)
+		pipe.ZAdd(ctx, s.timerQueueKey(), redis.Z{Score: float64(t.DueAt.UnixMilli()), Member: id})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("redis ZADD/HSET timer: %w", err)
+	}
+	return nil
+}
+
+// GetTimer returns the pending timer of a state, or ErrTimerNotFound.
+func (s *HmsttStore) GetTimer(ctx context.Context, tipe, k string) (Timer, error) {
+	ctx, span := otel.Tracer("hmstt").Start(ctx, "store.GetTimer")
+	defer span.End()
+
+	data, err := s.rdb.HGet(ctx, s.timerDataKey(), timerID(tipe, k)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return Timer{}, ErrTimerNotFound
+	}
+	if err != nil {
+		return Timer{}, fmt.Errorf("redis HGET timer: %w", err)
+	}
+	var t timerJSON
+	if err := json.Unmarshal(data, &t); err != nil {
+		return Timer{}, fmt.Errorf("unmarshal timer: %w", err)
+	}
+	return Timer(t), nil
+}
+
+// ListTimers returns all pending timers, soonest first.
+func (s *HmsttStore) ListTimers(ctx context.Context) ([]Timer, error) {
+	ctx, span := otel.Tracer("hmstt").Start(ctx, "store.ListTimers")
+	defer span.End()
+
+	result, err := s.rdb.HGetAll(ctx, s.timerDataKey()).Result()
+	if err != nil {
+		return nil, fmt.Errorf("redis HGETALL timers: %w", err)
+	}
+	timers := make([]Timer, 0, len(result))
+	for id, v := range result {
+		var t timerJSON
+		if err := json.Unmarshal([]byte(v), &t); err != nil {
+			return nil, fmt.Errorf("unmarshal timer %s: %w", id, err)
+		}
+		timers = append(timers, Timer(t))
+	}
+	sort.Slice(timers, func(i, j int) bool { return timers[i].DueAt.Before(timers[j].DueAt) })
+	return timers, nil
+}
+
+// DeleteTimer cancels the pending timer of a state. It returns
+// ErrTimerNotFound if there is none.
+func (s *HmsttStore) DeleteTimer(ctx context.Context, tipe, k string) error {
+	ctx, span := otel.Tracer("hmstt").Start(ctx, "store.DeleteTimer")
+	defer span.End()
+
+	id := timerID(tipe, k)
+	var removed *redis.IntCmd
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		removed = pipe.ZRem(ctx, s.timerQueueKey(), id)
+		pipe.HDel(ctx, s.timerDataKey(), id)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("redis ZREM/HDEL timer: %w", err)
+	}
+	if removed.Val() == 0 {
+		return ErrTimerNotFound
+	}
+	return nil
+}
+
+func (s *HmsttStore) timerQueue() redisqueue.Queue {
+	return redisqueue.Queue{QueueKey: s.timerQueueKey(), DataKey: s.timerDataKey()}
+}
+
+// ClaimDueTimers returns the timers due at now and leases them for lease.
+// Timers stay stored until FinishTimer removes them.
+func (s *HmsttStore) ClaimDueTimers(ctx context.Context, now time.Time, lease time.Duration) ([]Timer, error) {
+	ctx, span := otel.Tracer("hmstt").Start(ctx, "store.ClaimDueTimers")
+	defer span.End()
+
+	result, err := s.timerQueue().Claim(ctx, s.rdb, now, lease, timerClaimBatch)
+	if err != nil {
+		return nil, fmt.Errorf("redis claim timers script: %w", err)
+	}
+	timers := make([]Timer, 0, len(result))
+	for _, v := range result {
+		var t timerJSON
+		if err := json.Unmarshal([]byte(v), &t); err != nil {
+			log.Error().Err(err).Msg("skipping undecodable timer")
+			continue
+		}
+		timers = append(timers, Timer(t))
+	}
+	return timers, nil
+}
+
+// FinishTimer removes a claimed timer once it is done with. A timer that was
+// replaced since it was claimed is kept.
+func (s *HmsttStore) FinishTimer(ctx context.Context, t Timer) error {
+	ctx, span := otel.Tracer("hmstt").Start(ctx, "store.FinishTimer")
+	defer span.End()
+
+	data, err := json.Marshal(timerJSON(t))
+	if err != nil {
+		return fmt.Errorf("marshal timer: %w", err)
+	}
+	if _, err := s.timerQueue().Finish(ctx, s.rdb, timerID(t.Type, t.Key), string(data)); err != nil {
+		return fmt.Errorf("redis finish timer script: %w", err)
+	}
+	return nil
+}
+
+// SetStateFor sets a state like SetState and schedules it to return to its
+// previous value after revertAfter. Extending a pending revert keeps the
+// value it will return to. The state must already exist.
+func (s *HmsttService) SetStateFor(ctx context.Context, tipe, key, value string, description *string, meta *StateMeta, ifMatch *Precondition, revertAfter time.Duration) (StateEntry, Timer, error) {
+	l := zerolog.Ctx(ctx)
+	l.UpdateContext(func(c zerolog.Context) zerolog.Context {
+		return c.Str("hmstt_type", tipe).Str("hmstt_key", key).Dur("revert_after", revertAfter)
+	})
+	l.Info().Msg("Handling SetStateFor service")
+
+	if revertAfter <= 0 || revertAfter > MaxRevertAfter {
+		return StateEntry{}, Timer{}, fmt.Errorf("%w: revert_after must be between 0 and %s", ErrInvalidDuration, MaxRevertAfter)
+	}
+
+	for attempt := 1; ; attempt++ {
+		current, err := s.store.GetState(ctx, tipe, key)
+		if err != nil {
+			return StateEntry{}, Timer{}, ErrStateNotFound
+		}
+		if !ifMatch.holds(current, true) {
+			return StateEntry{}, Timer{}, ErrRevisionMismatch
+		}
+
+		revertTo := current.Value
+		if pending, err := s.store.GetTimer(ctx, tipe, key); err == nil && pending.Op == TIMER_OP_REVERT && pending.Revision == current.Revision {
+			revertTo = pending.Value
+		}
+
+		entry, err := s.SetState(ctx, tipe, key, value, description, meta, IfRevision(&current.Revision))
+		if errors.Is(err, ErrRevisionMismatch) && ifMatch == nil && attempt < maxWriteAttempts {
+			continue
+		}
+		if err != nil {
+			return StateEntry{}, Timer{}, err
+		}
+
+		now := time.Now().UTC()
+		timer := Timer{
+			Type:      tipe,
+			Key:       key,
+			Op:        TIMER_OP_REVERT,
+			Value:     revertTo,
+			Revision:  entry.Revision,
+			DueAt:     now.Add(revertAfter),
+			CreatedAt: now,
+			Caller:    CallerFromContext(ctx),
+		}
+		if err := s.store.PutTimer(ctx, timer); err != nil {
+			l.Error().Err(err).Msg("SetStateFor: scheduling revert failed")
+			return StateEntry{}, Timer{}, errors.New("SET TIMER ERROR")
+		}
+		return entry, timer, nil
+	}
+}
+
+// ListTimers returns the pending timers, soonest first.
+func (s *HmsttService) ListTimers(ctx context.Context) ([]Timer, error) {
+	timers, err := s.store.ListTimers(ctx)
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("ListTimers failed")
+		return nil, errors.New("LIST TIMERS ERROR")
+	}
+	return timers, nil
+}
+
+// CancelTimer removes the pending timer of a state and returns it. The state
+// keeps its current value.
+func (s *HmsttService) CancelTimer(ctx context.Context, tipe, key string) (Timer, error) {
+	l := zerolog.Ctx(ctx)
+	l.UpdateContext(func(c zerolog.Context) zerolog.Context {
+		return c.Str("hmstt_type", tipe).Str("hmstt_key", key)
+	})
+	l.Info().Msg("Handling CancelTimer service")
+
+	timer, err := s.store.GetTimer(ctx, tipe, key)
+	if err != nil {
+		if errors.Is(err, ErrTimerNotFound) {
+			return Timer{}, ErrTimerNotFound
+		}
+		l.Error().Err(err).Msg("CancelTimer: get timer failed")
+		return Timer{}, errors.New("CANCEL TIMER ERROR")
+	}
+	if err := s.store.DeleteTimer(ctx, tipe, key); err != nil {
+		if errors.Is(err, ErrTimerNotFound) {
+			return Timer{}, ErrTimerNotFound
+		}
+		l.Error().Err(err).Msg("CancelTimer failed")
+		return Timer{}, errors.New("CANCEL TIMER ERROR")
+	}
+	return timer, nil
+}
+
+// RunTimers applies due timers every interval until ctx is cancelled. Writes
+// go through SetState, so history and events are recorded as for any change.
+// A timer is removed only after it is applied, so one claimed by an instance
+// that stops before applying it is applied by another after its lease.
+func (s *HmsttService) RunTimers(ctx context.Context, interval time.Duration) error {
+	l := log.With().Str("component", "hmstt_timers").Logger()
+	ctx = WithCaller(l.WithContext(ctx), CALLER_TIMER)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		timers, err := s.store.ClaimDueTimers(ctx, time.Now(), timerLease)
+		if err != nil {
+			l.Error().Err(err).Msg("claiming due timers failed")
+			continue
+		}
+		for _, t := range timers {
+			s.applyTimer(ctx, t)
+		}
+	}
+}
+
+func (s *HmsttService) applyTimer(ctx context.Context, t Timer) {
+	l := zerolog.Ctx(ctx).With().Str("hmstt_type", t.Type).Str("hmstt_key", t.Key).Str("timer_op", t.Op).Logger()
+
+	_, err := s.SetState(l.WithContext(ctx), t.Type, t.Key, t.Value, nil, nil, IfRevision(&t.Revision))
+	switch {
+	case err == nil:
+		l.Info().Str("hmstt_value", t.Value).Msg("timer applied")
+	case errors.Is(err, ErrRevisionMismatch):
+		l.Warn().Msg("state changed since the timer was set, leaving it")
+	case errors.Is(err, ErrStateLocked):
+		l.Warn().Err(err).Msg("state is locked, dropping the timer")
+	case errors.Is(err, ErrConstraintViolation):
+		l.Warn().Err(err).Msg("timer would violate a constraint, dropping it")
+	case errors.Is(err, ErrUnknownType), errors.Is(err, ErrInvalidValue):
+		l.Error().Err(err).Msg("timer value is no longer valid, dropping it")
+	default:
+		l.Error().Err(err).Msg("applying timer failed, retrying when its lease ends")
+		return
+	}
+	if err := s.store.FinishTimer(ctx, t); err != nil {
+		l.Error().Err(err).Msg("removing applied timer failed")
+	}
+}
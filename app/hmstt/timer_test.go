@@ -0,0 +1,183 @@
+package hmstt
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nurhudajoantama/hmauto/internal/config"
+)
+
+func TestSetStateFor(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("reverts to the value before the first timed write", func(t *testing.T) {
+		store := newSwitchStore()
+		svc := NewService(store, nil, nil)
+
+		if _, _, err := svc.SetStateFor(ctx, "switch", "modem", "off", nil, nil, nil, 45*time.Minute); err != nil {
+			t.Fatalf("SetStateFor() error = %v", err)
+		}
+		// Extending keeps the original value to return to.
+		entry, timer, err := svc.SetStateFor(ctx, "switch", "modem", "off", nil, nil, nil, time.Hour)
+		if err != nil {
+			t.Fatalf("second SetStateFor() error = %v", err)
+		}
+		if timer.Value != "on" || timer.Revision != entry.Revision {
+			t.Fatalf("timer = %+v, want revert to on at revision %d", timer, entry.Revision)
+		}
+
+		due, _ := store.ClaimDueTimers(ctx, timer.DueAt, timerLease)
+		if len(due) != 1 {
+			t.Fatalf("due timers = %d, want 1", len(due))
+		}
+		svc.applyTimer(ctx, due[0])
+		if got, _ := store.GetState(ctx, "switch", "modem"); got.Value != "on" {
+			t.Fatalf("value after revert = %q, want on", got.Value)
+		}
+	})
+
+	t.Run("a claimed timer is kept until it is applied", func(t *testing.T) {
+		store := newSwitchStore()
+		svc := NewService(store, nil, nil)
+
+		_, timer, err := svc.SetStateFor(ctx, "switch", "modem", "off", nil, nil, nil, time.Minute)
+		if err != nil {
+			t.Fatalf("SetStateFor() error = %v", err)
+		}
+		// The claiming instance stops before applying the timer.
+		if due, _ := store.ClaimDueTimers(ctx, timer.DueAt, timerLease); len(due) != 1 {
+			t.Fatalf("due timers = %d, want 1", len(due))
+		}
+		if due, _ := store.ClaimDueTimers(ctx, timer.DueAt, timerLease); len(due) != 0 {
+			t.Fatalf("due timers during the lease = %d, want 0", len(due))
+		}
+		due, _ := store.ClaimDueTimers(ctx, timer.DueAt.Add(timerLease), timerLease)
+		if len(due) != 1 {
+			t.Fatalf("due timers after the lease = %d, want 1", len(due))
+		}
+		svc.applyTimer(ctx, due[0])
+		if got, _ := store.GetState(ctx, "switch", "modem"); got.Value != "on" {
+			t.Fatalf("value after revert = %q, want on", got.Value)
+		}
+		if _, err := store.GetTimer(ctx, "switch", "modem"); !errors.Is(err, ErrTimerNotFound) {
+			t.Fatalf("GetTimer() after apply error = %v, want %v", err, ErrTimerNotFound)
+		}
+	})
+
+	t.Run("leaves a state changed before the timer is due", func(t *testing.T) {
+		store := newSwitchStore()
+		svc := NewService(store, nil, nil)
+
+		_, timer, err := svc.SetStateFor(ctx, "switch", "modem", "off", nil, nil, nil, time.Minute)
+		if err != nil {
+			t.Fatalf("SetStateFor() error = %v", err)
+		}
+		if _, err := svc.ToggleState(ctx, "switch", "modem"); err != nil {
+			t.Fatalf("ToggleState() error = %v", err)
+		}
+		if _, err := svc.ToggleState(ctx, "switch", "modem"); err != nil {
+			t.Fatalf("ToggleState() error = %v", err)
+		}
+		svc.applyTimer(ctx, timer)
+		if got, _ := store.GetState(ctx, "switch", "modem"); got.Value != "off" {
+			t.Fatalf("value = %q, want off as last set", got.Value)
+		}
+	})
+
+	t.Run("device reports do not cancel the timer", func(t *testing.T) {
+		store := newSwitchStore()
+		svc := NewService(store, nil, nil)
+
+		_, timer, err := svc.SetStateFor(ctx, "switch", "modem", "off", nil, nil, nil, time.Minute)
+		if err != nil {
+			t.Fatalf("SetStateFor() error = %v", err)
+		}
+		if _, err := svc.ReportState(ctx, "switch", "modem", "off"); err != nil {
+			t.Fatalf("ReportState() error = %v", err)
+		}
+		svc.applyTimer(ctx, timer)
+		if got, _ := store.GetState(ctx, "switch", "modem"); got.Value != "on" {
+			t.Fatalf("value after report and revert = %q, want on", got.Value)
+		}
+	})
+
+	t.Run("drops a timer whose state is locked", func(t *testing.T) {
+		store := newSwitchStore()
+		svc := NewService(store, nil, nil)
+
+		entry, err := svc.LockState(ctx, "switch", "modem", "maintenance", "ops", time.Hour)
+		if err != nil {
+			t.Fatalf("LockState() error = %v", err)
+		}
+		timer := Timer{Type: "switch", Key: "modem", Op: TIMER_OP_REVERT, Value: "off", Revision: entry.Revision, DueAt: time.Now()}
+		if err := store.PutTimer(ctx, timer); err != nil {
+			t.Fatalf("PutTimer() error = %v", err)
+		}
+		svc.applyTimer(ctx, timer)
+		if got, _ := store.GetState(ctx, "switch", "modem"); got.Value != "on" {
+			t.Fatalf("value = %q, want on while locked", got.Value)
+		}
+		if _, err := store.GetTimer(ctx, "switch", "modem"); !errors.Is(err, ErrTimerNotFound) {
+			t.Fatalf("GetTimer() after apply error = %v, want %v", err, ErrTimerNotFound)
+		}
+	})
+
+	t.Run("drops a timer that would violate a constraint", func(t *testing.T) {
+		set, err := NewConstraintSet([]config.StateConstraint{
+			{Name: "pumps", Kind: CONSTRAINT_EXCLUSIVE, States: []string{"switch/pump_1", "switch/pump_2"}},
+		})
+		if err != nil {
+			t.Fatalf("NewConstraintSet() error = %v", err)
+		}
+		store := &fakeStateStore{}
+		store.CreateState(ctx, StateEntry{Type: "switch", K: "pump_1", Value: "on"})
+		store.CreateState(ctx, StateEntry{Type: "switch", K: "pump_2", Value: "off"})
+		svc := NewService(store, nil, &ServiceConfig{Constraints: set})
+
+		// pump_1 is off for a minute, and pump_2 takes over meanwhile.
+		_, timer, err := svc.SetStateFor(ctx, "switch", "pump_1", "off", nil, nil, nil, time.Minute)
+		if err != nil {
+			t.Fatalf("SetStateFor() error = %v", err)
+		}
+		if _, err := svc.SetState(ctx, "switch", "pump_2", "on", nil, nil, nil); err != nil {
+			t.Fatalf("SetState(pump_2) error = %v", err)
+		}
+		svc.applyTimer(ctx, timer)
+		if got, _ := store.GetState(ctx, "switch", "pump_1"); got.Value != "off" {
+			t.Fatalf("pump_1 = %q, want off", got.Value)
+		}
+		if _, err := store.GetTimer(ctx, "switch", "pump_1"); !errors.Is(err, ErrTimerNotFound) {
+			t.Fatalf("GetTimer() after apply error = %v, want %v", err, ErrTimerNotFound)
+		}
+	})
+
+	t.Run("requires an existing state and a valid duration", func(t *testing.T) {
+		svc := NewService(newSwitchStore(), nil, nil)
+		if _, _, err := svc.SetStateFor(ctx, "switch", "missing", "on", nil, nil, nil, time.Minute); !errors.Is(err, ErrStateNotFound) {
+			t.Fatalf("SetStateFor(missing) error = %v, want %v", err, ErrStateNotFound)
+		}
+		if _, _, err := svc.SetStateFor(ctx, "switch", "modem", "off", nil, nil, nil, -time.Minute); !errors.Is(err, ErrInvalidDuration) {
+			t.Fatalf("SetStateFor(-1m) error = %v, want %v", err, ErrInvalidDuration)
+		}
+	})
+
+	t.Run("cancel keeps the current value", func(t *testing.T) {
+		store := newSwitchStore()
+		svc := NewService(store, nil, nil)
+
+		if _, _, err := svc.SetStateFor(ctx, "switch", "modem", "off", nil, nil, nil, time.Minute); err != nil {
+			t.Fatalf("SetStateFor() error = %v", err)
+		}
+		if _, err := svc.CancelTimer(ctx, "switch", "modem"); err != nil {
+			t.Fatalf("CancelTimer() error = %v", err)
+		}
+		if _, err := svc.CancelTimer(ctx, "switch", "modem"); !errors.Is(err, ErrTimerNotFound) {
+			t.Fatalf("second CancelTimer() error = %v, want %v", err, ErrTimerNotFound)
+		}
+		if timers, _ := svc.ListTimers(ctx); len(timers) != 0 {
+			t.Fatalf("len(timers) = %d, want 0", len(timers))
+		}
+	})
+}
@@ -0,0 +1,154 @@
+package hmstt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+var ErrNotToggleable = errors.New("TYPE CANNOT BE TOGGLED")
+var ErrCycleInProgress = errors.New("CYCLE ALREADY IN PROGRESS")
+var ErrInvalidDuration = errors.New("INVALID DURATION")
+
+const (
+	DefaultCycleOffFor = 10 * time.Second
+	MaxCycleOffFor     = 10 * time.Minute
+)
+
+// updateValue replaces the value of an existing state with next(current),
+// retrying with a fresh read when another writer gets in between. If ifMatch
+// is set the state must still meet it.
+func (s *HmsttService) updateValue(ctx context.Context, tipe, key, op string, ifMatch *Precondition, next func(StateEntry) (string, error)) (StateEntry, error) {
+	l := zerolog.Ctx(ctx)
+	for attempt := 1; ; attempt++ {
+		current, err := s.store.GetState(ctx, tipe, key)
+		if err != nil {
+			return StateEntry{}, ErrStateNotFound
+		}
+		if !ifMatch.holds(current, true) {
+			return StateEntry{}, ErrRevisionMismatch
+		}
+		if err := checkUnlocked(current); err != nil {
+			return StateEntry{}, err
+		}
+		value, err := next(current)
+		if err != nil {
+			return StateEntry{}, err
+		}
+		if value == current.Value {
+			return current, nil
+		}
+
+		entry := current
+		entry.Value = value
+		entry.Lock = nil
+		stampDesired(current, &entry)
+		guards, err := s.checkConstraints(ctx, []stateChange{{before: current, after: entry}})
+		if err != nil {
+			return StateEntry{}, err
+		}
+		entry, err = s.writeState(ctx, entry, current.Revision, guards)
+		if errors.Is(err, ErrRevisionMismatch) {
+			if attempt < maxWriteAttempts {
+				l.Warn().Int("attempt", attempt).Str("op", op).Msg("concurrent write, retrying")
+				continue
+			}
+			return StateEntry{}, ErrRevisionMismatch
+		}
+		if err != nil {
+			l.Error().Err(err).Str("op", op).Msg("set state failed")
+			return StateEntry{}, errors.New("SET STATE ERROR")
+		}
+		s.recordHistory(ctx, op, current, entry)
+		s.notifyWrite(ctx, entry)
+		s.publishChange(ctx, entry)
+		return entry, nil
+	}
+}
+
+// ToggleState flips a two-valued state (e.g. a switch from on to off) in a
+// single compare-and-set, so concurrent toggles never cancel out silently.
+func (s *HmsttService) ToggleState(ctx context.Context, tipe, key string) (StateEntry, error) {
+	l := zerolog.Ctx(ctx)
+	l.UpdateContext(func(c zerolog.Context) zerolog.Context {
+		return c.Str("hmstt_type", tipe).Str("hmstt_key", key)
+	})
+	l.Info().Msg("Handling ToggleState service")
+
+	def, ok := s.types.Lookup(tipe)
+	if !ok {
+		return StateEntry{}, fmt.Errorf("%w: %q is not a registered type", ErrUnknownType, tipe)
+	}
+	if _, ok := def.Toggle(""); !ok {
+		return StateEntry{}, fmt.Errorf("%w: %s is not a bool or two-valued enum", ErrNotToggleable, tipe)
+	}
+
+	return s.updateValue(ctx, tipe, key, HISTORY_OP_TOGGLE, nil, func(current StateEntry) (string, error) {
+		next, _ := def.Toggle(current.Value)
+		return next, nil
+	})
+}
+
+// CycleState power-cycles a switch-like state: it is switched off now and a
+// timer switches it back on after offFor (DefaultCycleOffFor if zero). The
+// timer is stored in Redis, so it fires even if the caller disconnects or the
+// server restarts. If the state is changed by someone else in the meantime,
+// it is left as they set it.
+// It returns the state as switched off and the timer that switches it on.
+func (s *HmsttService) CycleState(ctx context.Context, tipe, key string, offFor time.Duration) (StateEntry, Timer, error) {
+	l := zerolog.Ctx(ctx)
+	l.UpdateContext(func(c zerolog.Context) zerolog.Context {
+		return c.Str("hmstt_type", tipe).Str("hmstt_key", key).Dur("off_for", offFor)
+	})
+	l.Info().Msg("Handling CycleState service")
+
+	if offFor == 0 {
+		offFor = DefaultCycleOffFor
+	}
+	if offFor < 0 || offFor > MaxCycleOffFor {
+		return StateEntry{}, Timer{}, fmt.Errorf("%w: off_for must be between 0 and %s", ErrInvalidDuration, MaxCycleOffFor)
+	}
+	def, ok := s.types.Lookup(tipe)
+	if !ok {
+		return StateEntry{}, Timer{}, fmt.Errorf("%w: %q is not a registered type", ErrUnknownType, tipe)
+	}
+	off, on, ok := def.OnOff()
+	if !ok {
+		return StateEntry{}, Timer{}, fmt.Errorf("%w: %s has no on and off values", ErrNotToggleable, tipe)
+	}
+
+	current, err := s.store.GetState(ctx, tipe, key)
+	if err != nil {
+		return StateEntry{}, Timer{}, ErrStateNotFound
+	}
+	if pending, err := s.store.GetTimer(ctx, tipe, key); err == nil && pending.Op == TIMER_OP_CYCLE && pending.Revision == current.Revision {
+		return StateEntry{}, Timer{}, ErrCycleInProgress
+	}
+
+	entry, err := s.updateValue(ctx, tipe, key, HISTORY_OP_CYCLE, IfRevision(&current.Revision), func(StateEntry) (string, error) {
+		return off, nil
+	})
+	if err != nil {
+		return StateEntry{}, Timer{}, err
+	}
+
+	now := time.Now().UTC()
+	timer := Timer{
+		Type:      tipe,
+		Key:       key,
+		Op:        TIMER_OP_CYCLE,
+		Value:     on,
+		Revision:  entry.Revision,
+		DueAt:     now.Add(offFor),
+		CreatedAt: now,
+		Caller:    CallerFromContext(ctx),
+	}
+	if err := s.store.PutTimer(ctx, timer); err != nil {
+		l.Error().Err(err).Msg("CycleState: scheduling switch on failed")
+		return StateEntry{}, Timer{}, errors.New("SET TIMER ERROR")
+	}
+	return entry, timer, nil
+}
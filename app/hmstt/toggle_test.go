@@ -0,0 +1,74 @@
+package hmstt
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nurhudajoantama/hmauto/internal/config"
+)
+
+func newSwitchStore() *fakeStateStore {
+	return &fakeStateStore{states: map[string][]StateEntry{
+		"switch": {{Type: "switch", K: "modem", Value: "on", Description: "Modem", Revision: 1}},
+		"label":  {{Type: "label", K: "room", Value: "office", Revision: 2}},
+	}, seq: 2}
+}
+
+func TestToggleState(t *testing.T) {
+	types, err := NewTypeRegistry([]config.StateType{{Name: "label", Kind: KIND_TEXT}})
+	if err != nil {
+		t.Fatalf("NewTypeRegistry() error = %v", err)
+	}
+	svc := NewService(newSwitchStore(), nil, &ServiceConfig{Types: types})
+	ctx := context.Background()
+
+	entry, err := svc.ToggleState(ctx, "switch", "modem")
+	if err != nil {
+		t.Fatalf("ToggleState() error = %v", err)
+	}
+	if entry.Value != "off" || entry.Description != "Modem" {
+		t.Fatalf("ToggleState() = %+v, want off with description kept", entry)
+	}
+	if entry, _ = svc.ToggleState(ctx, "switch", "modem"); entry.Value != "on" {
+		t.Fatalf("second ToggleState() value = %q, want on", entry.Value)
+	}
+	if _, err := svc.ToggleState(ctx, "label", "room"); !errors.Is(err, ErrNotToggleable) {
+		t.Fatalf("ToggleState(label) error = %v, want %v", err, ErrNotToggleable)
+	}
+	if _, err := svc.ToggleState(ctx, "switch", "missing"); !errors.Is(err, ErrStateNotFound) {
+		t.Fatalf("ToggleState(missing) error = %v, want %v", err, ErrStateNotFound)
+	}
+}
+
+func TestCycleState(t *testing.T) {
+	ctx := context.Background()
+	store := newSwitchStore()
+	svc := NewService(store, nil, nil)
+
+	entry, timer, err := svc.CycleState(ctx, "switch", "modem", 30*time.Second)
+	if err != nil {
+		t.Fatalf("CycleState() error = %v", err)
+	}
+	if entry.Value != "off" {
+		t.Fatalf("CycleState() value = %q, want off", entry.Value)
+	}
+	if timer.Op != TIMER_OP_CYCLE || timer.Value != "on" || timer.Revision != entry.Revision {
+		t.Fatalf("CycleState() timer = %+v, want switch on at revision %d", timer, entry.Revision)
+	}
+	if _, _, err := svc.CycleState(ctx, "switch", "modem", time.Second); !errors.Is(err, ErrCycleInProgress) {
+		t.Fatalf("second CycleState() error = %v, want %v", err, ErrCycleInProgress)
+	}
+	if _, _, err := svc.CycleState(ctx, "switch", "modem", time.Hour); !errors.Is(err, ErrInvalidDuration) {
+		t.Fatalf("CycleState(1h) error = %v, want %v", err, ErrInvalidDuration)
+	}
+
+	due, _ := store.ClaimDueTimers(ctx, timer.DueAt, timerLease)
+	for _, tm := range due {
+		svc.applyTimer(ctx, tm)
+	}
+	if got, _ := store.GetState(ctx, "switch", "modem"); got.Value != "on" {
+		t.Fatalf("value after timer = %q, want on", got.Value)
+	}
+}
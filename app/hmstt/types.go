@@ -0,0 +1,287 @@
+package hmstt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/jsonschema-go/jsonschema"
+	"github.com/nurhudajoantama/hmauto/internal/config"
+)
+
+var ErrUnknownType = errors.New("UNKNOWN TYPE")
+var ErrInvalidValue = errors.New("INVALID VALUE")
+
+// TypeDef is a validated state type from the registry.
+type TypeDef struct {
+	Name    string
+	Kind    string
+	Values  []string
+	Min     *float64
+	Max     *float64
+	Step    int64
+	Pattern string
+	Schema  json.RawMessage
+
+	pattern *regexp.Regexp
+	schema  *jsonschema.Resolved
+}
+
+// Structured reports whether values of this type are JSON objects rather than plain strings.
+func (t TypeDef) Structured() bool {
+	return t.Kind == KIND_JSON
+}
+
+// Validate reports whether value is acceptable for this type. The returned
+// error wraps ErrInvalidValue and names the violated constraint.
+func (t TypeDef) Validate(value string) error {
+	switch t.Kind {
+	case KIND_ENUM:
+		for _, v := range t.Values {
+			if v == value {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %s accepts one of [%s], got %q", ErrInvalidValue, t.Name, strings.Join(t.Values, ", "), value)
+
+	case KIND_INT:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: %s expects an integer, got %q", ErrInvalidValue, t.Name, value)
+		}
+		if err := t.checkRange(float64(n)); err != nil {
+			return err
+		}
+		if t.Step > 1 {
+			base := int64(0)
+			if t.Min != nil {
+				base = int64(*t.Min)
+			}
+			if (n-base)%t.Step != 0 {
+				return fmt.Errorf("%w: %s must be a multiple of %d from %d, got %d", ErrInvalidValue, t.Name, t.Step, base, n)
+			}
+		}
+		return nil
+
+	case KIND_FLOAT:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return fmt.Errorf("%w: %s expects a number, got %q", ErrInvalidValue, t.Name, value)
+		}
+		return t.checkRange(f)
+
+	case KIND_BOOL:
+		if value != "true" && value != "false" {
+			return fmt.Errorf("%w: %s expects true or false, got %q", ErrInvalidValue, t.Name, value)
+		}
+		return nil
+
+	case KIND_TEXT:
+		if t.pattern != nil && !t.pattern.MatchString(value) {
+			return fmt.Errorf("%w: %s must match %s, got %q", ErrInvalidValue, t.Name, t.Pattern, value)
+		}
+		return nil
+
+	case KIND_JSON:
+		var doc any
+		if err := json.Unmarshal([]byte(value), &doc); err != nil {
+			return fmt.Errorf("%w: %s expects a JSON object: %v", ErrInvalidValue, t.Name, err)
+		}
+		if _, ok := doc.(map[string]any); !ok {
+			return fmt.Errorf("%w: %s expects a JSON object, got %s", ErrInvalidValue, t.Name, value)
+		}
+		if err := t.schema.Validate(doc); err != nil {
+			return fmt.Errorf("%w: %s schema: %v", ErrInvalidValue, t.Name, err)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s has unsupported kind %q", ErrInvalidValue, t.Name, t.Kind)
+}
+
+// OnOff returns the off and on values of switch-like types: bools, and enums
+// that have both "on" and "off".
+func (t TypeDef) OnOff() (off, on string, ok bool) {
+	switch t.Kind {
+	case KIND_BOOL:
+		return "false", "true", true
+	case KIND_ENUM:
+		var hasOn, hasOff bool
+		for _, v := range t.Values {
+			hasOn = hasOn || v == "on"
+			hasOff = hasOff || v == "off"
+		}
+		if hasOn && hasOff {
+			return "off", "on", true
+		}
+	}
+	return "", "", false
+}
+
+// Toggle returns the value that value flips to. Bools and enums with exactly
+// two values can be toggled.
+func (t TypeDef) Toggle(value string) (string, bool) {
+	switch {
+	case t.Kind == KIND_BOOL:
+		if value == "true" {
+			return "false", true
+		}
+		return "true", true
+	case t.Kind == KIND_ENUM && len(t.Values) == 2:
+		if value == t.Values[0] {
+			return t.Values[1], true
+		}
+		return t.Values[0], true
+	}
+	return "", false
+}
+
+func (t TypeDef) checkRange(f float64) error {
+	if t.Min != nil && f < *t.Min {
+		return fmt.Errorf("%w: %s must be >= %v, got %v", ErrInvalidValue, t.Name, *t.Min, f)
+	}
+	if t.Max != nil && f > *t.Max {
+		return fmt.Errorf("%w: %s must be <= %v, got %v", ErrInvalidValue, t.Name, *t.Max, f)
+	}
+	return nil
+}
+
+// TypeRegistry holds the state types the service accepts.
+type TypeRegistry struct {
+	types map[string]TypeDef
+}
+
+// switchType is the built-in type available even when the config declares no types.
+var switchType = config.StateType{
+	Name:   PREFIX_SWITCH,
+	Kind:   KIND_ENUM,
+	Values: []string{STATE_ON, STATE_OFF},
+}
+
+// NewTypeRegistry builds a registry from the `types:` config section.
+// The built-in switch type is always registered unless the config redefines it.
+func NewTypeRegistry(types []config.StateType) (*TypeRegistry, error) {
+	r := &TypeRegistry{types: make(map[string]TypeDef, len(types)+1)}
+	for _, st := range types {
+		if _, dup := r.types[st.Name]; dup {
+			return nil, fmt.Errorf("types: duplicate type %q", st.Name)
+		}
+		def, err := compileType(st)
+		if err != nil {
+			return nil, err
+		}
+		r.types[def.Name] = def
+	}
+	if _, ok := r.types[PREFIX_SWITCH]; !ok {
+		def, _ := compileType(switchType)
+		r.types[def.Name] = def
+	}
+	return r, nil
+}
+
+// DefaultTypeRegistry returns a registry containing only the built-in types.
+func DefaultTypeRegistry() *TypeRegistry {
+	r, _ := NewTypeRegistry(nil)
+	return r
+}
+
+func compileType(st config.StateType) (TypeDef, error) {
+	if st.Name == "" {
+		return TypeDef{}, errors.New("types: name must be set")
+	}
+	def := TypeDef{
+		Name:    st.Name,
+		Kind:    st.Kind,
+		Values:  st.Values,
+		Min:     st.Min,
+		Max:     st.Max,
+		Step:    st.Step,
+		Pattern: st.Pattern,
+	}
+	if st.Min != nil && st.Max != nil && *st.Min > *st.Max {
+		return TypeDef{}, fmt.Errorf("types: %s min is greater than max", st.Name)
+	}
+
+	switch st.Kind {
+	case KIND_ENUM:
+		if len(st.Values) == 0 {
+			return TypeDef{}, fmt.Errorf("types: %s of kind enum needs values", st.Name)
+		}
+	case KIND_INT:
+		if st.Step < 0 {
+			return TypeDef{}, fmt.Errorf("types: %s step must not be negative", st.Name)
+		}
+		// min is the base of step, so it must be a whole number like max.
+		if st.Min != nil && !isInt64(*st.Min) {
+			return TypeDef{}, fmt.Errorf("types: %s min must be an integer for kind int, got %v", st.Name, *st.Min)
+		}
+		if st.Max != nil && !isInt64(*st.Max) {
+			return TypeDef{}, fmt.Errorf("types: %s max must be an integer for kind int, got %v", st.Name, *st.Max)
+		}
+	case KIND_FLOAT, KIND_BOOL:
+	case KIND_TEXT:
+		if st.Pattern != "" {
+			re, err := regexp.Compile(st.Pattern)
+			if err != nil {
+				return TypeDef{}, fmt.Errorf("types: %s pattern: %w", st.Name, err)
+			}
+			def.pattern = re
+		}
+	case KIND_JSON:
+		if st.Schema == "" {
+			return TypeDef{}, fmt.Errorf("types: %s of kind json needs a schema", st.Name)
+		}
+		var schema jsonschema.Schema
+		if err := json.Unmarshal([]byte(st.Schema), &schema); err != nil {
+			return TypeDef{}, fmt.Errorf("types: %s schema: %w", st.Name, err)
+		}
+		resolved, err := schema.Resolve(nil)
+		if err != nil {
+			return TypeDef{}, fmt.Errorf("types: %s schema: %w", st.Name, err)
+		}
+		def.Schema = json.RawMessage(st.Schema)
+		def.schema = resolved
+	default:
+		return TypeDef{}, fmt.Errorf("types: %s has unknown kind %q", st.Name, st.Kind)
+	}
+
+	return def, nil
+}
+
+// isInt64 reports whether f is a whole number that fits an int64.
+func isInt64(f float64) bool {
+	return f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64
+}
+
+// Lookup returns the definition for tipe.
+func (r *TypeRegistry) Lookup(tipe string) (TypeDef, bool) {
+	def, ok := r.types[tipe]
+	return def, ok
+}
+
+// Validate checks a type/key/value combination against the registry.
+func (r *TypeRegistry) Validate(tipe, key, value string) error {
+	if tipe == "" || key == "" {
+		return errors.New("INVALID TYPE OR KEY")
+	}
+	def, ok := r.types[tipe]
+	if !ok {
+		return fmt.Errorf("%w: %q is not a registered type", ErrUnknownType, tipe)
+	}
+	return def.Validate(value)
+}
+
+// List returns all registered types sorted by name.
+func (r *TypeRegistry) List() []TypeDef {
+	defs := make([]TypeDef, 0, len(r.types))
+	for _, def := range r.types {
+		defs = append(defs, def)
+	}
+	sort.Slice(defs, func(i, j int) bool { return defs[i].Name < defs[j].Name })
+	return defs
+}
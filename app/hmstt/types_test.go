@@ -0,0 +1,93 @@
+package hmstt
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/nurhudajoantama/hmauto/internal/config"
+)
+
+func float64Ptr(f float64) *float64 { return &f }
+
+func TestTypeRegistryValidate(t *testing.T) {
+	reg, err := NewTypeRegistry([]config.StateType{
+		{Name: "dimmer", Kind: KIND_INT, Min: float64Ptr(0), Max: float64Ptr(100), Step: 5},
+		{Name: "temperature", Kind: KIND_FLOAT, Min: float64Ptr(-20), Max: float64Ptr(50)},
+		{Name: "flag", Kind: KIND_BOOL},
+		{Name: "label", Kind: KIND_TEXT, Pattern: "^[a-z]{1,8}$"},
+		{Name: "thermostat", Kind: KIND_JSON, Schema: `{"type":"object","properties":{"mode":{"enum":["heat","cool","off"]},"setpoint":{"type":"number","minimum":5,"maximum":30}},"required":["mode"],"additionalProperties":false}`},
+	})
+	if err != nil {
+		t.Fatalf("NewTypeRegistry() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		tipe    string
+		value   string
+		wantErr error
+		wantMsg string
+	}{
+		{name: "built-in switch on", tipe: "switch", value: "on"},
+		{name: "built-in switch rejects dim", tipe: "switch", value: "dim", wantErr: ErrInvalidValue, wantMsg: "one of [on, off]"},
+		{name: "int in range on step", tipe: "dimmer", value: "45"},
+		{name: "int off step", tipe: "dimmer", value: "42", wantErr: ErrInvalidValue, wantMsg: "multiple of 5"},
+		{name: "int above max", tipe: "dimmer", value: "105", wantErr: ErrInvalidValue, wantMsg: "<= 100"},
+		{name: "int not a number", tipe: "dimmer", value: "4.5", wantErr: ErrInvalidValue, wantMsg: "expects an integer"},
+		{name: "float in range", tipe: "temperature", value: "21.5"},
+		{name: "float below min", tipe: "temperature", value: "-30", wantErr: ErrInvalidValue, wantMsg: ">= -20"},
+		{name: "bool", tipe: "flag", value: "true"},
+		{name: "bool rejects yes", tipe: "flag", value: "yes", wantErr: ErrInvalidValue, wantMsg: "true or false"},
+		{name: "text matches", tipe: "label", value: "office"},
+		{name: "text violates pattern", tipe: "label", value: "Office", wantErr: ErrInvalidValue, wantMsg: "must match"},
+		{name: "json matches schema", tipe: "thermostat", value: `{"mode":"heat","setpoint":21.5}`},
+		{name: "json not an object", tipe: "thermostat", value: `"heat"`, wantErr: ErrInvalidValue, wantMsg: "expects a JSON object"},
+		{name: "json violates schema", tipe: "thermostat", value: `{"mode":"heat","setpoint":40}`, wantErr: ErrInvalidValue, wantMsg: "schema"},
+		{name: "json extra property", tipe: "thermostat", value: `{"mode":"off","fan":"auto"}`, wantErr: ErrInvalidValue, wantMsg: "schema"},
+		{name: "unknown type", tipe: "dial", value: "1", wantErr: ErrUnknownType},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := reg.Validate(tt.tipe, "k", tt.value)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("Validate() error = %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Validate() error = %v, want %v", err, tt.wantErr)
+			}
+			if !strings.Contains(err.Error(), tt.wantMsg) {
+				t.Fatalf("Validate() error = %q, want it to mention %q", err.Error(), tt.wantMsg)
+			}
+		})
+	}
+}
+
+func TestNewTypeRegistryRejectsBadConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		types []config.StateType
+	}{
+		{name: "unknown kind", types: []config.StateType{{Name: "x", Kind: "color"}}},
+		{name: "enum without values", types: []config.StateType{{Name: "x", Kind: KIND_ENUM}}},
+		{name: "json without schema", types: []config.StateType{{Name: "x", Kind: KIND_JSON}}},
+		{name: "bad pattern", types: []config.StateType{{Name: "x", Kind: KIND_TEXT, Pattern: "("}}},
+		{name: "fractional int min", types: []config.StateType{{Name: "x", Kind: KIND_INT, Min: float64Ptr(0.5), Step: 2}}},
+		{name: "fractional int max", types: []config.StateType{{Name: "x", Kind: KIND_INT, Max: float64Ptr(9.5)}}},
+		{name: "int min out of range", types: []config.StateType{{Name: "x", Kind: KIND_INT, Min: float64Ptr(-1e19)}}},
+		{name: "min above max", types: []config.StateType{{Name: "x", Kind: KIND_FLOAT, Min: float64Ptr(2), Max: float64Ptr(1)}}},
+		{name: "duplicate", types: []config.StateType{{Name: "x", Kind: KIND_BOOL}, {Name: "x", Kind: KIND_BOOL}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewTypeRegistry(tt.types); err == nil {
+				t.Fatal("NewTypeRegistry() error = nil, want error")
+			}
+		})
+	}
+}
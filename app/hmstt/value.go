@@ -0,0 +1,91 @@
+package hmstt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// canonicalJSON re-encodes a JSON document with sorted object keys and no
+// insignificant whitespace, so equal documents compare equal as strings.
+func canonicalJSON(value string) (string, error) {
+	doc, err := decodeJSON(value)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// mergePatch applies an RFC 7386 JSON merge patch to a JSON object and
+// returns the canonical result. A null member in the patch removes the key.
+func mergePatch(current, patch string) (string, error) {
+	base, err := decodeJSON(current)
+	if err != nil {
+		return "", err
+	}
+	p, err := decodeJSON(patch)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(mergeValue(base, p))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func mergeValue(base, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	b, ok := base.(map[string]any)
+	if !ok {
+		b = map[string]any{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(b, k)
+			continue
+		}
+		b[k] = mergeValue(b[k], v)
+	}
+	return b
+}
+
+func decodeJSON(value string) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader([]byte(value)))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("%w: invalid JSON: %v", ErrInvalidValue, err)
+	}
+	return doc, nil
+}
+
+// valueFromRaw turns a request value into the string form the service works
+// with: a JSON string yields its contents, anything else (an object for
+// structured types) is passed through as JSON text.
+func valueFromRaw(raw json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	return string(bytes.TrimSpace(raw))
+}
+
+// valueFromAny converts an MCP tool argument into the service's string form.
+func valueFromAny(v any) (string, error) {
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,36 @@
+package hmstt
+
+import "testing"
+
+func TestMergePatch(t *testing.T) {
+	got, err := mergePatch(`{"mode":"heat","setpoint":21,"fan":{"speed":2,"auto":true}}`, `{"setpoint":22.5,"fan":{"auto":null}}`)
+	if err != nil {
+		t.Fatalf("mergePatch() error = %v", err)
+	}
+	want := `{"fan":{"speed":2},"mode":"heat","setpoint":22.5}`
+	if got != want {
+		t.Fatalf("mergePatch() = %s, want %s", got, want)
+	}
+}
+
+func TestEntryEncodingRoundTrip(t *testing.T) {
+	tests := []StateEntry{
+		{Type: "switch", K: "modem", Value: "on"},
+		{Type: "text", K: "note", Value: `{"looks":"like json"}`},
+		{Type: "thermostat", K: "living", Value: `{"mode":"heat","setpoint":21}`, Structured: true},
+	}
+
+	for _, want := range tests {
+		data, err := encodeEntry(want)
+		if err != nil {
+			t.Fatalf("encodeEntry() error = %v", err)
+		}
+		got, err := decodeEntry(want.Type, want.K, data)
+		if err != nil {
+			t.Fatalf("decodeEntry() error = %v", err)
+		}
+		if got.Value != want.Value || got.Structured != want.Structured {
+			t.Fatalf("round trip = (%q, %v), want (%q, %v)", got.Value, got.Structured, want.Value, want.Structured)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package hmstt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// MaxWait bounds how long a batch read may wait for a change.
+const MaxWait = time.Minute
+
+var hmsttWaiters = promauto.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "hmstt_state_waiters",
+		Help: "Batch reads currently waiting for a state change.",
+	},
+)
+
+// ChangeNotice says that a state was written, bumping its revision, or was
+// deleted. Origin is the instance that made the change.
+type ChangeNotice struct {
+	Origin   string `json:"origin"`
+	Type     string `json:"type"`
+	Key      string `json:"key"`
+	Revision int64  `json:"revision,omitempty"`
+	Deleted  bool   `json:"deleted,omitempty"`
+}
+
+// ChangeRelay shares change notices between instances, so a wait on one
+// instance ends when another one writes.
+type ChangeRelay interface {
+	PublishChange(ctx context.Context, n ChangeNotice) error
+	// SubscribeChanges calls fn for every notice published by any instance
+	// until ctx is cancelled.
+	SubscribeChanges(ctx context.Context, fn func(ChangeNotice)) error
+}
+
+// ChangeNotifier wakes the waits of this instance.
+type ChangeNotifier struct {
+	mu       sync.Mutex
+	closed   bool
+	watchers map[string]map[*watcher]struct{} // type → watchers
+}
+
+type watcher struct {
+	keys  map[string]bool
+	since int64
+	c     chan struct{}
+}
+
+func NewChangeNotifier() *ChangeNotifier {
+	return &ChangeNotifier{watchers: map[string]map[*watcher]struct{}{}}
+}
+
+// watch returns a channel that is closed once one of keys changes to a
+// revision after since or is deleted, and a func to stop watching.
+func (n *ChangeNotifier) watch(tipe string, keys []string, since int64) (<-chan struct{}, func()) {
+	w := &watcher{keys: make(map[string]bool, len(keys)), since: since, c: make(chan struct{})}
+	for _, k := range keys {
+		w.keys[k] = true
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		close(w.c)
+		return w.c, func() {}
+	}
+	if n.watchers[tipe] == nil {
+		n.watchers[tipe] = map[*watcher]struct{}{}
+	}
+	n.watchers[tipe][w] = struct{}{}
+	hmsttWaiters.Inc()
+	return w.c, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if _, ok := n.watchers[tipe][w]; !ok {
+			return
+		}
+		delete(n.watchers[tipe], w)
+		if len(n.watchers[tipe]) == 0 {
+			delete(n.watchers, tipe)
+		}
+		hmsttWaiters.Dec()
+	}
+}
+
+// Notify wakes the waits that watch the changed state.
+func (n *ChangeNotifier) Notify(c ChangeNotice) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for w := range n.watchers[c.Type] {
+		if !w.keys[c.Key] || (!c.Deleted && c.Revision <= w.since) {
+			continue
+		}
+		close(w.c)
+		delete(n.watchers[c.Type], w)
+		hmsttWaiters.Dec()
+	}
+	if len(n.watchers[c.Type]) == 0 {
+		delete(n.watchers, c.Type)
+	}
+}
+
+// Close wakes every wait and makes new ones return at once, so waiting
+// requests answer before the server shuts down.
+func (n *ChangeNotifier) Close() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.closed = true
+	for tipe, ws := range n.watchers {
+		for w := range ws {
+			close(w.c)
+			hmsttWaiters.Dec()
+		}
+		delete(n.watchers, tipe)
+	}
+}
+
+// notifyChange wakes local waits and tells the other instances.
+func (s *HmsttService) notifyChange(ctx context.Context, c ChangeNotice) {
+	c.Origin = s.origin
+	s.notifier.Notify(c)
+	if s.relay == nil {
+		return
+	}
+	if err := s.relay.PublishChange(ctx, c); err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("publishing change notice failed")
+	}
+}
+
+// notifyWrite wakes the waits on a state after any write, whether or not it
+// changed the value: every write bumps the revision, and so does end a wait
+// with since at once.
+func (s *HmsttService) notifyWrite(ctx context.Context, entry StateEntry) {
+	s.notifyChange(ctx, ChangeNotice{Type: entry.Type, Key: entry.K, Revision: entry.Revision})
+}
+
+// WaitStatesByKeys is GetStatesByKeys for long polling. If since is set and
+// one of the states has a newer revision, it returns at once; otherwise it
+// waits until one of the keys is written or deleted, or wait elapses, and
+// then returns the states as they are. Both use the revision, so any write
+// counts, including one that only changes the description, labels or lock;
+// device reports do not bump the revision and count for neither.
+func (s *HmsttService) WaitStatesByKeys(ctx context.Context, tipe string, keys []string, since *int64, wait time.Duration) ([]StateEntry, error) {
+	var after int64
+	if since != nil {
+		after = *since
+	}
+	// Watch before reading, so a change between the read and the wait
+	// is not missed.
+	changed, stop := s.notifier.watch(tipe, keys, after)
+	defer stop()
+
+	entries, err := s.GetStatesByKeys(ctx, tipe, keys)
+	if err != nil {
+		return nil, err
+	}
+	if since != nil {
+		for _, e := range entries {
+			if e.Revision > *since {
+				return entries, nil
+			}
+		}
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-changed:
+	case <-timer.C:
+		return entries, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return s.GetStatesByKeys(ctx, tipe, keys)
+}
+
+// RunChangeRelay feeds the notices of other instances to the local waits
+// until ctx is cancelled, then releases every wait.
+func (s *HmsttService) RunChangeRelay(ctx context.Context) error {
+	defer s.notifier.Close()
+	if s.relay == nil {
+		<-ctx.Done()
+		return nil
+	}
+	return s.relay.SubscribeChanges(ctx, func(c ChangeNotice) {
+		if c.Origin != s.origin {
+			s.notifier.Notify(c)
+		}
+	})
+}
+
+func (s *HmsttStore) changesChannel() string {
+	return s.prefix + ":hmstt_changes"
+}
+
+// PublishChange implements ChangeRelay with Redis pub/sub.
+func (s *HmsttStore) PublishChange(ctx context.Context, n ChangeNotice) error {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return fmt.Errorf("marshal change notice: %w", err)
+	}
+	if err := s.rdb.Publish(ctx, s.changesChannel(), data).Err(); err != nil {
+		return fmt.Errorf("redis PUBLISH change: %w", err)
+	}
+	return nil
+}
+
+// SubscribeChanges implements ChangeRelay with Redis pub/sub. The
+// subscription reconnects on its own; notices sent while it is down are
+// lost, and waits on this instance then end by their timeout.
+func (s *HmsttStore) SubscribeChanges(ctx context.Context, fn func(ChangeNotice)) error {
+	l := log.With().Str("component", "hmstt_change_relay").Logger()
+
+	sub := s.rdb.Subscribe(ctx, s.changesChannel())
+	defer sub.Close()
+	msgs := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg, ok := <-msgs:
+			if !ok {
+				return nil
+			}
+			var n ChangeNotice
+			if err := json.Unmarshal([]byte(msg.Payload), &n); err != nil {
+				l.Warn().Err(err).Msg("skipping undecodable change notice")
+				continue
+			}
+			fn(n)
+		}
+	}
+}
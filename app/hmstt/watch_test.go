@@ -0,0 +1,195 @@
+package hmstt
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nurhudajoantama/hmauto/app/server"
+)
+
+// fakeRelay delivers published notices to every subscriber, like Redis
+// pub/sub between instances.
+type fakeRelay struct {
+	subs chan func(ChangeNotice)
+	fns  []func(ChangeNotice)
+}
+
+func (r *fakeRelay) PublishChange(_ context.Context, n ChangeNotice) error {
+	for _, fn := range r.fns {
+		fn(n)
+	}
+	return nil
+}
+
+func (r *fakeRelay) SubscribeChanges(ctx context.Context, fn func(ChangeNotice)) error {
+	r.subs <- fn
+	<-ctx.Done()
+	return nil
+}
+
+func int64Ptr(v int64) *int64 { return &v }
+
+func TestWaitStatesByKeys(t *testing.T) {
+	ctx := context.Background()
+	svc := NewService(newSwitchStore(), nil, nil)
+
+	// A newer revision than since answers at once.
+	start := time.Now()
+	entries, err := svc.WaitStatesByKeys(ctx, "switch", []string{"modem"}, int64Ptr(0), time.Minute)
+	if err != nil || len(entries) != 1 || time.Since(start) > time.Second {
+		t.Fatalf("WaitStatesByKeys(since=0) = %+v, %v after %v, want modem at once", entries, err, time.Since(start))
+	}
+
+	// Nothing newer waits for the timeout and returns the states unchanged.
+	entries, err = svc.WaitStatesByKeys(ctx, "switch", []string{"modem"}, int64Ptr(1), 20*time.Millisecond)
+	if err != nil || len(entries) != 1 || entries[0].Value != "on" {
+		t.Fatalf("WaitStatesByKeys() after timeout = %+v, %v, want modem on", entries, err)
+	}
+
+	// A write of a watched key ends the wait.
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		svc.SetState(ctx, "switch", "modem", "off", nil, nil, nil)
+	}()
+	entries, err = svc.WaitStatesByKeys(ctx, "switch", []string{"modem"}, int64Ptr(1), time.Minute)
+	if err != nil || len(entries) != 1 || entries[0].Value != "off" {
+		t.Fatalf("WaitStatesByKeys() after write = %+v, %v, want modem off", entries, err)
+	}
+
+	// A write that only changes the description bumps the revision, so it
+	// ends a wait just as it would make since answer at once.
+	modem, _ := svc.GetState(ctx, "switch", "modem")
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		desc := "Modem power"
+		svc.PatchState(ctx, "switch", "modem", nil, &desc, nil, nil, nil)
+	}()
+	entries, err = svc.WaitStatesByKeys(ctx, "switch", []string{"modem"}, &modem.Revision, time.Minute)
+	if err != nil || len(entries) != 1 || entries[0].Revision <= modem.Revision {
+		t.Fatalf("WaitStatesByKeys() after description change = %+v, %v, want a revision after %d", entries, err, modem.Revision)
+	}
+
+	// A device report does not bump the revision and does not end a wait.
+	modem = entries[0]
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		svc.ReportState(ctx, "switch", "modem", "on")
+	}()
+	entries, err = svc.WaitStatesByKeys(ctx, "switch", []string{"modem"}, &modem.Revision, 50*time.Millisecond)
+	if err != nil || len(entries) != 1 || entries[0].Revision != modem.Revision {
+		t.Fatalf("WaitStatesByKeys() after report = %+v, %v, want revision %d", entries, err, modem.Revision)
+	}
+
+	// So does deleting it.
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		svc.DeleteState(ctx, "switch", "modem")
+	}()
+	entries, err = svc.WaitStatesByKeys(ctx, "switch", []string{"modem"}, nil, time.Minute)
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("WaitStatesByKeys() after delete = %+v, %v, want no states", entries, err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := svc.WaitStatesByKeys(cancelled, "switch", []string{"modem"}, nil, time.Minute); err == nil {
+		t.Fatal("WaitStatesByKeys() with a cancelled context error = nil")
+	}
+}
+
+func TestChangeNotifier(t *testing.T) {
+	n := NewChangeNotifier()
+
+	c, stop := n.watch("switch", []string{"modem"}, 5)
+	defer stop()
+	for _, notice := range []ChangeNotice{
+		{Type: "switch", Key: "fan", Revision: 9},
+		{Type: "dimmer", Key: "modem", Revision: 9},
+		{Type: "switch", Key: "modem", Revision: 5},
+	} {
+		n.Notify(notice)
+		select {
+		case <-c:
+			t.Fatalf("notice %+v woke the wait", notice)
+		default:
+		}
+	}
+	n.Notify(ChangeNotice{Type: "switch", Key: "modem", Revision: 6})
+	select {
+	case <-c:
+	default:
+		t.Fatal("newer revision did not wake the wait")
+	}
+
+	other, _ := n.watch("switch", []string{"fan"}, 0)
+	n.Close()
+	select {
+	case <-other:
+	default:
+		t.Fatal("Close did not wake the wait")
+	}
+	late, _ := n.watch("switch", []string{"fan"}, 0)
+	select {
+	case <-late:
+	default:
+		t.Fatal("wait after Close did not return at once")
+	}
+}
+
+func TestWaitAcrossInstances(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	relay := &fakeRelay{subs: make(chan func(ChangeNotice), 2)}
+	store := newSwitchStore()
+	writer := NewService(store, nil, &ServiceConfig{Relay: relay})
+	reader := NewService(store, nil, &ServiceConfig{Relay: relay})
+	go writer.RunChangeRelay(ctx)
+	go reader.RunChangeRelay(ctx)
+	relay.fns = append(relay.fns, <-relay.subs, <-relay.subs)
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		writer.SetState(ctx, "switch", "modem", "off", nil, nil, nil)
+	}()
+	entries, err := reader.WaitStatesByKeys(ctx, "switch", []string{"modem"}, int64Ptr(1), time.Minute)
+	if err != nil || len(entries) != 1 || entries[0].Value != "off" {
+		t.Fatalf("WaitStatesByKeys() on another instance = %+v, %v, want modem off", entries, err)
+	}
+}
+
+func TestGetStatesByKeysHandlerWaits(t *testing.T) {
+	svc := NewService(newSwitchStore(), nil, nil)
+	srv := server.NewWithConfig(":0", &server.ServerConfig{BearerToken: "test-token"})
+	RegisterHandlers(srv, svc)
+
+	get := func(url string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("Authorization", "Bearer test-token")
+		rr := httptest.NewRecorder()
+		srv.GetRouter().ServeHTTP(rr, req)
+		return rr
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		svc.SetState(context.Background(), "switch", "modem", "off", nil, nil, nil)
+	}()
+	rr := get("/v1/states/switch/batch?key=modem&wait=30s&since=1")
+	var resp struct {
+		Data []StateResponse `json:"data"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if rr.Code != http.StatusOK || len(resp.Data) != 1 || resp.Data[0].Value != "off" {
+		t.Fatalf("long poll = %d %s, want modem off", rr.Code, rr.Body.String())
+	}
+
+	for _, bad := range []string{"wait=soon", "wait=0s", "wait=2m", "since=-1", "since=x"} {
+		if rr := get("/v1/states/switch/batch?key=modem&" + bad); rr.Code != http.StatusBadRequest {
+			t.Fatalf("%s status = %d, want %d", bad, rr.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package rule
+
+const (
+	COND_OP_EQ = "eq"
+	COND_OP_NE = "ne"
+
+	// Firing statuses. A rule whose condition does not hold when its action
+	// is due is not recorded unless the action was delayed.
+	FIRING_STATUS_OK        = "ok"
+	FIRING_STATUS_FAILED    = "failed"
+	FIRING_STATUS_SCHEDULED = "scheduled"
+	FIRING_STATUS_LOOP      = "loop"
+	FIRING_STATUS_COOLDOWN  = "cooldown"
+	FIRING_STATUS_CONDITION = "condition_not_met"
+
+	// CALLER_PREFIX tags state history written by a rule, followed by its ID.
+	CALLER_PREFIX = "rule:"
+)
@@ -0,0 +1,64 @@
+package rule
+
+// RuleRequest is the request body for creating or replacing a rule.
+// Durations use Go syntax, e.g. 30s or 5m. Cooldown defaults to the
+// configured default cooldown when omitted.
+type RuleRequest struct {
+	Name     string            `json:"name"     example:"Fan follows server"`
+	Enabled  *bool             `json:"enabled"  example:"true"`
+	When     TriggerRequest    `json:"when"`
+	If       *ConditionRequest `json:"if,omitempty"`
+	Then     ActionRequest     `json:"then"`
+	Cooldown *string           `json:"cooldown" example:"10s"`
+}
+
+// TriggerRequest matches a value change of a state. Omit value to match
+// any change.
+type TriggerRequest struct {
+	Type  string `json:"type"  validate:"required" example:"switch"`
+	Key   string `json:"key"   validate:"required" example:"server_1"`
+	Value string `json:"value" example:"on"`
+}
+
+// ConditionRequest is checked against the current value of a state before
+// the action is applied. Op is eq (default) or ne.
+type ConditionRequest struct {
+	Type  string `json:"type"  validate:"required" example:"switch"`
+	Key   string `json:"key"   validate:"required" example:"night_mode"`
+	Op    string `json:"op"    validate:"omitempty,oneof=eq ne" example:"eq"`
+	Value string `json:"value" validate:"required" example:"off"`
+}
+
+// ActionRequest is the state write a rule makes, optionally after a delay.
+type ActionRequest struct {
+	Type  string `json:"type"  validate:"required" example:"switch"`
+	Key   string `json:"key"   validate:"required" example:"fan_1"`
+	Value string `json:"value" validate:"required" example:"on"`
+	Delay string `json:"delay" example:"30s"`
+}
+
+// RuleResponse is the JSON representation of a rule.
+type RuleResponse struct {
+	ID         string            `json:"id"                    example:"d0m5v7hc0f0s73ctg0a0"`
+	Name       string            `json:"name"                  example:"Fan follows server"`
+	Enabled    bool              `json:"enabled"               example:"true"`
+	When       TriggerRequest    `json:"when"`
+	If         *ConditionRequest `json:"if,omitempty"`
+	Then       ActionRequest     `json:"then"`
+	Cooldown   string            `json:"cooldown"              example:"10s"`
+	LastFiring *FiringResponse   `json:"last_firing,omitempty"`
+	CreatedAt  string            `json:"created_at"            example:"2026-03-16T12:34:56Z"`
+	UpdatedAt  string            `json:"updated_at"            example:"2026-03-16T12:34:56Z"`
+}
+
+// FiringResponse is the outcome of the last triggering of a rule. Status is
+// ok, failed, scheduled (delayed action queued), loop (chain too deep) or
+// condition_not_met (delayed action dropped).
+type FiringResponse struct {
+	At        string `json:"at"                   example:"2026-03-16T12:34:56Z"`
+	RequestID string `json:"request_id,omitempty" example:"d0m5v7hc0f0s73ctg0a0"`
+	Trigger   string `json:"trigger"              example:"switch/server_1=on"`
+	Depth     int    `json:"depth"                example:"1"`
+	Status    string `json:"status"               example:"ok"`
+	Error     string `json:"error,omitempty"      example:"INVALID VALUE: ..."`
+}
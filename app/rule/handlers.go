@@ -0,0 +1,302 @@
+package rule
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nurhudajoantama/hmauto/app/server"
+	"github.com/nurhudajoantama/hmauto/internal/request"
+	"github.com/nurhudajoantama/hmauto/internal/response"
+	"github.com/rs/zerolog"
+)
+
+type RuleHandler struct {
+	service *RuleService
+}
+
+func formatDuration(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+func ruleToResponse(r Rule) RuleResponse {
+	out := RuleResponse{
+		ID:      r.ID,
+		Name:    r.Name,
+		Enabled: r.Enabled,
+		When: TriggerRequest{
+			Type:  r.When.Type,
+			Key:   r.When.Key,
+			Value: r.When.Value,
+		},
+		Then: ActionRequest{
+			Type:  r.Then.Type,
+			Key:   r.Then.Key,
+			Value: r.Then.Value,
+			Delay: formatDuration(r.Then.Delay),
+		},
+		Cooldown:  r.Cooldown.String(),
+		CreatedAt: r.CreatedAt.UTC().Format(time.RFC3339),
+		UpdatedAt: r.UpdatedAt.UTC().Format(time.RFC3339),
+	}
+	if r.If != nil {
+		out.If = &ConditionRequest{
+			Type:  r.If.Type,
+			Key:   r.If.Key,
+			Op:    r.If.Op,
+			Value: r.If.Value,
+		}
+	}
+	if r.LastFiring != nil {
+		out.LastFiring = &FiringResponse{
+			At:        r.LastFiring.At.UTC().Format(time.RFC3339),
+			RequestID: r.LastFiring.RequestID,
+			Trigger:   r.LastFiring.Trigger,
+			Depth:     r.LastFiring.Depth,
+			Status:    r.LastFiring.Status,
+			Error:     r.LastFiring.Error,
+		}
+	}
+	return out
+}
+
+func requestToInput(body RuleRequest) (Input, error) {
+	in := Input{
+		Name:    body.Name,
+		Enabled: true,
+		When: Trigger{
+			Type:  body.When.Type,
+			Key:   body.When.Key,
+			Value: body.When.Value,
+		},
+		Then: Action{
+			Type:  body.Then.Type,
+			Key:   body.Then.Key,
+			Value: body.Then.Value,
+		},
+	}
+	if body.Enabled != nil {
+		in.Enabled = *body.Enabled
+	}
+	if body.If != nil {
+		in.If = &Condition{
+			Type:  body.If.Type,
+			Key:   body.If.Key,
+			Op:    body.If.Op,
+			Value: body.If.Value,
+		}
+	}
+	if body.Then.Delay != "" {
+		d, err := time.ParseDuration(body.Then.Delay)
+		if err != nil {
+			return Input{}, fmt.Errorf("%w: then.delay: %v", ErrInvalidRule, err)
+		}
+		in.Then.Delay = d
+	}
+	if body.Cooldown != nil {
+		d, err := time.ParseDuration(*body.Cooldown)
+		if err != nil {
+			return Input{}, fmt.Errorf("%w: cooldown: %v", ErrInvalidRule, err)
+		}
+		in.Cooldown = &d
+	}
+	return in, nil
+}
+
+func errorResponse(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrRuleNotFound):
+		response.ErrorResponse(w, http.StatusNotFound, "rule not found", err)
+	case errors.Is(err, ErrInvalidRule):
+		response.ErrorResponse(w, http.StatusBadRequest, err.Error(), err)
+	default:
+		response.ErrorResponse(w, http.StatusInternalServerError, err.Error(), err)
+	}
+}
+
+func RegisterHandlers(s *server.Server, svc *RuleService) {
+	h := &RuleHandler{service: svc}
+
+	v1 := s.GetRouter().PathPrefix("/v1").Subrouter()
+	s.ApplyAuthMiddleware(v1)
+
+	v1.HandleFunc("/rules", h.listRules).Methods("GET")
+	v1.HandleFunc("/rules", h.createRule).Methods("POST")
+	v1.HandleFunc("/rules/{id}", h.getRule).Methods("GET")
+	v1.HandleFunc("/rules/{id}", h.updateRule).Methods("PUT")
+	v1.HandleFunc("/rules/{id}", h.deleteRule).Methods("DELETE")
+}
+
+// listRules godoc
+//
+//	@Summary		List rules
+//	@Description	Returns all automation rules with the outcome of their last firing
+//	@Tags			rules
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Success		200	{object}	response.JsonResponse{data=[]RuleResponse}	"List of rules"
+//	@Failure		401	{object}	response.JsonResponse						"Unauthorized"
+//	@Failure		500	{object}	response.JsonResponse						"Internal error"
+//	@Router			/rules [get]
+func (h *RuleHandler) listRules(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+	l.Info().Msg("Handling listRules request")
+
+	rules, err := h.service.List(ctx)
+	if err != nil {
+		l.Error().Err(err).Msg("listRules failed")
+		errorResponse(w, err)
+		return
+	}
+
+	data := make([]RuleResponse, 0, len(rules))
+	for _, rl := range rules {
+		data = append(data, ruleToResponse(rl))
+	}
+	response.SuccessResponse(w, data)
+}
+
+// createRule godoc
+//
+//	@Summary		Create a rule
+//	@Description	When the when state changes to when.value (any change if omitted) and the optional if condition holds, sets the then state, optionally after then.delay. A rule fires at most once per cooldown. Enabled unless enabled is false.
+//	@Tags			rules
+//	@Accept			json
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			body	body		RuleRequest								true	"Rule"
+//	@Success		201		{object}	response.JsonResponse{data=RuleResponse}	"Created rule"
+//	@Failure		400		{object}	response.JsonResponse						"Invalid trigger, condition, action or duration"
+//	@Failure		401		{object}	response.JsonResponse						"Unauthorized"
+//	@Failure		500		{object}	response.JsonResponse						"Internal error"
+//	@Router			/rules [post]
+func (h *RuleHandler) createRule(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+	l.Info().Msg("Handling createRule request")
+
+	var body RuleRequest
+	if err := request.DecodeAndValidate(r, &body); err != nil {
+		l.Error().Err(err).Msg("createRule: validation failed")
+		response.ErrorResponse(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	in, err := requestToInput(body)
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+
+	rl, err := h.service.Create(ctx, in)
+	if err != nil {
+		l.Error().Err(err).Msg("createRule failed")
+		errorResponse(w, err)
+		return
+	}
+
+	response.CreatedResponse(w, ruleToResponse(rl))
+}
+
+// getRule godoc
+//
+//	@Summary		Get a rule
+//	@Tags			rules
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			id	path		string									true	"Rule ID"
+//	@Success		200	{object}	response.JsonResponse{data=RuleResponse}	"Rule"
+//	@Failure		401	{object}	response.JsonResponse						"Unauthorized"
+//	@Failure		404	{object}	response.JsonResponse						"Rule not found"
+//	@Router			/rules/{id} [get]
+func (h *RuleHandler) getRule(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+	id := mux.Vars(r)["id"]
+	l.Info().Str("rule_id", id).Msg("Handling getRule request")
+
+	rl, err := h.service.Get(ctx, id)
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+
+	response.SuccessResponse(w, ruleToResponse(rl))
+}
+
+// updateRule godoc
+//
+//	@Summary		Replace a rule
+//	@Description	Replaces the whole definition. A running cooldown and delayed actions already queued are kept.
+//	@Tags			rules
+//	@Accept			json
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			id		path		string									true	"Rule ID"
+//	@Param			body	body		RuleRequest								true	"Rule"
+//	@Success		200		{object}	response.JsonResponse{data=RuleResponse}	"Updated rule"
+//	@Failure		400		{object}	response.JsonResponse						"Invalid trigger, condition, action or duration"
+//	@Failure		401		{object}	response.JsonResponse						"Unauthorized"
+//	@Failure		404		{object}	response.JsonResponse						"Rule not found"
+//	@Failure		500		{object}	response.JsonResponse						"Internal error"
+//	@Router			/rules/{id} [put]
+func (h *RuleHandler) updateRule(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+	id := mux.Vars(r)["id"]
+	l.Info().Str("rule_id", id).Msg("Handling updateRule request")
+
+	var body RuleRequest
+	if err := request.DecodeAndValidate(r, &body); err != nil {
+		l.Error().Err(err).Msg("updateRule: validation failed")
+		response.ErrorResponse(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	in, err := requestToInput(body)
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+
+	rl, err := h.service.Update(ctx, id, in)
+	if err != nil {
+		l.Error().Err(err).Msg("updateRule failed")
+		errorResponse(w, err)
+		return
+	}
+
+	response.SuccessResponse(w, ruleToResponse(rl))
+}
+
+// deleteRule godoc
+//
+//	@Summary		Delete a rule
+//	@Description	Deletes the rule; delayed actions it already queued are dropped
+//	@Tags			rules
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			id	path		string									true	"Rule ID"
+//	@Success		200	{object}	response.JsonResponse{data=RuleResponse}	"Deleted rule"
+//	@Failure		401	{object}	response.JsonResponse						"Unauthorized"
+//	@Failure		404	{object}	response.JsonResponse						"Rule not found"
+//	@Failure		500	{object}	response.JsonResponse						"Internal error"
+//	@Router			/rules/{id} [delete]
+func (h *RuleHandler) deleteRule(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+	id := mux.Vars(r)["id"]
+	l.Info().Str("rule_id", id).Msg("Handling deleteRule request")
+
+	rl, err := h.service.Delete(ctx, id)
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+
+	response.SuccessResponse(w, ruleToResponse(rl))
+}
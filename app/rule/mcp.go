@@ -0,0 +1,56 @@
+package rule
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+type setRuleEnabledInput struct {
+	ID      string `json:"id"      jsonschema:"Rule ID (see list_rules)"`
+	Enabled bool   `json:"enabled" jsonschema:"Whether the rule fires"`
+}
+
+func textResult(v any) *mcp.CallToolResult {
+	b, _ := json.Marshal(v)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(b)}},
+	}
+}
+
+func errResult(msg string) *mcp.CallToolResult {
+	return &mcp.CallToolResult{
+		IsError: true,
+		Content: []mcp.Content{&mcp.TextContent{Text: msg}},
+	}
+}
+
+// RegisterMCPTools registers the rule tools on the given MCP server.
+func RegisterMCPTools(s *mcp.Server, svc *RuleService) {
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "list_rules",
+		Description: "List automation rules (when a state changes to a value, set another state) with the outcome of their last firing.",
+	}, func(ctx context.Context, _ *mcp.CallToolRequest, _ struct{}) (*mcp.CallToolResult, any, error) {
+		rules, err := svc.List(ctx)
+		if err != nil {
+			return errResult(err.Error()), nil, nil
+		}
+		data := make([]RuleResponse, 0, len(rules))
+		for _, r := range rules {
+			data = append(data, ruleToResponse(r))
+		}
+		return textResult(data), nil, nil
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "set_rule_enabled",
+		Description: "Enable or disable an automation rule without changing its definition.",
+	}, func(ctx context.Context, _ *mcp.CallToolRequest, input setRuleEnabledInput) (*mcp.CallToolResult, any, error) {
+		r, err := svc.SetEnabled(ctx, input.ID, input.Enabled)
+		if err != nil {
+			return errResult(err.Error()), nil, nil
+		}
+		return textResult(ruleToResponse(r)), nil, nil
+	})
+}
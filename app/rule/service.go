@@ -0,0 +1,448 @@
+package rule
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nurhudajoantama/hmauto/app/hmstt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+var ErrRuleNotFound = errors.New("RULE NOT FOUND")
+var ErrInvalidRule = errors.New("INVALID RULE")
+
+// MaxDuration bounds rule delays and cooldowns.
+const MaxDuration = 24 * time.Hour
+
+var ruleFiringsTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "rule_firings_total",
+		Help: "Total number of rule triggerings by outcome.",
+	},
+	[]string{"status"},
+)
+
+// StateWriter is the part of the hmstt service rules need.
+type StateWriter interface {
+	ValidateValue(tipe, key, value string) error
+	GetState(ctx context.Context, tipe, key string) (hmstt.StateEntry, error)
+	SetState(ctx context.Context, tipe, key, value string, description *string, meta *hmstt.StateMeta, ifMatch *hmstt.Precondition) (hmstt.StateEntry, error)
+}
+
+// ServiceConfig holds the rule engine policy. Zero values use the defaults.
+type ServiceConfig struct {
+	// MaxChainDepth is how many rules may trigger each other in a row
+	// before the chain is cut as a loop.
+	MaxChainDepth int
+	// DefaultCooldown applies to rules created without a cooldown.
+	DefaultCooldown time.Duration
+}
+
+type RuleService struct {
+	store           Store
+	states          StateWriter
+	maxDepth        int
+	defaultCooldown time.Duration
+}
+
+func NewService(store Store, states StateWriter, cfg *ServiceConfig) *RuleService {
+	if cfg == nil {
+		cfg = &ServiceConfig{}
+	}
+	maxDepth := cfg.MaxChainDepth
+	if maxDepth <= 0 {
+		maxDepth = 5
+	}
+	cooldown := cfg.DefaultCooldown
+	if cooldown == 0 {
+		cooldown = time.Second
+	}
+	return &RuleService{
+		store:           store,
+		states:          states,
+		maxDepth:        maxDepth,
+		defaultCooldown: cooldown,
+	}
+}
+
+type depthKey struct{}
+
+// withDepth marks ctx as running the action of a rule at the given chain
+// depth, so rules triggered by that write see how deep the chain is.
+func withDepth(ctx context.Context, depth int) context.Context {
+	return context.WithValue(ctx, depthKey{}, depth)
+}
+
+func depthFromContext(ctx context.Context) int {
+	depth, _ := ctx.Value(depthKey{}).(int)
+	return depth
+}
+
+// Input is the user-editable part of a rule. A nil Cooldown uses the
+// configured default.
+type Input struct {
+	Name     string
+	Enabled  bool
+	When     Trigger
+	If       *Condition
+	Then     Action
+	Cooldown *time.Duration
+}
+
+func (s *RuleService) validate(in Input) (Input, error) {
+	if in.When.Type == "" || in.When.Key == "" {
+		return in, fmt.Errorf("%w: when.type and when.key are required", ErrInvalidRule)
+	}
+	if in.When.Value != "" {
+		if err := s.states.ValidateValue(in.When.Type, in.When.Key, in.When.Value); err != nil {
+			return in, fmt.Errorf("%w: when: %v", ErrInvalidRule, err)
+		}
+	}
+	if in.If != nil {
+		cond := *in.If
+		if cond.Type == "" || cond.Key == "" {
+			return in, fmt.Errorf("%w: if.type and if.key are required", ErrInvalidRule)
+		}
+		if cond.Op == "" {
+			cond.Op = COND_OP_EQ
+		}
+		if cond.Op != COND_OP_EQ && cond.Op != COND_OP_NE {
+			return in, fmt.Errorf("%w: if.op must be %q or %q", ErrInvalidRule, COND_OP_EQ, COND_OP_NE)
+		}
+		if err := s.states.ValidateValue(cond.Type, cond.Key, cond.Value); err != nil {
+			return in, fmt.Errorf("%w: if: %v", ErrInvalidRule, err)
+		}
+		in.If = &cond
+	}
+	if in.Then.Type == "" || in.Then.Key == "" {
+		return in, fmt.Errorf("%w: then.type and then.key are required", ErrInvalidRule)
+	}
+	if err := s.states.ValidateValue(in.Then.Type, in.Then.Key, in.Then.Value); err != nil {
+		return in, fmt.Errorf("%w: then: %v", ErrInvalidRule, err)
+	}
+	if in.Then.Delay < 0 || in.Then.Delay > MaxDuration {
+		return in, fmt.Errorf("%w: then.delay must be between 0 and %s", ErrInvalidRule, MaxDuration)
+	}
+	if in.Cooldown == nil {
+		cooldown := s.defaultCooldown
+		in.Cooldown = &cooldown
+	}
+	if *in.Cooldown < 0 || *in.Cooldown > MaxDuration {
+		return in, fmt.Errorf("%w: cooldown must be between 0 and %s", ErrInvalidRule, MaxDuration)
+	}
+	return in, nil
+}
+
+func (s *RuleService) List(ctx context.Context) ([]Rule, error) {
+	rules, err := s.store.List(ctx)
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("List rules failed")
+		return nil, errors.New("LIST RULES ERROR")
+	}
+	return rules, nil
+}
+
+func (s *RuleService) Get(ctx context.Context, id string) (Rule, error) {
+	r, err := s.store.Get(ctx, id)
+	if err != nil {
+		if errors.Is(err, ErrRuleNotFound) {
+			return Rule{}, ErrRuleNotFound
+		}
+		zerolog.Ctx(ctx).Error().Err(err).Msg("Get rule failed")
+		return Rule{}, errors.New("GET RULE ERROR")
+	}
+	return r, nil
+}
+
+func (s *RuleService) Create(ctx context.Context, in Input) (Rule, error) {
+	l := zerolog.Ctx(ctx)
+	l.Info().Str("hmstt_type", in.When.Type).Str("hmstt_key", in.When.Key).Msg("Handling Create rule service")
+
+	in, err := s.validate(in)
+	if err != nil {
+		return Rule{}, err
+	}
+	now := time.Now().UTC()
+	r := Rule{
+		ID:        xid.New().String(),
+		CreatedAt: now,
+	}
+	return s.save(ctx, r, in, now)
+}
+
+// Update replaces the definition of a rule. Its cooldown and delayed
+// actions already scheduled are kept.
+func (s *RuleService) Update(ctx context.Context, id string, in Input) (Rule, error) {
+	l := zerolog.Ctx(ctx)
+	l.Info().Str("rule_id", id).Msg("Handling Update rule service")
+
+	in, err := s.validate(in)
+	if err != nil {
+		return Rule{}, err
+	}
+	r, err := s.Get(ctx, id)
+	if err != nil {
+		return Rule{}, err
+	}
+	return s.save(ctx, r, in, time.Now().UTC())
+}
+
+// SetEnabled enables or disables a rule, keeping the rest of its definition.
+func (s *RuleService) SetEnabled(ctx context.Context, id string, enabled bool) (Rule, error) {
+	l := zerolog.Ctx(ctx)
+	l.Info().Str("rule_id", id).Bool("enabled", enabled).Msg("Handling SetEnabled rule service")
+
+	r, err := s.Get(ctx, id)
+	if err != nil {
+		return Rule{}, err
+	}
+	cooldown := r.Cooldown
+	return s.save(ctx, r, Input{
+		Name:     r.Name,
+		Enabled:  enabled,
+		When:     r.When,
+		If:       r.If,
+		Then:     r.Then,
+		Cooldown: &cooldown,
+	}, time.Now().UTC())
+}
+
+func (s *RuleService) save(ctx context.Context, r Rule, in Input, now time.Time) (Rule, error) {
+	r.Name = in.Name
+	r.Enabled = in.Enabled
+	r.When = in.When
+	r.If = in.If
+	r.Then = in.Then
+	r.Cooldown = *in.Cooldown
+	r.UpdatedAt = now
+
+	if err := s.store.Put(ctx, r); err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("Put rule failed")
+		return Rule{}, errors.New("SAVE RULE ERROR")
+	}
+	return r, nil
+}
+
+func (s *RuleService) Delete(ctx context.Context, id string) (Rule, error) {
+	l := zerolog.Ctx(ctx)
+	l.Info().Str("rule_id", id).Msg("Handling Delete rule service")
+
+	r, err := s.Get(ctx, id)
+	if err != nil {
+		return Rule{}, err
+	}
+	if err := s.store.Delete(ctx, id); err != nil {
+		if errors.Is(err, ErrRuleNotFound) {
+			return Rule{}, ErrRuleNotFound
+		}
+		l.Error().Err(err).Msg("Delete rule failed")
+		return Rule{}, errors.New("DELETE RULE ERROR")
+	}
+	return r, nil
+}
+
+func (r Rule) matches(entry hmstt.StateEntry) bool {
+	if !r.Enabled || r.When.Type != entry.Type || r.When.Key != entry.K {
+		return false
+	}
+	return r.When.Value == "" || r.When.Value == entry.Value
+}
+
+func triggerString(entry hmstt.StateEntry) string {
+	return entry.Type + "/" + entry.K + "=" + entry.Value
+}
+
+// StateChanged evaluates the rules triggered by a committed value change.
+// It implements hmstt.ChangeListener, so actions without a delay run inside
+// the write that triggered them, with its request ID.
+func (s *RuleService) StateChanged(ctx context.Context, entry hmstt.StateEntry) {
+	rules, err := s.store.List(ctx)
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("listing rules to evaluate failed")
+		return
+	}
+	for _, r := range rules {
+		if r.matches(entry) {
+			s.trigger(ctx, r, entry)
+		}
+	}
+}
+
+// trigger fires one matching rule. Rules triggered by the write of another
+// rule run one level deeper; past the maximum depth the chain is cut.
+func (s *RuleService) trigger(ctx context.Context, r Rule, entry hmstt.StateEntry) {
+	depth := depthFromContext(ctx) + 1
+	f := Firing{
+		At:        time.Now().UTC(),
+		RequestID: hmstt.RequestIDFromContext(ctx),
+		Trigger:   triggerString(entry),
+		Depth:     depth,
+	}
+	l := zerolog.Ctx(ctx).With().Str("rule_id", r.ID).Str("request_id", f.RequestID).
+		Str("trigger", f.Trigger).Int("rule_depth", depth).Logger()
+	ctx = l.WithContext(ctx)
+
+	if depth > s.maxDepth {
+		f.Status = FIRING_STATUS_LOOP
+		l.Warn().Int("max_depth", s.maxDepth).Msg("rule chain too deep, not firing")
+		s.record(ctx, r.ID, f)
+		return
+	}
+	// A delayed action checks its condition when it is due.
+	if r.Then.Delay == 0 && r.If != nil && !s.conditionHolds(ctx, *r.If) {
+		l.Debug().Msg("rule condition not met")
+		return
+	}
+	ok, err := s.store.AcquireCooldown(ctx, r.ID, r.Cooldown)
+	if err != nil {
+		l.Error().Err(err).Msg("acquiring rule cooldown failed")
+		return
+	}
+	if !ok {
+		ruleFiringsTotal.WithLabelValues(FIRING_STATUS_COOLDOWN).Inc()
+		l.Debug().Msg("rule in cooldown, not firing")
+		return
+	}
+
+	if r.Then.Delay > 0 {
+		p := Pending{
+			ID:        xid.New().String(),
+			RuleID:    r.ID,
+			Action:    r.Then,
+			Trigger:   f.Trigger,
+			RequestID: f.RequestID,
+			Depth:     depth,
+			DueAt:     f.At.Add(r.Then.Delay),
+		}
+		if err := s.store.PutPending(ctx, p); err != nil {
+			f.Status = FIRING_STATUS_FAILED
+			f.Error = err.Error()
+			l.Error().Err(err).Msg("scheduling delayed rule action failed")
+		} else {
+			f.Status = FIRING_STATUS_SCHEDULED
+			l.Info().Time("due_at", p.DueAt).Msg("rule fired, action scheduled")
+		}
+		s.record(ctx, r.ID, f)
+		return
+	}
+
+	s.apply(ctx, r.ID, r.Then, depth, &f)
+	s.record(ctx, r.ID, f)
+}
+
+// apply writes the action of a rule and sets the outcome on f.
+func (s *RuleService) apply(ctx context.Context, ruleID string, a Action, depth int, f *Firing) {
+	l := zerolog.Ctx(ctx)
+	actionCtx := hmstt.WithCaller(withDepth(ctx, depth), CALLER_PREFIX+ruleID)
+	if _, err := s.states.SetState(actionCtx, a.Type, a.Key, a.Value, nil, nil, nil); err != nil {
+		f.Status = FIRING_STATUS_FAILED
+		f.Error = err.Error()
+		l.Error().Err(err).Str("hmstt_type", a.Type).Str("hmstt_key", a.Key).Msg("rule action failed")
+		return
+	}
+	f.Status = FIRING_STATUS_OK
+	l.Info().Str("hmstt_type", a.Type).Str("hmstt_key", a.Key).Str("hmstt_value", a.Value).Msg("rule fired")
+}
+
+// conditionHolds reports whether c matches the current state. A state that
+// cannot be read does not match.
+func (s *RuleService) conditionHolds(ctx context.Context, c Condition) bool {
+	entry, err := s.states.GetState(ctx, c.Type, c.Key)
+	if err != nil {
+		return false
+	}
+	if c.Op == COND_OP_NE {
+		return entry.Value != c.Value
+	}
+	return entry.Value == c.Value
+}
+
+func (s *RuleService) record(ctx context.Context, ruleID string, f Firing) {
+	ruleFiringsTotal.WithLabelValues(f.Status).Inc()
+	if err := s.store.RecordFiring(ctx, ruleID, f); err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("recording rule firing failed")
+	}
+}
+
+// pendingLease is how long a claimed delayed action is hidden from other
+// claims. An action that is not finished by then, because its rule could not
+// be read or the instance stopped, is claimed again.
+const pendingLease = 30 * time.Second
+
+// RunPending applies due delayed actions every interval until ctx is
+// cancelled. Each runs with the request ID and chain depth of the change
+// that triggered it, and only if its rule still exists, is enabled and its
+// condition holds. An action is removed only once it is handled.
+func (s *RuleService) RunPending(ctx context.Context, interval time.Duration) error {
+	l := log.With().Str("component", "rules").Logger()
+	ctx = l.WithContext(ctx)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		pending, err := s.store.ClaimDuePending(ctx, time.Now(), pendingLease)
+		if err != nil {
+			l.Error().Err(err).Msg("claiming due rule actions failed")
+			continue
+		}
+		for _, p := range pending {
+			if !s.applyPending(ctx, p) {
+				continue
+			}
+			if err := s.store.FinishPending(ctx, p); err != nil {
+				l.Error().Err(err).Str("rule_id", p.RuleID).Msg("removing handled rule action failed")
+			}
+		}
+	}
+}
+
+// applyPending runs a delayed action. done is false if it should be tried
+// again when its lease ends.
+func (s *RuleService) applyPending(ctx context.Context, p Pending) (done bool) {
+	ctx = hmstt.WithRequestID(ctx, p.RequestID)
+	l := zerolog.Ctx(ctx).With().Str("rule_id", p.RuleID).Str("request_id", p.RequestID).
+		Str("trigger", p.Trigger).Int("rule_depth", p.Depth).Logger()
+	ctx = l.WithContext(ctx)
+
+	r, err := s.store.Get(ctx, p.RuleID)
+	if err != nil {
+		if errors.Is(err, ErrRuleNotFound) {
+			l.Info().Msg("rule deleted, dropping delayed action")
+			return true
+		}
+		l.Error().Err(err).Msg("loading rule for delayed action failed, retrying later")
+		return false
+	}
+	if !r.Enabled {
+		l.Info().Msg("rule disabled, dropping delayed action")
+		return true
+	}
+
+	f := Firing{
+		At:        time.Now().UTC(),
+		RequestID: p.RequestID,
+		Trigger:   p.Trigger,
+		Depth:     p.Depth,
+	}
+	if r.If != nil && !s.conditionHolds(ctx, *r.If) {
+		f.Status = FIRING_STATUS_CONDITION
+		l.Info().Msg("rule condition not met, dropping delayed action")
+		s.record(ctx, r.ID, f)
+		return true
+	}
+	s.apply(ctx, r.ID, p.Action, p.Depth, &f)
+	s.record(ctx, r.ID, f)
+	return true
+}
@@ -0,0 +1,380 @@
+package rule
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nurhudajoantama/hmauto/app/hmstt"
+	"github.com/rs/xid"
+)
+
+type fakeStore struct {
+	mu        sync.Mutex
+	defs      map[string]Rule
+	firings   map[string]Firing
+	cooldowns map[string]bool
+	pending   []Pending
+	leased    map[string]time.Time
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		defs:      map[string]Rule{},
+		firings:   map[string]Firing{},
+		cooldowns: map[string]bool{},
+	}
+}
+
+func (f *fakeStore) Put(_ context.Context, r Rule) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.defs[r.ID] = r
+	return nil
+}
+
+func (f *fakeStore) Get(_ context.Context, id string) (Rule, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r, ok := f.defs[id]
+	if !ok {
+		return Rule{}, ErrRuleNotFound
+	}
+	if firing, ok := f.firings[id]; ok {
+		r.LastFiring = &firing
+	}
+	return r, nil
+}
+
+func (f *fakeStore) List(ctx context.Context) ([]Rule, error) {
+	f.mu.Lock()
+	ids := make([]string, 0, len(f.defs))
+	for id := range f.defs {
+		ids = append(ids, id)
+	}
+	f.mu.Unlock()
+	var out []Rule
+	for _, id := range ids {
+		r, _ := f.Get(ctx, id)
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+func (f *fakeStore) Delete(_ context.Context, id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.defs[id]; !ok {
+		return ErrRuleNotFound
+	}
+	delete(f.defs, id)
+	delete(f.firings, id)
+	delete(f.cooldowns, id)
+	return nil
+}
+
+// AcquireCooldown never expires; tests reset cooldowns explicitly.
+func (f *fakeStore) AcquireCooldown(_ context.Context, id string, cooldown time.Duration) (bool, error) {
+	if cooldown <= 0 {
+		return true, nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cooldowns[id] {
+		return false, nil
+	}
+	f.cooldowns[id] = true
+	return true, nil
+}
+
+func (f *fakeStore) RecordFiring(_ context.Context, id string, firing Firing) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.firings[id] = firing
+	return nil
+}
+
+func (f *fakeStore) PutPending(_ context.Context, p Pending) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pending = append(f.pending, p)
+	return nil
+}
+
+func (f *fakeStore) ClaimDuePending(_ context.Context, now time.Time, lease time.Duration) ([]Pending, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.leased == nil {
+		f.leased = map[string]time.Time{}
+	}
+	var due []Pending
+	for _, p := range f.pending {
+		dueAt := p.DueAt
+		if until, ok := f.leased[p.ID]; ok {
+			dueAt = until
+		}
+		if !dueAt.After(now) {
+			due = append(due, p)
+			f.leased[p.ID] = now.Add(lease)
+		}
+	}
+	return due, nil
+}
+
+func (f *fakeStore) FinishPending(_ context.Context, p Pending) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pending = slices.DeleteFunc(f.pending, func(q Pending) bool { return q.ID == p.ID })
+	delete(f.leased, p.ID)
+	return nil
+}
+
+// fakeStates keeps switch values in memory and, like HmsttService, notifies
+// the listener of committed changes from inside SetState.
+type fakeStates struct {
+	mu       sync.Mutex
+	values   map[string]string
+	writes   []string
+	callers  []string
+	listener hmstt.ChangeListener
+}
+
+func newFakeStates() *fakeStates {
+	return &fakeStates{values: map[string]string{}}
+}
+
+func (f *fakeStates) ValidateValue(tipe, key, value string) error {
+	if tipe != "switch" || (value != "on" && value != "off") {
+		return hmstt.ErrInvalidValue
+	}
+	return nil
+}
+
+func (f *fakeStates) GetState(_ context.Context, tipe, key string) (hmstt.StateEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, ok := f.values[tipe+"/"+key]
+	if !ok {
+		return hmstt.StateEntry{}, errors.New("GET STATE ERROR")
+	}
+	return hmstt.StateEntry{Type: tipe, K: key, Value: v}, nil
+}
+
+func (f *fakeStates) SetState(ctx context.Context, tipe, key, value string, _ *string, _ *hmstt.StateMeta, _ *hmstt.Precondition) (hmstt.StateEntry, error) {
+	f.mu.Lock()
+	entry := hmstt.StateEntry{Type: tipe, K: key, Value: value}
+	changed := f.values[tipe+"/"+key] != value
+	f.values[tipe+"/"+key] = value
+	f.writes = append(f.writes, tipe+"/"+key+"="+value)
+	f.callers = append(f.callers, hmstt.CallerFromContext(ctx))
+	f.mu.Unlock()
+
+	if changed && f.listener != nil {
+		f.listener.StateChanged(ctx, entry)
+	}
+	return entry, nil
+}
+
+func setup(t *testing.T, cfg *ServiceConfig) (*RuleService, *fakeStore, *fakeStates) {
+	t.Helper()
+	store, states := newFakeStore(), newFakeStates()
+	svc := NewService(store, states, cfg)
+	states.listener = svc
+	return svc, store, states
+}
+
+func follow(from, to string) Input {
+	return Input{
+		Name:    from + " -> " + to,
+		Enabled: true,
+		When:    Trigger{Type: "switch", Key: from, Value: "on"},
+		Then:    Action{Type: "switch", Key: to, Value: "on"},
+	}
+}
+
+func TestCreateValidates(t *testing.T) {
+	ctx := context.Background()
+	svc, _, _ := setup(t, nil)
+
+	tests := []struct {
+		name   string
+		modify func(*Input)
+	}{
+		{"missing trigger key", func(in *Input) { in.When.Key = "" }},
+		{"trigger value rejected by type", func(in *Input) { in.When.Value = "maybe" }},
+		{"action value rejected by type", func(in *Input) { in.Then.Value = "maybe" }},
+		{"negative delay", func(in *Input) { in.Then.Delay = -time.Second }},
+		{"delay too long", func(in *Input) { in.Then.Delay = MaxDuration + time.Second }},
+		{"unknown condition op", func(in *Input) {
+			in.If = &Condition{Type: "switch", Key: "night", Op: "gt", Value: "on"}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := follow("a", "b")
+			tt.modify(&in)
+			if _, err := svc.Create(ctx, in); !errors.Is(err, ErrInvalidRule) {
+				t.Fatalf("Create() error = %v, want ErrInvalidRule", err)
+			}
+		})
+	}
+
+	t.Run("defaults cooldown and condition op", func(t *testing.T) {
+		in := follow("a", "b")
+		in.If = &Condition{Type: "switch", Key: "night", Value: "off"}
+		r, err := svc.Create(ctx, in)
+		if err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+		if r.Cooldown != time.Second {
+			t.Fatalf("Cooldown = %v, want 1s", r.Cooldown)
+		}
+		if r.If.Op != COND_OP_EQ {
+			t.Fatalf("If.Op = %q, want eq", r.If.Op)
+		}
+	})
+}
+
+func TestStateChanged(t *testing.T) {
+	noCooldown := time.Duration(0)
+
+	t.Run("fires on a matching value with the request ID", func(t *testing.T) {
+		svc, store, states := setup(t, nil)
+		reqID := xid.New().String()
+		ctx := hmstt.WithRequestID(context.Background(), reqID)
+		r, _ := svc.Create(ctx, follow("server", "fan"))
+
+		states.SetState(ctx, "switch", "server", "off", nil, nil, nil)
+		states.SetState(ctx, "switch", "server", "on", nil, nil, nil)
+
+		if got := states.values["switch/fan"]; got != "on" {
+			t.Fatalf("fan = %q, want on", got)
+		}
+		if got := states.callers[len(states.callers)-1]; got != CALLER_PREFIX+r.ID {
+			t.Fatalf("caller = %q, want %q", got, CALLER_PREFIX+r.ID)
+		}
+		f := store.firings[r.ID]
+		if f.Status != FIRING_STATUS_OK || f.RequestID != reqID || f.Depth != 1 {
+			t.Fatalf("firing = %+v", f)
+		}
+	})
+
+	t.Run("skips when the condition does not hold", func(t *testing.T) {
+		svc, store, states := setup(t, nil)
+		ctx := context.Background()
+		in := follow("server", "fan")
+		in.If = &Condition{Type: "switch", Key: "night", Op: COND_OP_NE, Value: "on"}
+		r, _ := svc.Create(ctx, in)
+		states.values["switch/night"] = "on"
+
+		states.SetState(ctx, "switch", "server", "on", nil, nil, nil)
+
+		if _, ok := states.values["switch/fan"]; ok {
+			t.Fatalf("fan was set, want untouched")
+		}
+		if _, ok := store.firings[r.ID]; ok {
+			t.Fatalf("firing recorded, want none")
+		}
+	})
+
+	t.Run("cooldown suppresses refiring", func(t *testing.T) {
+		svc, _, states := setup(t, nil)
+		ctx := context.Background()
+		in := follow("server", "fan")
+		in.When.Value = ""
+		svc.Create(ctx, in)
+
+		states.SetState(ctx, "switch", "server", "on", nil, nil, nil)
+		states.SetState(ctx, "switch", "fan", "off", nil, nil, nil)
+		states.SetState(ctx, "switch", "server", "off", nil, nil, nil)
+
+		if got := states.values["switch/fan"]; got != "off" {
+			t.Fatalf("fan = %q, want off (second firing in cooldown)", got)
+		}
+	})
+
+	t.Run("cuts a loop at the maximum chain depth", func(t *testing.T) {
+		svc, store, states := setup(t, &ServiceConfig{MaxChainDepth: 3})
+		ctx := context.Background()
+		// a on -> b on -> a off -> b off -> a on -> ...
+		rules := []Input{
+			follow("a", "b"),
+			{Enabled: true, When: Trigger{Type: "switch", Key: "b", Value: "on"}, Then: Action{Type: "switch", Key: "a", Value: "off"}},
+			{Enabled: true, When: Trigger{Type: "switch", Key: "a", Value: "off"}, Then: Action{Type: "switch", Key: "b", Value: "off"}},
+			{Enabled: true, When: Trigger{Type: "switch", Key: "b", Value: "off"}, Then: Action{Type: "switch", Key: "a", Value: "on"}},
+		}
+		var ids []string
+		for _, in := range rules {
+			in.Cooldown = &noCooldown
+			r, err := svc.Create(ctx, in)
+			if err != nil {
+				t.Fatalf("Create() error = %v", err)
+			}
+			ids = append(ids, r.ID)
+		}
+
+		states.SetState(ctx, "switch", "a", "on", nil, nil, nil)
+
+		if len(states.writes) != 4 {
+			t.Fatalf("writes = %v, want the trigger and 3 rule actions", states.writes)
+		}
+		if f := store.firings[ids[3]]; f.Status != FIRING_STATUS_LOOP || f.Depth != 4 {
+			t.Fatalf("last firing = %+v, want loop at depth 4", f)
+		}
+	})
+
+	t.Run("delayed action runs later with the original request", func(t *testing.T) {
+		svc, store, states := setup(t, nil)
+		reqID := xid.New().String()
+		ctx := hmstt.WithRequestID(context.Background(), reqID)
+		in := follow("server", "fan")
+		in.Then.Delay = time.Minute
+		r, _ := svc.Create(ctx, in)
+
+		states.SetState(ctx, "switch", "server", "on", nil, nil, nil)
+
+		if _, ok := states.values["switch/fan"]; ok {
+			t.Fatalf("fan was set immediately, want delayed")
+		}
+		if f := store.firings[r.ID]; f.Status != FIRING_STATUS_SCHEDULED {
+			t.Fatalf("firing = %+v, want scheduled", f)
+		}
+
+		pending, _ := store.ClaimDuePending(context.Background(), time.Now().Add(2*time.Minute), pendingLease)
+		if len(pending) != 1 {
+			t.Fatalf("pending = %d, want 1", len(pending))
+		}
+		if !svc.applyPending(context.Background(), pending[0]) {
+			t.Fatalf("applyPending() = false, want the action done")
+		}
+
+		if got := states.values["switch/fan"]; got != "on" {
+			t.Fatalf("fan = %q, want on", got)
+		}
+		if f := store.firings[r.ID]; f.Status != FIRING_STATUS_OK || f.RequestID != reqID {
+			t.Fatalf("firing = %+v, want ok with request ID", f)
+		}
+	})
+
+	t.Run("delayed action of a deleted rule is dropped", func(t *testing.T) {
+		svc, store, states := setup(t, nil)
+		ctx := context.Background()
+		in := follow("server", "fan")
+		in.Then.Delay = time.Minute
+		r, _ := svc.Create(ctx, in)
+
+		states.SetState(ctx, "switch", "server", "on", nil, nil, nil)
+		svc.Delete(ctx, r.ID)
+		pending, _ := store.ClaimDuePending(ctx, time.Now().Add(2*time.Minute), pendingLease)
+		if !svc.applyPending(ctx, pending[0]) {
+			t.Fatalf("applyPending() = false, want the action dropped")
+		}
+
+		if _, ok := states.values["switch/fan"]; ok {
+			t.Fatalf("fan was set by a deleted rule")
+		}
+	})
+}
@@ -0,0 +1,374 @@
+package rule
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/nurhudajoantama/hmauto/internal/redisqueue"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+)
+
+// Rule sets a state when another state changes: when When matches, and If
+// holds, set Then, optionally after Then.Delay.
+type Rule struct {
+	ID      string
+	Name    string
+	Enabled bool
+	When    Trigger
+	If      *Condition
+	Then    Action
+	// Cooldown is the minimum time between two firings of the rule.
+	Cooldown  time.Duration
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	// LastFiring is read from the firing log; it is not part of the stored
+	// definition.
+	LastFiring *Firing
+}
+
+// Trigger matches a committed value change of one state. An empty Value
+// matches any change.
+type Trigger struct {
+	Type  string `json:"type"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+// Condition compares the current value of a state with Value.
+type Condition struct {
+	Type  string `json:"type"`
+	Key   string `json:"key"`
+	Op    string `json:"op"`
+	Value string `json:"value"`
+}
+
+// Action is the state write a rule makes.
+type Action struct {
+	Type  string        `json:"type"`
+	Key   string        `json:"key"`
+	Value string        `json:"value"`
+	Delay time.Duration `json:"delay,omitempty"`
+}
+
+// Firing is the outcome of one triggering of a rule.
+type Firing struct {
+	At        time.Time `json:"at"`
+	RequestID string    `json:"request_id,omitempty"`
+	Trigger   string    `json:"trigger"`
+	Depth     int       `json:"depth"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Pending is a delayed action waiting for DueAt. It carries the request ID
+// and chain depth of the change that triggered it.
+type Pending struct {
+	ID        string    `json:"id"`
+	RuleID    string    `json:"rule_id"`
+	Action    Action    `json:"action"`
+	Trigger   string    `json:"trigger"`
+	RequestID string    `json:"request_id,omitempty"`
+	Depth     int       `json:"depth"`
+	DueAt     time.Time `json:"due_at"`
+}
+
+type Store interface {
+	Put(ctx context.Context, r Rule) error
+	Get(ctx context.Context, id string) (Rule, error)
+	List(ctx context.Context) ([]Rule, error)
+	Delete(ctx context.Context, id string) error
+	// AcquireCooldown reports whether the rule may fire now and, if so,
+	// starts its cooldown. A zero cooldown always allows firing.
+	AcquireCooldown(ctx context.Context, id string, cooldown time.Duration) (bool, error)
+	RecordFiring(ctx context.Context, id string, f Firing) error
+	PutPending(ctx context.Context, p Pending) error
+	// ClaimDuePending returns due delayed actions and leases them, so no
+	// other claim returns them until lease has passed.
+	ClaimDuePending(ctx context.Context, now time.Time, lease time.Duration) ([]Pending, error)
+	// FinishPending removes a claimed action.
+	FinishPending(ctx context.Context, p Pending) error
+}
+
+type ruleJSON struct {
+	ID        string        `json:"id"`
+	Name      string        `json:"name"`
+	Enabled   bool          `json:"enabled"`
+	When      Trigger       `json:"when"`
+	If        *Condition    `json:"if,omitempty"`
+	Then      Action        `json:"then"`
+	Cooldown  time.Duration `json:"cooldown"`
+	CreatedAt time.Time     `json:"created_at"`
+	UpdatedAt time.Time     `json:"updated_at"`
+}
+
+func encodeRule(r Rule) ([]byte, error) {
+	return json.Marshal(ruleJSON{
+		ID:        r.ID,
+		Name:      r.Name,
+		Enabled:   r.Enabled,
+		When:      r.When,
+		If:        r.If,
+		Then:      r.Then,
+		Cooldown:  r.Cooldown,
+		CreatedAt: r.CreatedAt,
+		UpdatedAt: r.UpdatedAt,
+	})
+}
+
+func decodeRule(data []byte) (Rule, error) {
+	var raw ruleJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return Rule{}, err
+	}
+	return Rule{
+		ID:        raw.ID,
+		Name:      raw.Name,
+		Enabled:   raw.Enabled,
+		When:      raw.When,
+		If:        raw.If,
+		Then:      raw.Then,
+		Cooldown:  raw.Cooldown,
+		CreatedAt: raw.CreatedAt,
+		UpdatedAt: raw.UpdatedAt,
+	}, nil
+}
+
+func decodeFiring(data []byte) (*Firing, error) {
+	var f Firing
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+type RuleStore struct {
+	rdb    *redis.Client
+	prefix string
+}
+
+func NewStore(rdb *redis.Client, prefix string) *RuleStore {
+	return &RuleStore{
+		rdb:    rdb,
+		prefix: prefix,
+	}
+}
+
+func (s *RuleStore) rulesKey() string {
+	return s.prefix + ":rules"
+}
+
+func (s *RuleStore) firingsKey() string {
+	return s.prefix + ":rule_firings"
+}
+
+func (s *RuleStore) cooldownKey(id string) string {
+	return s.prefix + ":rule_cooldown:" + id
+}
+
+func (s *RuleStore) pendingQueueKey() string {
+	return s.prefix + ":rule_pending"
+}
+
+func (s *RuleStore) pendingDataKey() string {
+	return s.prefix + ":rule_pending_data"
+}
+
+func (s *RuleStore) Put(ctx context.Context, r Rule) error {
+	ctx, span := otel.Tracer("rule").Start(ctx, "store.Put")
+	defer span.End()
+
+	data, err := encodeRule(r)
+	if err != nil {
+		return fmt.Errorf("marshal rule: %w", err)
+	}
+	if err := s.rdb.HSet(ctx, s.rulesKey(), r.ID, data).Err(); err != nil {
+		return fmt.Errorf("redis HSET rule: %w", err)
+	}
+	return nil
+}
+
+func (s *RuleStore) Get(ctx context.Context, id string) (Rule, error) {
+	ctx, span := otel.Tracer("rule").Start(ctx, "store.Get")
+	defer span.End()
+
+	var defCmd, firingCmd *redis.StringCmd
+	_, err := s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		defCmd = pipe.HGet(ctx, s.rulesKey(), id)
+		firingCmd = pipe.HGet(ctx, s.firingsKey(), id)
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return Rule{}, fmt.Errorf("redis HGET rule: %w", err)
+	}
+	data, err := defCmd.Bytes()
+	if errors.Is(err, redis.Nil) {
+		return Rule{}, ErrRuleNotFound
+	}
+	if err != nil {
+		return Rule{}, fmt.Errorf("redis HGET rule: %w", err)
+	}
+	r, err := decodeRule(data)
+	if err != nil {
+		return Rule{}, fmt.Errorf("unmarshal rule: %w", err)
+	}
+	if data, err := firingCmd.Bytes(); err == nil {
+		r.LastFiring, _ = decodeFiring(data)
+	}
+	return r, nil
+}
+
+// List returns all rules ordered by name.
+func (s *RuleStore) List(ctx context.Context) ([]Rule, error) {
+	ctx, span := otel.Tracer("rule").Start(ctx, "store.List")
+	defer span.End()
+
+	var defsCmd, firingsCmd *redis.MapStringStringCmd
+	_, err := s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		defsCmd = pipe.HGetAll(ctx, s.rulesKey())
+		firingsCmd = pipe.HGetAll(ctx, s.firingsKey())
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("redis HGETALL rules: %w", err)
+	}
+	firings := firingsCmd.Val()
+
+	rules := make([]Rule, 0, len(defsCmd.Val()))
+	for id, v := range defsCmd.Val() {
+		r, err := decodeRule([]byte(v))
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal rule %s: %w", id, err)
+		}
+		if data, ok := firings[id]; ok {
+			r.LastFiring, _ = decodeFiring([]byte(data))
+		}
+		rules = append(rules, r)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].Name != rules[j].Name {
+			return rules[i].Name < rules[j].Name
+		}
+		return rules[i].ID < rules[j].ID
+	})
+	return rules, nil
+}
+
+// Delete removes a rule, its firing log and cooldown. Delayed actions it
+// already scheduled are dropped when they come due. It returns
+// ErrRuleNotFound if the rule does not exist.
+func (s *RuleStore) Delete(ctx context.Context, id string) error {
+	ctx, span := otel.Tracer("rule").Start(ctx, "store.Delete")
+	defer span.End()
+
+	var removed *redis.IntCmd
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		removed = pipe.HDel(ctx, s.rulesKey(), id)
+		pipe.HDel(ctx, s.firingsKey(), id)
+		pipe.Del(ctx, s.cooldownKey(id))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("redis HDEL rule: %w", err)
+	}
+	if removed.Val() == 0 {
+		return ErrRuleNotFound
+	}
+	return nil
+}
+
+func (s *RuleStore) AcquireCooldown(ctx context.Context, id string, cooldown time.Duration) (bool, error) {
+	if cooldown <= 0 {
+		return true, nil
+	}
+	ctx, span := otel.Tracer("rule").Start(ctx, "store.AcquireCooldown")
+	defer span.End()
+
+	ok, err := s.rdb.SetNX(ctx, s.cooldownKey(id), 1, cooldown).Result()
+	if err != nil {
+		return false, fmt.Errorf("redis SET NX cooldown: %w", err)
+	}
+	return ok, nil
+}
+
+func (s *RuleStore) RecordFiring(ctx context.Context, id string, f Firing) error {
+	ctx, span := otel.Tracer("rule").Start(ctx, "store.RecordFiring")
+	defer span.End()
+
+	data, err := json.Marshal(f)
+	if err != nil {
+		return fmt.Errorf("marshal firing: %w", err)
+	}
+	if err := s.rdb.HSet(ctx, s.firingsKey(), id, data).Err(); err != nil {
+		return fmt.Errorf("redis HSET firing: %w", err)
+	}
+	return nil
+}
+
+func (s *RuleStore) PutPending(ctx context.Context, p Pending) error {
+	ctx, span := otel.Tracer("rule").Start(ctx, "store.PutPending")
+	defer span.End()
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("marshal pending action: %w", err)
+	}
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, s.pendingDataKey(), p.ID, data)
+		pipe.ZAdd(ctx, s.pendingQueueKey(), redis.Z{Score: float64(p.DueAt.UnixMilli()), Member: p.ID})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("redis HSET/ZADD pending action: %w", err)
+	}
+	return nil
+}
+
+const pendingClaimBatch = 100
+
+func (s *RuleStore) pendingQueue() redisqueue.Queue {
+	return redisqueue.Queue{QueueKey: s.pendingQueueKey(), DataKey: s.pendingDataKey()}
+}
+
+// ClaimDuePending returns the actions due at now and leases them for lease.
+// They stay stored until FinishPending removes them.
+func (s *RuleStore) ClaimDuePending(ctx context.Context, now time.Time, lease time.Duration) ([]Pending, error) {
+	ctx, span := otel.Tracer("rule").Start(ctx, "store.ClaimDuePending")
+	defer span.End()
+
+	result, err := s.pendingQueue().Claim(ctx, s.rdb, now, lease, pendingClaimBatch)
+	if err != nil {
+		return nil, fmt.Errorf("redis claim pending actions script: %w", err)
+	}
+	pending := make([]Pending, 0, len(result))
+	for _, v := range result {
+		var p Pending
+		if err := json.Unmarshal([]byte(v), &p); err != nil {
+			log.Error().Err(err).Msg("skipping undecodable pending rule action")
+			continue
+		}
+		pending = append(pending, p)
+	}
+	return pending, nil
+}
+
+// FinishPending removes a claimed action once it is done with.
+func (s *RuleStore) FinishPending(ctx context.Context, p Pending) error {
+	ctx, span := otel.Tracer("rule").Start(ctx, "store.FinishPending")
+	defer span.End()
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("marshal pending action: %w", err)
+	}
+	if _, err := s.pendingQueue().Finish(ctx, s.rdb, p.ID, string(data)); err != nil {
+		return fmt.Errorf("redis finish pending action script: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,7 @@
+package scene
+
+const (
+	// CALLER_PREFIX tags state history written by activating a scene,
+	// followed by its name.
+	CALLER_PREFIX = "scene:"
+)
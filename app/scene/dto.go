@@ -0,0 +1,41 @@
+package scene
+
+import "github.com/nurhudajoantama/hmauto/app/hmstt"
+
+// SceneRequest is the request body for creating a scene. Name is taken from
+// the path on PUT.
+type SceneRequest struct {
+	Name        string              `json:"name"        example:"leave_home"`
+	Description string              `json:"description" example:"Everything off when nobody is home"`
+	States      []AssignmentRequest `json:"states"      validate:"required,min=1,dive"`
+}
+
+// AssignmentRequest is one state a scene sets. Value is the state value as a
+// string; for json types pass the JSON text.
+type AssignmentRequest struct {
+	Type  string `json:"type"  validate:"required" example:"switch"`
+	Key   string `json:"key"   validate:"required" example:"server_1"`
+	Value string `json:"value" validate:"required" example:"off"`
+}
+
+// SceneResponse is the JSON representation of a scene.
+type SceneResponse struct {
+	Name        string               `json:"name"        example:"leave_home"`
+	Description string               `json:"description" example:"Everything off when nobody is home"`
+	States      []AssignmentResponse `json:"states"`
+	CreatedAt   string               `json:"created_at"  example:"2026-03-16T12:34:56Z"`
+	UpdatedAt   string               `json:"updated_at"  example:"2026-03-16T12:34:56Z"`
+}
+
+type AssignmentResponse struct {
+	Type  string `json:"type"  example:"switch"`
+	Key   string `json:"key"   example:"server_1"`
+	Value string `json:"value" example:"off"`
+}
+
+// ActivateResponse reports the outcome of activating a scene, one result per
+// state in scene order.
+type ActivateResponse struct {
+	Scene   string                         `json:"scene"   example:"leave_home"`
+	Results []hmstt.BatchSetResultResponse `json:"results"`
+}
@@ -0,0 +1,279 @@
+package scene
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nurhudajoantama/hmauto/app/hmstt"
+	"github.com/nurhudajoantama/hmauto/app/server"
+	"github.com/nurhudajoantama/hmauto/internal/request"
+	"github.com/nurhudajoantama/hmauto/internal/response"
+	"github.com/rs/zerolog"
+)
+
+type SceneHandler struct {
+	service *SceneService
+}
+
+func sceneToResponse(sc Scene) SceneResponse {
+	states := make([]AssignmentResponse, 0, len(sc.States))
+	for _, a := range sc.States {
+		states = append(states, AssignmentResponse(a))
+	}
+	return SceneResponse{
+		Name:        sc.Name,
+		Description: sc.Description,
+		States:      states,
+		CreatedAt:   sc.CreatedAt.UTC().Format(time.RFC3339),
+		UpdatedAt:   sc.UpdatedAt.UTC().Format(time.RFC3339),
+	}
+}
+
+func requestToInput(body SceneRequest) Input {
+	states := make([]Assignment, 0, len(body.States))
+	for _, a := range body.States {
+		states = append(states, Assignment(a))
+	}
+	return Input{Description: body.Description, States: states}
+}
+
+func activateToResponse(name string, results []hmstt.BatchSetResult) ActivateResponse {
+	data := make([]hmstt.BatchSetResultResponse, 0, len(results))
+	for _, res := range results {
+		data = append(data, hmstt.BatchResultToResponse(res))
+	}
+	return ActivateResponse{Scene: name, Results: data}
+}
+
+func errorResponse(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrSceneNotFound):
+		response.ErrorResponse(w, http.StatusNotFound, "scene not found", err)
+	case errors.Is(err, ErrSceneAlreadyExists):
+		response.ErrorResponse(w, http.StatusConflict, "scene already exists", err)
+	case errors.Is(err, ErrInvalidScene):
+		response.ErrorResponse(w, http.StatusBadRequest, err.Error(), err)
+	default:
+		response.ErrorResponse(w, http.StatusInternalServerError, err.Error(), err)
+	}
+}
+
+func RegisterHandlers(s *server.Server, svc *SceneService) {
+	h := &SceneHandler{service: svc}
+
+	v1 := s.GetRouter().PathPrefix("/v1").Subrouter()
+	s.ApplyAuthMiddleware(v1)
+
+	v1.HandleFunc("/scenes", h.listScenes).Methods("GET")
+	v1.HandleFunc("/scenes", h.createScene).Methods("POST")
+	v1.HandleFunc("/scenes/{name}", h.getScene).Methods("GET")
+	v1.HandleFunc("/scenes/{name}", h.updateScene).Methods("PUT")
+	v1.HandleFunc("/scenes/{name}", h.deleteScene).Methods("DELETE")
+	v1.HandleFunc("/scenes/{name}/activate", h.activateScene).Methods("POST")
+}
+
+// listScenes godoc
+//
+//	@Summary		List scenes
+//	@Tags			scenes
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Success		200	{object}	response.JsonResponse{data=[]SceneResponse}	"List of scenes"
+//	@Failure		401	{object}	response.JsonResponse						"Unauthorized"
+//	@Failure		500	{object}	response.JsonResponse						"Internal error"
+//	@Router			/scenes [get]
+func (h *SceneHandler) listScenes(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+	l.Info().Msg("Handling listScenes request")
+
+	scenes, err := h.service.List(ctx)
+	if err != nil {
+		l.Error().Err(err).Msg("listScenes failed")
+		errorResponse(w, err)
+		return
+	}
+
+	data := make([]SceneResponse, 0, len(scenes))
+	for _, sc := range scenes {
+		data = append(data, sceneToResponse(sc))
+	}
+	response.SuccessResponse(w, data)
+}
+
+// createScene godoc
+//
+//	@Summary		Create a scene
+//	@Description	Stores a named set of state assignments. Every value is checked against its type; each state may appear once.
+//	@Tags			scenes
+//	@Accept			json
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			body	body		SceneRequest							true	"Scene"
+//	@Success		201		{object}	response.JsonResponse{data=SceneResponse}	"Created scene"
+//	@Failure		400		{object}	response.JsonResponse						"Invalid name or states"
+//	@Failure		401		{object}	response.JsonResponse						"Unauthorized"
+//	@Failure		409		{object}	response.JsonResponse						"Scene already exists"
+//	@Failure		500		{object}	response.JsonResponse						"Internal error"
+//	@Router			/scenes [post]
+func (h *SceneHandler) createScene(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+	l.Info().Msg("Handling createScene request")
+
+	var body SceneRequest
+	if err := request.DecodeAndValidate(r, &body); err != nil {
+		l.Error().Err(err).Msg("createScene: validation failed")
+		response.ErrorResponse(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	sc, err := h.service.Create(ctx, body.Name, requestToInput(body))
+	if err != nil {
+		l.Error().Err(err).Msg("createScene failed")
+		errorResponse(w, err)
+		return
+	}
+
+	response.CreatedResponse(w, sceneToResponse(sc))
+}
+
+// getScene godoc
+//
+//	@Summary		Get a scene
+//	@Tags			scenes
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			name	path		string									true	"Scene name"	example(leave_home)
+//	@Success		200		{object}	response.JsonResponse{data=SceneResponse}	"Scene"
+//	@Failure		401		{object}	response.JsonResponse						"Unauthorized"
+//	@Failure		404		{object}	response.JsonResponse						"Scene not found"
+//	@Router			/scenes/{name} [get]
+func (h *SceneHandler) getScene(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+	name := mux.Vars(r)["name"]
+	l.Info().Str("scene", name).Msg("Handling getScene request")
+
+	sc, err := h.service.Get(ctx, name)
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+
+	response.SuccessResponse(w, sceneToResponse(sc))
+}
+
+// updateScene godoc
+//
+//	@Summary		Replace a scene
+//	@Description	Replaces the description and states of an existing scene. The name in the body is ignored.
+//	@Tags			scenes
+//	@Accept			json
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			name	path		string									true	"Scene name"	example(leave_home)
+//	@Param			body	body		SceneRequest							true	"Scene"
+//	@Success		200		{object}	response.JsonResponse{data=SceneResponse}	"Updated scene"
+//	@Failure		400		{object}	response.JsonResponse						"Invalid states"
+//	@Failure		401		{object}	response.JsonResponse						"Unauthorized"
+//	@Failure		404		{object}	response.JsonResponse						"Scene not found"
+//	@Failure		500		{object}	response.JsonResponse						"Internal error"
+//	@Router			/scenes/{name} [put]
+func (h *SceneHandler) updateScene(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+	name := mux.Vars(r)["name"]
+	l.Info().Str("scene", name).Msg("Handling updateScene request")
+
+	var body SceneRequest
+	if err := request.DecodeAndValidate(r, &body); err != nil {
+		l.Error().Err(err).Msg("updateScene: validation failed")
+		response.ErrorResponse(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	sc, err := h.service.Update(ctx, name, requestToInput(body))
+	if err != nil {
+		l.Error().Err(err).Msg("updateScene failed")
+		errorResponse(w, err)
+		return
+	}
+
+	response.SuccessResponse(w, sceneToResponse(sc))
+}
+
+// deleteScene godoc
+//
+//	@Summary		Delete a scene
+//	@Description	Removes the scene definition; the states keep their current values
+//	@Tags			scenes
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			name	path		string									true	"Scene name"	example(leave_home)
+//	@Success		200		{object}	response.JsonResponse{data=SceneResponse}	"Deleted scene"
+//	@Failure		401		{object}	response.JsonResponse						"Unauthorized"
+//	@Failure		404		{object}	response.JsonResponse						"Scene not found"
+//	@Failure		500		{object}	response.JsonResponse						"Internal error"
+//	@Router			/scenes/{name} [delete]
+func (h *SceneHandler) deleteScene(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+	name := mux.Vars(r)["name"]
+	l.Info().Str("scene", name).Msg("Handling deleteScene request")
+
+	sc, err := h.service.Delete(ctx, name)
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+
+	response.SuccessResponse(w, sceneToResponse(sc))
+}
+
+// activateScene godoc
+//
+//	@Summary		Activate a scene
+//	@Description	Sets every state of the scene in one atomic batch write: all or nothing. Fires one MQTT event per changed value.
+//	@Tags			scenes
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			name	path		string										true	"Scene name"	example(leave_home)
+//	@Success		200		{object}	response.JsonResponse{data=ActivateResponse}	"Per-state results, in scene order"
+//	@Failure		401		{object}	response.JsonResponse							"Unauthorized"
+//	@Failure		404		{object}	response.JsonResponse							"Scene not found"
+//	@Failure		409		{object}	response.JsonResponse{data=ActivateResponse}	"A value is no longer accepted by its type, a constraint would be violated, or states kept changing; nothing was written"
+//	@Failure		423		{object}	response.JsonResponse{data=ActivateResponse}	"Some states of the scene are locked; nothing was written"
+//	@Failure		500		{object}	response.JsonResponse							"Internal error"
+//	@Router			/scenes/{name}/activate [post]
+func (h *SceneHandler) activateScene(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+	name := mux.Vars(r)["name"]
+	l.Info().Str("scene", name).Msg("Handling activateScene request")
+
+	_, results, err := h.service.Activate(ctx, name)
+	data := activateToResponse(name, results)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrSceneNotFound):
+			errorResponse(w, err)
+		case errors.Is(err, hmstt.ErrBatchInvalid):
+			response.ErrorDataResponse(w, http.StatusConflict, "scene has states the types no longer accept, nothing was written", err, data)
+		case errors.Is(err, hmstt.ErrRevisionMismatch):
+			response.ErrorResponse(w, http.StatusConflict, "states kept changing during activation, nothing was written", err)
+		case errors.Is(err, hmstt.ErrConstraintViolation):
+			hmstt.RespondConstraintViolation(w, err)
+		case errors.Is(err, hmstt.ErrStateLocked):
+			response.ErrorDataResponse(w, http.StatusLocked, "some states of the scene are locked, nothing was written", err, data)
+		default:
+			l.Error().Err(err).Msg("activateScene failed")
+			response.ErrorResponse(w, http.StatusInternalServerError, "failed to activate scene", err)
+		}
+		return
+	}
+
+	response.SuccessResponse(w, data)
+}
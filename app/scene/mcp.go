@@ -0,0 +1,62 @@
+package scene
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+	"github.com/nurhudajoantama/hmauto/app/hmstt"
+)
+
+type activateSceneInput struct {
+	Name string `json:"name" jsonschema:"Scene name, e.g. leave_home (see list_scenes)"`
+}
+
+func textResult(v any) *mcp.CallToolResult {
+	b, _ := json.Marshal(v)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(b)}},
+	}
+}
+
+func errResult(msg string) *mcp.CallToolResult {
+	return &mcp.CallToolResult{
+		IsError: true,
+		Content: []mcp.Content{&mcp.TextContent{Text: msg}},
+	}
+}
+
+// RegisterMCPTools registers the scene tools on the given MCP server.
+func RegisterMCPTools(s *mcp.Server, svc *SceneService) {
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "list_scenes",
+		Description: "List scenes: named sets of IoT state values such as leave_home, with the states each one sets.",
+	}, func(ctx context.Context, _ *mcp.CallToolRequest, _ struct{}) (*mcp.CallToolResult, any, error) {
+		scenes, err := svc.List(ctx)
+		if err != nil {
+			return errResult(err.Error()), nil, nil
+		}
+		data := make([]SceneResponse, 0, len(scenes))
+		for _, sc := range scenes {
+			data = append(data, sceneToResponse(sc))
+		}
+		return textResult(data), nil, nil
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "activate_scene",
+		Description: "Activate a scene by name: set all of its states at once, all or nothing. Use when the user asks to run a routine, e.g. leave home or server maintenance.",
+	}, func(ctx context.Context, _ *mcp.CallToolRequest, input activateSceneInput) (*mcp.CallToolResult, any, error) {
+		_, results, err := svc.Activate(ctx, input.Name)
+		data := activateToResponse(input.Name, results)
+		if errors.Is(err, hmstt.ErrBatchInvalid) || errors.Is(err, hmstt.ErrStateLocked) {
+			b, _ := json.Marshal(data)
+			return errResult(err.Error() + ": " + string(b)), nil, nil
+		}
+		if err != nil {
+			return errResult(err.Error()), nil, nil
+		}
+		return textResult(data), nil, nil
+	})
+}
@@ -0,0 +1,182 @@
+package scene
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/nurhudajoantama/hmauto/app/hmstt"
+	"github.com/rs/zerolog"
+)
+
+var ErrSceneNotFound = errors.New("SCENE NOT FOUND")
+var ErrSceneAlreadyExists = errors.New("SCENE ALREADY EXISTS")
+var ErrInvalidScene = errors.New("INVALID SCENE")
+
+// sceneNamePattern keeps scene names usable as a path segment.
+var sceneNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// StateWriter is the part of the hmstt service scenes need.
+type StateWriter interface {
+	ValidateValue(tipe, key, value string) error
+	BatchSetStates(ctx context.Context, items []hmstt.BatchSetItem) ([]hmstt.BatchSetResult, error)
+}
+
+type SceneService struct {
+	store  Store
+	states StateWriter
+}
+
+func NewService(store Store, states StateWriter) *SceneService {
+	return &SceneService{
+		store:  store,
+		states: states,
+	}
+}
+
+// Input is the user-editable part of a scene.
+type Input struct {
+	Description string
+	States      []Assignment
+}
+
+func (s *SceneService) validate(name string, in Input) error {
+	if !sceneNamePattern.MatchString(name) {
+		return fmt.Errorf("%w: name must be 1-64 letters, digits, '_' or '-'", ErrInvalidScene)
+	}
+	if len(in.States) == 0 {
+		return fmt.Errorf("%w: at least one state is required", ErrInvalidScene)
+	}
+	if len(in.States) > hmstt.MaxBatchSize {
+		return fmt.Errorf("%w: %d states, at most %d allowed", ErrInvalidScene, len(in.States), hmstt.MaxBatchSize)
+	}
+	seen := make(map[string]bool, len(in.States))
+	for _, a := range in.States {
+		id := a.Type + "/" + a.Key
+		if a.Type == "" || a.Key == "" {
+			return fmt.Errorf("%w: type and key are required", ErrInvalidScene)
+		}
+		if seen[id] {
+			return fmt.Errorf("%w: %s appears more than once", ErrInvalidScene, id)
+		}
+		seen[id] = true
+		if err := s.states.ValidateValue(a.Type, a.Key, a.Value); err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrInvalidScene, id, err)
+		}
+	}
+	return nil
+}
+
+func (s *SceneService) List(ctx context.Context) ([]Scene, error) {
+	scenes, err := s.store.List(ctx)
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("List scenes failed")
+		return nil, errors.New("LIST SCENES ERROR")
+	}
+	return scenes, nil
+}
+
+func (s *SceneService) Get(ctx context.Context, name string) (Scene, error) {
+	sc, err := s.store.Get(ctx, name)
+	if err != nil {
+		if errors.Is(err, ErrSceneNotFound) {
+			return Scene{}, ErrSceneNotFound
+		}
+		zerolog.Ctx(ctx).Error().Err(err).Msg("Get scene failed")
+		return Scene{}, errors.New("GET SCENE ERROR")
+	}
+	return sc, nil
+}
+
+func (s *SceneService) Create(ctx context.Context, name string, in Input) (Scene, error) {
+	l := zerolog.Ctx(ctx)
+	l.Info().Str("scene", name).Int("states", len(in.States)).Msg("Handling Create scene service")
+
+	if err := s.validate(name, in); err != nil {
+		return Scene{}, err
+	}
+	now := time.Now().UTC()
+	sc := Scene{
+		Name:        name,
+		Description: in.Description,
+		States:      in.States,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if err := s.store.Create(ctx, sc); err != nil {
+		if errors.Is(err, ErrSceneAlreadyExists) {
+			return Scene{}, ErrSceneAlreadyExists
+		}
+		l.Error().Err(err).Msg("Create scene failed")
+		return Scene{}, errors.New("CREATE SCENE ERROR")
+	}
+	return sc, nil
+}
+
+// Update replaces the description and states of an existing scene.
+func (s *SceneService) Update(ctx context.Context, name string, in Input) (Scene, error) {
+	l := zerolog.Ctx(ctx)
+	l.Info().Str("scene", name).Int("states", len(in.States)).Msg("Handling Update scene service")
+
+	if err := s.validate(name, in); err != nil {
+		return Scene{}, err
+	}
+	sc, err := s.Get(ctx, name)
+	if err != nil {
+		return Scene{}, err
+	}
+	sc.Description = in.Description
+	sc.States = in.States
+	sc.UpdatedAt = time.Now().UTC()
+	if err := s.store.Update(ctx, sc); err != nil {
+		if errors.Is(err, ErrSceneNotFound) {
+			return Scene{}, ErrSceneNotFound
+		}
+		l.Error().Err(err).Msg("Update scene failed")
+		return Scene{}, errors.New("UPDATE SCENE ERROR")
+	}
+	return sc, nil
+}
+
+func (s *SceneService) Delete(ctx context.Context, name string) (Scene, error) {
+	l := zerolog.Ctx(ctx)
+	l.Info().Str("scene", name).Msg("Handling Delete scene service")
+
+	sc, err := s.Get(ctx, name)
+	if err != nil {
+		return Scene{}, err
+	}
+	if err := s.store.Delete(ctx, name); err != nil {
+		if errors.Is(err, ErrSceneNotFound) {
+			return Scene{}, ErrSceneNotFound
+		}
+		l.Error().Err(err).Msg("Delete scene failed")
+		return Scene{}, errors.New("DELETE SCENE ERROR")
+	}
+	return sc, nil
+}
+
+// Activate applies every state of the scene in one atomic batch write. The
+// per-state results come from hmstt; on ErrBatchInvalid (the type registry
+// no longer accepts a value) nothing was written.
+func (s *SceneService) Activate(ctx context.Context, name string) (Scene, []hmstt.BatchSetResult, error) {
+	l := zerolog.Ctx(ctx)
+	l.Info().Str("scene", name).Msg("Handling Activate scene service")
+
+	sc, err := s.Get(ctx, name)
+	if err != nil {
+		return Scene{}, nil, err
+	}
+	items := make([]hmstt.BatchSetItem, 0, len(sc.States))
+	for _, a := range sc.States {
+		items = append(items, hmstt.BatchSetItem{Type: a.Type, Key: a.Key, Value: a.Value})
+	}
+	results, err := s.states.BatchSetStates(hmstt.WithCaller(ctx, CALLER_PREFIX+name), items)
+	if err != nil {
+		l.Warn().Err(err).Str("scene", name).Msg("Activate scene failed")
+		return sc, results, err
+	}
+	return sc, results, nil
+}
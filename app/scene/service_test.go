@@ -0,0 +1,172 @@
+package scene
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/nurhudajoantama/hmauto/app/hmstt"
+)
+
+type fakeStore struct {
+	mu     sync.Mutex
+	scenes map[string]Scene
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{scenes: map[string]Scene{}}
+}
+
+func (f *fakeStore) Create(_ context.Context, sc Scene) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.scenes[sc.Name]; ok {
+		return ErrSceneAlreadyExists
+	}
+	f.scenes[sc.Name] = sc
+	return nil
+}
+
+func (f *fakeStore) Update(_ context.Context, sc Scene) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.scenes[sc.Name]; !ok {
+		return ErrSceneNotFound
+	}
+	f.scenes[sc.Name] = sc
+	return nil
+}
+
+func (f *fakeStore) Get(_ context.Context, name string) (Scene, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sc, ok := f.scenes[name]
+	if !ok {
+		return Scene{}, ErrSceneNotFound
+	}
+	return sc, nil
+}
+
+func (f *fakeStore) List(context.Context) ([]Scene, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make([]Scene, 0, len(f.scenes))
+	for _, sc := range f.scenes {
+		out = append(out, sc)
+	}
+	return out, nil
+}
+
+func (f *fakeStore) Delete(_ context.Context, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.scenes[name]; !ok {
+		return ErrSceneNotFound
+	}
+	delete(f.scenes, name)
+	return nil
+}
+
+// fakeStates accepts on and off for switch states and records batch writes.
+type fakeStates struct {
+	batches [][]hmstt.BatchSetItem
+	callers []string
+	err     error
+}
+
+func (f *fakeStates) ValidateValue(tipe, key, value string) error {
+	if tipe != "switch" || (value != "on" && value != "off") {
+		return hmstt.ErrInvalidValue
+	}
+	return nil
+}
+
+func (f *fakeStates) BatchSetStates(ctx context.Context, items []hmstt.BatchSetItem) ([]hmstt.BatchSetResult, error) {
+	f.batches = append(f.batches, items)
+	f.callers = append(f.callers, hmstt.CallerFromContext(ctx))
+	results := make([]hmstt.BatchSetResult, 0, len(items))
+	for _, item := range items {
+		results = append(results, hmstt.BatchSetResult{
+			Entry:  hmstt.StateEntry{Type: item.Type, K: item.Key, Value: item.Value},
+			Status: hmstt.BATCH_STATUS_UPDATED,
+		})
+	}
+	return results, f.err
+}
+
+func leaveHome() Input {
+	return Input{
+		Description: "Everything off",
+		States: []Assignment{
+			{Type: "switch", Key: "server_1", Value: "off"},
+			{Type: "switch", Key: "lamp", Value: "off"},
+		},
+	}
+}
+
+func TestCreateScene(t *testing.T) {
+	ctx := context.Background()
+	svc := NewService(newFakeStore(), &fakeStates{})
+
+	tests := []struct {
+		name   string
+		scene  string
+		modify func(*Input)
+	}{
+		{"name with a space", "leave home", func(*Input) {}},
+		{"no states", "leave_home", func(in *Input) { in.States = nil }},
+		{"duplicate state", "leave_home", func(in *Input) { in.States[1].Key = "server_1" }},
+		{"value rejected by type", "leave_home", func(in *Input) { in.States[0].Value = "dim" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := leaveHome()
+			tt.modify(&in)
+			if _, err := svc.Create(ctx, tt.scene, in); !errors.Is(err, ErrInvalidScene) {
+				t.Fatalf("Create() error = %v, want ErrInvalidScene", err)
+			}
+		})
+	}
+
+	if _, err := svc.Create(ctx, "leave_home", leaveHome()); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if _, err := svc.Create(ctx, "leave_home", leaveHome()); !errors.Is(err, ErrSceneAlreadyExists) {
+		t.Fatalf("second Create() error = %v, want ErrSceneAlreadyExists", err)
+	}
+	if _, err := svc.Update(ctx, "maintenance", leaveHome()); !errors.Is(err, ErrSceneNotFound) {
+		t.Fatalf("Update() of missing scene error = %v, want ErrSceneNotFound", err)
+	}
+}
+
+func TestActivateScene(t *testing.T) {
+	ctx := context.Background()
+	states := &fakeStates{}
+	svc := NewService(newFakeStore(), states)
+	if _, err := svc.Create(ctx, "leave_home", leaveHome()); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	_, results, err := svc.Activate(ctx, "leave_home")
+	if err != nil {
+		t.Fatalf("Activate() error = %v", err)
+	}
+	if len(states.batches) != 1 || len(states.batches[0]) != 2 {
+		t.Fatalf("batches = %v, want one batch of 2", states.batches)
+	}
+	if states.callers[0] != CALLER_PREFIX+"leave_home" {
+		t.Fatalf("caller = %q, want %q", states.callers[0], CALLER_PREFIX+"leave_home")
+	}
+	if len(results) != 2 || results[0].Entry.K != "server_1" {
+		t.Fatalf("results = %+v, want scene order", results)
+	}
+
+	states.err = hmstt.ErrBatchInvalid
+	if _, _, err := svc.Activate(ctx, "leave_home"); !errors.Is(err, hmstt.ErrBatchInvalid) {
+		t.Fatalf("Activate() error = %v, want ErrBatchInvalid", err)
+	}
+	if _, _, err := svc.Activate(ctx, "maintenance"); !errors.Is(err, ErrSceneNotFound) {
+		t.Fatalf("Activate() of missing scene error = %v, want ErrSceneNotFound", err)
+	}
+}
@@ -0,0 +1,173 @@
+package scene
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel"
+)
+
+// Scene is a named set of state assignments applied together.
+type Scene struct {
+	Name        string
+	Description string
+	States      []Assignment
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// Assignment sets one state to Value when the scene is activated.
+type Assignment struct {
+	Type  string `json:"type"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type Store interface {
+	// Create stores a new scene. It returns ErrSceneAlreadyExists if the name
+	// is taken.
+	Create(ctx context.Context, sc Scene) error
+	// Update replaces an existing scene. It returns ErrSceneNotFound if there
+	// is none.
+	Update(ctx context.Context, sc Scene) error
+	Get(ctx context.Context, name string) (Scene, error)
+	List(ctx context.Context) ([]Scene, error)
+	Delete(ctx context.Context, name string) error
+}
+
+type sceneJSON struct {
+	Name        string       `json:"name"`
+	Description string       `json:"description"`
+	States      []Assignment `json:"states"`
+	CreatedAt   time.Time    `json:"created_at"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+}
+
+func decodeScene(data []byte) (Scene, error) {
+	var raw sceneJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return Scene{}, err
+	}
+	return Scene(raw), nil
+}
+
+type SceneStore struct {
+	rdb    *redis.Client
+	prefix string
+}
+
+func NewStore(rdb *redis.Client, prefix string) *SceneStore {
+	return &SceneStore{
+		rdb:    rdb,
+		prefix: prefix,
+	}
+}
+
+func (s *SceneStore) scenesKey() string {
+	return s.prefix + ":scenes"
+}
+
+func (s *SceneStore) Create(ctx context.Context, sc Scene) error {
+	ctx, span := otel.Tracer("scene").Start(ctx, "store.Create")
+	defer span.End()
+
+	data, err := json.Marshal(sceneJSON(sc))
+	if err != nil {
+		return fmt.Errorf("marshal scene: %w", err)
+	}
+	created, err := s.rdb.HSetNX(ctx, s.scenesKey(), sc.Name, data).Result()
+	if err != nil {
+		return fmt.Errorf("redis HSETNX scene: %w", err)
+	}
+	if !created {
+		return ErrSceneAlreadyExists
+	}
+	return nil
+}
+
+// updateSceneScript replaces a scene only while it exists, so a concurrent
+// delete is not undone.
+var updateSceneScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+return 1
+`)
+
+func (s *SceneStore) Update(ctx context.Context, sc Scene) error {
+	ctx, span := otel.Tracer("scene").Start(ctx, "store.Update")
+	defer span.End()
+
+	data, err := json.Marshal(sceneJSON(sc))
+	if err != nil {
+		return fmt.Errorf("marshal scene: %w", err)
+	}
+	updated, err := updateSceneScript.Run(ctx, s.rdb, []string{s.scenesKey()}, sc.Name, data).Int()
+	if err != nil {
+		return fmt.Errorf("redis update scene script: %w", err)
+	}
+	if updated == 0 {
+		return ErrSceneNotFound
+	}
+	return nil
+}
+
+func (s *SceneStore) Get(ctx context.Context, name string) (Scene, error) {
+	ctx, span := otel.Tracer("scene").Start(ctx, "store.Get")
+	defer span.End()
+
+	data, err := s.rdb.HGet(ctx, s.scenesKey(), name).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return Scene{}, ErrSceneNotFound
+	}
+	if err != nil {
+		return Scene{}, fmt.Errorf("redis HGET scene: %w", err)
+	}
+	sc, err := decodeScene(data)
+	if err != nil {
+		return Scene{}, fmt.Errorf("unmarshal scene: %w", err)
+	}
+	return sc, nil
+}
+
+// List returns all scenes ordered by name.
+func (s *SceneStore) List(ctx context.Context) ([]Scene, error) {
+	ctx, span := otel.Tracer("scene").Start(ctx, "store.List")
+	defer span.End()
+
+	vals, err := s.rdb.HGetAll(ctx, s.scenesKey()).Result()
+	if err != nil {
+		return nil, fmt.Errorf("redis HGETALL scenes: %w", err)
+	}
+	scenes := make([]Scene, 0, len(vals))
+	for name, v := range vals {
+		sc, err := decodeScene([]byte(v))
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal scene %s: %w", name, err)
+		}
+		scenes = append(scenes, sc)
+	}
+	sort.Slice(scenes, func(i, j int) bool { return scenes[i].Name < scenes[j].Name })
+	return scenes, nil
+}
+
+// Delete removes a scene. It returns ErrSceneNotFound if it does not exist.
+func (s *SceneStore) Delete(ctx context.Context, name string) error {
+	ctx, span := otel.Tracer("scene").Start(ctx, "store.Delete")
+	defer span.End()
+
+	removed, err := s.rdb.HDel(ctx, s.scenesKey(), name).Result()
+	if err != nil {
+		return fmt.Errorf("redis HDEL scene: %w", err)
+	}
+	if removed == 0 {
+		return ErrSceneNotFound
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+package schedule
+
+const (
+	CATCH_UP_SKIP = "skip"
+	CATCH_UP_ONCE = "once"
+
+	RUN_STATUS_OK     = "ok"
+	RUN_STATUS_FAILED = "failed"
+	RUN_STATUS_MISSED = "missed"
+
+	// CALLER_PREFIX tags state history written by a schedule, followed by its ID.
+	CALLER_PREFIX = "schedule:"
+)
@@ -0,0 +1,40 @@
+package schedule
+
+// ScheduleRequest is the request body for creating or replacing a schedule.
+// Value is the state value as a string; for json types pass the JSON text.
+type ScheduleRequest struct {
+	Name     string `json:"name"     example:"Servers on at night"`
+	Cron     string `json:"cron"     validate:"required" example:"0 22 * * *"`
+	Timezone string `json:"timezone" example:"Asia/Jakarta"`
+	Type     string `json:"type"     validate:"required" example:"switch"`
+	Key      string `json:"key"      validate:"required" example:"server_1"`
+	Value    string `json:"value"    validate:"required" example:"on"`
+	Enabled  *bool  `json:"enabled"  example:"true"`
+	CatchUp  string `json:"catch_up" example:"skip"`
+}
+
+// ScheduleResponse is the JSON representation of a schedule.
+type ScheduleResponse struct {
+	ID        string       `json:"id"                    example:"d0m5v7hc0f0s73ctg0a0"`
+	Name      string       `json:"name"                  example:"Servers on at night"`
+	Cron      string       `json:"cron"                  example:"0 22 * * *"`
+	Timezone  string       `json:"timezone"              example:"Asia/Jakarta"`
+	Type      string       `json:"type"                  example:"switch"`
+	Key       string       `json:"key"                   example:"server_1"`
+	Value     string       `json:"value"                 example:"on"`
+	Enabled   bool         `json:"enabled"               example:"true"`
+	CatchUp   string       `json:"catch_up,omitempty"    example:"once"`
+	NextRunAt string       `json:"next_run_at,omitempty" example:"2026-03-16T15:00:00Z"`
+	LastRun   *RunResponse `json:"last_run,omitempty"`
+	CreatedAt string       `json:"created_at"            example:"2026-03-16T12:34:56Z"`
+	UpdatedAt string       `json:"updated_at"            example:"2026-03-16T12:34:56Z"`
+}
+
+// RunResponse is the outcome of the last due run of a schedule.
+// Status is ok, failed or missed (skipped by the catch-up policy).
+type RunResponse struct {
+	At      string `json:"at"              example:"2026-03-15T15:00:01Z"`
+	Planned string `json:"planned"         example:"2026-03-15T15:00:00Z"`
+	Status  string `json:"status"          example:"ok"`
+	Error   string `json:"error,omitempty" example:"INVALID VALUE: ..."`
+}
@@ -0,0 +1,244 @@
+package schedule
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nurhudajoantama/hmauto/app/server"
+	"github.com/nurhudajoantama/hmauto/internal/request"
+	"github.com/nurhudajoantama/hmauto/internal/response"
+	"github.com/rs/zerolog"
+)
+
+type ScheduleHandler struct {
+	service *ScheduleService
+}
+
+func scheduleToResponse(sch Schedule) ScheduleResponse {
+	out := ScheduleResponse{
+		ID:        sch.ID,
+		Name:      sch.Name,
+		Cron:      sch.Cron,
+		Timezone:  sch.Timezone,
+		Type:      sch.Type,
+		Key:       sch.Key,
+		Value:     sch.Value,
+		Enabled:   sch.Enabled,
+		CatchUp:   sch.CatchUp,
+		CreatedAt: sch.CreatedAt.UTC().Format(time.RFC3339),
+		UpdatedAt: sch.UpdatedAt.UTC().Format(time.RFC3339),
+	}
+	if sch.Enabled && !sch.NextRunAt.IsZero() {
+		out.NextRunAt = sch.NextRunAt.UTC().Format(time.RFC3339)
+	}
+	if sch.LastRun != nil {
+		out.LastRun = &RunResponse{
+			At:      sch.LastRun.At.UTC().Format(time.RFC3339),
+			Planned: sch.LastRun.Planned.UTC().Format(time.RFC3339),
+			Status:  sch.LastRun.Status,
+			Error:   sch.LastRun.Error,
+		}
+	}
+	return out
+}
+
+func requestToInput(body ScheduleRequest) Input {
+	enabled := true
+	if body.Enabled != nil {
+		enabled = *body.Enabled
+	}
+	return Input{
+		Name:     body.Name,
+		Cron:     body.Cron,
+		Timezone: body.Timezone,
+		Type:     body.Type,
+		Key:      body.Key,
+		Value:    body.Value,
+		Enabled:  enabled,
+		CatchUp:  body.CatchUp,
+	}
+}
+
+func errorResponse(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrScheduleNotFound):
+		response.ErrorResponse(w, http.StatusNotFound, "schedule not found", err)
+	case errors.Is(err, ErrInvalidSchedule):
+		response.ErrorResponse(w, http.StatusBadRequest, err.Error(), err)
+	default:
+		response.ErrorResponse(w, http.StatusInternalServerError, err.Error(), err)
+	}
+}
+
+func RegisterHandlers(s *server.Server, svc *ScheduleService) {
+	h := &ScheduleHandler{service: svc}
+
+	v1 := s.GetRouter().PathPrefix("/v1").Subrouter()
+	s.ApplyAuthMiddleware(v1)
+
+	v1.HandleFunc("/schedules", h.listSchedules).Methods("GET")
+	v1.HandleFunc("/schedules", h.createSchedule).Methods("POST")
+	v1.HandleFunc("/schedules/{id}", h.getSchedule).Methods("GET")
+	v1.HandleFunc("/schedules/{id}", h.updateSchedule).Methods("PUT")
+	v1.HandleFunc("/schedules/{id}", h.deleteSchedule).Methods("DELETE")
+}
+
+// listSchedules godoc
+//
+//	@Summary		List schedules
+//	@Description	Returns all schedules with their next run and the outcome of the last run
+//	@Tags			schedules
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Success		200	{object}	response.JsonResponse{data=[]ScheduleResponse}	"List of schedules"
+//	@Failure		401	{object}	response.JsonResponse							"Unauthorized"
+//	@Failure		500	{object}	response.JsonResponse							"Internal error"
+//	@Router			/schedules [get]
+func (h *ScheduleHandler) listSchedules(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+	l.Info().Msg("Handling listSchedules request")
+
+	schedules, err := h.service.List(ctx)
+	if err != nil {
+		l.Error().Err(err).Msg("listSchedules failed")
+		errorResponse(w, err)
+		return
+	}
+
+	data := make([]ScheduleResponse, 0, len(schedules))
+	for _, sch := range schedules {
+		data = append(data, scheduleToResponse(sch))
+	}
+	response.SuccessResponse(w, data)
+}
+
+// createSchedule godoc
+//
+//	@Summary		Create a schedule
+//	@Description	Sets a state to a value whenever the cron expression fires in the given timezone (default UTC). Enabled unless enabled is false.
+//	@Tags			schedules
+//	@Accept			json
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			body	body		ScheduleRequest								true	"Schedule"
+//	@Success		201		{object}	response.JsonResponse{data=ScheduleResponse}	"Created schedule"
+//	@Failure		400		{object}	response.JsonResponse							"Invalid cron, timezone, catch_up or target value"
+//	@Failure		401		{object}	response.JsonResponse							"Unauthorized"
+//	@Failure		500		{object}	response.JsonResponse							"Internal error"
+//	@Router			/schedules [post]
+func (h *ScheduleHandler) createSchedule(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+	l.Info().Msg("Handling createSchedule request")
+
+	var body ScheduleRequest
+	if err := request.DecodeAndValidate(r, &body); err != nil {
+		l.Error().Err(err).Msg("createSchedule: validation failed")
+		response.ErrorResponse(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	sch, err := h.service.Create(ctx, requestToInput(body))
+	if err != nil {
+		l.Error().Err(err).Msg("createSchedule failed")
+		errorResponse(w, err)
+		return
+	}
+
+	response.CreatedResponse(w, scheduleToResponse(sch))
+}
+
+// getSchedule godoc
+//
+//	@Summary		Get a schedule
+//	@Tags			schedules
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			id	path		string										true	"Schedule ID"
+//	@Success		200	{object}	response.JsonResponse{data=ScheduleResponse}	"Schedule"
+//	@Failure		401	{object}	response.JsonResponse							"Unauthorized"
+//	@Failure		404	{object}	response.JsonResponse							"Schedule not found"
+//	@Router			/schedules/{id} [get]
+func (h *ScheduleHandler) getSchedule(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+	id := mux.Vars(r)["id"]
+	l.Info().Str("schedule_id", id).Msg("Handling getSchedule request")
+
+	sch, err := h.service.Get(ctx, id)
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+
+	response.SuccessResponse(w, scheduleToResponse(sch))
+}
+
+// updateSchedule godoc
+//
+//	@Summary		Replace a schedule
+//	@Description	Replaces the whole definition; the next run is computed from now
+//	@Tags			schedules
+//	@Accept			json
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			id		path		string										true	"Schedule ID"
+//	@Param			body	body		ScheduleRequest								true	"Schedule"
+//	@Success		200		{object}	response.JsonResponse{data=ScheduleResponse}	"Updated schedule"
+//	@Failure		400		{object}	response.JsonResponse							"Invalid cron, timezone, catch_up or target value"
+//	@Failure		401		{object}	response.JsonResponse							"Unauthorized"
+//	@Failure		404		{object}	response.JsonResponse							"Schedule not found"
+//	@Failure		500		{object}	response.JsonResponse							"Internal error"
+//	@Router			/schedules/{id} [put]
+func (h *ScheduleHandler) updateSchedule(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+	id := mux.Vars(r)["id"]
+	l.Info().Str("schedule_id", id).Msg("Handling updateSchedule request")
+
+	var body ScheduleRequest
+	if err := request.DecodeAndValidate(r, &body); err != nil {
+		l.Error().Err(err).Msg("updateSchedule: validation failed")
+		response.ErrorResponse(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	sch, err := h.service.Update(ctx, id, requestToInput(body))
+	if err != nil {
+		l.Error().Err(err).Msg("updateSchedule failed")
+		errorResponse(w, err)
+		return
+	}
+
+	response.SuccessResponse(w, scheduleToResponse(sch))
+}
+
+// deleteSchedule godoc
+//
+//	@Summary		Delete a schedule
+//	@Tags			schedules
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			id	path		string										true	"Schedule ID"
+//	@Success		200	{object}	response.JsonResponse{data=ScheduleResponse}	"Deleted schedule"
+//	@Failure		401	{object}	response.JsonResponse							"Unauthorized"
+//	@Failure		404	{object}	response.JsonResponse							"Schedule not found"
+//	@Failure		500	{object}	response.JsonResponse							"Internal error"
+//	@Router			/schedules/{id} [delete]
+func (h *ScheduleHandler) deleteSchedule(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	l := zerolog.Ctx(ctx)
+	id := mux.Vars(r)["id"]
+	l.Info().Str("schedule_id", id).Msg("Handling deleteSchedule request")
+
+	sch, err := h.service.Delete(ctx, id)
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+
+	response.SuccessResponse(w, scheduleToResponse(sch))
+}
@@ -0,0 +1,106 @@
+package schedule
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+type scheduleInput struct {
+	Name     string `json:"name,omitempty"     jsonschema:"Optional: human-readable name, e.g. Servers on at night"`
+	Cron     string `json:"cron"               jsonschema:"Standard five-field cron expression or descriptor, e.g. 0 22 * * * or @daily"`
+	Timezone string `json:"timezone,omitempty" jsonschema:"Optional: IANA timezone the cron expression is evaluated in, e.g. Asia/Jakarta (default UTC)"`
+	Type     string `json:"type"               jsonschema:"State type, e.g. switch"`
+	Key      string `json:"key"                jsonschema:"State key, e.g. server_1"`
+	Value    string `json:"value"              jsonschema:"Value to set when the schedule fires, e.g. on; must be accepted by the type (see list_state_types)"`
+	Enabled  *bool  `json:"enabled,omitempty"  jsonschema:"Optional: whether the schedule runs (default true)"`
+	CatchUp  string `json:"catch_up,omitempty" jsonschema:"Optional: what to do with a run missed while the service was down: skip or once (default from config)"`
+}
+
+type updateScheduleInput struct {
+	ID string `json:"id" jsonschema:"Schedule ID (see list_schedules)"`
+	scheduleInput
+}
+
+type deleteScheduleInput struct {
+	ID string `json:"id" jsonschema:"Schedule ID (see list_schedules)"`
+}
+
+func (in scheduleInput) toInput() Input {
+	return requestToInput(ScheduleRequest{
+		Name:     in.Name,
+		Cron:     in.Cron,
+		Timezone: in.Timezone,
+		Type:     in.Type,
+		Key:      in.Key,
+		Value:    in.Value,
+		Enabled:  in.Enabled,
+		CatchUp:  in.CatchUp,
+	})
+}
+
+func textResult(v any) *mcp.CallToolResult {
+	b, _ := json.Marshal(v)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(b)}},
+	}
+}
+
+func errResult(msg string) *mcp.CallToolResult {
+	return &mcp.CallToolResult{
+		IsError: true,
+		Content: []mcp.Content{&mcp.TextContent{Text: msg}},
+	}
+}
+
+// RegisterMCPTools registers the schedule tools on the given MCP server.
+func RegisterMCPTools(s *mcp.Server, svc *ScheduleService) {
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "list_schedules",
+		Description: "List schedules that set IoT states at recurring times, with their next run and the outcome of the last run.",
+	}, func(ctx context.Context, _ *mcp.CallToolRequest, _ struct{}) (*mcp.CallToolResult, any, error) {
+		schedules, err := svc.List(ctx)
+		if err != nil {
+			return errResult(err.Error()), nil, nil
+		}
+		data := make([]ScheduleResponse, 0, len(schedules))
+		for _, sch := range schedules {
+			data = append(data, scheduleToResponse(sch))
+		}
+		return textResult(data), nil, nil
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "create_schedule",
+		Description: "Create a schedule that sets an IoT state to a value whenever a cron expression fires, e.g. turn the servers on at 22:00 every night in Asia/Jakarta.",
+	}, func(ctx context.Context, _ *mcp.CallToolRequest, input scheduleInput) (*mcp.CallToolResult, any, error) {
+		sch, err := svc.Create(ctx, input.toInput())
+		if err != nil {
+			return errResult(err.Error()), nil, nil
+		}
+		return textResult(scheduleToResponse(sch)), nil, nil
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "update_schedule",
+		Description: "Replace the definition of a schedule, e.g. to change its time or disable it with enabled false. All fields are replaced.",
+	}, func(ctx context.Context, _ *mcp.CallToolRequest, input updateScheduleInput) (*mcp.CallToolResult, any, error) {
+		sch, err := svc.Update(ctx, input.ID, input.toInput())
+		if err != nil {
+			return errResult(err.Error()), nil, nil
+		}
+		return textResult(scheduleToResponse(sch)), nil, nil
+	})
+
+	mcp.AddTool(s, &mcp.Tool{
+		Name:        "delete_schedule",
+		Description: "Permanently delete a schedule. The state keeps its current value.",
+	}, func(ctx context.Context, _ *mcp.CallToolRequest, input deleteScheduleInput) (*mcp.CallToolResult, any, error) {
+		sch, err := svc.Delete(ctx, input.ID)
+		if err != nil {
+			return errResult(err.Error()), nil, nil
+		}
+		return textResult(scheduleToResponse(sch)), nil, nil
+	})
+}
@@ -0,0 +1,338 @@
+package schedule
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nurhudajoantama/hmauto/app/hmstt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/robfig/cron/v3"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+var ErrScheduleNotFound = errors.New("SCHEDULE NOT FOUND")
+var ErrInvalidSchedule = errors.New("INVALID SCHEDULE")
+
+var scheduleRunsTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "schedule_runs_total",
+		Help: "Total number of due schedule runs by outcome.",
+	},
+	[]string{"status"},
+)
+
+// cronParser accepts standard five-field expressions and descriptors such as
+// @daily. The timezone is a separate field of the schedule.
+var cronParser = cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// StateWriter is the part of the hmstt service schedules need.
+type StateWriter interface {
+	ValidateValue(tipe, key, value string) error
+	SetState(ctx context.Context, tipe, key, value string, description *string, meta *hmstt.StateMeta, ifMatch *hmstt.Precondition) (hmstt.StateEntry, error)
+}
+
+// ServiceConfig holds the scheduler policy. Zero values use the defaults.
+type ServiceConfig struct {
+	// CatchUp is the default policy for runs missed while the worker was
+	// down: CATCH_UP_SKIP or CATCH_UP_ONCE.
+	CatchUp string
+	// Grace is how late a run may be and still count as on time.
+	Grace time.Duration
+}
+
+type ScheduleService struct {
+	store   Store
+	states  StateWriter
+	catchUp string
+	grace   time.Duration
+}
+
+func NewService(store Store, states StateWriter, cfg *ServiceConfig) (*ScheduleService, error) {
+	if cfg == nil {
+		cfg = &ServiceConfig{}
+	}
+	catchUp := cfg.CatchUp
+	if catchUp == "" {
+		catchUp = CATCH_UP_SKIP
+	}
+	if !validCatchUp(catchUp) {
+		return nil, fmt.Errorf("schedules.catchUp must be %q or %q, got %q", CATCH_UP_SKIP, CATCH_UP_ONCE, catchUp)
+	}
+	grace := cfg.Grace
+	if grace == 0 {
+		grace = time.Minute
+	}
+	return &ScheduleService{
+		store:   store,
+		states:  states,
+		catchUp: catchUp,
+		grace:   grace,
+	}, nil
+}
+
+func validCatchUp(p string) bool {
+	return p == CATCH_UP_SKIP || p == CATCH_UP_ONCE
+}
+
+// Input is the user-editable part of a schedule.
+type Input struct {
+	Name     string
+	Cron     string
+	Timezone string
+	Type     string
+	Key      string
+	Value    string
+	Enabled  bool
+	CatchUp  string
+}
+
+// parse validates a cron expression and timezone.
+func parse(expr, timezone string) (cron.Schedule, *time.Location, error) {
+	if strings.HasPrefix(expr, "TZ=") || strings.HasPrefix(expr, "CRON_TZ=") {
+		return nil, nil, fmt.Errorf("%w: set the timezone field instead of a TZ prefix", ErrInvalidSchedule)
+	}
+	sched, err := cronParser.Parse(expr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: cron: %v", ErrInvalidSchedule, err)
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: timezone: %v", ErrInvalidSchedule, err)
+	}
+	return sched, loc, nil
+}
+
+// nextRun returns the first time the schedule fires after t.
+func nextRun(sch Schedule, t time.Time) (time.Time, error) {
+	cs, loc, err := parse(sch.Cron, sch.Timezone)
+	if err != nil {
+		return time.Time{}, err
+	}
+	next := cs.Next(t.In(loc))
+	if next.IsZero() {
+		return time.Time{}, fmt.Errorf("%w: cron never fires", ErrInvalidSchedule)
+	}
+	return next.UTC(), nil
+}
+
+func (s *ScheduleService) validate(in Input) (Input, error) {
+	if in.Timezone == "" {
+		in.Timezone = "UTC"
+	}
+	if in.Type == "" || in.Key == "" {
+		return in, fmt.Errorf("%w: type and key are required", ErrInvalidSchedule)
+	}
+	if in.CatchUp != "" && !validCatchUp(in.CatchUp) {
+		return in, fmt.Errorf("%w: catch_up must be %q or %q", ErrInvalidSchedule, CATCH_UP_SKIP, CATCH_UP_ONCE)
+	}
+	if _, _, err := parse(in.Cron, in.Timezone); err != nil {
+		return in, err
+	}
+	if err := s.states.ValidateValue(in.Type, in.Key, in.Value); err != nil {
+		return in, fmt.Errorf("%w: %v", ErrInvalidSchedule, err)
+	}
+	return in, nil
+}
+
+func (s *ScheduleService) List(ctx context.Context) ([]Schedule, error) {
+	schedules, err := s.store.List(ctx)
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("List schedules failed")
+		return nil, errors.New("LIST SCHEDULES ERROR")
+	}
+	return schedules, nil
+}
+
+func (s *ScheduleService) Get(ctx context.Context, id string) (Schedule, error) {
+	sch, err := s.store.Get(ctx, id)
+	if err != nil {
+		if errors.Is(err, ErrScheduleNotFound) {
+			return Schedule{}, ErrScheduleNotFound
+		}
+		zerolog.Ctx(ctx).Error().Err(err).Msg("Get schedule failed")
+		return Schedule{}, errors.New("GET SCHEDULE ERROR")
+	}
+	return sch, nil
+}
+
+func (s *ScheduleService) Create(ctx context.Context, in Input) (Schedule, error) {
+	l := zerolog.Ctx(ctx)
+	l.Info().Str("cron", in.Cron).Str("hmstt_type", in.Type).Str("hmstt_key", in.Key).Msg("Handling Create schedule service")
+
+	in, err := s.validate(in)
+	if err != nil {
+		return Schedule{}, err
+	}
+	now := time.Now().UTC()
+	sch := Schedule{
+		ID:        xid.New().String(),
+		CreatedAt: now,
+	}
+	return s.save(ctx, sch, in, now)
+}
+
+// Update replaces the definition of a schedule. The next run is computed
+// afresh from now.
+func (s *ScheduleService) Update(ctx context.Context, id string, in Input) (Schedule, error) {
+	l := zerolog.Ctx(ctx)
+	l.Info().Str("schedule_id", id).Msg("Handling Update schedule service")
+
+	in, err := s.validate(in)
+	if err != nil {
+		return Schedule{}, err
+	}
+	sch, err := s.Get(ctx, id)
+	if err != nil {
+		return Schedule{}, err
+	}
+	return s.save(ctx, sch, in, time.Now().UTC())
+}
+
+func (s *ScheduleService) save(ctx context.Context, sch Schedule, in Input, now time.Time) (Schedule, error) {
+	sch.Name = in.Name
+	sch.Cron = in.Cron
+	sch.Timezone = in.Timezone
+	sch.Type = in.Type
+	sch.Key = in.Key
+	sch.Value = in.Value
+	sch.Enabled = in.Enabled
+	sch.CatchUp = in.CatchUp
+	sch.UpdatedAt = now
+
+	next, err := nextRun(sch, now)
+	if err != nil {
+		return Schedule{}, err
+	}
+	if err := s.store.Put(ctx, sch, next); err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("Put schedule failed")
+		return Schedule{}, errors.New("SAVE SCHEDULE ERROR")
+	}
+	sch.NextRunAt = time.Time{}
+	if sch.Enabled {
+		sch.NextRunAt = next
+	}
+	return sch, nil
+}
+
+func (s *ScheduleService) Delete(ctx context.Context, id string) (Schedule, error) {
+	l := zerolog.Ctx(ctx)
+	l.Info().Str("schedule_id", id).Msg("Handling Delete schedule service")
+
+	sch, err := s.Get(ctx, id)
+	if err != nil {
+		return Schedule{}, err
+	}
+	if err := s.store.Delete(ctx, id); err != nil {
+		if errors.Is(err, ErrScheduleNotFound) {
+			return Schedule{}, ErrScheduleNotFound
+		}
+		l.Error().Err(err).Msg("Delete schedule failed")
+		return Schedule{}, errors.New("DELETE SCHEDULE ERROR")
+	}
+	return sch, nil
+}
+
+// Run executes due schedules every interval until ctx is cancelled.
+func (s *ScheduleService) Run(ctx context.Context, interval time.Duration) error {
+	l := log.With().Str("component", "schedules").Logger()
+	ctx = l.WithContext(ctx)
+
+	s.requeue(ctx)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		claims, err := s.store.ClaimDue(ctx, now)
+		if err != nil {
+			l.Error().Err(err).Msg("claiming due schedules failed")
+			continue
+		}
+		for _, c := range claims {
+			s.fire(ctx, c, now)
+		}
+	}
+}
+
+// requeue puts enabled schedules that are missing from the run queue back
+// on it, e.g. after a crash between claiming and finishing a run. Their last
+// planned run is used, so the catch-up policy decides about it.
+func (s *ScheduleService) requeue(ctx context.Context) {
+	l := zerolog.Ctx(ctx)
+	schedules, err := s.store.List(ctx)
+	if err != nil {
+		l.Error().Err(err).Msg("listing schedules to requeue failed")
+		return
+	}
+	for _, sch := range schedules {
+		if !sch.Enabled || !sch.NextRunAt.IsZero() {
+			continue
+		}
+		from := sch.UpdatedAt
+		if sch.LastRun != nil && sch.LastRun.Planned.After(from) {
+			from = sch.LastRun.Planned
+		}
+		next, err := nextRun(sch, from)
+		if err != nil {
+			l.Error().Err(err).Str("schedule_id", sch.ID).Msg("schedule no longer valid")
+			continue
+		}
+		if err := s.store.Enqueue(ctx, sch.ID, next); err != nil {
+			l.Error().Err(err).Str("schedule_id", sch.ID).Msg("requeueing schedule failed")
+		}
+	}
+}
+
+// fire applies one due run. A run later than the grace period was missed,
+// e.g. while the service was down; the catch-up policy decides whether it
+// still happens. Several missed runs of one schedule collapse into one.
+func (s *ScheduleService) fire(ctx context.Context, c Claim, now time.Time) {
+	sch := c.Schedule
+	l := zerolog.Ctx(ctx).With().Str("schedule_id", sch.ID).Str("hmstt_type", sch.Type).Str("hmstt_key", sch.Key).Logger()
+	if !sch.Enabled {
+		return
+	}
+
+	policy := sch.CatchUp
+	if policy == "" {
+		policy = s.catchUp
+	}
+
+	run := Run{At: now.UTC(), Planned: c.Planned}
+	if now.Sub(c.Planned) > s.grace && policy == CATCH_UP_SKIP {
+		run.Status = RUN_STATUS_MISSED
+		l.Warn().Time("planned", c.Planned).Msg("schedule run missed, skipping")
+	} else {
+		callerCtx := hmstt.WithCaller(l.WithContext(ctx), CALLER_PREFIX+sch.ID)
+		if _, err := s.states.SetState(callerCtx, sch.Type, sch.Key, sch.Value, nil, nil, nil); err != nil {
+			run.Status = RUN_STATUS_FAILED
+			run.Error = err.Error()
+			l.Error().Err(err).Msg("schedule run failed")
+		} else {
+			run.Status = RUN_STATUS_OK
+			l.Info().Str("hmstt_value", sch.Value).Msg("schedule run applied")
+		}
+	}
+	scheduleRunsTotal.WithLabelValues(run.Status).Inc()
+
+	next, err := nextRun(sch, now)
+	if err != nil {
+		l.Error().Err(err).Msg("schedule no longer valid, not requeued")
+		return
+	}
+	if err := s.store.FinishRun(ctx, sch, run, next); err != nil {
+		l.Error().Err(err).Msg("finishing schedule run failed")
+	}
+}
@@ -0,0 +1,273 @@
+package schedule
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nurhudajoantama/hmauto/app/hmstt"
+)
+
+type fakeStore struct {
+	mu    sync.Mutex
+	defs  map[string]Schedule
+	queue map[string]time.Time
+	runs  map[string]Run
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		defs:  map[string]Schedule{},
+		queue: map[string]time.Time{},
+		runs:  map[string]Run{},
+	}
+}
+
+func (f *fakeStore) Put(_ context.Context, sch Schedule, nextRun time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.defs[sch.ID] = sch
+	if sch.Enabled {
+		f.queue[sch.ID] = nextRun
+	} else {
+		delete(f.queue, sch.ID)
+	}
+	return nil
+}
+
+func (f *fakeStore) Get(_ context.Context, id string) (Schedule, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sch, ok := f.defs[id]
+	if !ok {
+		return Schedule{}, ErrScheduleNotFound
+	}
+	sch.NextRunAt = f.queue[id]
+	if run, ok := f.runs[id]; ok {
+		sch.LastRun = &run
+	}
+	return sch, nil
+}
+
+func (f *fakeStore) List(ctx context.Context) ([]Schedule, error) {
+	var out []Schedule
+	for id := range f.defs {
+		sch, _ := f.Get(ctx, id)
+		out = append(out, sch)
+	}
+	return out, nil
+}
+
+func (f *fakeStore) Delete(_ context.Context, id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.defs[id]; !ok {
+		return ErrScheduleNotFound
+	}
+	delete(f.defs, id)
+	delete(f.queue, id)
+	delete(f.runs, id)
+	return nil
+}
+
+func (f *fakeStore) ClaimDue(_ context.Context, now time.Time) ([]Claim, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var claims []Claim
+	for id, at := range f.queue {
+		if !at.After(now) {
+			delete(f.queue, id)
+			claims = append(claims, Claim{Schedule: f.defs[id], Planned: at})
+		}
+	}
+	return claims, nil
+}
+
+func (f *fakeStore) FinishRun(_ context.Context, sch Schedule, run Run, nextRun time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	current, ok := f.defs[sch.ID]
+	if !ok {
+		return nil
+	}
+	f.runs[sch.ID] = run
+	if current.UpdatedAt.Equal(sch.UpdatedAt) {
+		f.queue[sch.ID] = nextRun
+	}
+	return nil
+}
+
+func (f *fakeStore) Enqueue(_ context.Context, id string, nextRun time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.queue[id]; !ok {
+		f.queue[id] = nextRun
+	}
+	return nil
+}
+
+// fakeStates accepts on and off for switch states and records writes.
+type fakeStates struct {
+	mu      sync.Mutex
+	writes  []string
+	callers []string
+}
+
+func (f *fakeStates) ValidateValue(tipe, key, value string) error {
+	if tipe != "switch" || (value != "on" && value != "off") {
+		return hmstt.ErrInvalidValue
+	}
+	return nil
+}
+
+func (f *fakeStates) SetState(ctx context.Context, tipe, key, value string, _ *string, _ *hmstt.StateMeta, _ *hmstt.Precondition) (hmstt.StateEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.writes = append(f.writes, tipe+"/"+key+"="+value)
+	f.callers = append(f.callers, hmstt.CallerFromContext(ctx))
+	return hmstt.StateEntry{Type: tipe, K: key, Value: value}, nil
+}
+
+func nightly() Input {
+	return Input{
+		Name:     "servers on",
+		Cron:     "0 22 * * *",
+		Timezone: "Asia/Jakarta",
+		Type:     "switch",
+		Key:      "server_1",
+		Value:    "on",
+		Enabled:  true,
+	}
+}
+
+func TestCreateValidates(t *testing.T) {
+	ctx := context.Background()
+	svc, err := NewService(newFakeStore(), &fakeStates{}, nil)
+	if err != nil {
+		t.Fatalf("NewService() error = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*Input)
+	}{
+		{"bad cron", func(in *Input) { in.Cron = "0 25 * * *" }},
+		{"seconds field", func(in *Input) { in.Cron = "0 0 22 * * *" }},
+		{"tz prefix", func(in *Input) { in.Cron = "CRON_TZ=UTC 0 22 * * *" }},
+		{"bad timezone", func(in *Input) { in.Timezone = "Mars/Olympus" }},
+		{"bad catch_up", func(in *Input) { in.CatchUp = "all" }},
+		{"value rejected by type", func(in *Input) { in.Value = "maybe" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := nightly()
+			tt.modify(&in)
+			if _, err := svc.Create(ctx, in); !errors.Is(err, ErrInvalidSchedule) {
+				t.Fatalf("Create() error = %v, want ErrInvalidSchedule", err)
+			}
+		})
+	}
+
+	t.Run("next run in the schedule's timezone", func(t *testing.T) {
+		sch, err := svc.Create(ctx, nightly())
+		if err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+		// 22:00 in Jakarta (UTC+7) is 15:00 UTC.
+		if sch.NextRunAt.Hour() != 15 || sch.NextRunAt.Minute() != 0 {
+			t.Fatalf("NextRunAt = %v, want 15:00 UTC", sch.NextRunAt)
+		}
+	})
+}
+
+func TestFire(t *testing.T) {
+	ctx := context.Background()
+
+	setup := func(t *testing.T, cfg *ServiceConfig, in Input) (*ScheduleService, *fakeStore, *fakeStates, Schedule) {
+		t.Helper()
+		store, states := newFakeStore(), &fakeStates{}
+		svc, err := NewService(store, states, cfg)
+		if err != nil {
+			t.Fatalf("NewService() error = %v", err)
+		}
+		sch, err := svc.Create(ctx, in)
+		if err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+		return svc, store, states, sch
+	}
+
+	t.Run("applies an on-time run and requeues", func(t *testing.T) {
+		svc, store, states, sch := setup(t, nil, nightly())
+
+		now := sch.NextRunAt.Add(time.Second)
+		claims, _ := store.ClaimDue(ctx, now)
+		if len(claims) != 1 {
+			t.Fatalf("claims = %d, want 1", len(claims))
+		}
+		svc.fire(ctx, claims[0], now)
+
+		if len(states.writes) != 1 || states.writes[0] != "switch/server_1=on" {
+			t.Fatalf("writes = %v", states.writes)
+		}
+		if states.callers[0] != CALLER_PREFIX+sch.ID {
+			t.Fatalf("caller = %q, want %q", states.callers[0], CALLER_PREFIX+sch.ID)
+		}
+		got, _ := svc.Get(ctx, sch.ID)
+		if got.LastRun == nil || got.LastRun.Status != RUN_STATUS_OK {
+			t.Fatalf("LastRun = %+v, want ok", got.LastRun)
+		}
+		if want := sch.NextRunAt.Add(24 * time.Hour); !got.NextRunAt.Equal(want) {
+			t.Fatalf("NextRunAt = %v, want %v", got.NextRunAt, want)
+		}
+	})
+
+	t.Run("skips a missed run by default", func(t *testing.T) {
+		svc, store, states, sch := setup(t, nil, nightly())
+
+		now := sch.NextRunAt.Add(time.Hour)
+		claims, _ := store.ClaimDue(ctx, now)
+		svc.fire(ctx, claims[0], now)
+
+		if len(states.writes) != 0 {
+			t.Fatalf("writes = %v, want none", states.writes)
+		}
+		got, _ := svc.Get(ctx, sch.ID)
+		if got.LastRun == nil || got.LastRun.Status != RUN_STATUS_MISSED {
+			t.Fatalf("LastRun = %+v, want missed", got.LastRun)
+		}
+	})
+
+	t.Run("runs several missed runs once with catch_up once", func(t *testing.T) {
+		in := nightly()
+		in.CatchUp = CATCH_UP_ONCE
+		svc, store, states, sch := setup(t, nil, in)
+
+		now := sch.NextRunAt.Add(72 * time.Hour)
+		claims, _ := store.ClaimDue(ctx, now)
+		svc.fire(ctx, claims[0], now)
+
+		if len(states.writes) != 1 {
+			t.Fatalf("writes = %v, want one", states.writes)
+		}
+		got, _ := svc.Get(ctx, sch.ID)
+		if !got.NextRunAt.After(now) {
+			t.Fatalf("NextRunAt = %v, want after %v", got.NextRunAt, now)
+		}
+	})
+
+	t.Run("disabled schedules are not queued", func(t *testing.T) {
+		in := nightly()
+		in.Enabled = false
+		_, store, _, sch := setup(t, nil, in)
+
+		if !sch.NextRunAt.IsZero() {
+			t.Fatalf("NextRunAt = %v, want none", sch.NextRunAt)
+		}
+		if claims, _ := store.ClaimDue(ctx, time.Now().Add(48*time.Hour)); len(claims) != 0 {
+			t.Fatalf("claims = %d, want 0", len(claims))
+		}
+	})
+}
@@ -0,0 +1,377 @@
+package schedule
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+)
+
+// Schedule sets a state to Value whenever its cron expression fires.
+type Schedule struct {
+	ID       string
+	Name     string
+	Cron     string
+	Timezone string
+	Type     string
+	Key      string
+	Value    string
+	Enabled  bool
+	// CatchUp overrides the configured catch-up policy when set.
+	CatchUp   string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	// NextRunAt and LastRun are read from the run queue and run log; they are
+	// not part of the stored definition.
+	NextRunAt time.Time
+	LastRun   *Run
+}
+
+// Run is the outcome of one due run of a schedule.
+type Run struct {
+	At      time.Time
+	Planned time.Time
+	Status  string
+	Error   string
+}
+
+// Claim is a schedule taken from the run queue together with the time it was
+// due.
+type Claim struct {
+	Schedule Schedule
+	Planned  time.Time
+}
+
+type Store interface {
+	Put(ctx context.Context, sch Schedule, nextRun time.Time) error
+	Get(ctx context.Context, id string) (Schedule, error)
+	List(ctx context.Context) ([]Schedule, error)
+	Delete(ctx context.Context, id string) error
+	// ClaimDue removes due schedules from the run queue and returns them.
+	ClaimDue(ctx context.Context, now time.Time) ([]Claim, error)
+	// FinishRun records run and queues the claimed schedule for nextRun,
+	// unless it was deleted or changed in the meantime.
+	FinishRun(ctx context.Context, sch Schedule, run Run, nextRun time.Time) error
+	// Enqueue queues a schedule for nextRun if it is not queued already.
+	Enqueue(ctx context.Context, id string, nextRun time.Time) error
+}
+
+type scheduleJSON struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Cron      string    `json:"cron"`
+	Timezone  string    `json:"timezone"`
+	Type      string    `json:"type"`
+	Key       string    `json:"key"`
+	Value     string    `json:"value"`
+	Enabled   bool      `json:"enabled"`
+	CatchUp   string    `json:"catch_up,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type runJSON struct {
+	At      time.Time `json:"at"`
+	Planned time.Time `json:"planned"`
+	Status  string    `json:"status"`
+	Error   string    `json:"error,omitempty"`
+}
+
+func encodeSchedule(sch Schedule) ([]byte, error) {
+	return json.Marshal(scheduleJSON{
+		ID:        sch.ID,
+		Name:      sch.Name,
+		Cron:      sch.Cron,
+		Timezone:  sch.Timezone,
+		Type:      sch.Type,
+		Key:       sch.Key,
+		Value:     sch.Value,
+		Enabled:   sch.Enabled,
+		CatchUp:   sch.CatchUp,
+		CreatedAt: sch.CreatedAt,
+		UpdatedAt: sch.UpdatedAt,
+	})
+}
+
+func decodeSchedule(data []byte) (Schedule, error) {
+	var raw scheduleJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return Schedule{}, err
+	}
+	return Schedule{
+		ID:        raw.ID,
+		Name:      raw.Name,
+		Cron:      raw.Cron,
+		Timezone:  raw.Timezone,
+		Type:      raw.Type,
+		Key:       raw.Key,
+		Value:     raw.Value,
+		Enabled:   raw.Enabled,
+		CatchUp:   raw.CatchUp,
+		CreatedAt: raw.CreatedAt,
+		UpdatedAt: raw.UpdatedAt,
+	}, nil
+}
+
+func decodeRun(data []byte) (*Run, error) {
+	var raw runJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	run := Run(raw)
+	return &run, nil
+}
+
+type ScheduleStore struct {
+	rdb    *redis.Client
+	prefix string
+}
+
+func NewStore(rdb *redis.Client, prefix string) *ScheduleStore {
+	return &ScheduleStore{
+		rdb:    rdb,
+		prefix: prefix,
+	}
+}
+
+func (s *ScheduleStore) defsKey() string {
+	return s.prefix + ":schedules"
+}
+
+func (s *ScheduleStore) queueKey() string {
+	return s.prefix + ":schedule_due"
+}
+
+func (s *ScheduleStore) runsKey() string {
+	return s.prefix + ":schedule_runs"
+}
+
+// Put writes the definition. Enabled schedules are queued for nextRun,
+// disabled ones are taken off the queue.
+func (s *ScheduleStore) Put(ctx context.Context, sch Schedule, nextRun time.Time) error {
+	ctx, span := otel.Tracer("schedule").Start(ctx, "store.Put")
+	defer span.End()
+
+	data, err := encodeSchedule(sch)
+	if err != nil {
+		return fmt.Errorf("marshal schedule: %w", err)
+	}
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, s.defsKey(), sch.ID, data)
+		if sch.Enabled {
+			pipe.ZAdd(ctx, s.queueKey(), redis.Z{Score: float64(nextRun.UnixMilli()), Member: sch.ID})
+		} else {
+			pipe.ZRem(ctx, s.queueKey(), sch.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("redis HSET/ZADD schedule: %w", err)
+	}
+	return nil
+}
+
+func (s *ScheduleStore) Get(ctx context.Context, id string) (Schedule, error) {
+	ctx, span := otel.Tracer("schedule").Start(ctx, "store.Get")
+	defer span.End()
+
+	var (
+		defCmd   *redis.StringCmd
+		scoreCmd *redis.FloatCmd
+		runCmd   *redis.StringCmd
+	)
+	_, err := s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		defCmd = pipe.HGet(ctx, s.defsKey(), id)
+		scoreCmd = pipe.ZScore(ctx, s.queueKey(), id)
+		runCmd = pipe.HGet(ctx, s.runsKey(), id)
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return Schedule{}, fmt.Errorf("redis HGET schedule: %w", err)
+	}
+	data, err := defCmd.Bytes()
+	if errors.Is(err, redis.Nil) {
+		return Schedule{}, ErrScheduleNotFound
+	}
+	if err != nil {
+		return Schedule{}, fmt.Errorf("redis HGET schedule: %w", err)
+	}
+	sch, err := decodeSchedule(data)
+	if err != nil {
+		return Schedule{}, fmt.Errorf("unmarshal schedule: %w", err)
+	}
+	if score, err := scoreCmd.Result(); err == nil {
+		sch.NextRunAt = time.UnixMilli(int64(score)).UTC()
+	}
+	if data, err := runCmd.Bytes(); err == nil {
+		sch.LastRun, _ = decodeRun(data)
+	}
+	return sch, nil
+}
+
+// List returns all schedules ordered by name.
+func (s *ScheduleStore) List(ctx context.Context) ([]Schedule, error) {
+	ctx, span := otel.Tracer("schedule").Start(ctx, "store.List")
+	defer span.End()
+
+	var (
+		defsCmd  *redis.MapStringStringCmd
+		queueCmd *redis.ZSliceCmd
+		runsCmd  *redis.MapStringStringCmd
+	)
+	_, err := s.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		defsCmd = pipe.HGetAll(ctx, s.defsKey())
+		queueCmd = pipe.ZRangeWithScores(ctx, s.queueKey(), 0, -1)
+		runsCmd = pipe.HGetAll(ctx, s.runsKey())
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("redis HGETALL schedules: %w", err)
+	}
+
+	next := make(map[string]time.Time, len(queueCmd.Val()))
+	for _, z := range queueCmd.Val() {
+		if id, ok := z.Member.(string); ok {
+			next[id] = time.UnixMilli(int64(z.Score)).UTC()
+		}
+	}
+	runs := runsCmd.Val()
+
+	schedules := make([]Schedule, 0, len(defsCmd.Val()))
+	for id, v := range defsCmd.Val() {
+		sch, err := decodeSchedule([]byte(v))
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal schedule %s: %w", id, err)
+		}
+		sch.NextRunAt = next[id]
+		if data, ok := runs[id]; ok {
+			sch.LastRun, _ = decodeRun([]byte(data))
+		}
+		schedules = append(schedules, sch)
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		if schedules[i].Name != schedules[j].Name {
+			return schedules[i].Name < schedules[j].Name
+		}
+		return schedules[i].ID < schedules[j].ID
+	})
+	return schedules, nil
+}
+
+// Delete removes a schedule. It returns ErrScheduleNotFound if it does not exist.
+func (s *ScheduleStore) Delete(ctx context.Context, id string) error {
+	ctx, span := otel.Tracer("schedule").Start(ctx, "store.Delete")
+	defer span.End()
+
+	var removed *redis.IntCmd
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		removed = pipe.HDel(ctx, s.defsKey(), id)
+		pipe.ZRem(ctx, s.queueKey(), id)
+		pipe.HDel(ctx, s.runsKey(), id)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("redis HDEL schedule: %w", err)
+	}
+	if removed.Val() == 0 {
+		return ErrScheduleNotFound
+	}
+	return nil
+}
+
+// claimDueScript pops the schedules due at or before ARGV[1] from the queue
+// and returns id, due score and definition for each. Popping and reading
+// happen in one step, so with several instances each run is claimed once.
+var claimDueScript = redis.NewScript(`
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'WITHSCORES', 'LIMIT', 0, ARGV[2])
+local out = {}
+for i = 1, #due, 2 do
+	local id = due[i]
+	redis.call('ZREM', KEYS[1], id)
+	local data = redis.call('HGET', KEYS[2], id)
+	if data then
+		table.insert(out, id)
+		table.insert(out, due[i + 1])
+		table.insert(out, data)
+	end
+end
+return out
+`)
+
+const claimBatch = 100
+
+func (s *ScheduleStore) ClaimDue(ctx context.Context, now time.Time) ([]Claim, error) {
+	ctx, span := otel.Tracer("schedule").Start(ctx, "store.ClaimDue")
+	defer span.End()
+
+	result, err := claimDueScript.Run(ctx, s.rdb, []string{s.queueKey(), s.defsKey()},
+		strconv.FormatInt(now.UnixMilli(), 10), claimBatch).StringSlice()
+	if err != nil {
+		return nil, fmt.Errorf("redis claim schedules script: %w", err)
+	}
+	claims := make([]Claim, 0, len(result)/3)
+	for i := 0; i+2 < len(result); i += 3 {
+		sch, err := decodeSchedule([]byte(result[i+2]))
+		if err != nil {
+			log.Error().Err(err).Str("schedule_id", result[i]).Msg("dropping undecodable schedule")
+			continue
+		}
+		ms, _ := strconv.ParseFloat(result[i+1], 64)
+		claims = append(claims, Claim{Schedule: sch, Planned: time.UnixMilli(int64(ms)).UTC()})
+	}
+	return claims, nil
+}
+
+// finishRunScript stores the run and requeues the schedule, but only while
+// its definition is still the one that was claimed. A deleted schedule stays
+// gone; an updated one was already queued by Put.
+var finishRunScript = redis.NewScript(`
+local def = redis.call('HGET', KEYS[1], ARGV[1])
+if not def then
+	return 0
+end
+redis.call('HSET', KEYS[3], ARGV[1], ARGV[2])
+if def == ARGV[4] then
+	redis.call('ZADD', KEYS[2], ARGV[3], ARGV[1])
+end
+return 1
+`)
+
+func (s *ScheduleStore) FinishRun(ctx context.Context, sch Schedule, run Run, nextRun time.Time) error {
+	ctx, span := otel.Tracer("schedule").Start(ctx, "store.FinishRun")
+	defer span.End()
+
+	data, err := json.Marshal(runJSON(run))
+	if err != nil {
+		return fmt.Errorf("marshal run: %w", err)
+	}
+	def, err := encodeSchedule(sch)
+	if err != nil {
+		return fmt.Errorf("marshal schedule: %w", err)
+	}
+	err = finishRunScript.Run(ctx, s.rdb, []string{s.defsKey(), s.queueKey(), s.runsKey()},
+		sch.ID, data, nextRun.UnixMilli(), def).Err()
+	if err != nil {
+		return fmt.Errorf("redis finish run script: %w", err)
+	}
+	return nil
+}
+
+func (s *ScheduleStore) Enqueue(ctx context.Context, id string, nextRun time.Time) error {
+	ctx, span := otel.Tracer("schedule").Start(ctx, "store.Enqueue")
+	defer span.End()
+
+	err := s.rdb.ZAddNX(ctx, s.queueKey(), redis.Z{Score: float64(nextRun.UnixMilli()), Member: id}).Err()
+	if err != nil {
+		return fmt.Errorf("redis ZADD NX schedule: %w", err)
+	}
+	return nil
+}
@@ -49,6 +49,7 @@ func (m *MCPServer) Start(ctx context.Context) error {
 	}, nil)
 
 	var h http.Handler = mcpHandler
+	h = hlog.RequestIDHandler("request_id", "X-Request-ID")(h)
 	h = hlog.NewHandler(log.Logger)(h)
 	h = middleware.QueryTokenAuth(m.token)(h)
 
@@ -20,6 +20,7 @@ type ServerConfig struct {
 	BearerToken    string
 	MaxRequestSize int64
 	RateLimiter    *middleware.RateLimiter
+	TrustedProxies middleware.TrustedProxies
 }
 
 // Server wraps an http.Server and a mux.Router.
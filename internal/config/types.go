@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"time"
 )
 
 type TCPServer struct {
@@ -48,6 +49,10 @@ type Security struct {
 	MaxRequestSize  int64  `yaml:"maxRequestSize"`  // in bytes
 	RateLimitPerMin int    `yaml:"rateLimitPerMin"` // requests per minute
 	RateLimitBurst  int    `yaml:"rateLimitBurst"`  // max burst size
+	// TrustedProxies are the IPs or CIDR ranges of reverse proxies whose
+	// X-Forwarded-For header is believed; without any, the peer address is
+	// the client.
+	TrustedProxies []string `yaml:"trustedProxies"`
 }
 
 func (s Security) ValidateAuthTokens() error {
@@ -93,16 +98,186 @@ type OTel struct {
 	Enabled     bool   `yaml:"enabled"`
 }
 
+// StateType declares a state type and the values it accepts.
+// Which fields apply depends on Kind: Values for enum, Min/Max for int and
+// float, Step for int, Pattern for text, Schema for json.
+type StateType struct {
+	Name    string   `yaml:"name"`
+	Kind    string   `yaml:"kind"` // enum, int, float, bool, text, json
+	Values  []string `yaml:"values"`
+	Min     *float64 `yaml:"min"`
+	Max     *float64 `yaml:"max"`
+	Step    int64    `yaml:"step"`
+	Pattern string   `yaml:"pattern"`
+	Schema  string   `yaml:"schema"` // JSON Schema document, as a JSON string
+}
+
+// StateConstraint declares an interlock between states, given as type/key.
+// Which fields apply depends on Kind: States for exclusive (at most one of
+// them active), States and Requires for requires (States may only be active
+// while Requires is), Group and Max for max_on (at most Max active members).
+// Active is the value that counts as active, "on" by default.
+type StateConstraint struct {
+	Name     string   `yaml:"name"`
+	Kind     string   `yaml:"kind"` // exclusive, requires, max_on
+	States   []string `yaml:"states"`
+	Requires string   `yaml:"requires"`
+	Group    string   `yaml:"group"`
+	Max      int      `yaml:"max"`
+	Active   string   `yaml:"active"`
+}
+
+// History configures retention of per-key state change history.
+type History struct {
+	MaxLen int64         `yaml:"maxLen"` // max records kept per key (approximate)
+	MaxAge time.Duration `yaml:"maxAge"` // records older than this are trimmed; 0 keeps them
+}
+
+func (h History) GetMaxLen() int64 {
+	if h.MaxLen == 0 {
+		return 1000
+	}
+	return h.MaxLen
+}
+
+// Timers configures the worker that applies the revert and cycle timers of
+// SetStateFor and CycleState.
+type Timers struct {
+	PollInterval time.Duration `yaml:"pollInterval"` // how often due timers are checked
+}
+
+func (t Timers) GetPollInterval() time.Duration {
+	if t.PollInterval == 0 {
+		return time.Second
+	}
+	return t.PollInterval
+}
+
+// Schedules configures the cron schedule worker.
+type Schedules struct {
+	CatchUp      string        `yaml:"catchUp"`      // skip or once: what to do with runs missed while down
+	Grace        time.Duration `yaml:"grace"`        // how late a run may be and still count as on time
+	PollInterval time.Duration `yaml:"pollInterval"` // how often due schedules are checked
+}
+
+func (s Schedules) GetPollInterval() time.Duration {
+	if s.PollInterval == 0 {
+		return time.Second
+	}
+	return s.PollInterval
+}
+
+// Rules configures the automation rule engine.
+type Rules struct {
+	MaxChainDepth   int           `yaml:"maxChainDepth"`   // how many rules may trigger each other in a row
+	DefaultCooldown time.Duration `yaml:"defaultCooldown"` // cooldown of rules created without one
+	PollInterval    time.Duration `yaml:"pollInterval"`    // how often due delayed actions are checked
+}
+
+func (r Rules) GetPollInterval() time.Duration {
+	if r.PollInterval == 0 {
+		return time.Second
+	}
+	return r.PollInterval
+}
+
+// Reports configures the consumer of values reported by devices.
+type Reports struct {
+	Enabled    bool   `yaml:"enabled"`
+	Queue      string `yaml:"queue"`      // durable queue bound to amq.topic
+	RoutingKey string `yaml:"routingKey"` // binding pattern; the last two segments are type and key
+	Prefetch   int    `yaml:"prefetch"`   // unacknowledged deliveries in flight
+}
+
+func (r Reports) GetQueue() string {
+	if r.Queue == "" {
+		return "hmauto_reports"
+	}
+	return r.Queue
+}
+
+func (r Reports) GetRoutingKey() string {
+	if r.RoutingKey == "" {
+		return "hmstt_report.hmstt.*.*"
+	}
+	return r.RoutingKey
+}
+
+func (r Reports) GetPrefetch() int {
+	if r.Prefetch == 0 {
+		return 10
+	}
+	return r.Prefetch
+}
+
+// Commands configures delivery tracking of published state values.
+type Commands struct {
+	Enabled      bool          `yaml:"enabled"`
+	AckTimeout   time.Duration `yaml:"ackTimeout"`   // wait for the device report before the first retry; doubles per retry
+	MaxRetries   int           `yaml:"maxRetries"`   // republishes before a command is marked failed
+	PollInterval time.Duration `yaml:"pollInterval"` // how often overdue commands are checked
+}
+
+func (c Commands) GetAckTimeout() time.Duration {
+	if c.AckTimeout == 0 {
+		return 10 * time.Second
+	}
+	return c.AckTimeout
+}
+
+func (c Commands) GetMaxRetries() int {
+	if c.MaxRetries == 0 {
+		return 3
+	}
+	return c.MaxRetries
+}
+
+func (c Commands) GetPollInterval() time.Duration {
+	if c.PollInterval == 0 {
+		return time.Second
+	}
+	return c.PollInterval
+}
+
+// Devices configures the device registry.
+type Devices struct {
+	OfflineAfter    time.Duration `yaml:"offlineAfter"`    // silence after which a device is offline
+	RefreshInterval time.Duration `yaml:"refreshInterval"` // how often the registry is reloaded from Redis
+}
+
+func (d Devices) GetOfflineAfter() time.Duration {
+	if d.OfflineAfter == 0 {
+		return time.Minute
+	}
+	return d.OfflineAfter
+}
+
+func (d Devices) GetRefreshInterval() time.Duration {
+	if d.RefreshInterval == 0 {
+		return 5 * time.Second
+	}
+	return d.RefreshInterval
+}
+
 type Config struct {
-	HTTP           TCPServer `yaml:"http"`
-	MCP            TCPServer `yaml:"mcp"`
-	Log            Logging   `yaml:"log"`
-	Redis          Redis     `yaml:"redis"`
-	MQTT           MQTT      `yaml:"mqtt"`
-	Security       Security  `yaml:"security"`
-	Sentry         Sentry    `yaml:"sentry"`
-	OTel           OTel      `yaml:"otel"`
-	RedisKeyPrefix string    `yaml:"redisKeyPrefix"`
+	HTTP           TCPServer         `yaml:"http"`
+	MCP            TCPServer         `yaml:"mcp"`
+	Log            Logging           `yaml:"log"`
+	Redis          Redis             `yaml:"redis"`
+	MQTT           MQTT              `yaml:"mqtt"`
+	Security       Security          `yaml:"security"`
+	Sentry         Sentry            `yaml:"sentry"`
+	OTel           OTel              `yaml:"otel"`
+	RedisKeyPrefix string            `yaml:"redisKeyPrefix"`
+	Types          []StateType       `yaml:"types"`
+	Constraints    []StateConstraint `yaml:"constraints"`
+	History        History           `yaml:"history"`
+	Timers         Timers            `yaml:"timers"`
+	Schedules      Schedules         `yaml:"schedules"`
+	Rules          Rules             `yaml:"rules"`
+	Reports        Reports           `yaml:"reports"`
+	Devices        Devices           `yaml:"devices"`
+	Commands       Commands          `yaml:"commands"`
 }
 
 func (c Config) GetRedisKeyPrefix() string {
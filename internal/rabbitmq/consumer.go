@@ -0,0 +1,132 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/rs/zerolog/log"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Handler processes one delivery. A nil error acknowledges it. An error
+// wrapping ErrPermanent rejects it without requeueing, so a malformed message
+// is not redelivered forever; any other error requeues it after
+// requeueDelay, so a delivery that failed on an outage is tried again.
+type Handler func(ctx context.Context, d amqp.Delivery) error
+
+// ErrPermanent marks a handler error that a redelivery cannot fix.
+var ErrPermanent = errors.New("permanent failure")
+
+// Permanent wraps err so that the delivery is dropped rather than requeued.
+func Permanent(err error) error {
+	return fmt.Errorf("%w: %w", ErrPermanent, err)
+}
+
+// requeueDelay keeps a failing delivery from being redelivered in a tight
+// loop while, say, Redis is down.
+const requeueDelay = time.Second
+
+type ConsumerConfig struct {
+	Queue      string // durable queue, declared if missing
+	Exchange   string // exchange the queue is bound to, e.g. amq.topic
+	RoutingKey string // binding pattern
+	Prefetch   int    // unacknowledged deliveries in flight
+}
+
+// Consumer binds a queue to an exchange and feeds its deliveries to a
+// Handler, one at a time.
+type Consumer struct {
+	conn    *amqp.Connection
+	cfg     ConsumerConfig
+	handler Handler
+}
+
+func NewConsumer(conn *amqp.Connection, cfg ConsumerConfig, handler Handler) *Consumer {
+	return &Consumer{conn: conn, cfg: cfg, handler: handler}
+}
+
+// Run consumes until ctx is cancelled, which cancels the subscription and
+// returns nil once the delivery in progress is handled. It returns an error
+// if the queue cannot be set up or the broker closes the channel.
+func (c *Consumer) Run(ctx context.Context) error {
+	if c.conn == nil {
+		return errors.New("rabbitmq connection is nil")
+	}
+	ch, err := c.conn.Channel()
+	if err != nil {
+		return fmt.Errorf("open channel: %w", err)
+	}
+	defer ch.Close()
+
+	if err := ch.Qos(c.cfg.Prefetch, 0, false); err != nil {
+		return fmt.Errorf("set qos: %w", err)
+	}
+	q, err := ch.QueueDeclare(
+		c.cfg.Queue,
+		true,  // durable
+		false, // auto-delete
+		false, // exclusive
+		false, // no-wait
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf("declare queue %s: %w", c.cfg.Queue, err)
+	}
+	if err := ch.QueueBind(q.Name, c.cfg.RoutingKey, c.cfg.Exchange, false, nil); err != nil {
+		return fmt.Errorf("bind queue %s to %s: %w", q.Name, c.cfg.RoutingKey, err)
+	}
+
+	tag := "hmauto-" + q.Name
+	deliveries, err := ch.Consume(
+		q.Name,
+		tag,
+		false, // auto-ack
+		false, // exclusive
+		false, // no-local
+		false, // no-wait
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf("consume %s: %w", q.Name, err)
+	}
+	log.Info().Str("queue", q.Name).Str("routing_key", c.cfg.RoutingKey).Msg("Consuming from RabbitMQ")
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := ch.Cancel(tag, false); err != nil {
+				log.Warn().Err(err).Str("queue", q.Name).Msg("failed to cancel consumer")
+			}
+			log.Info().Str("queue", q.Name).Msg("RabbitMQ consumer stopped")
+			return nil
+		case d, ok := <-deliveries:
+			if !ok {
+				return fmt.Errorf("rabbitmq deliveries for %s closed", q.Name)
+			}
+			c.handle(ctx, d)
+		}
+	}
+}
+
+func (c *Consumer) handle(ctx context.Context, d amqp.Delivery) {
+	if err := c.handler(ctx, d); err != nil {
+		requeue := !errors.Is(err, ErrPermanent)
+		log.Warn().Err(err).Str("routing_key", d.RoutingKey).Bool("requeue", requeue).Msg("rejecting delivery")
+		if requeue {
+			select {
+			case <-ctx.Done():
+			case <-time.After(requeueDelay):
+			}
+		}
+		if err := d.Nack(false, requeue); err != nil {
+			log.Error().Err(err).Msg("failed to nack delivery")
+		}
+		return
+	}
+	if err := d.Ack(false); err != nil {
+		log.Error().Err(err).Msg("failed to ack delivery")
+	}
+}
@@ -0,0 +1,55 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type recordingAcknowledger struct {
+	acked, nacked, requeued bool
+}
+
+func (a *recordingAcknowledger) Ack(uint64, bool) error {
+	a.acked = true
+	return nil
+}
+
+func (a *recordingAcknowledger) Nack(_ uint64, _ bool, requeue bool) error {
+	a.nacked, a.requeued = true, requeue
+	return nil
+}
+
+func (a *recordingAcknowledger) Reject(_ uint64, requeue bool) error {
+	a.nacked, a.requeued = true, requeue
+	return nil
+}
+
+func TestConsumerHandle(t *testing.T) {
+	// A cancelled context skips the requeue delay.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name                    string
+		err                     error
+		acked, nacked, requeued bool
+	}{
+		{"success", nil, true, false, false},
+		{"permanent", Permanent(errors.New("bad message")), false, true, false},
+		{"transient", errors.New("store down"), false, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ack := &recordingAcknowledger{}
+			c := NewConsumer(nil, ConsumerConfig{}, func(context.Context, amqp.Delivery) error { return tt.err })
+			c.handle(ctx, amqp.Delivery{Acknowledger: ack})
+			if ack.acked != tt.acked || ack.nacked != tt.nacked || ack.requeued != tt.requeued {
+				t.Fatalf("got acked=%v nacked=%v requeued=%v, want %v %v %v",
+					ack.acked, ack.nacked, ack.requeued, tt.acked, tt.nacked, tt.requeued)
+			}
+		})
+	}
+}
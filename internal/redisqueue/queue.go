@@ -0,0 +1,62 @@
+// Package redisqueue is a delay queue in Redis: a sorted set of ids scored by
+// due time (unix ms) and a hash with the data of each id. Workers lease due
+// entries instead of popping them, so an entry whose worker stops before it
+// is done with it is claimed again when the lease ends.
+package redisqueue
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Queue names the sorted set and the data hash of one queue.
+type Queue struct {
+	QueueKey string
+	DataKey  string
+}
+
+// claimScript returns the data of up to ARGV[3] ids due at or before ARGV[1]
+// and pushes them back to ARGV[2], the end of their lease, in the same step,
+// so with several instances each due entry is claimed once. Ids without data
+// are dropped from the queue.
+var claimScript = redis.NewScript(`
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[3])
+local out = {}
+for _, id in ipairs(ids) do
+	local data = redis.call('HGET', KEYS[2], id)
+	if data then
+		redis.call('ZADD', KEYS[1], ARGV[2], id)
+		table.insert(out, data)
+	else
+		redis.call('ZREM', KEYS[1], id)
+	end
+end
+return out
+`)
+
+// finishScript removes the id ARGV[1] if its data is still exactly ARGV[2].
+var finishScript = redis.NewScript(`
+if redis.call('HGET', KEYS[2], ARGV[1]) ~= ARGV[2] then
+	return 0
+end
+redis.call('HDEL', KEYS[2], ARGV[1])
+redis.call('ZREM', KEYS[1], ARGV[1])
+return 1
+`)
+
+// Claim returns the data of up to limit entries due at now and leases them:
+// no other claim returns them until lease has passed.
+func (q Queue) Claim(ctx context.Context, rdb redis.Scripter, now time.Time, lease time.Duration, limit int) ([]string, error) {
+	return claimScript.Run(ctx, rdb, []string{q.QueueKey, q.DataKey},
+		strconv.FormatInt(now.UnixMilli(), 10), strconv.FormatInt(now.Add(lease).UnixMilli(), 10), limit).StringSlice()
+}
+
+// Finish removes a claimed entry once its worker is done with it. An entry
+// whose data changed since it was claimed is kept; removed is false then.
+func (q Queue) Finish(ctx context.Context, rdb redis.Scripter, id, data string) (removed bool, err error) {
+	n, err := finishScript.Run(ctx, rdb, []string{q.QueueKey, q.DataKey}, id, data).Int()
+	return n == 1, err
+}
@@ -0,0 +1,49 @@
+package redisqueue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestQueueLease(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	q := Queue{QueueKey: "test:queue", DataKey: "test:data"}
+
+	now := time.Now()
+	rdb.HSet(ctx, q.DataKey, "a", "one", "b", "two")
+	rdb.ZAdd(ctx, q.QueueKey, redis.Z{Score: float64(now.UnixMilli()), Member: "a"},
+		redis.Z{Score: float64(now.Add(time.Hour).UnixMilli()), Member: "b"},
+		redis.Z{Score: float64(now.UnixMilli()), Member: "orphan"})
+
+	got, err := q.Claim(ctx, rdb, now, time.Minute, 10)
+	if err != nil || len(got) != 1 || got[0] != "one" {
+		t.Fatalf("Claim() = %q, %v, want [one]", got, err)
+	}
+	if err := rdb.ZScore(ctx, q.QueueKey, "orphan").Err(); err != redis.Nil {
+		t.Fatalf("ZScore(orphan) error = %v, want the id dropped", err)
+	}
+	if got, _ := q.Claim(ctx, rdb, now.Add(time.Second), time.Minute, 10); len(got) != 0 {
+		t.Fatalf("Claim() during the lease = %q, want none", got)
+	}
+	// The worker stopped without finishing; the entry comes back.
+	if got, _ := q.Claim(ctx, rdb, now.Add(time.Minute), time.Minute, 10); len(got) != 1 {
+		t.Fatalf("Claim() after the lease = %q, want [one]", got)
+	}
+
+	rdb.HSet(ctx, q.DataKey, "a", "changed")
+	if removed, err := q.Finish(ctx, rdb, "a", "one"); err != nil || removed {
+		t.Fatalf("Finish(changed) = %v, %v, want kept", removed, err)
+	}
+	if removed, err := q.Finish(ctx, rdb, "a", "changed"); err != nil || !removed {
+		t.Fatalf("Finish() = %v, %v, want removed", removed, err)
+	}
+	if n := rdb.ZCard(ctx, q.QueueKey).Val(); n != 1 {
+		t.Fatalf("queued ids = %d, want only b", n)
+	}
+}
@@ -0,0 +1,324 @@
+package response
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+var ErrNotAcceptable = errors.New("NOT ACCEPTABLE")
+var ErrInvalidFields = errors.New("INVALID FIELDS")
+
+// Format is a representation a client can ask for with the Accept header.
+type Format string
+
+const (
+	FORMAT_JSON    Format = "json"
+	FORMAT_TEXT    Format = "text"
+	FORMAT_CBOR    Format = "cbor"
+	FORMAT_MSGPACK Format = "msgpack"
+)
+
+// MaxFields bounds the fields of one projection.
+const MaxFields = 32
+
+// HEADER_NEXT_CURSOR carries next_cursor for formats without an envelope.
+const HEADER_NEXT_CURSOR = "X-Next-Cursor"
+
+// textFields is the projection of text/plain when fields is not given.
+var textFields = []string{"key", "value"}
+
+var fieldPattern = regexp.MustCompile(`^[a-z_]{1,32}$`)
+
+// mediaTypes maps the accepted media types to formats, in the order a
+// wildcard such as text/* picks them.
+var mediaTypes = []struct {
+	mediaType string
+	format    Format
+}{
+	{"application/json", FORMAT_JSON},
+	{"text/plain", FORMAT_TEXT},
+	{"application/cbor", FORMAT_CBOR},
+	{"application/msgpack", FORMAT_MSGPACK},
+	{"application/vnd.msgpack", FORMAT_MSGPACK},
+	{"application/x-msgpack", FORMAT_MSGPACK},
+}
+
+// contentTypes is the Content-Type each format is served with.
+var contentTypes = map[Format]string{
+	FORMAT_JSON:    "application/json",
+	FORMAT_TEXT:    "text/plain; charset=utf-8",
+	FORMAT_CBOR:    "application/cbor",
+	FORMAT_MSGPACK: "application/msgpack",
+}
+
+// Representation is how a list response is written: its format and, if
+// Fields is set, the members kept of each item.
+type Representation struct {
+	Format Format
+	Fields []string
+}
+
+// Negotiate picks the representation from the Accept header and the fields
+// query parameter. JSON is served when Accept is missing or allows anything.
+// It returns ErrNotAcceptable if no supported format is acceptable and
+// ErrInvalidFields for a bad projection.
+func Negotiate(r *http.Request) (Representation, error) {
+	format, err := negotiateFormat(r.Header.Values("Accept"))
+	if err != nil {
+		return Representation{}, err
+	}
+	fields, err := parseFields(r.URL.Query().Get("fields"))
+	if err != nil {
+		return Representation{}, err
+	}
+	return Representation{Format: format, Fields: fields}, nil
+}
+
+// negotiateFormat returns the supported format with the highest q value,
+// preferring the earlier media range on ties.
+func negotiateFormat(accept []string) (Format, error) {
+	header := strings.Join(accept, ",")
+	if strings.TrimSpace(header) == "" {
+		return FORMAT_JSON, nil
+	}
+	best, bestQ := Format(""), 0.0
+	for _, part := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q <= bestQ {
+			continue
+		}
+		if f, ok := matchFormat(mediaType); ok {
+			best, bestQ = f, q
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("%w: supported types are application/json, text/plain, application/cbor and application/msgpack", ErrNotAcceptable)
+	}
+	return best, nil
+}
+
+// matchFormat returns the first supported format a media range covers.
+func matchFormat(mediaRange string) (Format, bool) {
+	if mediaRange == "*/*" || mediaRange == "application/*" {
+		return FORMAT_JSON, true
+	}
+	for _, m := range mediaTypes {
+		if m.mediaType == mediaRange || (strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(m.mediaType, strings.TrimSuffix(mediaRange, "*"))) {
+			return m.format, true
+		}
+	}
+	return "", false
+}
+
+func parseFields(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	parts := strings.Split(s, ",")
+	if len(parts) > MaxFields {
+		return nil, fmt.Errorf("%w: at most %d fields allowed", ErrInvalidFields, MaxFields)
+	}
+	seen := make(map[string]bool, len(parts))
+	for _, f := range parts {
+		if !fieldPattern.MatchString(f) {
+			return nil, fmt.Errorf("%w: %q is not a field name", ErrInvalidFields, f)
+		}
+		if seen[f] {
+			return nil, fmt.Errorf("%w: %q appears more than once", ErrInvalidFields, f)
+		}
+		seen[f] = true
+	}
+	return parts, nil
+}
+
+// SuccessResponse is SuccessResponse in the negotiated representation.
+func (rep Representation) SuccessResponse(w http.ResponseWriter, data interface{}) {
+	rep.PageResponse(w, data, "")
+}
+
+// PageResponse is PageResponse in the negotiated representation. CBOR and
+// MessagePack carry the same envelope as JSON. text/plain has no envelope:
+// each item is one line of its fields joined by '=', key=value unless fields
+// says otherwise, with '=', '\\' and line breaks in values escaped, and
+// next_cursor is sent in the X-Next-Cursor header.
+func (rep Representation) PageResponse(w http.ResponseWriter, data interface{}, nextCursor string) {
+	if rep.Format == "" || (rep.Format == FORMAT_JSON && rep.Fields == nil) {
+		w.Header().Add("Vary", "Accept")
+		PageResponse(w, data, nextCursor)
+		return
+	}
+
+	generic, err := toGeneric(data)
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "failed to encode response", err)
+		return
+	}
+	fields := rep.Fields
+	if fields == nil && rep.Format == FORMAT_TEXT {
+		fields = textFields
+	}
+	if fields != nil {
+		generic = project(generic, fields)
+	}
+
+	var body []byte
+	switch rep.Format {
+	case FORMAT_TEXT:
+		body = encodeText(generic, fields)
+	case FORMAT_JSON:
+		body, err = json.Marshal(JsonResponse{Message: "success", Data: generic, NextCursor: nextCursor})
+	default:
+		envelope := map[string]any{"message": "success", "data": generic}
+		if nextCursor != "" {
+			envelope["next_cursor"] = nextCursor
+		}
+		body, err = encodeBinary(rep.Format, envelope)
+	}
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, "failed to encode response", err)
+		return
+	}
+
+	w.Header().Add("Vary", "Accept")
+	w.Header().Set("Content-Type", contentTypes[rep.Format])
+	if rep.Format == FORMAT_TEXT && nextCursor != "" {
+		w.Header().Set(HEADER_NEXT_CURSOR, nextCursor)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// toGeneric turns data into what it looks like as JSON (maps, slices,
+// strings, json.Number, bools and nil), so every format has the JSON field
+// names and omissions.
+func toGeneric(data interface{}) (any, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// project keeps only fields of an object, or of each object in a list.
+func project(v any, fields []string) any {
+	switch v := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(fields))
+		for _, f := range fields {
+			if fv, ok := v[f]; ok {
+				out[f] = fv
+			}
+		}
+		return out
+	case []any:
+		for i := range v {
+			v[i] = project(v[i], fields)
+		}
+		return v
+	}
+	return v
+}
+
+// textEscaper escapes the field separator too, so a line splits back into
+// its fields at every '=' not preceded by a backslash.
+var textEscaper = strings.NewReplacer(`\`, `\\`, "=", `\=`, "\n", `\n`, "\r", `\r`)
+
+// encodeText writes one line per item, or a single line for an object.
+// A missing field is an empty string.
+func encodeText(v any, fields []string) []byte {
+	items, ok := v.([]any)
+	if !ok {
+		items = []any{v}
+	}
+	var b bytes.Buffer
+	for _, item := range items {
+		obj, _ := item.(map[string]any)
+		for i, f := range fields {
+			if i > 0 {
+				b.WriteByte('=')
+			}
+			b.WriteString(textEscaper.Replace(textValue(obj[f])))
+		}
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// textValue is a string as is and anything else as compact JSON.
+func textValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	}
+	raw, _ := json.Marshal(v)
+	return string(raw)
+}
+
+func encodeBinary(format Format, v any) ([]byte, error) {
+	v = binaryNumbers(v)
+	if format == FORMAT_CBOR {
+		em, err := cbor.CoreDetEncOptions().EncMode()
+		if err != nil {
+			return nil, err
+		}
+		return em.Marshal(v)
+	}
+	var b bytes.Buffer
+	enc := msgpack.NewEncoder(&b)
+	enc.SetSortMapKeys(true)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// binaryNumbers replaces json.Number with an integer or float, so binary
+// formats get numbers rather than strings.
+func binaryNumbers(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]any:
+		for k, e := range v {
+			v[k] = binaryNumbers(e)
+		}
+	case []any:
+		for i, e := range v {
+			v[i] = binaryNumbers(e)
+		}
+	}
+	return v
+}
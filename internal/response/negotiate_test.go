@@ -0,0 +1,141 @@
+package response
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type item struct {
+	Key         string `json:"key"`
+	Value       any    `json:"value"`
+	Description string `json:"description,omitempty"`
+	Revision    int64  `json:"revision"`
+}
+
+var items = []item{
+	{Key: "modem", Value: "on", Description: "Modem", Revision: 42},
+	{Key: "rgb", Value: map[string]any{"r": 255}, Revision: 43},
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name    string
+		accept  string
+		url     string
+		want    Format
+		wantErr error
+	}{
+		{name: "no accept", url: "/", want: FORMAT_JSON},
+		{name: "anything", accept: "*/*", url: "/", want: FORMAT_JSON},
+		{name: "text", accept: "text/plain", url: "/", want: FORMAT_TEXT},
+		{name: "text wildcard", accept: "text/*", url: "/", want: FORMAT_TEXT},
+		{name: "cbor", accept: "application/cbor", url: "/", want: FORMAT_CBOR},
+		{name: "msgpack alias", accept: "application/x-msgpack", url: "/", want: FORMAT_MSGPACK},
+		{name: "highest q wins", accept: "application/json;q=0.5, application/cbor", url: "/", want: FORMAT_CBOR},
+		{name: "unsupported skipped", accept: "text/html, text/plain;q=0.1", url: "/", want: FORMAT_TEXT},
+		{name: "refused", accept: "text/plain;q=0", url: "/", wantErr: ErrNotAcceptable},
+		{name: "unsupported", accept: "image/png", url: "/", wantErr: ErrNotAcceptable},
+		{name: "bad field", url: "/?fields=key,Value", wantErr: ErrInvalidFields},
+		{name: "duplicate field", url: "/?fields=key,key", wantErr: ErrInvalidFields},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rep, err := Negotiate(req)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Negotiate() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || rep.Format != tt.want {
+				t.Fatalf("Negotiate() = %+v, %v, want %s", rep, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRepresentationText(t *testing.T) {
+	rr := httptest.NewRecorder()
+	Representation{Format: FORMAT_TEXT}.PageResponse(rr, items, "next")
+
+	if got := rr.Header().Get("Content-Type"); got != "text/plain; charset=utf-8" {
+		t.Fatalf("Content-Type = %q", got)
+	}
+	if got := rr.Header().Get(HEADER_NEXT_CURSOR); got != "next" {
+		t.Fatalf("%s = %q, want next", HEADER_NEXT_CURSOR, got)
+	}
+	if got, want := rr.Body.String(), "modem=on\nrgb={\"r\":255}\n"; got != want {
+		t.Fatalf("body = %q, want %q", got, want)
+	}
+
+	rr = httptest.NewRecorder()
+	Representation{Format: FORMAT_TEXT, Fields: []string{"key", "revision", "description"}}.SuccessResponse(rr, items[0])
+	if got, want := rr.Body.String(), "modem=42=Modem\n"; got != want {
+		t.Fatalf("projected body = %q, want %q", got, want)
+	}
+
+	rr = httptest.NewRecorder()
+	Representation{Format: FORMAT_TEXT}.SuccessResponse(rr, item{Key: "label", Value: "room=office\\a\nb"})
+	if got, want := rr.Body.String(), `label=room\=office\\a\nb`+"\n"; got != want {
+		t.Fatalf("escaped body = %q, want %q", got, want)
+	}
+}
+
+func TestRepresentationBinary(t *testing.T) {
+	decoders := map[Format]func([]byte, any) error{
+		FORMAT_CBOR:    cbor.Unmarshal,
+		FORMAT_MSGPACK: msgpack.Unmarshal,
+	}
+	for format, decode := range decoders {
+		t.Run(string(format), func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			Representation{Format: format, Fields: []string{"key", "revision"}}.PageResponse(rr, items, "next")
+
+			if got := rr.Header().Get("Content-Type"); got != contentTypes[format] {
+				t.Fatalf("Content-Type = %q, want %q", got, contentTypes[format])
+			}
+			var got map[string]any
+			if err := decode(rr.Body.Bytes(), &got); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			data, _ := got["data"].([]any)
+			if got["message"] != "success" || got["next_cursor"] != "next" || len(data) != 2 {
+				t.Fatalf("envelope = %v", got)
+			}
+			// CBOR decodes nested maps with interface keys, MessagePack with strings.
+			first, _ := data[0].(map[any]any)
+			if first == nil {
+				m, _ := data[0].(map[string]any)
+				first = map[any]any{}
+				for k, v := range m {
+					first[k] = v
+				}
+			}
+			if len(first) != 2 || first["key"] != "modem" {
+				t.Fatalf("data[0] = %v, want key and revision only", data[0])
+			}
+			switch rev := first["revision"].(type) {
+			case int8, int16, int32, int64, uint8, uint16, uint32, uint64:
+			default:
+				t.Fatalf("revision = %T %v, want an integer", rev, rev)
+			}
+		})
+	}
+}
+
+func TestRepresentationJSONFields(t *testing.T) {
+	rr := httptest.NewRecorder()
+	Representation{Format: FORMAT_JSON, Fields: []string{"key", "value"}}.SuccessResponse(rr, items[:1])
+	if got, want := rr.Body.String(), `{"message":"success","data":[{"key":"modem","value":"on"}]}`; got != want {
+		t.Fatalf("body = %s, want %s", got, want)
+	}
+}
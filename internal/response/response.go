@@ -14,6 +14,18 @@ func SuccessResponse(w http.ResponseWriter, data interface{}) {
 	})
 }
 
+// PageResponse is SuccessResponse for one page of a list; nextCursor fetches
+// the next page and is empty on the last one.
+func PageResponse(w http.ResponseWriter, data interface{}, nextCursor string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(JsonResponse{
+		Message:    "success",
+		Data:       data,
+		NextCursor: nextCursor,
+	})
+}
+
 func CreatedResponse(w http.ResponseWriter, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
@@ -23,6 +35,15 @@ func CreatedResponse(w http.ResponseWriter, data interface{}) {
 	})
 }
 
+func AcceptedResponse(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(JsonResponse{
+		Message: "accepted",
+		Data:    data,
+	})
+}
+
 func ErrorResponse(w http.ResponseWriter, statusCode int, message string, err error) {
 	r := JsonResponse{Message: message}
 	if err != nil {
@@ -32,3 +53,15 @@ func ErrorResponse(w http.ResponseWriter, statusCode int, message string, err er
 	w.WriteHeader(statusCode)
 	json.NewEncoder(w).Encode(r)
 }
+
+// ErrorDataResponse is ErrorResponse with a data payload, for errors that
+// carry details such as per-item results.
+func ErrorDataResponse(w http.ResponseWriter, statusCode int, message string, err error, data interface{}) {
+	r := JsonResponse{Message: message, Data: data}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(r)
+}
@@ -5,4 +5,6 @@ type JsonResponse struct {
 	Message string      `json:"message,omitempty"`
 	Data    interface{} `json:"data,omitempty"`
 	Error   interface{} `json:"error,omitempty"`
+	// NextCursor is set on paginated lists that have more pages.
+	NextCursor string `json:"next_cursor,omitempty"`
 }
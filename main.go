@@ -22,7 +22,11 @@ import (
 	"time"
 
 	"github.com/getsentry/sentry-go"
+	"github.com/nurhudajoantama/hmauto/app/device"
 	"github.com/nurhudajoantama/hmauto/app/hmstt"
+	"github.com/nurhudajoantama/hmauto/app/rule"
+	"github.com/nurhudajoantama/hmauto/app/scene"
+	"github.com/nurhudajoantama/hmauto/app/schedule"
 	"github.com/nurhudajoantama/hmauto/app/server"
 	_ "github.com/nurhudajoantama/hmauto/docs"
 	"github.com/nurhudajoantama/hmauto/internal/config"
@@ -80,11 +84,17 @@ func main() {
 
 	rateLimiter := middleware.NewRateLimiter(cfg.Security.GetRateLimitPerMin(), time.Minute, cfg.Security.GetRateLimitBurst())
 
+	trustedProxies, err := middleware.ParseTrustedProxies(cfg.Security.TrustedProxies)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid security configuration")
+	}
+
 	// Initialize server
 	serverConfig := &server.ServerConfig{
 		BearerToken:    cfg.Security.BearerToken,
 		MaxRequestSize: cfg.Security.GetMaxRequestSize(),
 		RateLimiter:    rateLimiter,
+		TrustedProxies: trustedProxies,
 	}
 	srv := server.NewWithConfig(cfg.HTTP.Addr(), serverConfig)
 
@@ -97,16 +107,76 @@ func main() {
 	r.HandleFunc("/live", health.LivenessHandler()).Methods("GET")
 
 	// HMSTT
-	hmsttStore := hmstt.NewStore(rdb, cfg.GetRedisKeyPrefix())
+	hmsttStore := hmstt.NewStore(rdb, cfg.GetRedisKeyPrefix(), &hmstt.StoreConfig{
+		HistoryMaxLen: cfg.History.GetMaxLen(),
+		HistoryMaxAge: cfg.History.MaxAge,
+	})
+	if err := hmsttStore.IndexTypes(ctx); err != nil {
+		log.Fatal().Err(err).Msg("failed to index state types")
+	}
 	hmsttEvent := hmstt.NewEvent(rabbitMQConn)
-	hmsttService := hmstt.NewService(hmsttStore, hmsttEvent)
+	hmsttTypes, err := hmstt.NewTypeRegistry(cfg.Types)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid state type configuration")
+	}
+	hmsttConstraints, err := hmstt.NewConstraintSet(cfg.Constraints)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid constraint configuration")
+	}
+	var hmsttCommands *hmstt.CommandConfig
+	if cfg.Commands.Enabled {
+		hmsttCommands = &hmstt.CommandConfig{
+			AckTimeout: cfg.Commands.GetAckTimeout(),
+			MaxRetries: cfg.Commands.GetMaxRetries(),
+		}
+	}
+	hmsttService := hmstt.NewService(hmsttStore, hmsttEvent, &hmstt.ServiceConfig{
+		Types:       hmsttTypes,
+		Constraints: hmsttConstraints,
+		Commands:    hmsttCommands,
+		Relay:       hmsttStore,
+	})
 	hmstt.RegisterHandlers(srv, hmsttService)
 
+	// Devices
+	deviceService := device.NewService(device.NewStore(rdb, cfg.GetRedisKeyPrefix()), &device.ServiceConfig{
+		OfflineAfter: cfg.Devices.GetOfflineAfter(),
+	})
+	hmsttService.SetDeviceRegistry(deviceService)
+	device.RegisterHandlers(srv, deviceService)
+
+	// Scenes
+	sceneService := scene.NewService(scene.NewStore(rdb, cfg.GetRedisKeyPrefix()), hmsttService)
+	scene.RegisterHandlers(srv, sceneService)
+
+	// Schedules
+	scheduleStore := schedule.NewStore(rdb, cfg.GetRedisKeyPrefix())
+	scheduleService, err := schedule.NewService(scheduleStore, hmsttService, &schedule.ServiceConfig{
+		CatchUp: cfg.Schedules.CatchUp,
+		Grace:   cfg.Schedules.Grace,
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid schedules configuration")
+	}
+	schedule.RegisterHandlers(srv, scheduleService)
+
+	// Rules
+	ruleService := rule.NewService(rule.NewStore(rdb, cfg.GetRedisKeyPrefix()), hmsttService, &rule.ServiceConfig{
+		MaxChainDepth:   cfg.Rules.MaxChainDepth,
+		DefaultCooldown: cfg.Rules.DefaultCooldown,
+	})
+	hmsttService.AddChangeListener(ruleService)
+	rule.RegisterHandlers(srv, ruleService)
+
 	// MCP server
 	mcpSrv := server.NewMCPServer(cfg.MCP.Addr(), &server.MCPServerConfig{
 		Token: cfg.Security.MCPToken,
 	})
 	hmstt.RegisterMCPTools(mcpSrv.GetServer(), hmsttService)
+	scene.RegisterMCPTools(mcpSrv.GetServer(), sceneService)
+	schedule.RegisterMCPTools(mcpSrv.GetServer(), scheduleService)
+	rule.RegisterMCPTools(mcpSrv.GetServer(), ruleService)
+	device.RegisterMCPTools(mcpSrv.GetServer(), deviceService)
 
 	errgrp, ctx := errgroup.WithContext(ctx)
 	errgrp.Go(func() error {
@@ -115,6 +185,35 @@ func main() {
 	errgrp.Go(func() error {
 		return mcpSrv.Start(ctx)
 	})
+	errgrp.Go(func() error {
+		return hmsttService.RunTimers(ctx, cfg.Timers.GetPollInterval())
+	})
+	errgrp.Go(func() error {
+		return hmsttService.RunCommands(ctx, cfg.Commands.GetPollInterval())
+	})
+	errgrp.Go(func() error {
+		return hmsttService.RunChangeRelay(ctx)
+	})
+	errgrp.Go(func() error {
+		return scheduleService.Run(ctx, cfg.Schedules.GetPollInterval())
+	})
+	errgrp.Go(func() error {
+		return ruleService.RunPending(ctx, cfg.Rules.GetPollInterval())
+	})
+	errgrp.Go(func() error {
+		return deviceService.Run(ctx, cfg.Devices.GetRefreshInterval())
+	})
+	if cfg.Reports.Enabled {
+		reportConsumer := rabbitmq.NewConsumer(rabbitMQConn, rabbitmq.ConsumerConfig{
+			Queue:      cfg.Reports.GetQueue(),
+			Exchange:   "amq.topic",
+			RoutingKey: cfg.Reports.GetRoutingKey(),
+			Prefetch:   cfg.Reports.GetPrefetch(),
+		}, hmsttService.HandleReport)
+		errgrp.Go(func() error {
+			return reportConsumer.Run(ctx)
+		})
+	}
 
 	if err := errgrp.Wait(); err != nil {
 		log.Error().Err(err).Msg("closing application due to error")